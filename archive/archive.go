@@ -0,0 +1,209 @@
+// Package archive packs a single log with everything needed to restore it
+// on another proxy into a zip or tar.gz file.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"cs2-log-proxy/parser"
+	"cs2-log-proxy/storage"
+)
+
+// Archive formats
+const (
+	FormatZip   = "zip"
+	FormatTarGz = "tar.gz"
+)
+
+// Version is the archive layout written by Write
+const Version = 1
+
+// Files of an archive. The manifest comes first and lists the checksums
+// of the others.
+const (
+	manifestFile = "manifest.json"
+	sessionFile  = "session.json"
+	chunksFile   = "chunks.json"
+	logFile      = "session.log"
+	eventsFile   = "events.json"
+)
+
+// Manifest describes an archive
+type Manifest struct {
+	Version   int       `json:"version"`
+	LogID     string    `json:"log_id"`
+	Token     string    `json:"server_instance_token"`
+	CreatedAt time.Time `json:"created_at"`
+	Files     []File    `json:"files"`
+}
+
+// File is a file of an archive with its SHA-256 checksum
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Session is the session metadata of an archived log
+type Session struct {
+	Token   string          `json:"server_instance_token"`
+	SteamID string          `json:"steam_id"`
+	Log     storage.LogMeta `json:"log"`
+}
+
+// Event is a parsed event with the byte offset of its line in the log
+type Event struct {
+	Offset int `json:"offset"`
+	parser.Event
+}
+
+// Archive is the content of an archive
+type Archive struct {
+	Manifest Manifest
+	Session  Session
+	Chunks   []storage.ChunkMeta
+	Log      string
+}
+
+var (
+	// ErrLogNotFound is returned when exporting a log no server knows
+	ErrLogNotFound = errors.New("log not found")
+	// ErrLogExists is returned when restoring a log the store already has
+	ErrLogExists = errors.New("log already exists")
+)
+
+// Load reads a log and its metadata from store
+func Load(store storage.Backend, logID string) (*Archive, error) {
+	logID = storage.CanonicalLogID(logID)
+	tokens, err := store.ListServers()
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		meta, err := store.LoadServerMeta(token)
+		if err != nil {
+			return nil, err
+		}
+		for _, lm := range meta.Logs {
+			if lm.LogID != logID {
+				continue
+			}
+			a := &Archive{Session: Session{Token: token, SteamID: meta.SteamID, Log: lm}}
+			if a.Chunks, err = store.LoadChunkMetas(logID); err != nil {
+				return nil, err
+			}
+			if a.Log, err = store.GetLog(logID); err != nil {
+				return nil, err
+			}
+			a.Manifest = Manifest{Version: Version, LogID: logID, Token: token, CreatedAt: time.Now().UTC()}
+			return a, nil
+		}
+	}
+	return nil, ErrLogNotFound
+}
+
+// events parses the events of every line of the log
+func (a *Archive) events() []Event {
+	events := []Event{}
+	offset := 0
+	for _, line := range strings.SplitAfter(a.Log, "\n") {
+		if ev, ok := parser.ParseLine(line); ok {
+			ev.Line = strings.TrimRight(ev.Line, "\r\n")
+			events = append(events, Event{Offset: offset, Event: ev})
+		}
+		offset += len(line)
+	}
+	return events
+}
+
+// entry is a file of an archive being written
+type entry struct {
+	name string
+	data []byte
+}
+
+// Write writes the archive in the given format
+func (a *Archive) Write(w io.Writer, format string) error {
+	var files []entry
+	add := func(name string, v any) error {
+		data, ok := v.([]byte)
+		if !ok {
+			var err error
+			if data, err = json.MarshalIndent(v, "", "  "); err != nil {
+				return err
+			}
+		}
+		files = append(files, entry{name, data})
+		return nil
+	}
+	chunks := a.Chunks
+	if chunks == nil {
+		chunks = []storage.ChunkMeta{}
+	}
+	if err := add(sessionFile, a.Session); err != nil {
+		return err
+	}
+	if err := add(chunksFile, chunks); err != nil {
+		return err
+	}
+	if err := add(logFile, []byte(a.Log)); err != nil {
+		return err
+	}
+	if err := add(eventsFile, a.events()); err != nil {
+		return err
+	}
+
+	a.Manifest.Files = nil
+	for _, f := range files {
+		sum := sha256.Sum256(f.data)
+		a.Manifest.Files = append(a.Manifest.Files, File{Name: f.name, Size: int64(len(f.data)), SHA256: hex.EncodeToString(sum[:])})
+	}
+	manifest, err := json.MarshalIndent(a.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	files = append([]entry{{manifestFile, manifest}}, files...)
+
+	switch format {
+	case FormatZip, "":
+		zw := zip.NewWriter(w)
+		for _, f := range files {
+			fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: a.Manifest.CreatedAt})
+			if err != nil {
+				return err
+			}
+			if _, err := fw.Write(f.data); err != nil {
+				return err
+			}
+		}
+		return zw.Close()
+	case FormatTarGz:
+		gw := gzip.NewWriter(w)
+		tw := tar.NewWriter(gw)
+		for _, f := range files {
+			hdr := &tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.data)), ModTime: a.Manifest.CreatedAt}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := tw.Write(f.data); err != nil {
+				return err
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		return gw.Close()
+	default:
+		return fmt.Errorf("unknown archive format %q", format)
+	}
+}
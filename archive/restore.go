@@ -0,0 +1,247 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"cs2-log-proxy/storage"
+)
+
+// maxManifestSize limits the manifest, the other files are limited to the
+// sizes it lists
+const maxManifestSize = 1 << 20
+
+// maxContentSize limits the decompressed size of the files together,
+// whatever sizes the manifest lists
+const maxContentSize = 1 << 30
+
+// Read parses an archive written by Write, zip or tar.gz, and verifies the
+// checksums in its manifest. The manifest must come first; files it
+// doesn't list, or lists with a smaller size, are refused before they are
+// decompressed any further, as are manifests listing more than
+// maxContentSize bytes.
+func Read(data []byte) (*Archive, error) {
+	a := &Archive{}
+	files := make(map[string][]byte)
+	listed := make(map[string]File)
+	var total int64
+	err := readEntries(data, func(name string, r io.Reader) error {
+		if len(files) == 0 {
+			if name != manifestFile {
+				return fmt.Errorf("%s must come first", manifestFile)
+			}
+			data, err := readLimited(r, maxManifestSize)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			files[name] = data
+			if err := unmarshalFile(files, manifestFile, &a.Manifest); err != nil {
+				return err
+			}
+			if a.Manifest.Version != Version {
+				return fmt.Errorf("unsupported archive version %d", a.Manifest.Version)
+			}
+			for _, f := range a.Manifest.Files {
+				if _, ok := listed[f.Name]; ok || f.Name == manifestFile {
+					return fmt.Errorf("%s is listed twice", f.Name)
+				}
+				if f.Size < 0 || f.Size > maxContentSize-total {
+					return fmt.Errorf("files larger than %d bytes", int64(maxContentSize))
+				}
+				total += f.Size
+				listed[f.Name] = f
+			}
+			return nil
+		}
+		if _, ok := files[name]; ok {
+			return fmt.Errorf("%s is in the archive twice", name)
+		}
+		f, ok := listed[name]
+		if !ok {
+			return fmt.Errorf("%s is not in the manifest", name)
+		}
+		data, err := readLimited(r, f.Size)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		files[name] = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s is missing", manifestFile)
+	}
+
+	for _, f := range a.Manifest.Files {
+		data, ok := files[f.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s is missing", f.Name)
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != f.Size || hex.EncodeToString(sum[:]) != f.SHA256 {
+			return nil, fmt.Errorf("%s: checksum mismatch", f.Name)
+		}
+	}
+	for _, name := range []string{sessionFile, chunksFile, logFile} {
+		if !a.Manifest.listed(name) {
+			return nil, fmt.Errorf("%s is not in the manifest", name)
+		}
+	}
+	if err := unmarshalFile(files, sessionFile, &a.Session); err != nil {
+		return nil, err
+	}
+	if err := unmarshalFile(files, chunksFile, &a.Chunks); err != nil {
+		return nil, err
+	}
+	a.Log = string(files[logFile])
+	if err := a.validate(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// validate checks that the session matches the manifest and that the log
+// belongs to the session's server, so an archive can't write into the logs
+// of another server. Former log IDs are replaced by the current ones.
+func (a *Archive) validate() error {
+	a.Manifest.LogID = storage.CanonicalLogID(a.Manifest.LogID)
+	a.Session.Log.LogID = storage.CanonicalLogID(a.Session.Log.LogID)
+	if a.Session.Log.LogID != a.Manifest.LogID || a.Session.Token == "" {
+		return errors.New("session does not match the manifest")
+	}
+	if a.Manifest.Token != "" && a.Manifest.Token != a.Session.Token {
+		return errors.New("server of the session does not match the manifest")
+	}
+	if owner, ok := storage.LogIDOwner(a.Manifest.LogID); !ok || owner != a.Session.Token {
+		return fmt.Errorf("log %s does not belong to server %s", a.Manifest.LogID, a.Session.Token)
+	}
+	return nil
+}
+
+// readEntries calls visit with the regular files of a zip or tar.gz
+// archive in the order they are stored
+func readEntries(data []byte, visit func(name string, r io.Reader) error) error {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return err
+		}
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+			err = visit(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		tr := tar.NewReader(gr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := visit(hdr.Name, tr); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("not a zip or tar.gz archive")
+	}
+}
+
+// readLimited reads r, which must not hold more than n bytes
+func readLimited(r io.Reader, n int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, n+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > n {
+		return nil, fmt.Errorf("larger than %d bytes", n)
+	}
+	return data, nil
+}
+
+func (m Manifest) listed(name string) bool {
+	for _, f := range m.Files {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func unmarshalFile(files map[string][]byte, name string, v any) error {
+	data, ok := files[name]
+	if !ok {
+		return fmt.Errorf("%s is missing", name)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// Restore writes the archived log, its chunk index and session metadata to
+// store. Logs the store already has are refused with ErrLogExists.
+func (a *Archive) Restore(store storage.Backend) error {
+	if err := a.validate(); err != nil {
+		return err
+	}
+	logID := a.Manifest.LogID
+	defer storage.LockServerMeta(a.Session.Token)()
+	metas, err := store.LoadChunkMetas(logID)
+	if err != nil {
+		return err
+	}
+	meta, err := store.LoadServerMeta(a.Session.Token)
+	if err != nil {
+		return err
+	}
+	for _, lm := range meta.Logs {
+		if lm.LogID == logID {
+			return ErrLogExists
+		}
+	}
+	if len(metas) > 0 {
+		return ErrLogExists
+	}
+
+	if err := storage.AppendChunks(store, logID, a.Log, a.Chunks); err != nil {
+		return err
+	}
+	meta.ServerInstanceToken = a.Session.Token
+	if meta.SteamID == "" {
+		meta.SteamID = a.Session.SteamID
+	}
+	meta.Logs = append(meta.Logs, a.Session.Log)
+	return store.SaveServerMeta(a.Session.Token, meta)
+}
@@ -0,0 +1,202 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"cs2-log-proxy/storage"
+)
+
+const testLog = "L 01/30/2025 - 16:33:56: World triggered \"Round_Start\"\nL 01/30/2025 - 16:33:57: World triggered \"Round_End\"\n"
+
+// newTestArchive stores a log of server srv in two chunks and loads it
+func newTestArchive(t *testing.T) *Archive {
+	t.Helper()
+	store := storage.NewLogStore(t.TempDir())
+	logID := "srv_2025-01-30T16-33-56.470"
+	half := len(testLog) / 2
+	chunks := []storage.ChunkMeta{
+		{BeginOffset: 0, EndOffset: half},
+		{BeginOffset: half, EndOffset: len(testLog)},
+	}
+	if err := storage.AppendChunks(store, logID, testLog, chunks); err != nil {
+		t.Fatal(err)
+	}
+	meta := storage.ServerMeta{ServerInstanceToken: "srv", SteamID: "76561198000000000", Logs: []storage.LogMeta{
+		{LogID: logID, LogStartTime: "01/30/2025 - 16:33:56.470", LastByteOffset: len(testLog)},
+	}}
+	if err := store.SaveServerMeta("srv", &meta); err != nil {
+		t.Fatal(err)
+	}
+	a, err := Load(store, logID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func writeArchive(t *testing.T, a *Archive, format string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := a.Write(&buf, format); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []string{FormatZip, FormatTarGz} {
+		a, err := Read(writeArchive(t, newTestArchive(t), format))
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		store := storage.NewLogStore(t.TempDir())
+		if err := a.Restore(store); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if got, err := store.GetLog(a.Manifest.LogID); err != nil || got != testLog {
+			t.Errorf("%s: restored log %q, %v", format, got, err)
+		}
+		metas, err := store.LoadChunkMetas(a.Manifest.LogID)
+		if err != nil || len(metas) != 2 {
+			t.Errorf("%s: restored %d chunks, %v", format, len(metas), err)
+		}
+		if err := a.Restore(store); !errors.Is(err, ErrLogExists) {
+			t.Errorf("%s: second restore: %v, want ErrLogExists", format, err)
+		}
+	}
+}
+
+func TestRestoreFormerLogID(t *testing.T) {
+	// Archives written by earlier versions name the log by its former ID
+	a := newTestArchive(t)
+	canonical := a.Manifest.LogID
+	a.Manifest.LogID = "srv_01_30_2025 - 16:33:56.470"
+	a.Session.Log.LogID = a.Manifest.LogID
+	a, err := Read(writeArchive(t, a, FormatZip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := storage.NewLogStore(t.TempDir())
+	if err := a.Restore(store); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := store.LoadServerMeta("srv")
+	if err != nil || len(meta.Logs) != 1 || meta.Logs[0].LogID != canonical {
+		t.Fatalf("restored server metadata %+v, %v", meta, err)
+	}
+	if got, err := store.GetLog(canonical); err != nil || got != testLog {
+		t.Errorf("restored log %q, %v", got, err)
+	}
+}
+
+// zipFiles writes a zip holding the given files in order
+func zipFiles(t *testing.T, files ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		fw, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(f.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func manifestEntry(t *testing.T, m Manifest) entry {
+	t.Helper()
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry{manifestFile, data}
+}
+
+func TestReadRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		archive func(t *testing.T) []byte
+		wantErr string
+	}{
+		{"other server's log", func(t *testing.T) []byte {
+			a := newTestArchive(t)
+			a.Session.Token, a.Manifest.Token = "other", "other"
+			return writeArchive(t, a, FormatZip)
+		}, "does not belong to server other"},
+		{"token prefix only", func(t *testing.T) []byte {
+			a := newTestArchive(t)
+			a.Session.Token, a.Manifest.Token = "sr", "sr"
+			return writeArchive(t, a, FormatZip)
+		}, "does not belong to server sr"},
+		{"manifest of another server", func(t *testing.T) []byte {
+			a := newTestArchive(t)
+			a.Manifest.Token = "other"
+			return writeArchive(t, a, FormatTarGz)
+		}, "does not match the manifest"},
+		{"session of another log", func(t *testing.T) []byte {
+			a := newTestArchive(t)
+			a.Session.Log.LogID = "srv_2025-01-30T17-00-00.000"
+			return writeArchive(t, a, FormatZip)
+		}, "does not match the manifest"},
+		{"manifest not first", func(t *testing.T) []byte {
+			return zipFiles(t, entry{logFile, []byte(testLog)}, manifestEntry(t, Manifest{Version: Version}))
+		}, "must come first"},
+		{"unsupported version", func(t *testing.T) []byte {
+			return zipFiles(t, manifestEntry(t, Manifest{Version: Version + 1}))
+		}, "unsupported archive version"},
+		{"unlisted file", func(t *testing.T) []byte {
+			return zipFiles(t, manifestEntry(t, Manifest{Version: Version}), entry{logFile, []byte(testLog)})
+		}, "not in the manifest"},
+		{"file larger than listed", func(t *testing.T) []byte {
+			m := Manifest{Version: Version, Files: []File{{Name: logFile, Size: 10}}}
+			return zipFiles(t, manifestEntry(t, m), entry{logFile, []byte(testLog)})
+		}, "larger than 10 bytes"},
+		{"listed sizes above the limit", func(t *testing.T) []byte {
+			m := Manifest{Version: Version, Files: []File{
+				{Name: logFile, Size: maxContentSize},
+				{Name: chunksFile, Size: 1},
+			}}
+			return zipFiles(t, manifestEntry(t, m), entry{logFile, []byte(testLog)})
+		}, "files larger than"},
+		{"negative size", func(t *testing.T) []byte {
+			m := Manifest{Version: Version, Files: []File{{Name: logFile, Size: -1}}}
+			return zipFiles(t, manifestEntry(t, m))
+		}, "files larger than"},
+		{"checksum mismatch", func(t *testing.T) []byte {
+			m := Manifest{Version: Version, Files: []File{{Name: logFile, Size: int64(len(testLog)), SHA256: "00"}}}
+			return zipFiles(t, manifestEntry(t, m), entry{logFile, []byte(testLog)})
+		}, "checksum mismatch"},
+		{"not an archive", func(t *testing.T) []byte {
+			return []byte(testLog)
+		}, "not a zip or tar.gz archive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Read(tt.archive(t))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRestoreRejectsOtherServer(t *testing.T) {
+	a := newTestArchive(t)
+	a.Session.Token = "other"
+	store := storage.NewLogStore(t.TempDir())
+	if err := a.Restore(store); err == nil {
+		t.Fatal("restored a log of another server")
+	}
+	if tokens, _ := store.ListServers(); len(tokens) != 0 {
+		t.Errorf("store has servers %v after a refused restore", tokens)
+	}
+}
@@ -0,0 +1,309 @@
+// Package auth checks API keys and their roles on HTTP routes and the
+// websocket handshake.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Role is the access level of an API key. Each role includes the ones
+// before it.
+type Role string
+
+const (
+	Viewer   Role = "viewer"   // read logs, servers and search, live updates
+	Operator Role = "operator" // manage receivers, retention, protection and imports
+	Admin    Role = "admin"    // change the config
+)
+
+var roleRank = map[Role]int{Viewer: 1, Operator: 2, Admin: 3}
+
+// Includes reports whether r grants at least the access of min
+func (r Role) Includes(min Role) bool {
+	return roleRank[r] >= roleRank[min]
+}
+
+// Config lists the API keys. Without keys or OIDC the API is open.
+type Config struct {
+	Keys []Key `json:"keys"`
+	// AllowedOrigins may open websockets, "*" for any. Empty allows
+	// same-origin pages and non-browser clients only.
+	AllowedOrigins []string `json:"allowedOrigins,omitempty"`
+	// IngestKey, if set, must be passed as ?key= by game servers posting
+	// logs, e.g. logaddress_add_http "http://proxy:8081/api/logs?key=..."
+	IngestKey string `json:"ingestKey,omitempty"`
+	// OIDC enables login to the web UI, see OIDCConfig
+	OIDC *OIDCConfig `json:"oidc,omitempty"`
+}
+
+// Key is an API key. Key is the key itself or "sha256:" and its hex
+// SHA-256 hash. Keys with Servers only see those servers' logs.
+type Key struct {
+	Name    string   `json:"name"`
+	Key     string   `json:"key"`
+	Role    Role     `json:"role"`
+	Servers []string `json:"servers,omitempty"` // ServerInstanceTokens
+}
+
+// Principal is the key a request was made with
+type Principal struct {
+	Name    string
+	Role    Role
+	Servers map[string]bool // nil for all servers
+	session bool            // logged in with OIDC rather than a key
+}
+
+// Scoped reports whether the principal is limited to some servers. A nil
+// principal, used while auth is disabled, has full access.
+func (p *Principal) Scoped() bool {
+	return p != nil && p.Servers != nil
+}
+
+// CanSee reports whether the principal may see a server
+func (p *Principal) CanSee(token string) bool {
+	return !p.Scoped() || p.Servers[token]
+}
+
+// LogOwner returns the ServerInstanceToken of a log. main sets it to the
+// log catalog; logs it doesn't know are only visible to unscoped principals.
+var LogOwner = func(logID string) (token string, ok bool) {
+	return "", false
+}
+
+// CanSeeLog reports whether the principal may see a log, by the server the
+// log belongs to
+func (p *Principal) CanSeeLog(logID string) bool {
+	if !p.Scoped() {
+		return true
+	}
+	token, ok := LogOwner(logID)
+	return ok && p.Servers[token]
+}
+
+type contextKey struct{}
+
+// FromContext returns the principal of a request, nil while auth is disabled
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(contextKey{}).(*Principal)
+	return p
+}
+
+// Authenticator checks requests against the configured keys
+type Authenticator struct {
+	mu        sync.RWMutex
+	keys      map[string]*Principal // hex SHA-256 of the key -> principal
+	origins   []string
+	ingestKey string
+	oidc      *oidcProvider
+	sessions  *sessions
+}
+
+// New creates an Authenticator for config
+func New(config Config) (*Authenticator, error) {
+	a := &Authenticator{sessions: newSessions()}
+	return a, a.Update(config)
+}
+
+// Validate checks config without applying it
+func Validate(config Config) error {
+	if config.OIDC != nil {
+		if err := config.OIDC.validate(); err != nil {
+			return err
+		}
+	}
+	_, err := principals(config)
+	return err
+}
+
+func principals(config Config) (map[string]*Principal, error) {
+	keys := make(map[string]*Principal)
+	for i, k := range config.Keys {
+		name := k.Name
+		if name == "" {
+			name = fmt.Sprintf("key %d", i)
+		}
+		if roleRank[k.Role] == 0 {
+			return nil, fmt.Errorf("%s: unknown role %q", name, k.Role)
+		}
+		hash, err := keyHash(k.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if _, ok := keys[hash]; ok {
+			return nil, fmt.Errorf("%s: duplicate key", name)
+		}
+		p := &Principal{Name: name, Role: k.Role}
+		if len(k.Servers) > 0 {
+			p.Servers = make(map[string]bool)
+			for _, token := range k.Servers {
+				p.Servers[token] = true
+			}
+		}
+		keys[hash] = p
+	}
+	return keys, nil
+}
+
+// keyHash returns the hex SHA-256 of a configured key
+func keyHash(key string) (string, error) {
+	if hash, ok := strings.CutPrefix(key, "sha256:"); ok {
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return "", errors.New("invalid sha256 key hash")
+		}
+		return strings.ToLower(hash), nil
+	}
+	if len(key) < 16 {
+		return "", errors.New("keys must be at least 16 characters")
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Update replaces the keys, origins and OIDC settings. Changed OIDC
+// settings end all sessions.
+func (a *Authenticator) Update(config Config) error {
+	if err := Validate(config); err != nil {
+		return err
+	}
+	keys, _ := principals(config)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = keys
+	a.origins = config.AllowedOrigins
+	a.ingestKey = config.IngestKey
+	switch {
+	case config.OIDC == nil:
+		if a.oidc != nil {
+			a.sessions.clear()
+		}
+		a.oidc = nil
+	case a.oidc == nil || !reflect.DeepEqual(a.oidc.config, *config.OIDC):
+		if a.oidc != nil {
+			a.sessions.clear()
+		}
+		a.oidc = newOIDCProvider(*config.OIDC)
+	}
+	return nil
+}
+
+// Enabled reports whether any keys or OIDC are configured
+func (a *Authenticator) Enabled() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.keys) > 0 || a.oidc != nil
+}
+
+func (a *Authenticator) provider() *oidcProvider {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.oidc
+}
+
+// requestKey returns the key of a request from the Authorization bearer
+// token, X-API-Key or, for websockets and event streams, ?api_key=
+func requestKey(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api_key")
+}
+
+// Authenticate returns the principal of a request from its key or OIDC
+// session. ok is false if auth is enabled and the request has neither.
+func (a *Authenticator) Authenticate(r *http.Request) (p *Principal, ok bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if len(a.keys) == 0 && a.oidc == nil {
+		return nil, true
+	}
+	if key := requestKey(r); key != "" {
+		sum := sha256.Sum256([]byte(key))
+		p, ok = a.keys[hex.EncodeToString(sum[:])]
+		return p, ok
+	}
+	if a.oidc != nil {
+		if p := a.sessions.principal(r); p != nil {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Require only lets requests through whose key has at least role. Global
+// routes act on all servers and refuse keys scoped to some servers.
+func (a *Authenticator) Require(role Role, global bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := a.Authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cs2-log-proxy"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if p != nil && (!p.Role.Includes(role) || global && p.Scoped()) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		// Browsers send the session cookie along with requests from other
+		// sites, only same-origin pages may change things with it
+		if p != nil && p.session && !safeMethod(r.Method) && (r.Header.Get("Origin") == "" || !a.CheckOrigin(r)) {
+			http.Error(w, "Cross-origin request refused", http.StatusForbidden)
+			return
+		}
+		if p != nil {
+			r = r.WithContext(context.WithValue(r.Context(), contextKey{}, p))
+		}
+		h(w, r)
+	}
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// Ingest checks the ingest key of log posts from game servers. rejected is
+// called for posts refused for a missing or wrong key.
+func (a *Authenticator) Ingest(h http.HandlerFunc, rejected func(r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.mu.RLock()
+		want := a.ingestKey
+		a.mu.RUnlock()
+		if want != "" && subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("key")), []byte(want)) != 1 {
+			rejected(r)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// CheckOrigin decides whether a websocket may be opened from a page.
+// Requests without Origin come from non-browser clients.
+func (a *Authenticator) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	a.mu.RLock()
+	origins := a.origins
+	a.mu.RUnlock()
+	for _, allowed := range origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanSeeLog(t *testing.T) {
+	owners := map[string]string{
+		"abc_2025-01-30T16-33-56.470":   "abc",
+		"abc_x_2025-01-30T16-40-00.000": "abc_x",
+	}
+	defer func(f func(string) (string, bool)) { LogOwner = f }(LogOwner)
+	LogOwner = func(logID string) (string, bool) {
+		token, ok := owners[logID]
+		return token, ok
+	}
+
+	p := &Principal{Name: "partner", Role: Viewer, Servers: map[string]bool{"abc": true}}
+	tests := []struct {
+		logID string
+		want  bool
+	}{
+		{"abc_2025-01-30T16-33-56.470", true},
+		// Shares the prefix "abc_" but belongs to server abc_x
+		{"abc_x_2025-01-30T16-40-00.000", false},
+		{"abc_unknown", false},
+	}
+	for _, tt := range tests {
+		if got := p.CanSeeLog(tt.logID); got != tt.want {
+			t.Errorf("CanSeeLog(%q) = %v, want %v", tt.logID, got, tt.want)
+		}
+	}
+	var unscoped *Principal
+	if !unscoped.CanSeeLog("abc_unknown") {
+		t.Error("unscoped principal can't see an unknown log")
+	}
+}
+
+func TestIngest(t *testing.T) {
+	a, err := New(Config{IngestKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := 0
+	h := a.Ingest(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}, func(*http.Request) { rejected++ })
+
+	for _, tt := range []struct {
+		target string
+		want   int
+	}{
+		{"/api/logs?key=secret", http.StatusNoContent},
+		{"/api/logs?key=wrong", http.StatusUnauthorized},
+		{"/api/logs", http.StatusUnauthorized},
+	} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("POST", tt.target, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: %d, want %d", tt.target, w.Code, tt.want)
+		}
+	}
+	if rejected != 2 {
+		t.Errorf("rejected called %d times, want 2", rejected)
+	}
+}
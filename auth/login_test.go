@@ -0,0 +1,305 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"cs2-log-proxy/auth/mockidp"
+)
+
+const (
+	testClientID = "cs2-log-proxy"
+	testCallback = "http://proxy.test/auth/callback"
+)
+
+// newTestLogin serves a mock IdP and returns an Authenticator logging in
+// with it
+func newTestLogin(t *testing.T, users ...mockidp.User) (*Authenticator, *mockidp.Provider) {
+	t.Helper()
+	var idp *mockidp.Provider
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idp.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	idp, err := mockidp.New(srv.URL, testClientID, users...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := New(Config{OIDC: &OIDCConfig{
+		Issuer:      srv.URL,
+		ClientID:    testClientID,
+		RedirectURL: testCallback,
+		Groups: []GroupRole{
+			{Group: "viewers", Role: Viewer},
+			{Group: "x-admins", Role: Admin, Servers: []string{"x"}},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, idp
+}
+
+// startLogin calls /auth/login and returns the authorization URL it
+// redirects to
+func startLogin(t *testing.T, a *Authenticator) *url.URL {
+	t.Helper()
+	w := httptest.NewRecorder()
+	a.Login(w, httptest.NewRequest("GET", "/auth/login?redirect=/logs", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// authorize logs in at the IdP and returns the callback URL it redirects to
+func authorize(t *testing.T, authURL *url.URL) string {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: %s", resp.Status)
+	}
+	return resp.Header.Get("Location")
+}
+
+// callback completes a login at /auth/callback
+func callback(a *Authenticator, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	a.Callback(w, httptest.NewRequest("GET", target, nil))
+	return w
+}
+
+// setParam returns u with a query parameter replaced
+func setParam(u *url.URL, key, value string) *url.URL {
+	q := u.Query()
+	q.Set(key, value)
+	c := *u
+	c.RawQuery = q.Encode()
+	return &c
+}
+
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == SessionCookie && c.MaxAge > 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestLogin(t *testing.T) {
+	a, _ := newTestLogin(t, mockidp.User{Subject: "alice", Email: "alice@example.com", Groups: []string{"viewers", "x-admins"}})
+
+	authURL := startLogin(t, a)
+	q := authURL.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" || q.Get("nonce") == "" || q.Get("state") == "" {
+		t.Fatalf("authorization URL lacks PKCE, nonce or state: %s", authURL)
+	}
+	w := callback(a, authorize(t, authURL))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/logs" {
+		t.Fatalf("callback: %d to %q, %s", w.Code, w.Header().Get("Location"), w.Body)
+	}
+	cookie := sessionCookie(w)
+	if cookie == nil || !cookie.HttpOnly {
+		t.Fatalf("no session cookie in %v", w.Result().Cookies())
+	}
+
+	r := httptest.NewRequest("GET", "/auth/me", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	a.Me(w, r)
+	var me struct {
+		Name    string   `json:"name"`
+		Role    Role     `json:"role"`
+		Servers []string `json:"servers"`
+		Login   bool     `json:"login"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&me); err != nil {
+		t.Fatal(err)
+	}
+	if me.Name != "alice@example.com" || me.Role != Admin || len(me.Servers) != 1 || me.Servers[0] != "x" || !me.Login {
+		t.Errorf("me = %+v, want alice@example.com as admin on x", me)
+	}
+}
+
+func TestLoginWithoutRole(t *testing.T) {
+	a, _ := newTestLogin(t, mockidp.User{Subject: "mallory", Groups: []string{"other"}})
+	w := callback(a, authorize(t, startLogin(t, a)))
+	if w.Code != http.StatusForbidden || sessionCookie(w) != nil {
+		t.Errorf("callback: %d, want 403 without a session", w.Code)
+	}
+}
+
+func TestLoginPKCE(t *testing.T) {
+	a, _ := newTestLogin(t, mockidp.User{Subject: "alice", Groups: []string{"viewers"}})
+	// A code issued for another challenge can't be redeemed with the
+	// verifier of this login
+	sum := sha256.Sum256([]byte("another verifier"))
+	authURL := setParam(startLogin(t, a), "code_challenge", base64.RawURLEncoding.EncodeToString(sum[:]))
+	if w := callback(a, authorize(t, authURL)); w.Code != http.StatusUnauthorized {
+		t.Errorf("callback: %d, want 401", w.Code)
+	}
+}
+
+func TestLoginNonce(t *testing.T) {
+	a, _ := newTestLogin(t, mockidp.User{Subject: "alice", Groups: []string{"viewers"}})
+	authURL := setParam(startLogin(t, a), "nonce", "replayed")
+	if w := callback(a, authorize(t, authURL)); w.Code != http.StatusUnauthorized {
+		t.Errorf("callback: %d, want 401", w.Code)
+	}
+}
+
+func TestLoginState(t *testing.T) {
+	a, _ := newTestLogin(t, mockidp.User{Subject: "alice", Groups: []string{"viewers"}})
+
+	target := authorize(t, startLogin(t, a))
+	if w := callback(a, target); w.Code != http.StatusFound {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+	if w := callback(a, target); w.Code != http.StatusUnauthorized {
+		t.Errorf("reused state: %d, want 401", w.Code)
+	}
+
+	u, _ := url.Parse(authorize(t, startLogin(t, a)))
+	if w := callback(a, setParam(u, "state", "forged").String()); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown state: %d, want 401", w.Code)
+	}
+
+	authURL := startLogin(t, a)
+	o := a.provider()
+	o.mu.Lock()
+	o.pending[authURL.Query().Get("state")].expires = time.Now().Add(-time.Second)
+	o.mu.Unlock()
+	if w := callback(a, authorize(t, authURL)); w.Code != http.StatusUnauthorized {
+		t.Errorf("expired state: %d, want 401", w.Code)
+	}
+}
+
+func TestLoginKeyRotation(t *testing.T) {
+	a, _ := newTestLogin(t, mockidp.User{Subject: "alice", Groups: []string{"viewers"}})
+	authURL := startLogin(t, a)
+
+	// Keys cached before the IdP rotated to its current key
+	old, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := a.provider()
+	o.mu.Lock()
+	o.keys, o.keysAt = map[string]*rsa.PublicKey{"old": &old.PublicKey}, time.Now().Add(-2*jwksRefresh)
+	o.mu.Unlock()
+
+	if w := callback(a, authorize(t, authURL)); w.Code != http.StatusFound {
+		t.Errorf("callback: %d %s, want the key set refetched", w.Code, w.Body)
+	}
+}
+
+// signToken returns a JWT with the given header and claims, signed with key
+func signToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]interface{}) string {
+	t.Helper()
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestParseIDToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]*rsa.PublicKey{"k1": &key.PublicKey}
+	claims := map[string]interface{}{"sub": "alice"}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", signToken(t, key, map[string]interface{}{"alg": "RS256", "kid": "k1"}, claims), false},
+		{"single key without kid", signToken(t, key, map[string]interface{}{"alg": "RS256"}, claims), false},
+		{"alg none", signToken(t, key, map[string]interface{}{"alg": "none", "kid": "k1"}, claims), true},
+		{"alg HS256", signToken(t, key, map[string]interface{}{"alg": "HS256", "kid": "k1"}, claims), true},
+		{"unknown kid", signToken(t, key, map[string]interface{}{"alg": "RS256", "kid": "k2"}, claims), true},
+		{"other key", signToken(t, other, map[string]interface{}{"alg": "RS256", "kid": "k1"}, claims), true},
+		{"malformed", "not.a-token", true},
+	}
+	for _, tt := range tests {
+		c, err := parseIDToken(tt.token, keys)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if err == nil && c.Subject != "alice" {
+			t.Errorf("%s: subject %q", tt.name, c.Subject)
+		}
+	}
+	token := signToken(t, key, map[string]interface{}{"alg": "RS256", "kid": "k2"}, claims)
+	if _, err := parseIDToken(token, keys); !errors.Is(err, errUnknownKey) {
+		t.Errorf("unknown kid: err = %v, want errUnknownKey", err)
+	}
+}
+
+func TestSessionCrossOrigin(t *testing.T) {
+	a, _ := newTestLogin(t, mockidp.User{Subject: "alice", Groups: []string{"x-admins"}})
+	cookie := sessionCookie(callback(a, authorize(t, startLogin(t, a))))
+	if cookie == nil {
+		t.Fatal("login failed")
+	}
+	h := a.Require(Viewer, false, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		method string
+		origin string
+		want   int
+	}{
+		{"GET", "http://evil.test", http.StatusNoContent},
+		{"POST", "http://proxy.test", http.StatusNoContent},
+		{"POST", "http://evil.test", http.StatusForbidden},
+		{"DELETE", "http://evil.test", http.StatusForbidden},
+		{"POST", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://proxy.test/api/logs/x", nil)
+		r.AddCookie(cookie)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s from %q: %d, want %d", tt.method, tt.origin, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig enables login to the web UI with an OpenID Connect provider
+type OIDCConfig struct {
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret,omitempty"` // empty for public clients
+	// RedirectURL is the URL of /auth/callback as seen by the browser
+	RedirectURL string   `json:"redirectUrl"`
+	Scopes      []string `json:"scopes,omitempty"`      // default openid, profile, email, groups
+	GroupsClaim string   `json:"groupsClaim,omitempty"` // default "groups"
+	// Groups map the IdP groups of a user to a role. Users in none of them
+	// can't log in.
+	Groups     []GroupRole `json:"groups"`
+	SessionTTL string      `json:"sessionTTL,omitempty"` // default 12h
+}
+
+// GroupRole gives the members of an IdP group a role, limited to Servers
+// if set
+type GroupRole struct {
+	Group   string   `json:"group"`
+	Role    Role     `json:"role"`
+	Servers []string `json:"servers,omitempty"`
+}
+
+const (
+	defaultSessionTTL = 12 * time.Hour
+	// loginTimeout is how long a user may take at the IdP
+	loginTimeout = 10 * time.Minute
+	// maxPendingLogins bounds the logins waiting for their callback
+	maxPendingLogins = 10000
+	// jwksRefresh limits how often an unknown key ID refetches the key set
+	jwksRefresh = time.Minute
+)
+
+func (c *OIDCConfig) validate() error {
+	if c.Issuer == "" || c.ClientID == "" {
+		return errors.New("oidc: issuer and clientId are required")
+	}
+	if u, err := url.Parse(c.RedirectURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return errors.New("oidc: redirectUrl must be an absolute URL")
+	}
+	if _, err := c.sessionTTL(); err != nil {
+		return err
+	}
+	for _, g := range c.Groups {
+		if roleRank[g.Role] == 0 {
+			return fmt.Errorf("oidc: group %s: unknown role %q", g.Group, g.Role)
+		}
+	}
+	return nil
+}
+
+func (c *OIDCConfig) sessionTTL() (time.Duration, error) {
+	if c.SessionTTL == "" {
+		return defaultSessionTTL, nil
+	}
+	d, err := time.ParseDuration(c.SessionTTL)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("oidc: invalid sessionTTL %q", c.SessionTTL)
+	}
+	return d, nil
+}
+
+// principal maps the groups of a user to a principal. Each group grants a
+// role on its servers; the user gets the grants with the highest role, and
+// the servers of those grants only, so a group with a higher role doesn't
+// widen to the servers of a lower one. nil if no group matches.
+func (c *OIDCConfig) principal(name string, groups []string) *Principal {
+	var p *Principal
+	for _, g := range c.Groups {
+		if !containsString(groups, g.Group) {
+			continue
+		}
+		switch {
+		case p == nil || !p.Role.Includes(g.Role):
+			p = &Principal{Name: name, Role: g.Role, session: true}
+			if len(g.Servers) > 0 {
+				p.Servers = map[string]bool{}
+			}
+		case g.Role != p.Role:
+			// A lower role than the grants kept
+			continue
+		case len(g.Servers) == 0:
+			p.Servers = nil
+		}
+		if p.Servers == nil {
+			continue
+		}
+		for _, token := range g.Servers {
+			p.Servers[token] = true
+		}
+	}
+	return p
+}
+
+// pendingLogin is a login waiting for the callback from the IdP
+type pendingLogin struct {
+	verifier string // PKCE code verifier
+	nonce    string
+	redirect string
+	expires  time.Time
+}
+
+// oidcProvider talks to the IdP of an OIDCConfig. The discovery document
+// and keys are fetched on the first login.
+type oidcProvider struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      map[string]*rsa.PublicKey
+	keysAt    time.Time
+	pending   map[string]*pendingLogin // state -> login
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func newOIDCProvider(config OIDCConfig) *oidcProvider {
+	return &oidcProvider{
+		config:  config,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		pending: make(map[string]*pendingLogin),
+	}
+}
+
+func (o *oidcProvider) getJSON(url string, v interface{}) error {
+	resp, err := o.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// discover returns the discovery document of the issuer
+func (o *oidcProvider) discover() (*discovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+	var d discovery
+	if err := o.getJSON(strings.TrimSuffix(o.config.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if d.Issuer != o.config.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q", d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("incomplete discovery document")
+	}
+	o.discovery = &d
+	return o.discovery, nil
+}
+
+// signingKeys returns the cached keys of the IdP, fetching them if there
+// are none or refresh is set and they weren't fetched recently
+func (o *oidcProvider) signingKeys(d *discovery, refresh bool) (map[string]*rsa.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.keys != nil && (!refresh || time.Since(o.keysAt) < jwksRefresh) {
+		return o.keys, nil
+	}
+	resp, err := o.client.Get(d.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", d.JWKSURI, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	o.keys, o.keysAt = keys, time.Now()
+	return keys, nil
+}
+
+// start registers a login and returns the URL of the IdP to send the user to
+func (o *oidcProvider) start(redirect string) (string, error) {
+	d, err := o.discover()
+	if err != nil {
+		return "", err
+	}
+	state, login := randomString(16), &pendingLogin{
+		verifier: randomString(32),
+		nonce:    randomString(16),
+		redirect: redirect,
+		expires:  time.Now().Add(loginTimeout),
+	}
+	o.mu.Lock()
+	if len(o.pending) >= maxPendingLogins {
+		now := time.Now()
+		for s, l := range o.pending {
+			if now.After(l.expires) {
+				delete(o.pending, s)
+			}
+		}
+	}
+	if len(o.pending) >= maxPendingLogins {
+		o.mu.Unlock()
+		return "", errors.New("too many pending logins")
+	}
+	o.pending[state] = login
+	o.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.verifier))
+	scopes := o.config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email", "groups"}
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {o.config.ClientID},
+		"redirect_uri":          {o.config.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// finish redeems the code of a callback and returns the principal of the
+// user and where to send them
+func (o *oidcProvider) finish(state, code string) (*Principal, string, error) {
+	o.mu.Lock()
+	login := o.pending[state]
+	delete(o.pending, state)
+	o.mu.Unlock()
+	if login == nil || time.Now().After(login.expires) {
+		return nil, "", errors.New("unknown or expired login")
+	}
+	d, err := o.discover()
+	if err != nil {
+		return nil, "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.config.RedirectURL},
+		"client_id":     {o.config.ClientID},
+		"code_verifier": {login.verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if o.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.ClientSecret))
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, "", fmt.Errorf("token request failed: %s %s", resp.Status, body)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil {
+		return nil, "", err
+	}
+	if tokens.IDToken == "" {
+		return nil, "", errors.New("no id_token in token response")
+	}
+
+	keys, err := o.signingKeys(d, false)
+	if err != nil {
+		return nil, "", err
+	}
+	claims, err := parseIDToken(tokens.IDToken, keys)
+	if errors.Is(err, errUnknownKey) {
+		// The IdP may have rotated its keys
+		if keys, err = o.signingKeys(d, true); err == nil {
+			claims, err = parseIDToken(tokens.IDToken, keys)
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := claims.validate(o.config.Issuer, o.config.ClientID, login.nonce, time.Now()); err != nil {
+		return nil, "", err
+	}
+
+	name := claims.Email
+	if name == "" {
+		name = claims.Username
+	}
+	if name == "" {
+		name = claims.Subject
+	}
+	claim := o.config.GroupsClaim
+	if claim == "" {
+		claim = "groups"
+	}
+	p := o.config.principal(name, claims.groups(claim))
+	if p == nil {
+		return nil, "", errNoRole
+	}
+	return p, login.redirect, nil
+}
+
+// errNoRole means none of the user's groups has a role
+var errNoRole = errors.New("no role for the user's groups")
+
+// localRedirect returns target if it is a path on this host, "/" otherwise
+func localRedirect(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	return target
+}
+
+// Login sends the browser to the IdP. ?redirect= is where to go after
+// logging in.
+func (a *Authenticator) Login(w http.ResponseWriter, r *http.Request) {
+	o := a.provider()
+	if o == nil {
+		http.Error(w, "OIDC login is not configured", http.StatusNotFound)
+		return
+	}
+	target, err := o.start(localRedirect(r.URL.Query().Get("redirect")))
+	if err != nil {
+		log.Printf("OIDC login: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// Callback completes a login and sets the session cookie
+func (a *Authenticator) Callback(w http.ResponseWriter, r *http.Request) {
+	o := a.provider()
+	if o == nil {
+		http.Error(w, "OIDC login is not configured", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "Login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+	p, redirect, err := o.finish(q.Get("state"), q.Get("code"))
+	if errors.Is(err, errNoRole) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("OIDC callback: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	ttl, _ := o.config.sessionTTL()
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    a.sessions.create(p, ttl),
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(o.config.RedirectURL, "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Printf("OIDC login of %s as %s", p.Name, p.Role)
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// Logout ends the session
+func (a *Authenticator) Logout(w http.ResponseWriter, r *http.Request) {
+	a.sessions.remove(r)
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Path: "/", MaxAge: -1, HttpOnly: true})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Me returns who a request is authenticated as
+func (a *Authenticator) Me(w http.ResponseWriter, r *http.Request) {
+	p, ok := a.Authenticate(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	me := struct {
+		Name    string   `json:"name,omitempty"`
+		Role    Role     `json:"role"`
+		Servers []string `json:"servers,omitempty"`
+		Login   bool     `json:"login"` // logged in with OIDC, can log out
+	}{Role: Admin}
+	if p != nil {
+		me.Name, me.Role, me.Login = p.Name, p.Role, p.session
+		for token := range p.Servers {
+			me.Servers = append(me.Servers, token)
+		}
+		sort.Strings(me.Servers)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(me)
+}
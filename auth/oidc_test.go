@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrincipalGroups(t *testing.T) {
+	config := OIDCConfig{Groups: []GroupRole{
+		{Group: "all-viewers", Role: Viewer},
+		{Group: "x-admins", Role: Admin, Servers: []string{"x"}},
+		{Group: "y-admins", Role: Admin, Servers: []string{"y"}},
+		{Group: "z-operators", Role: Operator, Servers: []string{"z"}},
+		{Group: "operators", Role: Operator},
+	}}
+	tests := []struct {
+		groups  []string
+		role    Role
+		servers map[string]bool
+	}{
+		{[]string{"all-viewers"}, Viewer, nil},
+		// The viewer grant on all servers must not widen the admin grant
+		{[]string{"all-viewers", "x-admins"}, Admin, map[string]bool{"x": true}},
+		{[]string{"x-admins", "all-viewers"}, Admin, map[string]bool{"x": true}},
+		{[]string{"x-admins", "y-admins"}, Admin, map[string]bool{"x": true, "y": true}},
+		{[]string{"z-operators", "x-admins"}, Admin, map[string]bool{"x": true}},
+		{[]string{"z-operators", "operators"}, Operator, nil},
+		{[]string{"operators", "z-operators"}, Operator, nil},
+	}
+	for _, tt := range tests {
+		p := config.principal("alice", tt.groups)
+		if p == nil {
+			t.Fatalf("%v: no principal", tt.groups)
+		}
+		if p.Role != tt.role || !reflect.DeepEqual(p.Servers, tt.servers) {
+			t.Errorf("%v: got %s on %v, want %s on %v", tt.groups, p.Role, p.Servers, tt.role, tt.servers)
+		}
+	}
+	if p := config.principal("bob", []string{"other"}); p != nil {
+		t.Errorf("unknown group: got %+v, want nil", p)
+	}
+}
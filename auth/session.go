@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SessionCookie holds the session of users logged in with OIDC
+const SessionCookie = "cs2_session"
+
+// maxSessions bounds the sessions kept in memory
+const maxSessions = 100000
+
+type session struct {
+	principal *Principal
+	expires   time.Time
+}
+
+// sessions are kept in memory, users log in again after a restart
+type sessions struct {
+	mu   sync.Mutex
+	byID map[string]*session
+}
+
+func newSessions() *sessions {
+	return &sessions{byID: make(map[string]*session)}
+}
+
+// randomString returns n random bytes, base64url encoded
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// create starts a session for p and returns its ID
+func (s *sessions) create(p *Principal, ttl time.Duration) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if len(s.byID) >= maxSessions {
+		for id, sess := range s.byID {
+			if now.After(sess.expires) {
+				delete(s.byID, id)
+			}
+		}
+	}
+	if len(s.byID) >= maxSessions {
+		// Drop an arbitrary session rather than refusing logins
+		for id := range s.byID {
+			delete(s.byID, id)
+			break
+		}
+	}
+	id := randomString(32)
+	s.byID[id] = &session{principal: p, expires: now.Add(ttl)}
+	return id
+}
+
+// principal returns the principal of the session cookie of r, if any
+func (s *sessions) principal(r *http.Request) *Principal {
+	c, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess := s.byID[c.Value]
+	if sess == nil {
+		return nil
+	}
+	if time.Now().After(sess.expires) {
+		delete(s.byID, c.Value)
+		return nil
+	}
+	return sess.principal
+}
+
+func (s *sessions) remove(r *http.Request) {
+	if c, err := r.Cookie(SessionCookie); err == nil {
+		s.mu.Lock()
+		delete(s.byID, c.Value)
+		s.mu.Unlock()
+	}
+}
+
+// clear ends all sessions, e.g. when the OIDC settings change
+func (s *sessions) clear() {
+	s.mu.Lock()
+	s.byID = make(map[string]*session)
+	s.mu.Unlock()
+}
@@ -0,0 +1,36 @@
+// mock-idp runs a local OpenID Connect provider that logs in a fixed user,
+// for trying out the OIDC login of the proxy
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"cs2-log-proxy/auth/mockidp"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:9000", "address to listen on")
+	clientID := flag.String("client", "cs2-log-proxy", "client ID to accept")
+	subject := flag.String("sub", "alice", "subject of the user")
+	email := flag.String("email", "alice@example.com", "email of the user")
+	groups := flag.String("groups", "admins", "comma separated groups of the user")
+	flag.Parse()
+
+	user := mockidp.User{Subject: *subject, Email: *email}
+	if *groups != "" {
+		user.Groups = strings.Split(*groups, ",")
+	}
+	issuer := "http://" + *addr
+	idp, err := mockidp.New(issuer, *clientID, user)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Mock identity provider %s logging in %s (%s)\n", issuer, user.Subject, strings.Join(user.Groups, ", "))
+	if err := http.ListenAndServe(*addr, idp); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -2,32 +2,60 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"time"
+
+	"cs2-log-proxy/auth"
+	"cs2-log-proxy/receiver"
+	"cs2-log-proxy/storage"
 )
 
 type Config struct {
 	Server struct {
-		Port int `json:"port"`
+		Port int `json:"port"` // default 8081
 	} `json:"server"`
 
-	Storage struct {
-		Type        string `json:"type"`
-		Path        string `json:"path"`
-		MaxFileSize int64  `json:"maxFileSize"`
-		MaxFiles    int    `json:"maxFiles"`
-	} `json:"storage"`
+	// Proxy identifies this instance when proxies forward to each other
+	Proxy struct {
+		ID      string `json:"id"`
+		MaxHops int    `json:"maxHops"`
+		// Peers are the addresses or CIDR ranges of proxies relaying to
+		// this one, the only ones whose proxy chain and arrival time are kept
+		Peers []string `json:"peers,omitempty"`
+	} `json:"proxy"`
+
+	// Delay holds chunks back before they are forwarded to receivers, e.g. "2m"
+	Delay string `json:"delay,omitempty"`
+
+	Storage storage.Config `json:"storage"`
+
+	Receivers []ReceiverConfig `json:"receivers"`
+
+	// Auth holds the API keys, the API is open without any
+	Auth auth.Config `json:"auth"`
+}
+
+// ReceiverConfig configures a receiver, see receiver.NewSink
+type ReceiverConfig struct {
+	ID     string                 `json:"id"`
+	Type   string                 `json:"type"`
+	Config map[string]interface{} `json:"config"`
+}
 
-	Receivers []struct {
-		ID   string `json:"id"`
-		Type string `json:"type"`
-		Config map[string]interface{} `json:"config"`
-	} `json:"receivers"`
+// DefaultPath is used when no config file is given
+func DefaultPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".cs2-log-manager", "config.json")
 }
 
 func LoadConfig(path string) (*Config, error) {
 	if path == "" {
-		path = filepath.Join(os.Getenv("HOME"), ".cs2-log-manager", "config.json")
+		path = DefaultPath()
 	}
 
 	data, err := os.ReadFile(path)
@@ -42,3 +70,290 @@ func LoadConfig(path string) (*Config, error) {
 
 	return &c, nil
 }
+
+// Save writes c to path, replacing the file atomically
+func Save(path string, c *Config) error {
+	if path == "" {
+		path = DefaultPath()
+	}
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".config-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// The config holds secrets
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Environment variables overriding config values
+const (
+	EnvPath        = "CS2_LOG_PROXY_CONFIG"
+	EnvPort        = "CS2_LOG_PROXY_PORT"
+	EnvProxyID     = "CS2_LOG_PROXY_ID"
+	EnvMaxHops     = "CS2_LOG_PROXY_MAX_HOPS"
+	EnvDelay       = "CS2_LOG_PROXY_DELAY"
+	EnvStorageType = "CS2_LOG_PROXY_STORAGE_TYPE"
+	EnvStoragePath = "CS2_LOG_PROXY_STORAGE_PATH"
+	EnvCompression = "CS2_LOG_PROXY_COMPRESSION"
+	EnvS3AccessKey = "CS2_LOG_PROXY_S3_ACCESS_KEY"
+	EnvS3SecretKey = "CS2_LOG_PROXY_S3_SECRET_KEY"
+)
+
+// envStrings and envInts map the environment variables to the values of c
+// they override
+func (c *Config) envStrings() map[string]*string {
+	return map[string]*string{
+		EnvProxyID:     &c.Proxy.ID,
+		EnvDelay:       &c.Delay,
+		EnvStorageType: &c.Storage.Type,
+		EnvStoragePath: &c.Storage.Path,
+		EnvCompression: &c.Storage.Compression,
+		EnvS3AccessKey: &c.Storage.S3.AccessKey,
+		EnvS3SecretKey: &c.Storage.S3.SecretKey,
+	}
+}
+
+func (c *Config) envInts() map[string]*int {
+	return map[string]*int{
+		EnvPort:    &c.Server.Port,
+		EnvMaxHops: &c.Proxy.MaxHops,
+	}
+}
+
+// ApplyEnv overrides config values with the environment variables that are set
+func (c *Config) ApplyEnv() error {
+	for name, dst := range c.envStrings() {
+		if v, ok := os.LookupEnv(name); ok {
+			*dst = v
+		}
+	}
+	for name, dst := range c.envInts() {
+		if v, ok := os.LookupEnv(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*dst = n
+		}
+	}
+	return nil
+}
+
+// WithoutEnv returns a copy of c with the values overridden by environment
+// variables taken from file, the config as read from the config file, so
+// the environment, e.g. S3 secrets, isn't written to the file
+func (c *Config) WithoutEnv(file *Config) *Config {
+	out := c.Clone()
+	fileStrings := file.envStrings()
+	for name, dst := range out.envStrings() {
+		if _, ok := os.LookupEnv(name); ok {
+			*dst = *fileStrings[name]
+		}
+	}
+	fileInts := file.envInts()
+	for name, dst := range out.envInts() {
+		if _, ok := os.LookupEnv(name); ok {
+			*dst = *fileInts[name]
+		}
+	}
+	return out
+}
+
+// Validate checks the config without applying it
+func (c *Config) Validate() error {
+	if c.Server.Port < 0 || c.Server.Port > 65535 {
+		return fmt.Errorf("invalid server port %d", c.Server.Port)
+	}
+	if c.Proxy.MaxHops < 0 {
+		return errors.New("proxy maxHops must not be negative")
+	}
+	if _, err := c.ProxyPeers(); err != nil {
+		return err
+	}
+	if _, err := c.DelayDuration(); err != nil {
+		return err
+	}
+	if err := storage.ValidateConfig(c.Storage); err != nil {
+		return fmt.Errorf("storage: %w", err)
+	}
+	seen := make(map[string]bool)
+	for i, rc := range c.Receivers {
+		if rc.ID == "" {
+			return fmt.Errorf("receiver %d: missing id", i)
+		}
+		if err := receiver.ValidateID(rc.ID); err != nil {
+			return err
+		}
+		if seen[rc.ID] {
+			return fmt.Errorf("receiver %s: duplicate id", rc.ID)
+		}
+		seen[rc.ID] = true
+		if rc.Type == "" {
+			return fmt.Errorf("receiver %s: missing type", rc.ID)
+		}
+	}
+	if err := auth.Validate(c.Auth); err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+	return nil
+}
+
+// ProxyPeers parses Proxy.Peers. Single addresses match only themselves.
+func (c *Config) ProxyPeers() ([]netip.Prefix, error) {
+	var peers []netip.Prefix
+	for _, p := range c.Proxy.Peers {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(p)
+			if aerr != nil {
+				return nil, fmt.Errorf("invalid proxy peer %q", p)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		peers = append(peers, prefix.Masked())
+	}
+	return peers, nil
+}
+
+// DelayDuration parses Delay
+func (c *Config) DelayDuration() (time.Duration, error) {
+	if c.Delay == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.Delay)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid delay %q", c.Delay)
+	}
+	return d, nil
+}
+
+// Clone returns a deep copy of c
+func (c *Config) Clone() *Config {
+	data, _ := json.Marshal(c)
+	var out Config
+	json.Unmarshal(data, &out)
+	return &out
+}
+
+// redacted replaces secret values
+const redacted = "***"
+
+// Redacted returns a copy of c with secrets hidden
+func (c *Config) Redacted() *Config {
+	out := c.Clone()
+	for _, s3 := range out.s3Configs() {
+		if s3.AccessKey != "" {
+			s3.AccessKey = redacted
+		}
+		if s3.SecretKey != "" {
+			s3.SecretKey = redacted
+		}
+	}
+	for i := range out.Receivers {
+		out.Receivers[i].Config = receiver.RedactConfig(out.Receivers[i].Config)
+	}
+	for i := range out.Auth.Keys {
+		out.Auth.Keys[i].Key = redacted
+	}
+	if out.Auth.IngestKey != "" {
+		out.Auth.IngestKey = redacted
+	}
+	if out.Auth.OIDC != nil && out.Auth.OIDC.ClientSecret != "" {
+		out.Auth.OIDC.ClientSecret = redacted
+	}
+	return out
+}
+
+// RestoreSecrets puts the secrets of old back where c holds the redacted
+// placeholder, so a config read from the API can be sent back unchanged
+func (c *Config) RestoreSecrets(old *Config) {
+	oldS3 := old.s3Configs()
+	for i, s3 := range c.s3Configs() {
+		if i >= len(oldS3) {
+			break
+		}
+		if s3.AccessKey == redacted {
+			s3.AccessKey = oldS3[i].AccessKey
+		}
+		if s3.SecretKey == redacted {
+			s3.SecretKey = oldS3[i].SecretKey
+		}
+	}
+	for _, rc := range c.Receivers {
+		for _, prev := range old.Receivers {
+			if prev.ID != rc.ID {
+				continue
+			}
+			receiver.RestoreSecrets(rc.Config, prev.Config)
+		}
+	}
+	// API keys are matched by name
+	for i, k := range c.Auth.Keys {
+		if k.Key != redacted {
+			continue
+		}
+		for _, prev := range old.Auth.Keys {
+			if prev.Name == k.Name {
+				c.Auth.Keys[i].Key = prev.Key
+			}
+		}
+	}
+	if c.Auth.IngestKey == redacted {
+		c.Auth.IngestKey = old.Auth.IngestKey
+	}
+	if c.Auth.OIDC != nil && c.Auth.OIDC.ClientSecret == redacted && old.Auth.OIDC != nil {
+		c.Auth.OIDC.ClientSecret = old.Auth.OIDC.ClientSecret
+	}
+}
+
+// s3Configs returns the S3 settings of the store and of the retention
+// archive, if any
+func (c *Config) s3Configs() []*storage.S3Config {
+	out := []*storage.S3Config{&c.Storage.S3}
+	if c.Storage.Retention.Archive != nil {
+		out = append(out, &c.Storage.Retention.Archive.S3)
+	}
+	return out
+}
+
+// RestartRequired lists the changed settings that only take effect after
+// a restart
+func RestartRequired(old, c *Config) []string {
+	var fields []string
+	if old.Server.Port != c.Server.Port {
+		fields = append(fields, "server.port")
+	}
+	if !reflect.DeepEqual(old.Proxy, c.Proxy) {
+		fields = append(fields, "proxy")
+	}
+	if old.Storage.Type != c.Storage.Type {
+		fields = append(fields, "storage.type")
+	}
+	if old.Storage.Path != c.Storage.Path {
+		fields = append(fields, "storage.path")
+	}
+	if old.Storage.MaxFileSize != c.Storage.MaxFileSize {
+		fields = append(fields, "storage.maxFileSize")
+	}
+	if !reflect.DeepEqual(old.Storage.S3, c.Storage.S3) {
+		fields = append(fields, "storage.s3")
+	}
+	return fields
+}
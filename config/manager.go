@@ -0,0 +1,129 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"cs2-log-proxy/receiver"
+)
+
+// Applier applies the changes from old to c to a running component
+type Applier func(old, c *Config) error
+
+// Manager holds the effective config of the running proxy and applies
+// updates to it. The effective config is the config file with the
+// environment variables applied on top; only the file layer is written.
+type Manager struct {
+	path string
+
+	mu       sync.Mutex
+	file     *Config // as read from or written to path
+	current  *Config // effective
+	appliers []Applier
+}
+
+// UpdateResult is returned by Update
+type UpdateResult struct {
+	Config          *Config  `json:"config"` // redacted
+	RestartRequired []string `json:"restart_required,omitempty"`
+}
+
+// ValidationError is returned by Update for configs that fail Validate
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string { return e.Err.Error() }
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// NewManager manages the effective config c, read from file at path and
+// with the environment applied
+func NewManager(path string, file, c *Config) *Manager {
+	return &Manager{path: path, file: file.Clone(), current: c}
+}
+
+// OnChange registers an applier. Appliers run in the order they were
+// registered.
+func (m *Manager) OnChange(a Applier) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.appliers = append(m.appliers, a)
+}
+
+// Config returns a copy of the effective config
+func (m *Manager) Config() *Config {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current.Clone()
+}
+
+// Update validates c, applies it to the running proxy and writes it to
+// the config file. Values set by environment variables keep those and
+// aren't written. If an applier fails, the appliers that ran are called
+// again to go back to the current config, which stays in effect and isn't
+// written.
+func (m *Manager) Update(c *Config) (*UpdateResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c = c.Clone()
+	c.RestoreSecrets(m.current)
+	file := c.WithoutEnv(m.file)
+	c = file.Clone()
+	if err := c.ApplyEnv(); err != nil {
+		return nil, &ValidationError{err}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, &ValidationError{err}
+	}
+	// Receivers are created by an applier, check them before any applier
+	// has changed something
+	if err := validateReceivers(m.current.Receivers, c.Receivers); err != nil {
+		return nil, &ValidationError{err}
+	}
+
+	for i, apply := range m.appliers {
+		if err := apply(m.current, c); err != nil {
+			return nil, fmt.Errorf("failed to apply config: %w", m.rollback(i, c, err))
+		}
+	}
+	result := &UpdateResult{Config: c.Redacted(), RestartRequired: RestartRequired(m.current, c)}
+	m.current = c
+	m.file = file
+	if err := Save(m.path, file); err != nil {
+		return result, fmt.Errorf("config applied but not saved: %w", err)
+	}
+	return result, nil
+}
+
+// rollback applies the current config again after the applier at index
+// failed applying c with err. The failed applier is rolled back too, it
+// may have applied part of c.
+func (m *Manager) rollback(failed int, c *Config, err error) error {
+	errs := []error{err}
+	for i := failed; i >= 0; i-- {
+		if rerr := m.appliers[i](c, m.current); rerr != nil {
+			errs = append(errs, fmt.Errorf("rolling back: %w", rerr))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateReceivers checks the receivers of next that differ from old by
+// creating their sinks
+func validateReceivers(old, next []ReceiverConfig) error {
+	previous := make(map[string]ReceiverConfig)
+	for _, rc := range old {
+		previous[rc.ID] = rc
+	}
+	for _, rc := range next {
+		if prev, ok := previous[rc.ID]; ok && reflect.DeepEqual(prev, rc) {
+			continue
+		}
+		if err := receiver.ValidateReceiver(rc.Type, rc.Config); err != nil {
+			return fmt.Errorf("receiver %s: %w", rc.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// applied records the delay of every config an applier was called with
+type applied struct {
+	calls []string
+	fail  string // delay to fail at
+}
+
+func (a *applied) apply(old, c *Config) error {
+	a.calls = append(a.calls, old.Delay+"->"+c.Delay)
+	if c.Delay == a.fail {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func newTestManager(t *testing.T) (*Manager, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	c := &Config{Delay: "1s"}
+	return NewManager(path, c, c.Clone()), path
+}
+
+func TestUpdateRollsBack(t *testing.T) {
+	m, path := newTestManager(t)
+	first, second, third := &applied{}, &applied{fail: "2s"}, &applied{}
+	m.OnChange(first.apply)
+	m.OnChange(second.apply)
+	m.OnChange(third.apply)
+
+	if _, err := m.Update(&Config{Delay: "2s"}); err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Fatalf("err = %v, want the applier's error", err)
+	}
+	for _, tt := range []struct {
+		name string
+		a    *applied
+		want []string
+	}{
+		{"first", first, []string{"1s->2s", "2s->1s"}},
+		{"failed", second, []string{"1s->2s", "2s->1s"}},
+		{"third", third, nil},
+	} {
+		if !reflect.DeepEqual(tt.a.calls, tt.want) {
+			t.Errorf("%s applier calls = %v, want %v", tt.name, tt.a.calls, tt.want)
+		}
+	}
+	if d := m.Config().Delay; d != "1s" {
+		t.Errorf("effective delay = %q after a failed update, want 1s", d)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("config written after a failed update: %v", err)
+	}
+
+	// A later update still applies against the old config
+	if _, err := m.Update(&Config{Delay: "3s"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := third.calls; !reflect.DeepEqual(got, []string{"1s->3s"}) {
+		t.Errorf("third applier calls = %v", got)
+	}
+	saved, err := LoadConfig(path)
+	if err != nil || saved.Delay != "3s" {
+		t.Errorf("saved config %+v, %v", saved, err)
+	}
+}
+
+func TestUpdateRejectsInvalid(t *testing.T) {
+	m, _ := newTestManager(t)
+	a := &applied{}
+	m.OnChange(a.apply)
+	tests := []*Config{
+		{Delay: "soon"},
+		{Receivers: []ReceiverConfig{{ID: "r1"}}},
+		{Receivers: []ReceiverConfig{{ID: "r1", Type: "webhook"}, {ID: "r1", Type: "webhook"}}},
+		{Receivers: []ReceiverConfig{{ID: "r1", Type: "no-such-sink"}}},
+	}
+	for _, c := range tests {
+		var invalid *ValidationError
+		if _, err := m.Update(c); !errors.As(err, &invalid) {
+			t.Errorf("%+v: err = %v, want a ValidationError", c, err)
+		}
+	}
+	if len(a.calls) != 0 {
+		t.Errorf("appliers called for invalid configs: %v", a.calls)
+	}
+}
+
+func TestWithoutEnv(t *testing.T) {
+	t.Setenv(EnvDelay, "5s")
+	t.Setenv(EnvPort, "9000")
+	file := &Config{Delay: "1s"}
+	file.Server.Port = 8081
+
+	c := file.Clone()
+	if err := c.ApplyEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Delay != "5s" || c.Server.Port != 9000 {
+		t.Fatalf("ApplyEnv: delay %q, port %d", c.Delay, c.Server.Port)
+	}
+	c.Proxy.ID = "edited"
+	out := c.WithoutEnv(file)
+	if out.Delay != "1s" || out.Server.Port != 8081 || out.Proxy.ID != "edited" {
+		t.Errorf("WithoutEnv: delay %q, port %d, id %q", out.Delay, out.Server.Port, out.Proxy.ID)
+	}
+
+	t.Setenv(EnvPort, "port")
+	if err := file.Clone().ApplyEnv(); err == nil {
+		t.Error("invalid port accepted")
+	}
+}
@@ -0,0 +1,374 @@
+package domain
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cs2-log-proxy/storage"
+)
+
+// logContinueWindow is how long after its last chunk a server may still
+// continue a log. Logs with activity inside the window count as active.
+const logContinueWindow = 2 * time.Hour
+
+// timestampLayout is the layout of CS2 X-Timestamp headers
+const timestampLayout = "01/02/2006 - 15:04:05.000"
+
+// Sort orders of ListLogs
+const (
+	SortLastActivity = "last_activity"
+	SortStartTime    = "start_time"
+	SortMap          = "map"
+	SortServer       = "server"
+)
+
+// LogQuery filters and pages ListLogs. Empty fields don't filter.
+type LogQuery struct {
+	Token      string
+	Servers    map[string]bool // only these servers, nil for all
+	SteamID    string
+	ServerAddr string
+	Map        string
+	Team       string    // either team, case-insensitive
+	Player     string    // SteamID seen in the log, needs a storage.PlayerIndex
+	From       time.Time // log start, inclusive
+	To         time.Time // log start, exclusive
+	Active     *bool     // activity inside logContinueWindow
+	Complete   *bool     // starts at offset 0 without gaps
+	Sort       string    // SortLastActivity by default
+	Asc        bool
+	Limit      int
+	Cursor     string // NextCursor of the previous page
+}
+
+// LogPage is a page of ListLogs
+type LogPage struct {
+	Logs       []LogSummary `json:"logs"`
+	Total      int          `json:"total"` // logs matching the filters on all pages
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// ErrInvalidCursor is returned for cursors ListLogs didn't create for the
+// same sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ErrNoPlayerIndex is returned for player filters when the store doesn't
+// index players
+var ErrNoPlayerIndex = errors.New("storage backend doesn't index players")
+
+// catalogEntry is a log known to the catalog
+type catalogEntry struct {
+	summary  LogSummary
+	start    time.Time
+	activity time.Time
+	begin    int // begin offset of the first chunk
+	end      int // end offset of the last chunk
+	teams    []string
+}
+
+// catalog keeps the summaries of all logs in memory so listing doesn't
+// reload every ServerMeta. It is loaded from the store on first use and
+// kept current by the LogService.
+type catalog struct {
+	mu      sync.Mutex
+	loaded  bool
+	entries map[string]*catalogEntry
+}
+
+// load reads every log from the store once. If the store fails the
+// catalog stays unloaded and the next listing tries again. Callers hold c.mu.
+func (c *catalog) load(store storage.Backend) error {
+	if c.loaded {
+		return nil
+	}
+	c.entries = make(map[string]*catalogEntry)
+	if lister, ok := store.(storage.SessionLister); ok {
+		sessions, err := lister.ListSessions()
+		if err != nil {
+			return err
+		}
+		for _, sess := range sessions {
+			if err := c.loadLog(store, sess.Token, sess.SteamID, sess.LogMeta); err != nil {
+				return err
+			}
+		}
+		c.loaded = true
+		return nil
+	}
+
+	tokens, err := store.ListServers()
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		meta, err := store.LoadServerMeta(token)
+		if err != nil {
+			return fmt.Errorf("server %s: %w", token, err)
+		}
+		for _, lm := range meta.Logs {
+			if err := c.loadLog(store, token, meta.SteamID, lm); err != nil {
+				return err
+			}
+		}
+	}
+	c.loaded = true
+	return nil
+}
+
+// loadLog adds a log and its chunks to the catalog. Callers hold c.mu.
+func (c *catalog) loadLog(store storage.Backend, token, steamID string, lm storage.LogMeta) error {
+	metas, err := store.LoadChunkMetas(lm.LogID)
+	if err != nil {
+		return fmt.Errorf("log %s: %w", lm.LogID, err)
+	}
+	for _, m := range metas {
+		c.apply(token, steamID, lm, m)
+	}
+	if len(metas) == 0 {
+		c.apply(token, steamID, lm, storage.ChunkMeta{})
+	}
+	return nil
+}
+
+// update records a chunk saved to a log. Before the first listing there
+// is nothing to update, load picks it up from the store.
+func (c *catalog) update(token, steamID string, lm storage.LogMeta, chunk storage.ChunkMeta) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.loaded {
+		c.apply(token, steamID, lm, chunk)
+	}
+}
+
+// apply updates the entry of a log with its metadata and a chunk.
+// Callers hold c.mu.
+func (c *catalog) apply(token, steamID string, lm storage.LogMeta, chunk storage.ChunkMeta) {
+	e, ok := c.entries[lm.LogID]
+	if !ok {
+		e = &catalogEntry{begin: chunk.BeginOffset, end: chunk.BeginOffset}
+		e.summary.Complete = chunk.BeginOffset == 0
+		c.entries[lm.LogID] = e
+	}
+	e.summary = LogSummary{
+		Token:        token,
+		LogID:        lm.LogID,
+		LogStartTime: lm.LogStartTime,
+		LogMetadata: storage.LogMetadata{
+			ServerInstanceToken: token,
+			GameMap:             lm.GameMap,
+			ServerAddr:          lm.ServerAddr,
+			SteamID:             steamID,
+		},
+		LastActivity: lm.LastActivity,
+		Teams:        e.teams,
+		Protected:    lm.Protected,
+		Complete:     e.summary.Complete,
+	}
+	e.start, _ = time.Parse(timestampLayout, lm.LogStartTime)
+	e.activity = lm.LastReceivedAt
+	if e.activity.IsZero() {
+		e.activity, _ = time.Parse(timestampLayout, lm.LastActivity)
+	}
+
+	if chunk.EndOffset > e.end {
+		if chunk.BeginOffset > e.end {
+			e.summary.Complete = false
+		}
+		e.end = chunk.EndOffset
+	}
+	for _, team := range []string{chunk.GameTeamCT, chunk.GameTeamT} {
+		if team != "" && !containsFold(e.teams, team) {
+			e.teams = append(e.teams, team)
+			e.summary.Teams = e.teams
+		}
+	}
+}
+
+// storedBytes returns the bytes stored for logs, from the first chunk's
+// begin to the last chunk's end offset
+func (c *catalog) storedBytes(store storage.Backend, logs []storage.LogMeta) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.load(store); err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, lm := range logs {
+		if e, ok := c.entries[lm.LogID]; ok {
+			n += int64(e.end - e.begin)
+		}
+	}
+	return n, nil
+}
+
+// setProtected updates the protected flag of a listed log
+func (c *catalog) setProtected(logID string, protected bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[logID]; ok {
+		e.summary.Protected = protected
+	}
+}
+
+func (c *catalog) remove(logID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, logID)
+}
+
+// LogOwner returns the ServerInstanceToken of a log, see auth.LogOwner
+func (svc *LogService) LogOwner(logID string) (string, bool) {
+	svc.catalog.mu.Lock()
+	defer svc.catalog.mu.Unlock()
+	if err := svc.catalog.load(svc.Store); err != nil {
+		return "", false
+	}
+	e, ok := svc.catalog.entries[storage.CanonicalLogID(logID)]
+	if !ok {
+		return "", false
+	}
+	return e.summary.Token, true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks the filters of q against an entry
+func (q LogQuery) matches(e *catalogEntry, now time.Time) bool {
+	s := e.summary
+	switch {
+	case q.Token != "" && s.Token != q.Token,
+		q.Servers != nil && !q.Servers[s.Token],
+		q.SteamID != "" && s.LogMetadata.SteamID != q.SteamID,
+		q.ServerAddr != "" && s.LogMetadata.ServerAddr != q.ServerAddr,
+		q.Map != "" && s.LogMetadata.GameMap != q.Map,
+		q.Team != "" && !containsFold(e.teams, q.Team),
+		!q.From.IsZero() && e.start.Before(q.From),
+		!q.To.IsZero() && !e.start.Before(q.To),
+		q.Active != nil && *q.Active != (now.Sub(e.activity) < logContinueWindow),
+		q.Complete != nil && *q.Complete != s.Complete:
+		return false
+	}
+	return true
+}
+
+// sortKey orders entries by q.Sort; ties are broken by log ID
+func (q LogQuery) sortKey(e *catalogEntry) string {
+	const layout = "2006-01-02T15:04:05.000000000"
+	switch q.Sort {
+	case SortStartTime:
+		return e.start.UTC().Format(layout)
+	case SortMap:
+		return e.summary.LogMetadata.GameMap
+	case SortServer:
+		return e.summary.Token
+	default:
+		return e.activity.UTC().Format(layout)
+	}
+}
+
+// logCursor is the position after the last log of a page
+type logCursor struct {
+	Sort  string `json:"s"`
+	Asc   bool   `json:"a,omitempty"`
+	Key   string `json:"k"`
+	LogID string `json:"id"`
+}
+
+// ListLogs returns a page of the logs matching q, by default the most
+// recently active first
+func (svc *LogService) ListLogs(q LogQuery) (*LogPage, error) {
+	if q.Sort == "" {
+		q.Sort = SortLastActivity
+	}
+	var after *logCursor
+	if q.Cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err != nil || json.Unmarshal(data, &after) != nil || after == nil || after.Sort != q.Sort || after.Asc != q.Asc {
+			return nil, ErrInvalidCursor
+		}
+	}
+
+	var players map[string]bool
+	if q.Player != "" {
+		index, ok := svc.Store.(storage.PlayerIndex)
+		if !ok {
+			return nil, ErrNoPlayerIndex
+		}
+		ids, err := index.LogsWithPlayer(q.Player)
+		if err != nil {
+			return nil, err
+		}
+		players = make(map[string]bool, len(ids))
+		for _, id := range ids {
+			players[id] = true
+		}
+	}
+
+	type item struct {
+		key     string
+		summary LogSummary
+	}
+	var items []item
+	now := time.Now()
+	svc.catalog.mu.Lock()
+	if err := svc.catalog.load(svc.Store); err != nil {
+		svc.catalog.mu.Unlock()
+		return nil, err
+	}
+	for _, e := range svc.catalog.entries {
+		if q.matches(e, now) && (players == nil || players[e.summary.LogID]) {
+			s := e.summary
+			s.Active = now.Sub(e.activity) < logContinueWindow
+			items = append(items, item{q.sortKey(e), s})
+		}
+	}
+	svc.catalog.mu.Unlock()
+
+	less := func(key, id string, than item) bool {
+		if key != than.key {
+			return (key < than.key) == q.Asc
+		}
+		if id != than.summary.LogID {
+			return (id < than.summary.LogID) == q.Asc
+		}
+		return false
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return less(items[i].key, items[i].summary.LogID, items[j])
+	})
+
+	page := &LogPage{Logs: []LogSummary{}, Total: len(items)}
+	start := 0
+	if after != nil {
+		// First item the cursor sorts before
+		start = sort.Search(len(items), func(i int) bool {
+			return less(after.Key, after.LogID, items[i])
+		})
+	}
+	end := len(items)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+	}
+	for _, it := range items[start:end] {
+		page.Logs = append(page.Logs, it.summary)
+	}
+	if end < len(items) {
+		last := items[end-1]
+		data, _ := json.Marshal(logCursor{Sort: q.Sort, Asc: q.Asc, Key: last.key, LogID: last.summary.LogID})
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(data)
+	}
+	return page, nil
+}
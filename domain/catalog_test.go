@@ -0,0 +1,199 @@
+package domain
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"cs2-log-proxy/storage"
+)
+
+// testLog is a log stored for the catalog tests
+type testLog struct {
+	token, logID, start, gameMap, teamCT, teamT string
+	begin                                       int // offset of the first chunk
+	receivedAt                                  time.Time
+}
+
+func newTestService(t *testing.T, logs ...testLog) *LogService {
+	t.Helper()
+	store := storage.NewLogStore(t.TempDir())
+	for _, l := range logs {
+		err := storage.UpdateServerMeta(store, l.token, func(meta *storage.ServerMeta) error {
+			meta.ServerInstanceToken = l.token
+			meta.Logs = append(meta.Logs, storage.LogMeta{
+				LogID:          l.logID,
+				LogStartTime:   l.start,
+				GameMap:        l.gameMap,
+				LastActivity:   l.start,
+				LastByteOffset: l.begin + 10,
+				LastReceivedAt: l.receivedAt,
+			})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunk := storage.ChunkMeta{BeginOffset: l.begin, EndOffset: l.begin + 10, GameTeamCT: l.teamCT, GameTeamT: l.teamT, Timestamp: l.start}
+		if err := store.AppendChunk(l.logID, "L 0123456\n", chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewLogService(store, nil, nil)
+}
+
+func catalogTestLogs() []testLog {
+	now := time.Now()
+	old := now.Add(-24 * time.Hour)
+	return []testLog{
+		{"a", "a_1", "01/30/2025 - 16:00:00.000", "de_dust2", "Vitality", "NAVI", 0, old},
+		{"a", "a_2", "01/30/2025 - 17:00:00.000", "de_mirage", "FaZe", "Vitality", 0, now},
+		{"a", "a_3", "01/30/2025 - 18:00:00.000", "de_dust2", "G2", "Spirit", 200, now},
+		{"b", "b_1", "01/30/2025 - 16:30:00.000", "de_dust2", "MOUZ", "NAVI", 0, old},
+		{"b", "b_2", "01/31/2025 - 10:00:00.000", "de_inferno", "", "", 0, now},
+	}
+}
+
+func logIDs(logs []LogSummary) []string {
+	ids := []string{}
+	for _, l := range logs {
+		ids = append(ids, l.LogID)
+	}
+	return ids
+}
+
+func TestListLogsSort(t *testing.T) {
+	svc := newTestService(t, catalogTestLogs()...)
+	tests := []struct {
+		sort string
+		asc  bool
+		want []string
+	}{
+		// Ties on the sort key are ordered by log ID in the same direction
+		{SortLastActivity, false, []string{"b_2", "a_3", "a_2", "b_1", "a_1"}},
+		{SortStartTime, true, []string{"a_1", "b_1", "a_2", "a_3", "b_2"}},
+		{SortMap, true, []string{"a_1", "a_3", "b_1", "b_2", "a_2"}},
+		{SortMap, false, []string{"a_2", "b_2", "b_1", "a_3", "a_1"}},
+		{SortServer, true, []string{"a_1", "a_2", "a_3", "b_1", "b_2"}},
+	}
+	for _, tt := range tests {
+		page, err := svc.ListLogs(LogQuery{Sort: tt.sort, Asc: tt.asc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := logIDs(page.Logs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sort %s asc=%v: got %v, want %v", tt.sort, tt.asc, got, tt.want)
+		}
+	}
+}
+
+func TestListLogsCursor(t *testing.T) {
+	svc := newTestService(t, catalogTestLogs()...)
+	for _, sort := range []string{SortLastActivity, SortStartTime, SortMap, SortServer} {
+		for _, asc := range []bool{false, true} {
+			all, err := svc.ListLogs(LogQuery{Sort: sort, Asc: asc})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paged []string
+			q := LogQuery{Sort: sort, Asc: asc, Limit: 2}
+			for pages := 0; ; pages++ {
+				if pages > len(all.Logs) {
+					t.Fatalf("sort %s asc=%v: cursor doesn't advance", sort, asc)
+				}
+				page, err := svc.ListLogs(q)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if page.Total != len(all.Logs) || len(page.Logs) > 2 {
+					t.Fatalf("sort %s asc=%v: page of %d with total %d", sort, asc, len(page.Logs), page.Total)
+				}
+				paged = append(paged, logIDs(page.Logs)...)
+				if page.NextCursor == "" {
+					break
+				}
+				q.Cursor = page.NextCursor
+			}
+			if want := logIDs(all.Logs); !reflect.DeepEqual(paged, want) {
+				t.Errorf("sort %s asc=%v: pages give %v, want %v", sort, asc, paged, want)
+			}
+		}
+	}
+
+	page, err := svc.ListLogs(LogQuery{Sort: SortMap, Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []LogQuery{
+		{Sort: SortServer, Cursor: page.NextCursor},
+		{Sort: SortMap, Asc: true, Cursor: page.NextCursor},
+		{Sort: SortMap, Cursor: "not a cursor"},
+	} {
+		if _, err := svc.ListLogs(q); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("%+v: err = %v, want ErrInvalidCursor", q, err)
+		}
+	}
+}
+
+func TestListLogsFilters(t *testing.T) {
+	svc := newTestService(t, catalogTestLogs()...)
+	yes, no := true, false
+	tests := []struct {
+		name string
+		q    LogQuery
+		want []string
+	}{
+		{"token", LogQuery{Token: "b"}, []string{"b_1", "b_2"}},
+		{"servers", LogQuery{Servers: map[string]bool{"a": true}}, []string{"a_1", "a_2", "a_3"}},
+		{"map", LogQuery{Map: "de_dust2"}, []string{"a_1", "a_3", "b_1"}},
+		{"team", LogQuery{Team: "navi"}, []string{"a_1", "b_1"}},
+		{"from", LogQuery{From: time.Date(2025, 1, 30, 17, 0, 0, 0, time.UTC)}, []string{"a_2", "a_3", "b_2"}},
+		{"to", LogQuery{To: time.Date(2025, 1, 30, 17, 0, 0, 0, time.UTC)}, []string{"a_1", "b_1"}},
+		{"active", LogQuery{Active: &yes}, []string{"a_2", "a_3", "b_2"}},
+		{"complete", LogQuery{Complete: &no}, []string{"a_3"}},
+		{"combined", LogQuery{Map: "de_dust2", Team: "NAVI", Token: "a"}, []string{"a_1"}},
+	}
+	for _, tt := range tests {
+		tt.q.Sort, tt.q.Asc = SortServer, true
+		page, err := svc.ListLogs(tt.q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := logIDs(page.Logs); !reflect.DeepEqual(got, tt.want) || page.Total != len(tt.want) {
+			t.Errorf("%s: got %v of %d, want %v", tt.name, got, page.Total, tt.want)
+		}
+	}
+}
+
+// failingStore fails to load server metadata while fail is set
+type failingStore struct {
+	storage.Backend
+	fail bool
+}
+
+func (s *failingStore) LoadServerMeta(token string) (*storage.ServerMeta, error) {
+	if s.fail {
+		return nil, errors.New("disk unavailable")
+	}
+	return s.Backend.LoadServerMeta(token)
+}
+
+func TestListLogsLoadError(t *testing.T) {
+	svc := newTestService(t, catalogTestLogs()...)
+	store := &failingStore{Backend: svc.Store, fail: true}
+	svc.Store = store
+
+	if _, err := svc.ListLogs(LogQuery{}); err == nil {
+		t.Fatal("listing succeeded with a failing store")
+	}
+	// The failed load isn't kept, the next listing loads again
+	store.fail = false
+	page, err := svc.ListLogs(LogQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 5 {
+		t.Errorf("listed %d logs, want 5", page.Total)
+	}
+}
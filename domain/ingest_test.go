@@ -0,0 +1,81 @@
+package domain
+
+import (
+	"reflect"
+	"testing"
+
+	"cs2-log-proxy/storage"
+	"cs2-log-proxy/websocket"
+)
+
+func TestProcessLogChunk(t *testing.T) {
+	type chunk struct {
+		begin         int
+		data, gameMap string
+		timestamp     string
+	}
+	tests := []struct {
+		name   string
+		chunks []chunk
+		want   map[string]string // stored logs by ID
+	}{
+		{"one log", []chunk{
+			{0, "L 01\n", "de_dust2", "01/30/2025 - 16:00:00.000"},
+			{5, "L 02\n", "de_dust2", "01/30/2025 - 16:00:05.000"},
+		}, map[string]string{"srv_2025-01-30T16-00-00.000": "L 01\nL 02\n"}},
+		{"another map", []chunk{
+			{0, "L 01\n", "de_dust2", "01/30/2025 - 16:00:00.000"},
+			{5, "L 02\n", "de_mirage", "01/30/2025 - 16:00:05.000"},
+		}, map[string]string{"srv_2025-01-30T16-00-00.000": "L 01\n", "srv_2025-01-30T16-00-05.000": "L 02\n"}},
+		{"after the continue window", []chunk{
+			{0, "L 01\n", "de_dust2", "01/30/2025 - 16:00:00.000"},
+			{5, "L 02\n", "de_dust2", "01/30/2025 - 19:00:00.000"},
+		}, map[string]string{"srv_2025-01-30T16-00-00.000": "L 01\n", "srv_2025-01-30T19-00-00.000": "L 02\n"}},
+		{"gap", []chunk{
+			{0, "L 01\n", "de_dust2", "01/30/2025 - 16:00:00.000"},
+			{10, "L 03\n", "de_dust2", "01/30/2025 - 16:00:10.000"},
+		}, map[string]string{"srv_2025-01-30T16-00-00.000": "L 01\n", "srv_2025-01-30T16-00-10.000": "L 03\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := storage.NewLogStore(t.TempDir())
+			svc := NewLogService(store, websocket.NewHub(), nil)
+			for _, c := range tt.chunks {
+				meta := storage.ChunkMeta{BeginOffset: c.begin, EndOffset: c.begin + len(c.data), Timestamp: c.timestamp}
+				if _, err := svc.ProcessLogChunk("srv", c.data, meta, c.gameMap, "", "", ""); err != nil {
+					t.Fatal(err)
+				}
+			}
+			serverMeta, err := store.LoadServerMeta("srv")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, lm := range serverMeta.Logs {
+				if got[lm.LogID], err = store.GetLog(lm.LogID); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stored %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessLogChunkNewLog(t *testing.T) {
+	store := storage.NewLogStore(t.TempDir())
+	svc := NewLogService(store, websocket.NewHub(), nil)
+	meta := storage.ChunkMeta{EndOffset: 5, Timestamp: "01/30/2025 - 16:00:00.000"}
+	for i, want := range []bool{true, false} {
+		meta := meta
+		meta.BeginOffset, meta.EndOffset = 5*i, 5*i+5
+		if isNew, err := svc.ProcessLogChunk("srv", "L 01\n", meta, "de_dust2", "", "", ""); err != nil || isNew != want {
+			t.Errorf("chunk %d: new log %v, %v; want %v", i, isNew, err, want)
+		}
+	}
+	// The log is found by its former ID as well
+	if owner, ok := svc.LogOwner("srv_01_30_2025 - 16:00:00.000"); !ok || owner != "srv" {
+		t.Errorf("LogOwner of former ID = %q, %v", owner, ok)
+	}
+}
@@ -1,18 +1,35 @@
 package domain
 
 import (
+	"errors"
+	"fmt"
 	"log"
-	"sort"
-	"strings"
+	"net/netip"
 	"time"
 
+	"cs2-log-proxy/archive"
+	"cs2-log-proxy/receiver"
+	"cs2-log-proxy/search"
 	"cs2-log-proxy/storage"
 	"cs2-log-proxy/websocket"
 )
 
 type LogService struct {
-	Store *storage.LogStore
-	Hub   *websocket.Hub
+	Store     storage.Backend
+	Hub       *websocket.Hub
+	Receivers *receiver.Manager
+	Search    *search.Index
+
+	// ProxyID identifies this proxy when chaining proxies. Chunks that
+	// already passed through ProxyID or more than MaxHops proxies are refused.
+	ProxyID string
+	MaxHops int
+	// Peers are the proxies trusted to report the proxy chain and arrival
+	// time of the chunks they relay
+	Peers []netip.Prefix
+
+	catalog catalog
+	stats   serverStatsMap
 }
 
 // LogSummary holds summary info for listing logs
@@ -23,28 +40,43 @@ type LogSummary struct {
 	LogStartTime string              `json:"log_start_time"`
 	LogMetadata  storage.LogMetadata `json:"metadata"`
 	LastActivity string              `json:"last_activity"`
+
+	Teams     []string `json:"teams,omitempty"`
+	Protected bool     `json:"protected"`
+	Complete  bool     `json:"complete"` // starts at offset 0 without gaps
+	Active    bool     `json:"active"`   // may still be continued by the server
 }
 
-func NewLogService(store *storage.LogStore, hub *websocket.Hub) *LogService {
-	return &LogService{Store: store, Hub: hub}
+func NewLogService(store storage.Backend, hub *websocket.Hub, receivers *receiver.Manager) *LogService {
+	return &LogService{Store: store, Hub: hub, Receivers: receivers}
 }
 
 // ProcessLogChunk checks for new logs, chunk overlaps, and triggers events.
-func (svc *LogService) ProcessLogChunk(token string, chunkData string, meta storage.ChunkMeta, gameMap, steamID, serverAddr string) (bool, error) {
-	// Load or create ServerMeta
+func (svc *LogService) ProcessLogChunk(token string, chunkData string, meta storage.ChunkMeta, gameMap, steamID, serverAddr, uniqueToken string) (bool, error) {
+	svc.stats.received(token, len(chunkData), meta)
+	ingestChunks.Inc()
+	ingestBytes.Add(float64(len(chunkData)))
+
+	// Load or create ServerMeta, and keep retention, imports and
+	// protection from changing it until it is saved
+	defer storage.LockServerMeta(token)()
 	serverMeta, err := svc.Store.LoadServerMeta(token)
 	if err != nil {
 		return false, err
 	}
+	if uniqueToken != "" {
+		serverMeta.UniqueToken = uniqueToken
+	}
 
 	var logId string = ""
 	var isNewLog bool = false
 
 	for i, log := range serverMeta.Logs {
-		if log.LastByteOffset == meta.BeginOffset && TimestampDiff(log.LastActivity, meta.Timestamp) < time.Hour*2 && log.GameMap == gameMap {
+		if log.LastByteOffset == meta.BeginOffset && TimestampDiff(log.LastActivity, meta.Timestamp) < logContinueWindow && log.GameMap == gameMap {
 			logId = log.LogID
 			serverMeta.Logs[i].LastActivity = meta.Timestamp
 			serverMeta.Logs[i].LastByteOffset = meta.EndOffset
+			serverMeta.Logs[i].LastReceivedAt = meta.ReceivedAt
 			break
 		}
 	}
@@ -53,17 +85,26 @@ func (svc *LogService) ProcessLogChunk(token string, chunkData string, meta stor
 		if meta.BeginOffset != 0 {
 			// Warn create new log from non-zero offset
 			log.Printf("Creating new log from non-zero offset: %d", meta.BeginOffset)
+			ingestPartialLogs.Inc()
+			if outOfOrder(serverMeta.Logs, meta, gameMap) {
+				ingestOutOfOrder.Inc()
+			}
 		}
 
-		logId = token + "_" + strings.ReplaceAll(meta.Timestamp, "/", "_")
+		logId = storage.NewLogID(token, meta.Timestamp)
 
 		newLog := storage.LogMeta{
-			LogID:          logId,
-			LogStartTime:   meta.Timestamp,
-			GameMap:        gameMap,
-			ServerAddr:     serverAddr,
-			LastActivity:   meta.Timestamp,
-			LastByteOffset: meta.EndOffset,
+			LogID:           logId,
+			LogStartTime:    meta.Timestamp,
+			GameMap:         gameMap,
+			ServerAddr:      serverAddr,
+			LastActivity:    meta.Timestamp,
+			LastByteOffset:  meta.EndOffset,
+			FirstReceivedAt: meta.ReceivedAt,
+			LastReceivedAt:  meta.ReceivedAt,
+		}
+		if n := len(serverMeta.Logs); n > 0 {
+			svc.compressLog(serverMeta.Logs[n-1].LogID)
 		}
 		serverMeta.Logs = append(serverMeta.Logs, newLog)
 		serverMeta.SteamID = steamID
@@ -87,10 +128,12 @@ func (svc *LogService) ProcessLogChunk(token string, chunkData string, meta stor
 		if m.BeginOffset == meta.BeginOffset {
 			if meta.EndOffset > m.EndOffset {
 				log.Printf("Overlapping chunk: %d", meta.BeginOffset)
+				ingestOverlaps.Inc()
 				// Overlapping, but new chunk extends further: split and save only the new part
 				newPart, newMeta := splitChunk(m.EndOffset, meta, chunkData)
 				if newPart == "" {
 					shouldSave = false
+					ingestDuplicates.Inc()
 				} else {
 					chunkToSave = newPart
 					metaToSave = newMeta
@@ -98,19 +141,56 @@ func (svc *LogService) ProcessLogChunk(token string, chunkData string, meta stor
 			} else {
 				// Duplicate or less complete chunk, ignore
 				shouldSave = false
+				ingestDuplicates.Inc()
 			}
 			break
 		}
 	}
 
 	if shouldSave {
+		start := time.Now()
 		if err := svc.Store.AppendChunk(logId, chunkToSave, metaToSave); err != nil {
 			return false, err
 		}
+		observeWrite("append_chunk", start)
+		start = time.Now()
 		if err := svc.Store.SaveServerMeta(token, serverMeta); err != nil {
 			return false, err
 		}
-		svc.Hub.BroadcastEvent("log_chunk", logId, chunkToSave)
+		observeWrite("save_server_meta", start)
+		for _, lm := range serverMeta.Logs {
+			if lm.LogID == logId {
+				svc.catalog.update(token, serverMeta.SteamID, lm, metaToSave)
+			}
+		}
+		if svc.Search != nil {
+			svc.Search.Add(logId, token, gameMap, metaToSave, chunkToSave)
+		}
+		// Offsets in the stored log, which starts at the first chunk
+		base := metaToSave.BeginOffset
+		if len(metas) > 0 {
+			base = metas[0].BeginOffset
+		}
+		svc.Hub.Publish(websocket.Event{
+			Type:        "log_chunk",
+			Token:       logId,
+			Server:      token,
+			Payload:     chunkToSave,
+			BeginOffset: int64(metaToSave.BeginOffset - base),
+			EndOffset:   int64(metaToSave.EndOffset - base),
+		})
+		if svc.Receivers != nil {
+			svc.Receivers.Forward(receiver.Chunk{
+				LogID:      logId,
+				Token:      token,
+				Data:       chunkToSave,
+				Meta:       metaToSave,
+				NewLog:     isNewLog,
+				GameMap:    gameMap,
+				SteamID:    steamID,
+				ServerAddr: serverAddr,
+			})
+		}
 	}
 
 	if isNewLog {
@@ -125,45 +205,127 @@ func (svc *LogService) ProcessLogChunk(token string, chunkData string, meta stor
 				ServerAddr:          serverAddr,
 			},
 			LastActivity: meta.Timestamp,
+			Complete:     meta.BeginOffset == 0,
+			Active:       true,
 		}
 		log.Printf("New log: %v", summary)
-		svc.Hub.BroadcastEvent("new_log", "*", summary)
+		svc.Hub.Publish(websocket.Event{Type: "new_log", Token: "*", Server: token, Payload: summary})
 	}
 
 	return isNewLog, nil
 }
 
-// ListLogs returns all logs with metadata and last activity, ordered by last activity desc
-func (svc *LogService) ListLogs() ([]LogSummary, error) {
+// ErrLogNotFound is returned for log IDs no server knows
+var ErrLogNotFound = errors.New("log not found")
+
+// SetProtected exempts a log from retention, or makes it subject to
+// retention again
+func (svc *LogService) SetProtected(logID string, protected bool) error {
+	logID = storage.CanonicalLogID(logID)
 	tokens, err := svc.Store.ListServers()
 	if err != nil {
-		return []LogSummary{}, err
-	}
-	var result []LogSummary = []LogSummary{}
-	for _, serverId := range tokens {
-		meta, err := svc.Store.LoadServerMeta(serverId)
-		if err != nil {
-			continue
-		}
-		for _, log := range meta.Logs {
-			result = append(result, LogSummary{
-				Token:        serverId,
-				LogID:        log.LogID,
-				LogStartTime: log.LogStartTime,
-				LogMetadata: storage.LogMetadata{
-					ServerInstanceToken: serverId,
-					GameMap:             log.GameMap,
-					ServerAddr:          log.ServerAddr,
-					SteamID:             meta.SteamID,
-				},
-				LastActivity: log.LastActivity,
-			})
+		return err
+	}
+	for _, token := range tokens {
+		found := false
+		err := storage.UpdateServerMeta(svc.Store, token, func(meta *storage.ServerMeta) error {
+			for i := range meta.Logs {
+				if meta.Logs[i].LogID == logID {
+					meta.Logs[i].Protected = protected
+					found = true
+					return nil
+				}
+			}
+			return ErrLogNotFound
+		})
+		if found {
+			if err != nil {
+				return err
+			}
+			svc.catalog.setProtected(logID, protected)
+			return nil
 		}
+		if err != ErrLogNotFound {
+			return err
+		}
+	}
+	return ErrLogNotFound
+}
+
+// ImportArchive restores an exported log into the store and indexes it
+func (svc *LogService) ImportArchive(a *archive.Archive) error {
+	if err := a.Restore(svc.Store); err != nil {
+		return err
+	}
+	for _, chunk := range a.Chunks {
+		svc.catalog.update(a.Session.Token, a.Session.SteamID, a.Session.Log, chunk)
+	}
+	if svc.Search != nil && len(a.Chunks) > 0 {
+		base := a.Chunks[0].BeginOffset
+		svc.Search.Add(a.Manifest.LogID, a.Session.Token, a.Session.Log.GameMap, storage.ChunkMeta{
+			BeginOffset: base,
+			EndOffset:   base + len(a.Log),
+			Timestamp:   a.Session.Log.LogStartTime,
+		}, a.Log)
 	}
-	sort.Slice(result, func(i, j int) bool {
-		return result[i].LastActivity > result[j].LastActivity
-	})
-	return result, nil
+	log.Printf("Imported log %s of server %s", a.Manifest.LogID, a.Session.Token)
+	return nil
+}
+
+// LogRemoved drops a log the store no longer has, e.g. after retention,
+// from the log list and the search index
+func (svc *LogService) LogRemoved(token, logID string) {
+	svc.catalog.remove(logID)
+	if svc.Search != nil {
+		svc.Search.Remove(logID)
+	}
+}
+
+// compressLog compresses a log the server moved on from, if the store
+// supports it. A late chunk for the log still restores it.
+func (svc *LogService) compressLog(logID string) {
+	c, ok := svc.Store.(storage.LogCompressor)
+	if !ok {
+		return
+	}
+	go func() {
+		if err := c.CompressLog(logID); err != nil {
+			log.Printf("Failed to compress log %s: %v", logID, err)
+		}
+	}()
+}
+
+// CheckProxyChain returns an error if a chunk relayed through the given
+// proxies must be refused because it would loop or exceeds MaxHops
+func (svc *LogService) CheckProxyChain(via []string, hops int) error {
+	for _, id := range via {
+		if id == svc.ProxyID {
+			return fmt.Errorf("proxy loop: %s already in chain %v", svc.ProxyID, via)
+		}
+	}
+	if len(via) > hops {
+		hops = len(via)
+	}
+	if svc.MaxHops > 0 && hops >= svc.MaxHops {
+		return fmt.Errorf("too many proxy hops: %d", hops)
+	}
+	return nil
+}
+
+// IsPeer reports whether a request from remoteAddr (host:port) comes from
+// one of the Peers
+func (svc *LogService) IsPeer(remoteAddr string) bool {
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, p := range svc.Peers {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
 
 // IsNewLog returns true if this is the first chunk for the token
@@ -175,6 +337,17 @@ func (svc *LogService) IsNewLog(token string) (bool, error) {
 	return len(metas) == 0, nil
 }
 
+// outOfOrder reports whether a chunk that continues none of logs belongs to
+// one of them by its map and time, e.g. after a lost or late chunk
+func outOfOrder(logs []storage.LogMeta, meta storage.ChunkMeta, gameMap string) bool {
+	for _, lm := range logs {
+		if lm.GameMap == gameMap && lm.LastByteOffset != meta.BeginOffset && TimestampDiff(lm.LastActivity, meta.Timestamp) < logContinueWindow {
+			return true
+		}
+	}
+	return false
+}
+
 // splitChunk returns only the new part of the chunk and adjusted meta
 func splitChunk(existingEnd int, meta storage.ChunkMeta, chunkData string) (string, storage.ChunkMeta) {
 	// Assume chunkData is contiguous log text, and offsets refer to byte positions
@@ -182,23 +355,13 @@ func splitChunk(existingEnd int, meta storage.ChunkMeta, chunkData string) (stri
 	if start < 0 || start >= len(chunkData) {
 		return "", meta // nothing new
 	}
-	return chunkData[start:], storage.ChunkMeta{
-		BeginOffset: existingEnd,
-		EndOffset:   meta.EndOffset,
-		GameScoreCT: meta.GameScoreCT,
-		GameScoreT:  meta.GameScoreT,
-		GameState:   meta.GameState,
-		GameTeamCT:  meta.GameTeamCT,
-		GameTeamT:   meta.GameTeamT,
-		TickEnd:     meta.TickEnd,
-		TickStart:   meta.TickStart,
-		Timestamp:   meta.Timestamp,
-	}
+	newMeta := meta
+	newMeta.BeginOffset = existingEnd
+	return chunkData[start:], newMeta
 }
 
 func TimestampDiff(first, second string) time.Duration {
-	layout := "01/02/2006 - 15:04:05.000"
-	firstTime, _ := time.Parse(layout, first)
-	secondTime, _ := time.Parse(layout, second)
+	firstTime, _ := time.Parse(timestampLayout, first)
+	secondTime, _ := time.Parse(timestampLayout, second)
 	return secondTime.Sub(firstTime)
 }
@@ -0,0 +1,32 @@
+package domain
+
+import (
+	"testing"
+
+	"cs2-log-proxy/storage"
+)
+
+func TestOutOfOrder(t *testing.T) {
+	logs := []storage.LogMeta{
+		{LogID: "a_1", GameMap: "de_dust2", LastActivity: "01/30/2025 - 16:00:00.000", LastByteOffset: 100},
+	}
+	tests := []struct {
+		name    string
+		begin   int
+		time    string
+		gameMap string
+		want    bool
+	}{
+		{"gap after the stored end", 150, "01/30/2025 - 16:01:00.000", "de_dust2", true},
+		{"late chunk before the stored end", 50, "01/30/2025 - 16:01:00.000", "de_dust2", true},
+		{"continues the log", 100, "01/30/2025 - 16:01:00.000", "de_dust2", false},
+		{"another map", 150, "01/30/2025 - 16:01:00.000", "de_mirage", false},
+		{"after the continue window", 150, "01/30/2025 - 19:00:00.000", "de_dust2", false},
+	}
+	for _, tt := range tests {
+		meta := storage.ChunkMeta{BeginOffset: tt.begin, EndOffset: tt.begin + 10, Timestamp: tt.time}
+		if got := outOfOrder(logs, meta, tt.gameMap); got != tt.want {
+			t.Errorf("%s: outOfOrder = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
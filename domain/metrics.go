@@ -0,0 +1,40 @@
+package domain
+
+import (
+	"time"
+
+	"cs2-log-proxy/metrics"
+)
+
+var (
+	ingestChunks      = metrics.NewCounter("cs2_log_proxy_ingest_chunks_total", "Chunks received from game servers and proxies.")
+	ingestBytes       = metrics.NewCounter("cs2_log_proxy_ingest_bytes_total", "Bytes of log data received.")
+	ingestDuplicates  = metrics.NewCounter("cs2_log_proxy_ingest_duplicate_chunks_total", "Chunks ignored because they were already stored.")
+	ingestOverlaps    = metrics.NewCounter("cs2_log_proxy_ingest_overlapping_chunks_total", "Chunks overlapping a stored chunk, of which only the new part was stored.")
+	ingestOutOfOrder  = metrics.NewCounter("cs2_log_proxy_ingest_out_of_order_chunks_total", "Chunks whose offset doesn't continue the log they belong to.")
+	ingestPartialLogs = metrics.NewCounter("cs2_log_proxy_ingest_partial_logs_total", "Logs started from a chunk at a non-zero offset, missing their beginning.")
+	ingestRejected    = metrics.NewCounter("cs2_log_proxy_ingest_rejected_chunks_total", "Chunks that couldn't be ingested, by reason.", "reason")
+	storageWrites     = metrics.NewHistogram("cs2_log_proxy_storage_write_seconds", "Time taken by storage writes, by operation.", metrics.LatencyBuckets, "op")
+)
+
+// observeWrite records the duration of a storage write started at start
+func observeWrite(op string, start time.Time) {
+	storageWrites.Observe(time.Since(start).Seconds(), op)
+}
+
+// RegisterMetrics adds the gauges of the service to r
+func (svc *LogService) RegisterMetrics(r *metrics.Registry) {
+	r.NewGaugeFunc("cs2_log_proxy_server_last_chunk_age_seconds", "Seconds since the last chunk of each server was received.", []string{"server"}, func() []metrics.Sample {
+		svc.stats.mu.Lock()
+		defer svc.stats.mu.Unlock()
+		now := time.Now()
+		var samples []metrics.Sample
+		for token, s := range svc.stats.servers {
+			if s.last.ReceivedAt.IsZero() {
+				continue
+			}
+			samples = append(samples, metrics.Sample{Labels: []string{token}, Value: now.Sub(s.last.ReceivedAt).Seconds()})
+		}
+		return samples
+	})
+}
@@ -0,0 +1,223 @@
+package domain
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"cs2-log-proxy/storage"
+)
+
+// serverOnlineWindow is how recently a server must have sent a chunk to
+// count as online. CS2 posts logs every few seconds while a server runs.
+const serverOnlineWindow = 5 * time.Minute
+
+// Server states of ServerInfo
+const (
+	ServerOnline  = "online"
+	ServerIdle    = "idle" // may still continue its latest log
+	ServerOffline = "offline"
+)
+
+// Ingest error kinds counted per server
+const (
+	IngestBadHeaders     = "bad_headers"
+	IngestLengthMismatch = "length_mismatch"
+	IngestReadFailed     = "read_failed"
+	IngestRefused        = "refused" // proxy loop or too many hops
+	IngestFailed         = "failed"  // processing or storing the chunk failed
+	// Posts without the ingest key are only counted in the metrics, their
+	// token can't be trusted
+	IngestUnauthorized = "unauthorized"
+)
+
+// ErrServerNotFound is returned for tokens no server has used
+var ErrServerNotFound = errors.New("server not found")
+
+// ServerInfo is the inventory entry of a game server
+type ServerInfo struct {
+	Token       string `json:"server_instance_token"`
+	SteamID     string `json:"steam_id"`
+	UniqueToken string `json:"unique_token,omitempty"`
+	ServerAddr  string `json:"server_addr"`
+
+	State     string `json:"state"`
+	GameState string `json:"game_state,omitempty"`
+	GameMap   string `json:"game_map"`
+	TeamCT    string `json:"team_ct,omitempty"`
+	TeamT     string `json:"team_t,omitempty"`
+	ScoreCT   int    `json:"score_ct"`
+	ScoreT    int    `json:"score_t"`
+
+	Sessions       int       `json:"sessions"`
+	BytesStored    int64     `json:"bytes_stored"`
+	LastActivity   string    `json:"last_activity"` // X-Timestamp of the latest chunk
+	LastReceivedAt time.Time `json:"last_received_at"`
+
+	// Counted since the proxy started, duplicates and failed chunks included
+	BytesReceived  int64            `json:"bytes_received"`
+	ChunksReceived int64            `json:"chunks_received"`
+	IngestErrors   map[string]int64 `json:"ingest_errors"`
+	// ClockSkewSeconds is the arrival time minus X-Timestamp of the latest
+	// chunk. X-Timestamp is server local time, so this includes the
+	// server's UTC offset.
+	ClockSkewSeconds *float64 `json:"clock_skew_seconds,omitempty"`
+}
+
+// serverStats are the ingest counters of a server since startup
+type serverStats struct {
+	bytes  int64
+	chunks int64
+	errors map[string]int64
+	last   storage.ChunkMeta // latest chunk received
+}
+
+type serverStatsMap struct {
+	mu      sync.Mutex
+	servers map[string]*serverStats
+}
+
+// get returns the stats of a server. Callers hold m.mu.
+func (m *serverStatsMap) get(token string) *serverStats {
+	if m.servers == nil {
+		m.servers = make(map[string]*serverStats)
+	}
+	s, ok := m.servers[token]
+	if !ok {
+		s = &serverStats{errors: make(map[string]int64)}
+		m.servers[token] = s
+	}
+	return s
+}
+
+func (m *serverStatsMap) received(token string, n int, meta storage.ChunkMeta) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(token)
+	s.bytes += int64(n)
+	s.chunks++
+	if !meta.ReceivedAt.Before(s.last.ReceivedAt) {
+		s.last = meta
+	}
+}
+
+// RecordIngestError counts a chunk of a server that couldn't be ingested.
+// Errors are only kept per server for servers that sent a chunk since
+// startup or have stored logs, so made-up tokens don't grow the stats.
+func (svc *LogService) RecordIngestError(token, kind string) {
+	ingestRejected.Inc(kind)
+	if token == "" {
+		return
+	}
+	svc.stats.mu.Lock()
+	_, known := svc.stats.servers[token]
+	svc.stats.mu.Unlock()
+	if !known {
+		meta, err := svc.Store.LoadServerMeta(token)
+		if err != nil || len(meta.Logs) == 0 {
+			return
+		}
+	}
+	svc.stats.mu.Lock()
+	defer svc.stats.mu.Unlock()
+	svc.stats.get(token).errors[kind]++
+}
+
+// Servers returns the inventory of all servers, most recently active first
+func (svc *LogService) Servers() ([]ServerInfo, error) {
+	tokens, err := svc.Store.ListServers()
+	if err != nil {
+		return nil, err
+	}
+	servers := []ServerInfo{}
+	for _, token := range tokens {
+		info, err := svc.Server(token)
+		if errors.Is(err, ErrServerNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, *info)
+	}
+	sort.SliceStable(servers, func(i, j int) bool {
+		return servers[i].LastReceivedAt.After(servers[j].LastReceivedAt)
+	})
+	return servers, nil
+}
+
+// Server returns the inventory entry of a server
+func (svc *LogService) Server(token string) (*ServerInfo, error) {
+	meta, err := svc.Store.LoadServerMeta(token)
+	if err != nil {
+		return nil, err
+	}
+	svc.stats.mu.Lock()
+	var stats serverStats
+	if s, ok := svc.stats.servers[token]; ok {
+		stats = *s
+		stats.errors = make(map[string]int64, len(s.errors))
+		for k, v := range s.errors {
+			stats.errors[k] = v
+		}
+	}
+	svc.stats.mu.Unlock()
+	if len(meta.Logs) == 0 && stats.chunks == 0 && len(stats.errors) == 0 {
+		return nil, ErrServerNotFound
+	}
+
+	info := &ServerInfo{
+		Token:          token,
+		SteamID:        meta.SteamID,
+		UniqueToken:    meta.UniqueToken,
+		Sessions:       len(meta.Logs),
+		BytesReceived:  stats.bytes,
+		ChunksReceived: stats.chunks,
+		IngestErrors:   stats.errors,
+	}
+	if info.IngestErrors == nil {
+		info.IngestErrors = map[string]int64{}
+	}
+	if info.BytesStored, err = svc.catalog.storedBytes(svc.Store, meta.Logs); err != nil {
+		return nil, err
+	}
+
+	last := stats.last
+	if n := len(meta.Logs); n > 0 {
+		lm := meta.Logs[n-1]
+		info.ServerAddr = lm.ServerAddr
+		info.GameMap = lm.GameMap
+		info.LastActivity = lm.LastActivity
+		info.LastReceivedAt = lm.LastReceivedAt
+		if last.ReceivedAt.IsZero() {
+			// Nothing received since startup, use the stored chunk index
+			if metas, err := svc.Store.LoadChunkMetas(lm.LogID); err == nil && len(metas) > 0 {
+				last = metas[len(metas)-1]
+			}
+		}
+	}
+	if last.ReceivedAt.After(info.LastReceivedAt) {
+		info.LastReceivedAt = last.ReceivedAt
+		info.LastActivity = last.Timestamp
+	}
+	info.GameState = last.GameState
+	info.TeamCT, info.TeamT = last.GameTeamCT, last.GameTeamT
+	info.ScoreCT, info.ScoreT = last.GameScoreCT, last.GameScoreT
+	if ts, err := time.Parse(timestampLayout, last.Timestamp); err == nil && !last.ReceivedAt.IsZero() {
+		skew := last.ReceivedAt.Sub(ts).Seconds()
+		info.ClockSkewSeconds = &skew
+	}
+
+	switch since := time.Since(info.LastReceivedAt); {
+	case info.LastReceivedAt.IsZero():
+		info.State = ServerOffline
+	case since < serverOnlineWindow:
+		info.State = ServerOnline
+	case since < logContinueWindow:
+		info.State = ServerIdle
+	default:
+		info.State = ServerOffline
+	}
+	return info, nil
+}
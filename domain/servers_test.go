@@ -0,0 +1,35 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestServerBytesStored(t *testing.T) {
+	svc := newTestService(t, catalogTestLogs()...)
+	// a_3 starts at offset 200 but only holds its 10 bytes
+	info, err := svc.Server("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.BytesStored != 30 {
+		t.Errorf("bytes stored = %d, want 30", info.BytesStored)
+	}
+}
+
+func TestRecordIngestErrorUnknownServer(t *testing.T) {
+	svc := newTestService(t, catalogTestLogs()...)
+	svc.RecordIngestError("a", IngestBadHeaders)
+	svc.RecordIngestError("made-up", IngestBadHeaders)
+
+	info, err := svc.Server("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.IngestErrors[IngestBadHeaders] != 1 {
+		t.Errorf("ingest errors of a = %v", info.IngestErrors)
+	}
+	if _, err := svc.Server("made-up"); !errors.Is(err, ErrServerNotFound) {
+		t.Errorf("made-up server: err = %v, want ErrServerNotFound", err)
+	}
+}
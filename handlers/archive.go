@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"cs2-log-proxy/archive"
+	"cs2-log-proxy/auth"
+	"cs2-log-proxy/domain"
+	"cs2-log-proxy/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// maxArchiveSize limits the size of uploaded archives
+const maxArchiveSize = 1 << 30
+
+// HandleExportArchive sends a log as a zip (default) or tar.gz archive,
+// selected with ?format=
+func HandleExportArchive(logStore storage.Backend) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = archive.FormatZip
+		}
+		contentType := map[string]string{
+			archive.FormatZip:   "application/zip",
+			archive.FormatTarGz: "application/gzip",
+		}[format]
+		if contentType == "" {
+			http.Error(w, "Unknown archive format", http.StatusBadRequest)
+			return
+		}
+
+		logID := mux.Vars(r)["token"]
+		if !auth.FromContext(r.Context()).CanSeeLog(logID) {
+			http.Error(w, "Log not found", http.StatusNotFound)
+			return
+		}
+		a, err := archive.Load(logStore, logID)
+		if errors.Is(err, archive.ErrLogNotFound) {
+			http.Error(w, "Log not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to load log", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, storage.SafeName(logID), format))
+		if err := a.Write(w, format); err != nil {
+			log.Printf("Failed to write archive of %s: %v", logID, err)
+		}
+	}
+}
+
+// HandleImportArchive restores an archive from the request body and returns
+// its manifest
+func HandleImportArchive(logService *domain.LogService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxArchiveSize))
+		if err != nil {
+			http.Error(w, "Failed to read archive", http.StatusBadRequest)
+			return
+		}
+		a, err := archive.Read(data)
+		if err != nil {
+			http.Error(w, "Invalid archive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = logService.ImportArchive(a)
+		if errors.Is(err, archive.ErrLogExists) {
+			http.Error(w, "Log already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to import archive of %s: %v", a.Manifest.LogID, err)
+			http.Error(w, "Failed to import archive", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(a.Manifest)
+	}
+}
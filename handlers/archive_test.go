@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+
+	"cs2-log-proxy/archive"
+	"cs2-log-proxy/domain"
+	"cs2-log-proxy/storage"
+	"cs2-log-proxy/websocket"
+)
+
+func TestArchiveExportImport(t *testing.T) {
+	const logID = "srv_2025-01-30T16-00-00.000"
+	const data = "L 01\nL 02\nL 03\n"
+	source := storage.NewLogStore(t.TempDir())
+	if err := storage.AppendChunks(source, logID, data, []storage.ChunkMeta{{EndOffset: 5}, {BeginOffset: 5, EndOffset: len(data)}}); err != nil {
+		t.Fatal(err)
+	}
+	meta := storage.ServerMeta{ServerInstanceToken: "srv", Logs: []storage.LogMeta{{LogID: logID, LastByteOffset: len(data)}}}
+	if err := source.SaveServerMeta("srv", &meta); err != nil {
+		t.Fatal(err)
+	}
+
+	req := mux.SetURLVars(httptest.NewRequest("GET", "/logs/x/archive?format=zip", nil), map[string]string{"token": logID})
+	rec := httptest.NewRecorder()
+	HandleExportArchive(source)(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("export: status %d", rec.Code)
+	}
+	exported := rec.Body.Bytes()
+
+	// The same log claimed by another server
+	a, err := archive.Read(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Manifest.Token, a.Session.Token = "other", "other"
+	var other bytes.Buffer
+	if err := a.Write(&other, archive.FormatZip); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := storage.NewLogStore(t.TempDir())
+	handler := HandleImportArchive(domain.NewLogService(dest, websocket.NewHub(), nil))
+	tests := []struct {
+		name   string
+		body   []byte
+		status int
+	}{
+		{"another server's log", other.Bytes(), http.StatusBadRequest},
+		{"not an archive", []byte("L 01\n"), http.StatusBadRequest},
+		{"archive", exported, http.StatusCreated},
+		{"existing log", exported, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("POST", "/archives", bytes.NewReader(tt.body)))
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, rec.Code, tt.status, rec.Body)
+		}
+	}
+	if got, err := dest.GetLog(logID); err != nil || got != data {
+		t.Errorf("imported log %q, %v", got, err)
+	}
+	if metas, err := dest.LoadChunkMetas(logID); err != nil || len(metas) != 2 {
+		t.Errorf("imported chunks %+v, %v", metas, err)
+	}
+}
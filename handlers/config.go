@@ -1,9 +1,48 @@
 package handlers
 
-import "net/http"
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
 
-// HandleConfig handles configuration management
-func HandleConfig(w http.ResponseWriter, r *http.Request) {
-	// TODO: Implement config management
-}
+	"cs2-log-proxy/config"
+)
+
+// HandleConfig returns the effective config with secrets redacted (GET) or
+// validates, applies and saves a new one (POST). Redacted secrets sent back
+// unchanged keep their current values.
+func HandleConfig(cfg *config.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Type", "application/json")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.Encode(cfg.Config().Redacted())
+			return
+		}
 
+		var c config.Config
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&c); err != nil {
+			http.Error(w, "Invalid config: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := cfg.Update(&c)
+		var invalid *config.ValidationError
+		if errors.As(err, &invalid) {
+			http.Error(w, "Invalid config: "+invalid.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("Config update: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	}
+}
@@ -0,0 +1,410 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cs2-log-proxy/storage"
+)
+
+// LogOffsetHeader tells where in the log a partial response starts
+const LogOffsetHeader = "X-Log-Offset"
+
+// chunkTimestampLayout is the layout of chunk timestamps (X-Timestamp)
+const chunkTimestampLayout = "01/02/2006 - 15:04:05.000"
+
+// logWindow is the part of a log selected by query parameters, in bytes
+// of the stored log
+type logWindow struct {
+	start int64
+	end   int64 // exclusive, -1 for the end of the log
+	tail  int   // only the last tail lines of the window, 0 for all
+	set   bool  // a window parameter was given
+	size  int64 // log size from the chunk index, -1 if unknown
+}
+
+// bounds clamps the window to a log of size bytes
+func (win logWindow) bounds(size int64) (int64, int64) {
+	start, end := win.start, win.end
+	if end < 0 || end > size {
+		end = size
+	}
+	if start > end {
+		start = end
+	}
+	return start, end
+}
+
+// parseLogWindow reads the window parameters:
+//
+//	from_offset, to_offset  byte offsets in the stored log, to_offset exclusive
+//	from_time, to_time      RFC 3339 or "MM/DD/YYYY - hh:mm:ss.sss", to_time exclusive
+//	from_tick, to_tick      server ticks, inclusive
+//	tail                    number of lines at the end of the window
+//
+// Time and tick windows are resolved to chunk boundaries through the chunk
+// index. All given parameters narrow the window.
+func parseLogWindow(q url.Values, store storage.Backend, logID string) (logWindow, error) {
+	win := logWindow{end: -1, size: -1}
+	intParam := func(name string) (int64, bool, error) {
+		v := q.Get(name)
+		if v == "" {
+			return 0, false, nil
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, false, fmt.Errorf("invalid %s", name)
+		}
+		win.set = true
+		return n, true, nil
+	}
+	narrow := func(start, end int64) {
+		if start > win.start {
+			win.start = start
+		}
+		if end >= 0 && (win.end < 0 || end < win.end) {
+			win.end = end
+		}
+	}
+
+	if n, ok, err := intParam("from_offset"); err != nil {
+		return win, err
+	} else if ok {
+		narrow(n, -1)
+	}
+	if n, ok, err := intParam("to_offset"); err != nil {
+		return win, err
+	} else if ok {
+		narrow(0, n)
+	}
+	if n, ok, err := intParam("tail"); err != nil {
+		return win, err
+	} else if ok {
+		win.tail = int(n)
+	}
+
+	metas, err := store.LoadChunkMetas(logID)
+	if err != nil {
+		return win, err
+	}
+	var base int
+	if len(metas) > 0 {
+		base = metas[0].BeginOffset
+		win.size = int64(metas[len(metas)-1].EndOffset - base)
+	}
+	// chunkStart returns the stored offset of the first chunk matching
+	// pred, or def if none does
+	chunkStart := func(pred func(m storage.ChunkMeta) bool, def int64) int64 {
+		for _, m := range metas {
+			if pred(m) {
+				return int64(m.BeginOffset - base)
+			}
+		}
+		return def
+	}
+	end := win.size
+	if end < 0 {
+		end = 0
+	}
+
+	for _, name := range []string{"from_time", "to_time"} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		t, err := parseTimeParam(v)
+		if err != nil {
+			return win, fmt.Errorf("invalid %s", name)
+		}
+		win.set = true
+		atOrAfter := func(m storage.ChunkMeta) bool {
+			ct, err := time.Parse(chunkTimestampLayout, m.Timestamp)
+			return err == nil && !ct.Before(t)
+		}
+		if name == "from_time" {
+			narrow(chunkStart(atOrAfter, end), -1)
+		} else {
+			narrow(0, chunkStart(atOrAfter, -1))
+		}
+	}
+	if n, ok, err := intParam("from_tick"); err != nil {
+		return win, err
+	} else if ok {
+		narrow(chunkStart(func(m storage.ChunkMeta) bool { return int64(m.TickEnd) >= n }, end), -1)
+	}
+	if n, ok, err := intParam("to_tick"); err != nil {
+		return win, err
+	} else if ok {
+		narrow(0, chunkStart(func(m storage.ChunkMeta) bool { return int64(m.TickStart) > n }, -1))
+	}
+	return win, nil
+}
+
+func parseTimeParam(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.Parse(chunkTimestampLayout, v)
+}
+
+// stringLog serves logs of backends that only return whole strings
+type stringLog struct {
+	*strings.Reader
+}
+
+func (stringLog) Close() error { return nil }
+
+type seekableLog interface {
+	io.ReaderAt
+	io.Seeker
+}
+
+// serveLog streams a log or a window of it. Plain logs are served from
+// disk with http.ServeContent, which also handles Range requests. gzip
+// compressed logs go out as they are stored to clients that accept gzip,
+// unless only a part of the log was requested.
+func serveLog(w http.ResponseWriter, r *http.Request, store storage.Backend, logID string) {
+	win, err := parseLogWindow(r.URL.Query(), store, logID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var f io.ReadCloser
+	encoding := ""
+	if opener, ok := store.(storage.LogOpener); ok {
+		f, encoding, err = opener.OpenLog(logID)
+	} else {
+		var data string
+		data, err = store.GetLog(logID)
+		f = stringLog{strings.NewReader(data)}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "Log not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get log", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Vary", "Accept-Encoding")
+	if seekable, ok := f.(seekableLog); ok && encoding == "" {
+		if err := serveSeekable(w, r, seekable, win); err != nil {
+			http.Error(w, "Failed to get log", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !win.set && r.Header.Get("Range") == "" && encoding == storage.CompressionGzip && acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		io.Copy(w, f)
+		return
+	}
+	body, err := storage.Decompress(f, encoding)
+	if err != nil {
+		http.Error(w, "Failed to get log", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+	if err := serveStream(w, r, body, win); err != nil {
+		log.Printf("Failed to send log %s: %v", logID, err)
+	}
+}
+
+func serveSeekable(w http.ResponseWriter, r *http.Request, f seekableLog, win logWindow) error {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	start, end := win.bounds(size)
+	if win.tail > 0 {
+		if start, err = tailStart(f, start, end, win.tail); err != nil {
+			return err
+		}
+	}
+	if win.set {
+		w.Header().Set(LogOffsetHeader, strconv.FormatInt(start, 10))
+	}
+	var modTime time.Time
+	if file, ok := f.(*os.File); ok {
+		if info, err := file.Stat(); err == nil {
+			modTime = info.ModTime()
+		}
+	}
+	http.ServeContent(w, r, "", modTime, io.NewSectionReader(f, start, end-start))
+	return nil
+}
+
+// tailStart returns the offset of the first of the last n lines in
+// [start, end), reading backwards from end
+func tailStart(f io.ReaderAt, start, end int64, n int) (int64, error) {
+	buf := make([]byte, 64<<10)
+	pos := end
+	for pos > start {
+		size := min(int64(len(buf)), pos-start)
+		pos -= size
+		if _, err := f.ReadAt(buf[:size], pos); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for i := size - 1; i >= 0; i-- {
+			// The newline ending the last line doesn't start another
+			if buf[i] != '\n' || pos+i == end-1 {
+				continue
+			}
+			if n--; n == 0 {
+				return pos + i + 1, nil
+			}
+		}
+	}
+	return start, nil
+}
+
+// serveStream serves a window of a log that can only be read front to
+// back, such as a decompressed one
+func serveStream(w http.ResponseWriter, r *http.Request, body io.Reader, win logWindow) error {
+	start, end := win.start, win.end
+	if win.size >= 0 {
+		start, end = win.bounds(win.size)
+	}
+	if _, err := io.CopyN(io.Discard, body, start); err != nil && err != io.EOF {
+		return err
+	}
+
+	if win.tail > 0 {
+		if end >= 0 {
+			body = io.LimitReader(body, end-start)
+		}
+		return serveTail(w, body, start, win.tail)
+	}
+
+	if win.set {
+		// Like http.ServeContent, Range applies within the window
+		w.Header().Set(LogOffsetHeader, strconv.FormatInt(start, 10))
+	}
+	status := http.StatusOK
+	if h := r.Header.Get("Range"); h != "" && end >= 0 {
+		rs, re, ignore, ok := singleRange(h, end-start)
+		if !ok {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", end-start))
+			http.Error(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return nil
+		}
+		if !ignore {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rs, re-1, end-start))
+			if _, err := io.CopyN(io.Discard, body, rs); err != nil {
+				return err
+			}
+			start, end = start+rs, start+re
+			status = http.StatusPartialContent
+		}
+	}
+	if end >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start, 10))
+		w.WriteHeader(status)
+		_, err := io.CopyN(w, body, end-start)
+		return err
+	}
+	w.WriteHeader(status)
+	_, err := io.Copy(w, body)
+	return err
+}
+
+// serveTail writes the last n lines of body, which starts at offset
+func serveTail(w http.ResponseWriter, body io.Reader, offset int64, n int) error {
+	type line struct {
+		offset int64
+		text   string
+	}
+	ring := make([]line, 0, min(n, 1024))
+	next := 0
+	br := bufio.NewReader(body)
+	for {
+		text, err := br.ReadString('\n')
+		if text != "" {
+			if len(ring) < n {
+				ring = append(ring, line{offset, text})
+			} else {
+				ring[next] = line{offset, text}
+				next = (next + 1) % n
+			}
+			offset += int64(len(text))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	ordered := append(ring[next:], ring[:next]...)
+	if len(ordered) > 0 {
+		offset = ordered[0].offset
+	}
+	w.Header().Set(LogOffsetHeader, strconv.FormatInt(offset, 10))
+	for _, l := range ordered {
+		if _, err := io.WriteString(w, l.text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// singleRange parses a Range header for a body of size bytes into
+// [start, end). Headers with several ranges or other units are ignored and
+// the whole body is served; ok is false if the range can't be satisfied.
+func singleRange(h string, size int64) (start, end int64, ignore, ok bool) {
+	spec, found := strings.CutPrefix(h, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, true, true
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, false
+	}
+	if first == "" {
+		// Suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false, false
+		}
+		return max(size-n, 0), size, false, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false, false
+	}
+	end = size
+	if last != "" {
+		l, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || l < start {
+			return 0, 0, false, false
+		}
+		end = min(l+1, size)
+	}
+	return start, end, false, true
+}
+
+// acceptsGzip reports whether the Accept-Encoding header allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		params = strings.ReplaceAll(params, " ", "")
+		return params != "q=0" && params != "q=0.0" && params != "q=0.00" && params != "q=0.000"
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"cs2-log-proxy/storage"
+)
+
+func TestHandleGetLogWindows(t *testing.T) {
+	const logID = "srv_2025-01-30T16-00-00.000"
+	const c1, c2, c3 = "L 01\nL 02\n", "L 03\nL 04\n", "L 05\nL 06\n"
+	metas := []storage.ChunkMeta{
+		{BeginOffset: 0, EndOffset: 10, Timestamp: "01/30/2025 - 16:00:00.000", TickStart: 1, TickEnd: 100},
+		{BeginOffset: 10, EndOffset: 20, Timestamp: "01/30/2025 - 16:01:00.000", TickStart: 101, TickEnd: 200},
+		{BeginOffset: 20, EndOffset: 30, Timestamp: "01/30/2025 - 16:02:00.000", TickStart: 201, TickEnd: 300},
+	}
+	tests := []struct {
+		query    string
+		rangeHdr string
+		status   int
+		body     string
+		offset   string // X-Log-Offset, "" if not set
+	}{
+		{"", "", http.StatusOK, c1 + c2 + c3, ""},
+		{"from_offset=10", "", http.StatusOK, c2 + c3, "10"},
+		{"from_offset=5&to_offset=15", "", http.StatusOK, c1[5:] + c2[:5], "5"},
+		{"tail=3", "", http.StatusOK, c2[5:] + c3, "15"},
+		{"to_offset=20&tail=1", "", http.StatusOK, c2[5:], "15"},
+		{"from_time=2025-01-30T16:01:00Z", "", http.StatusOK, c2 + c3, "10"},
+		{"to_time=01%2F30%2F2025+-+16%3A01%3A00.000", "", http.StatusOK, c1, "0"},
+		{"from_tick=150&to_tick=200", "", http.StatusOK, c2, "10"},
+		{"", "bytes=5-14", http.StatusPartialContent, c1[5:] + c2[:5], ""},
+		{"", "bytes=-5", http.StatusPartialContent, c3[5:], ""},
+		{"from_offset=10", "bytes=0-4", http.StatusPartialContent, c2[:5], "10"},
+		{"", "bytes=30-", http.StatusRequestedRangeNotSatisfiable, "", ""},
+		{"from_offset=x", "", http.StatusBadRequest, "", ""},
+	}
+	for _, algo := range []string{"", storage.CompressionGzip} {
+		store := storage.NewLogStore(t.TempDir())
+		if err := storage.AppendChunks(store, logID, c1+c2+c3, metas); err != nil {
+			t.Fatal(err)
+		}
+		if algo != "" {
+			store.SetCompression(algo, time.Hour)
+			if err := store.CompressLog(logID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		handler := HandleGetLog(store)
+		for _, tt := range tests {
+			req := httptest.NewRequest("GET", "/logs/x?"+tt.query, nil)
+			req = mux.SetURLVars(req, map[string]string{"token": logID})
+			if tt.rangeHdr != "" {
+				req.Header.Set("Range", tt.rangeHdr)
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("%q %q %s: status %d, want %d", algo, tt.query, tt.rangeHdr, rec.Code, tt.status)
+				continue
+			}
+			if tt.status >= 400 {
+				continue
+			}
+			body, _ := io.ReadAll(rec.Body)
+			if string(body) != tt.body || rec.Header().Get(LogOffsetHeader) != tt.offset {
+				t.Errorf("%q %q %s: got %q at %q, want %q at %q", algo, tt.query, tt.rangeHdr, body, rec.Header().Get(LogOffsetHeader), tt.body, tt.offset)
+			}
+		}
+		store.Close()
+	}
+}
@@ -1,11 +1,20 @@
 package handlers
 
 import (
+	"cs2-log-proxy/auth"
 	"cs2-log-proxy/domain"
+	"cs2-log-proxy/receiver"
+	"cs2-log-proxy/search"
 	"cs2-log-proxy/storage"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mozillazg/go-httpheader"
@@ -31,6 +40,31 @@ type CS2ServerHeaders struct {
 	Timestamp           string `header:"X-Timestamp"` // MM/DD/YYYY - HH:MM:SS.MMM Example: 01/30/2025 - 16:33:56.470
 }
 
+// proxyChain reads the headers upstream proxies add to relayed chunks, see
+// receiver.ProxyViaHeader. They are absent on packages sent by game servers.
+// ReceivedAt is zero unless the request carries a valid arrival time.
+func proxyChain(h http.Header) (via []string, hops int, receivedAt time.Time, err error) {
+	if v := h.Get(receiver.ProxyHopsHeader); v != "" {
+		if hops, err = strconv.Atoi(v); err != nil {
+			return nil, 0, time.Time{}, err
+		}
+	}
+	origin := h.Get(receiver.ProxyOriginHeader)
+	if h.Get(receiver.ProxyViaHeader) == "" && origin == "" {
+		return nil, hops, time.Time{}, nil
+	}
+	for _, id := range strings.Split(h.Get(receiver.ProxyViaHeader), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			via = append(via, id)
+		}
+	}
+	if len(via) == 0 {
+		via = []string{origin}
+	}
+	receivedAt, _ = time.Parse(time.RFC3339Nano, h.Get(receiver.ProxyReceivedAtHeader))
+	return via, hops, receivedAt, nil
+}
+
 // HandleLogPackage handles incoming CS2 log packages
 func HandleLogPackage(logService *domain.LogService) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -38,12 +72,42 @@ func HandleLogPackage(logService *domain.LogService) func(w http.ResponseWriter,
 		// Parse headers into struct
 		headers := CS2ServerHeaders{}
 		if err := httpheader.Decode(r.Header, &headers); err != nil {
+			if logService != nil {
+				logService.RecordIngestError(r.Header.Get("X-Server-Instance-Token"), domain.IngestBadHeaders)
+			}
 			http.Error(w, "Failed to parse headers", http.StatusBadRequest)
 			return
 		}
 
+		via, hops, relayedAt, err := proxyChain(r.Header)
+		if err != nil {
+			if logService != nil {
+				logService.RecordIngestError(headers.ServerInstanceToken, domain.IngestBadHeaders)
+			}
+			http.Error(w, "Failed to parse proxy headers", http.StatusBadRequest)
+			return
+		}
+		if logService != nil {
+			// Refusing a chain is safe whoever claims it, keeping it isn't
+			if err := logService.CheckProxyChain(via, hops); err != nil {
+				log.Printf("Refusing relayed log chunk: %v", err)
+				logService.RecordIngestError(headers.ServerInstanceToken, domain.IngestRefused)
+				http.Error(w, err.Error(), http.StatusLoopDetected)
+				return
+			}
+		}
+		receivedAt := time.Now().UTC()
+		if logService == nil || !logService.IsPeer(r.RemoteAddr) {
+			via = nil
+		} else if !relayedAt.IsZero() {
+			receivedAt = relayedAt
+		}
+
 		if int(r.ContentLength) != headers.LogBytesEndOffset-headers.LogBytesBeginOffset {
 			log.Printf("Content length mismatch: %d != %d", r.ContentLength, headers.LogBytesEndOffset-headers.LogBytesBeginOffset)
+			if logService != nil {
+				logService.RecordIngestError(headers.ServerInstanceToken, domain.IngestLengthMismatch)
+			}
 		}
 
 		// Read the POST body as the log chunk
@@ -51,12 +115,18 @@ func HandleLogPackage(logService *domain.LogService) func(w http.ResponseWriter,
 		logData := make([]byte, r.ContentLength)
 		n, err := r.Body.Read(logData)
 		if err != nil && err.Error() != "EOF" {
+			if logService != nil {
+				logService.RecordIngestError(headers.ServerInstanceToken, domain.IngestReadFailed)
+			}
 			http.Error(w, "Failed to read log chunk", http.StatusBadRequest)
 			return
 		}
 		if n != int(r.ContentLength) {
 			log.Printf("Content length mismatch: %d != %d", n, r.ContentLength)
 			log.Printf("This somtimes happens during start, recovers after log gets appended")
+			if logService != nil {
+				logService.RecordIngestError(headers.ServerInstanceToken, domain.IngestReadFailed)
+			}
 			http.Error(w, "Failed to read log chunk", http.StatusBadRequest)
 			return
 		}
@@ -73,6 +143,7 @@ func HandleLogPackage(logService *domain.LogService) func(w http.ResponseWriter,
 			TickEnd:     headers.TickEnd,
 			TickStart:   headers.TickStart,
 			Timestamp:   headers.Timestamp,
+			ReceivedAt:  receivedAt,
 		}
 		token := headers.ServerInstanceToken
 		if token == "" {
@@ -87,9 +158,11 @@ func HandleLogPackage(logService *domain.LogService) func(w http.ResponseWriter,
 			http.Error(w, "Log service unavailable", http.StatusInternalServerError)
 			return
 		}
-		_, err = logService.ProcessLogChunk(token, string(logData), meta, gameMap, steamID, serverAddr)
+		meta.ProxyVia = append(via, logService.ProxyID)
+		_, err = logService.ProcessLogChunk(token, string(logData), meta, gameMap, steamID, serverAddr, headers.ServerUniqueToken)
 		if err != nil {
 			log.Printf("Failed to process log chunk: %v", err)
+			logService.RecordIngestError(token, domain.IngestFailed)
 			http.Error(w, "Failed to process log chunk", http.StatusInternalServerError)
 			return
 		}
@@ -97,31 +170,119 @@ func HandleLogPackage(logService *domain.LogService) func(w http.ResponseWriter,
 	}
 }
 
-func HandleGetLog(logStore *storage.LogStore) func(w http.ResponseWriter, r *http.Request) {
+// HandleGetLog serves a stored log, or the part of it selected with
+// Range, from_offset/to_offset, from_time/to_time, from_tick/to_tick or
+// tail, see parseLogWindow
+func HandleGetLog(logStore storage.Backend) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		token := mux.Vars(r)["token"]
 		if token == "" {
 			http.Error(w, "Missing token", http.StatusBadRequest)
 			return
 		}
-		logs, err := logStore.GetLog(token)
-		if err != nil {
-			http.Error(w, "Failed to get log", http.StatusInternalServerError)
+		if !auth.FromContext(r.Context()).CanSeeLog(token) {
+			http.Error(w, "Log not found", http.StatusNotFound)
 			return
 		}
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte(logs))
+		serveLog(w, r, logStore, token)
 	}
 }
 
+// HandleListLogs returns a page of logs, see parseLogQuery for the parameters
 func HandleListLogs(logService *domain.LogService) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		logs, err := logService.ListLogs()
+		q, err := parseLogQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if p := auth.FromContext(r.Context()); p.Scoped() {
+			q.Servers = p.Servers
+		}
+		page, err := logService.ListLogs(q)
+		if errors.Is(err, domain.ErrInvalidCursor) {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, domain.ErrNoPlayerIndex) {
+			http.Error(w, "The player filter needs the sqlite storage backend", http.StatusBadRequest)
+			return
+		}
 		if err != nil {
 			http.Error(w, "Failed to list logs", http.StatusInternalServerError)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(logs)
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// maxListLimit caps the page size of /api/listlogs
+const maxListLimit = 1000
+
+// parseLogQuery reads the filters server, steam_id, server_addr, map, team,
+// player, from and to (log start, YYYY-MM-DD or RFC 3339), state (active or
+// finished) and complete (true or false), the order sort (last_activity,
+// start_time, map or server) with order (asc or desc), and limit and cursor
+func parseLogQuery(v url.Values) (domain.LogQuery, error) {
+	q := domain.LogQuery{
+		Token:      v.Get("server"),
+		SteamID:    v.Get("steam_id"),
+		ServerAddr: v.Get("server_addr"),
+		Map:        v.Get("map"),
+		Team:       v.Get("team"),
+		Player:     v.Get("player"),
+		Sort:       v.Get("sort"),
+		Limit:      100,
+		Cursor:     v.Get("cursor"),
+	}
+	var err error
+	if s := v.Get("from"); s != "" {
+		if q.From, err = search.ParseDate(s); err != nil {
+			return q, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if s := v.Get("to"); s != "" {
+		if q.To, err = search.ParseDate(s); err != nil {
+			return q, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	switch v.Get("state") {
+	case "":
+	case "active", "finished":
+		active := v.Get("state") == "active"
+		q.Active = &active
+	default:
+		return q, errors.New("state must be active or finished")
+	}
+	if s := v.Get("complete"); s != "" {
+		complete, err := strconv.ParseBool(s)
+		if err != nil {
+			return q, errors.New("complete must be true or false")
+		}
+		q.Complete = &complete
+	}
+	switch q.Sort {
+	case "", domain.SortLastActivity, domain.SortStartTime:
+	case domain.SortMap, domain.SortServer:
+		q.Asc = true
+	default:
+		return q, fmt.Errorf("unknown sort %q", q.Sort)
+	}
+	switch v.Get("order") {
+	case "":
+	case "asc":
+		q.Asc = true
+	case "desc":
+		q.Asc = false
+	default:
+		return q, errors.New("order must be asc or desc")
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit <= 0 {
+			return q, errors.New("invalid limit")
+		}
 	}
+	q.Limit = min(q.Limit, maxListLimit)
+	return q, nil
 }
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"cs2-log-proxy/receiver"
+
+	"github.com/gorilla/mux"
+)
+
+// AddReceiverRequest is the body of POST /api/receivers.
+// Backfill is optional and selects stored logs to send before live forwarding.
+type AddReceiverRequest struct {
+	ID       string                    `json:"id"`
+	Type     string                    `json:"type"`
+	Config   map[string]interface{}    `json:"config"`
+	Backfill *receiver.BackfillRequest `json:"backfill,omitempty"`
+}
+
+func HandleListReceivers(manager *receiver.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		infos := []receiver.ReceiverInfo{}
+		for _, rec := range manager.ListReceivers() {
+			infos = append(infos, rec.Info())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	}
+}
+
+func HandleAddReceiver(manager *receiver.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req AddReceiverRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid receiver", http.StatusBadRequest)
+			return
+		}
+		if req.ID == "" || req.Type == "" {
+			http.Error(w, "Missing receiver id or type", http.StatusBadRequest)
+			return
+		}
+		var rec *receiver.Receiver
+		var err error
+		if req.Backfill != nil {
+			// Started with the backfill, so no live chunk gets ahead of it
+			rec, err = manager.AddReceiverWithBackfill(req.ID, req.Type, req.Config, *req.Backfill)
+		} else {
+			rec, err = manager.AddReceiver(req.ID, req.Type, req.Config)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rec.Info())
+	}
+}
+
+func HandleGetReceiver(manager *receiver.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec, exists := manager.GetReceiver(mux.Vars(r)["id"])
+		if !exists {
+			http.Error(w, "Receiver not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rec.Info())
+	}
+}
+
+func HandleRemoveReceiver(manager *receiver.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !manager.RemoveReceiver(mux.Vars(r)["id"]) {
+			http.Error(w, "Receiver not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleGetBackfill reports the progress of a receiver's latest backfill
+func HandleGetBackfill(manager *receiver.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec, exists := manager.GetReceiver(mux.Vars(r)["id"])
+		if !exists {
+			http.Error(w, "Receiver not found", http.StatusNotFound)
+			return
+		}
+		progress, ok := rec.BackfillProgress()
+		if !ok {
+			http.Error(w, "No backfill", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(progress)
+	}
+}
+
+// HandleStartBackfill starts a backfill for an existing receiver
+func HandleStartBackfill(manager *receiver.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, exists := manager.GetReceiver(id); !exists {
+			http.Error(w, "Receiver not found", http.StatusNotFound)
+			return
+		}
+		var req receiver.BackfillRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid backfill request", http.StatusBadRequest)
+			return
+		}
+		if err := manager.Backfill(id, req); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, receiver.ErrBackfillRunning) {
+				status = http.StatusConflict
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// DeadLetterRequest selects dead letters to retry or purge, all if IDs is empty
+type DeadLetterRequest struct {
+	IDs []string `json:"ids"`
+}
+
+func HandleListDeadLetters(manager *receiver.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, exists := manager.GetReceiver(id); !exists {
+			http.Error(w, "Receiver not found", http.StatusNotFound)
+			return
+		}
+		letters, err := manager.DeadLetters(id)
+		if err != nil {
+			http.Error(w, "Failed to list dead letters", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(letters)
+	}
+}
+
+// HandleRetryDeadLetters queues dead letters for redelivery
+func HandleRetryDeadLetters(manager *receiver.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req DeadLetterRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, "Invalid dead letter request", http.StatusBadRequest)
+				return
+			}
+		}
+		if err := manager.RetryDeadLetters(mux.Vars(r)["id"], req.IDs); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// HandlePurgeDeadLetters deletes dead letters, selected by repeated ?id= parameters
+func HandlePurgeDeadLetters(manager *receiver.Manager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if _, exists := manager.GetReceiver(id); !exists {
+			http.Error(w, "Receiver not found", http.StatusNotFound)
+			return
+		}
+		if err := manager.PurgeDeadLetters(id, r.URL.Query()["id"]); err != nil {
+			http.Error(w, "Failed to purge dead letters", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"cs2-log-proxy/auth"
+	"cs2-log-proxy/domain"
+	"cs2-log-proxy/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// HandleRetentionReport reports what the retention policy would remove
+// right now without changing anything
+func HandleRetentionReport(retention *storage.Retention) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := retention.Run(time.Now(), true)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// HandleRunRetention applies the retention policy immediately
+func HandleRunRetention(retention *storage.Retention) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := retention.Run(time.Now(), false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// HandleSetProtected sets (PUT) or clears (DELETE) the protected flag of a log
+func HandleSetProtected(logService *domain.LogService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logID := mux.Vars(r)["token"]
+		if !auth.FromContext(r.Context()).CanSeeLog(logID) {
+			http.Error(w, "Log not found", http.StatusNotFound)
+			return
+		}
+		err := logService.SetProtected(logID, r.Method == http.MethodPut)
+		if errors.Is(err, domain.ErrLogNotFound) {
+			http.Error(w, "Log not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to update log", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
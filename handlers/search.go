@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cs2-log-proxy/auth"
+	"cs2-log-proxy/search"
+)
+
+// Caps of the context and limit parameters of /api/search
+const (
+	maxSearchContext = 20
+	maxSearchLimit   = 1000
+)
+
+// HandleSearch serves GET /api/search?q=... Filters may be given in q
+// (server:, map:, from:, to:) or as query parameters of the same names.
+// context and limit set the lines around each hit and the number of hits.
+func HandleSearch(index *search.Index) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		q, err := search.ParseQuery(params.Get("q"))
+		if err != nil {
+			http.Error(w, "Invalid query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if v := params.Get("server"); v != "" {
+			q.Server = v
+		}
+		if v := params.Get("map"); v != "" {
+			q.Map = v
+		}
+		for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+			if v := params.Get(name); v != "" {
+				if *t, err = search.ParseDate(v); err != nil {
+					http.Error(w, "Invalid "+name, http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		// context may be 0, at least one hit must be asked for
+		for _, p := range []struct {
+			name     string
+			n        *int
+			min, max int
+		}{{"context", &q.Context, 0, maxSearchContext}, {"limit", &q.Limit, 1, maxSearchLimit}} {
+			if v := params.Get(p.name); v != "" {
+				if *p.n, err = strconv.Atoi(v); err != nil || *p.n < p.min || *p.n > p.max {
+					http.Error(w, "Invalid "+p.name, http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		if p := auth.FromContext(r.Context()); p.Scoped() {
+			q.Servers = p.Servers
+		}
+		results, err := index.Search(q)
+		if errors.Is(err, search.ErrBroadQuery) {
+			http.Error(w, "Query needs a word of at least two letters or digits", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Search failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	}
+}
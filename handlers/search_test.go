@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cs2-log-proxy/search"
+	"cs2-log-proxy/storage"
+)
+
+func TestHandleSearchParameters(t *testing.T) {
+	index := search.NewIndex(storage.NewLogStore(t.TempDir()))
+	data := "L 01/30/2025 - 16:33:56: World triggered \"Round_Start\"\n"
+	index.Add("a_1", "a", "de_dust2", storage.ChunkMeta{EndOffset: len(data), Timestamp: "01/30/2025 - 16:33:56.000"}, data)
+	handler := HandleSearch(index)
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"q=round_start", http.StatusOK},
+		{"q=round_start&context=0&limit=1", http.StatusOK},
+		{"q=round_start&context=20&limit=1000", http.StatusOK},
+		{"q=round_start&context=21", http.StatusBadRequest},
+		{"q=round_start&context=-1", http.StatusBadRequest},
+		{"q=round_start&limit=1001", http.StatusBadRequest},
+		{"q=round_start&limit=0", http.StatusBadRequest},
+		{"q=round_start&limit=many", http.StatusBadRequest},
+		{"q=round_start&from=yesterday", http.StatusBadRequest},
+		{"q=a", http.StatusBadRequest},
+		{`q="round`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/api/search?"+tt.query, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d: %s", tt.query, w.Code, tt.want, w.Body)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"cs2-log-proxy/auth"
+	"cs2-log-proxy/domain"
+
+	"github.com/gorilla/mux"
+)
+
+// HandleListServers returns the inventory of all game servers
+func HandleListServers(logService *domain.LogService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		servers, err := logService.Servers()
+		if err != nil {
+			http.Error(w, "Failed to list servers", http.StatusInternalServerError)
+			return
+		}
+		p := auth.FromContext(r.Context())
+		visible := servers[:0]
+		for _, s := range servers {
+			if p.CanSee(s.Token) {
+				visible = append(visible, s)
+			}
+		}
+		servers = visible
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(servers)
+	}
+}
+
+// HandleGetServer returns the inventory entry of one game server
+func HandleGetServer(logService *domain.LogService) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := mux.Vars(r)["token"]
+		if !auth.FromContext(r.Context()).CanSee(token) {
+			http.Error(w, "Server not found", http.StatusNotFound)
+			return
+		}
+		server, err := logService.Server(token)
+		if errors.Is(err, domain.ErrServerNotFound) {
+			http.Error(w, "Server not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to get server", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server)
+	}
+}
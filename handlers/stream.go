@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"cs2-log-proxy/auth"
+	"cs2-log-proxy/storage"
+	"cs2-log-proxy/websocket"
+)
+
+const (
+	// maxStreamSubscriptions caps the event/token pairs of a stream
+	maxStreamSubscriptions = 100
+	// streamHeartbeat keeps idle streams from being closed by proxies
+	streamHeartbeat = 25 * time.Second
+)
+
+// HandleStream serves GET /api/stream, the websocket events as
+// Server-Sent Events. Each event parameter is subscribed with each token
+// parameter, "*" if there is none, as with Hub.Subscribe over /ws. The
+// ID of log_chunk events holds the stored log offsets sent so far; a
+// stream reconnecting with Last-Event-ID (or ?last_event_id=) first gets
+// the chunks it missed. Streams falling behind are closed rather than
+// skip a chunk, and resume from their last event ID.
+func HandleStream(hub *websocket.Hub) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		params := r.URL.Query()
+		events, tokens := params["event"], params["token"]
+		if len(events) == 0 {
+			http.Error(w, "Missing event", http.StatusBadRequest)
+			return
+		}
+		if len(tokens) == 0 {
+			tokens = []string{"*"}
+		}
+		for i, token := range tokens {
+			tokens[i] = storage.CanonicalLogID(token)
+		}
+		if len(events)*len(tokens) > maxStreamSubscriptions {
+			http.Error(w, fmt.Sprintf("At most %d subscriptions per stream", maxStreamSubscriptions), http.StatusBadRequest)
+			return
+		}
+
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = params.Get("last_event_id")
+		}
+		// Event IDs of earlier versions hold former log IDs
+		ids, _ := url.ParseQuery(lastID)
+		resume := url.Values{}
+		for logID, n := range ids {
+			resume[storage.CanonicalLogID(logID)] = n
+		}
+		// offsets are the ends of the chunks sent per log, the event ID
+		offsets := make(map[string]int64)
+		from := make(map[string]int64)
+		for _, event := range events {
+			if event != "log_chunk" {
+				continue
+			}
+			for _, token := range tokens {
+				if n, err := strconv.ParseInt(resume.Get(token), 10, 64); err == nil && n >= 0 {
+					offsets[token], from[token] = n, n
+				}
+			}
+		}
+
+		client := websocket.NewClient(nil, auth.FromContext(r.Context()), 1024)
+		client.Resumable = true
+		hub.AddClient(client)
+		defer hub.RemoveClient(client)
+		// Replays block until they are sent, which happens below
+		go func() {
+			for _, event := range events {
+				for _, token := range tokens {
+					if n, ok := from[token]; ok && event == "log_chunk" {
+						hub.SubscribeFrom(client, token, n)
+					} else {
+						hub.Subscribe(client, event, token)
+					}
+				}
+			}
+		}()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		fmt.Fprint(w, "retry: 3000\n\n")
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-client.Slow():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+			case data := <-client.Send:
+				var msg struct {
+					Type      string `json:"type"`
+					Token     string `json:"token"`
+					EndOffset int64  `json:"end_offset"`
+				}
+				json.Unmarshal(data, &msg)
+				if msg.Type == "log_chunk" && msg.EndOffset > 0 {
+					offsets[msg.Token] = msg.EndOffset
+					fmt.Fprintf(w, "id: %s\n", streamID(offsets))
+				}
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", msg.Type, data)
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// streamID encodes the offsets per log as an event ID, e.g. "logA=120&logB=4096"
+func streamID(offsets map[string]int64) string {
+	v := url.Values{}
+	for logID, n := range offsets {
+		v.Set(logID, strconv.FormatInt(n, 10))
+	}
+	return v.Encode()
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"cs2-log-proxy/storage"
+	"cs2-log-proxy/websocket"
+)
+
+type streamEvent struct {
+	id, event string
+	payload   string
+	begin     int64
+}
+
+// readStream returns the next n events of a stream that carry data
+func readStream(t *testing.T, r *bufio.Reader, n int) []streamEvent {
+	t.Helper()
+	var events []streamEvent
+	var e streamEvent
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("after %d events: %v", len(events), err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var msg struct {
+				Payload     string `json:"payload"`
+				BeginOffset int64  `json:"begin_offset"`
+			}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg); err != nil {
+				t.Fatal(err)
+			}
+			e.payload, e.begin = msg.Payload, msg.BeginOffset
+		case line == "" && e.event != "":
+			events = append(events, e)
+			e = streamEvent{}
+		}
+	}
+	return events
+}
+
+func TestHandleStreamResume(t *testing.T) {
+	const (
+		logID  = "srv_2025-01-30T16-00-00.000"
+		former = "srv_01_30_2025 - 16:00:00.000"
+		stored = "L 01\nL 02\nL 03\n"
+		live   = "L 04\n"
+	)
+	store := storage.NewLogStore(t.TempDir())
+	if err := store.AppendChunk(logID, stored, storage.ChunkMeta{EndOffset: len(stored)}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		token  string
+		lastID string
+		replay string // the replayed part of the stored log
+	}{
+		{"from the start", logID, logID + "=0", stored},
+		{"mid-log", logID, logID + "=5", stored[5:]},
+		{"at the end", logID, logID + "=15", ""},
+		{"by former ID", former, url.Values{former: {"10"}}.Encode(), stored[10:]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := websocket.NewHub()
+			hub.Logs = store
+			srv := httptest.NewServer(http.HandlerFunc(HandleStream(hub)))
+			defer srv.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"?event=log_chunk&token="+url.QueryEscape(tt.token), nil)
+			req.Header.Set("Last-Event-ID", tt.lastID)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			r := bufio.NewReader(resp.Body)
+
+			var got string
+			if tt.replay != "" {
+				replayed := readStream(t, r, 1)[0]
+				if int(replayed.begin)+len(replayed.payload) != len(stored) {
+					t.Errorf("replay [%d+%d] doesn't end at %d", replayed.begin, len(replayed.payload), len(stored))
+				}
+				got = replayed.payload
+			}
+			// Wait for the subscription before the live chunk
+			for deadline := time.Now().Add(time.Second); !subscribed(hub, logID); time.Sleep(time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("stream not subscribed")
+				}
+			}
+			// A live chunk overlapping the stored log only adds its new bytes
+			hub.Publish(websocket.Event{Type: "log_chunk", Token: logID, Payload: stored[10:] + live, BeginOffset: 10, EndOffset: 20})
+			e := readStream(t, r, 1)[0]
+			if got += e.payload; got != tt.replay+live {
+				t.Errorf("received %q, want %q", got, tt.replay+live)
+			}
+			// The event ID resumes after the live chunk, under the current ID
+			if want := (url.Values{logID: {"20"}}).Encode(); e.id != want {
+				t.Errorf("event ID %q, want %q", e.id, want)
+			}
+		})
+	}
+}
+
+// subscribed reports whether a client receives the log_chunk events of logID
+func subscribed(hub *websocket.Hub, logID string) bool {
+	hub.Mutex.Lock()
+	defer hub.Mutex.Unlock()
+	return len(hub.Subscriptions["log_chunk"][logID]) > 0
+}
@@ -1,46 +1,257 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"reflect"
 
+	"cs2-log-proxy/archive"
+	"cs2-log-proxy/auth"
+	"cs2-log-proxy/config"
 	"cs2-log-proxy/domain"
 	"cs2-log-proxy/handlers"
+	"cs2-log-proxy/metrics"
+	"cs2-log-proxy/receiver"
+	"cs2-log-proxy/search"
 	"cs2-log-proxy/storage"
+	_ "cs2-log-proxy/storage/s3"
+	"cs2-log-proxy/storage/sqlite"
 	"cs2-log-proxy/websocket"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	configPath := flag.String("config", "", "config file (default $"+config.EnvPath+" or ~/.cs2-log-manager/config.json)")
+	importJSON := flag.String("import-json", "", "import JSON metadata from a file storage directory into the sqlite store and exit")
+	importArchive := flag.String("import-archive", "", "restore a log archive exported from /api/logs/{id}/archive and exit")
+	flag.Parse()
+
 	// Initialize router
 	r := mux.NewRouter()
 
-	// Initialize log store
-	logStore := storage.NewLogStore("./logs")
-
 	// Initialize WebSocket hub
 	hub := websocket.NewHub()
 
-	// WebSocket endpoint
-	r.HandleFunc("/ws", websocket.HandleConnections(hub))
+	// Load config, receivers are optional
+	if *configPath == "" {
+		*configPath = os.Getenv(config.EnvPath)
+	}
+	if *configPath == "" {
+		*configPath = config.DefaultPath()
+	}
+	cfg, err := config.LoadConfig(*configPath)
+	if os.IsNotExist(err) {
+		log.Printf("No config at %s, running without receivers", *configPath)
+		cfg = &config.Config{}
+	} else if err != nil {
+		log.Fatalf("Failed to load config %s: %v", *configPath, err)
+	}
+	// The config file without the environment is kept for config updates
+	fileCfg := cfg.Clone()
+	if err := cfg.ApplyEnv(); err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+
+	// API keys and OIDC login, see auth.Config
+	authn, err := auth.New(cfg.Auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !authn.Enabled() {
+		log.Printf("No API keys or OIDC configured, the API is open to everyone")
+	}
+	websocket.Upgrader.CheckOrigin = authn.CheckOrigin
+
+	// Initialize log storage
+	logStore, err := storage.NewBackend(cfg.Storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *importJSON != "" {
+		store, ok := logStore.(*sqlite.Store)
+		if !ok {
+			log.Fatal("-import-json requires the sqlite storage type")
+		}
+		stats, err := store.ImportJSON(*importJSON)
+		if err != nil {
+			log.Fatalf("Import failed: %v", err)
+		}
+		fmt.Printf("Imported %d servers, %d sessions, %d chunks\n", stats.Servers, stats.Sessions, stats.Chunks)
+		store.Close()
+		return
+	}
+
+	if *importArchive != "" {
+		data, err := os.ReadFile(*importArchive)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a, err := archive.Read(data)
+		if err != nil {
+			log.Fatalf("Invalid archive: %v", err)
+		}
+		if err := a.Restore(logStore); err != nil {
+			log.Fatalf("Import failed: %v", err)
+		}
+		fmt.Printf("Imported log %s of server %s\n", a.Manifest.LogID, a.Session.Token)
+		return
+	}
+
+	// Reconnecting clients get the chunks they missed from the store
+	hub.Logs = logStore
+
+	// Retention policy
+	retention, err := storage.NewRetention(logStore, cfg.Storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Initialize receivers
+	receivers := receiver.NewManager(logStore, receiver.NewDeadLetterStore("./deadletter"))
+	for _, rc := range cfg.Receivers {
+		if _, err := receivers.AddReceiver(rc.ID, rc.Type, rc.Config); err != nil {
+			log.Printf("Failed to add receiver %s: %v", rc.ID, err)
+		}
+	}
+	delay, _ := cfg.DelayDuration()
+	receivers.SetDelay(delay)
 
 	// Domain service
-	logService := domain.NewLogService(logStore, hub)
+	logService := domain.NewLogService(logStore, hub, receivers)
+	logService.ProxyID = cfg.Proxy.ID
+	if logService.ProxyID == "" {
+		logService.ProxyID, _ = os.Hostname()
+	}
+	logService.MaxHops = cfg.Proxy.MaxHops
+	if logService.MaxHops == 0 {
+		logService.MaxHops = 8
+	}
+	logService.Peers, _ = cfg.ProxyPeers()
+
+	// Keys scoped to some servers see the logs the catalog lists for them
+	auth.LogOwner = logService.LogOwner
+
+	// Full-text search, built from the stored logs in the background
+	logService.Search = search.NewIndex(logStore)
+	go func() {
+		if err := logService.Search.Build(); err != nil {
+			log.Printf("Failed to build search index: %v", err)
+		}
+	}()
+
+	// Prometheus metrics
+	hub.RegisterMetrics(metrics.Default)
+	receivers.RegisterMetrics(metrics.Default)
+	logService.RegisterMetrics(metrics.Default)
 
-	// API endpoints
-	r.HandleFunc("/api/logs", handlers.HandleLogPackage(logService)).Methods("POST")
-	r.HandleFunc("/api/logs/{token}", handlers.HandleGetLog(logStore)).Methods("GET")
-	r.HandleFunc("/api/listlogs", handlers.HandleListLogs(logService)).Methods("GET")
-	r.HandleFunc("/api/config", handlers.HandleConfig).Methods("GET", "POST")
+	retention.OnRemove = logService.LogRemoved
+	retention.Start()
+
+	// Config changes posted to /api/config are applied without a restart
+	configManager := config.NewManager(*configPath, fileCfg, cfg)
+	configManager.OnChange(func(old, c *config.Config) error {
+		delay, _ := c.DelayDuration()
+		receivers.SetDelay(delay)
+		return nil
+	})
+	configManager.OnChange(func(old, c *config.Config) error {
+		if rc, ok := logStore.(storage.Reconfigurable); ok {
+			if err := rc.Reconfigure(c.Storage); err != nil {
+				return err
+			}
+		}
+		return retention.Update(c.Storage)
+	})
+	configManager.OnChange(func(old, c *config.Config) error {
+		return applyReceivers(receivers, old.Receivers, c.Receivers)
+	})
+	configManager.OnChange(func(old, c *config.Config) error {
+		return authn.Update(c.Auth)
+	})
+
+	// API endpoints. Global routes act on all servers and refuse keys
+	// scoped to some servers.
+	viewer := func(h http.HandlerFunc) http.HandlerFunc { return authn.Require(auth.Viewer, false, h) }
+	operator := func(h http.HandlerFunc) http.HandlerFunc { return authn.Require(auth.Operator, false, h) }
+	global := func(role auth.Role, h http.HandlerFunc) http.HandlerFunc { return authn.Require(role, true, h) }
+
+	r.HandleFunc("/auth/login", authn.Login).Methods("GET")
+	r.HandleFunc("/auth/callback", authn.Callback).Methods("GET")
+	r.HandleFunc("/auth/logout", authn.Logout).Methods("POST")
+	r.HandleFunc("/auth/me", authn.Me).Methods("GET")
+	r.HandleFunc("/ws", viewer(websocket.HandleConnections(hub)))
+	r.HandleFunc("/metrics", global(auth.Viewer, metrics.Handler(metrics.Default))).Methods("GET")
+	r.HandleFunc("/api/stream", viewer(handlers.HandleStream(hub))).Methods("GET")
+	r.HandleFunc("/api/logs", authn.Ingest(handlers.HandleLogPackage(logService), func(*http.Request) {
+		logService.RecordIngestError("", domain.IngestUnauthorized)
+	})).Methods("POST")
+	r.HandleFunc("/api/logs/{token}", viewer(handlers.HandleGetLog(logStore))).Methods("GET")
+	r.HandleFunc("/api/logs/import", global(auth.Operator, handlers.HandleImportArchive(logService))).Methods("POST")
+	r.HandleFunc("/api/logs/{token}/archive", viewer(handlers.HandleExportArchive(logStore))).Methods("GET")
+	r.HandleFunc("/api/logs/{token}/protected", operator(handlers.HandleSetProtected(logService))).Methods("PUT", "DELETE")
+	r.HandleFunc("/api/retention", global(auth.Operator, handlers.HandleRetentionReport(retention))).Methods("GET")
+	r.HandleFunc("/api/retention/run", global(auth.Operator, handlers.HandleRunRetention(retention))).Methods("POST")
+	r.HandleFunc("/api/search", viewer(handlers.HandleSearch(logService.Search))).Methods("GET")
+	r.HandleFunc("/api/servers", viewer(handlers.HandleListServers(logService))).Methods("GET")
+	r.HandleFunc("/api/servers/{token}", viewer(handlers.HandleGetServer(logService))).Methods("GET")
+	r.HandleFunc("/api/listlogs", viewer(handlers.HandleListLogs(logService))).Methods("GET")
+	r.HandleFunc("/api/config", global(auth.Admin, handlers.HandleConfig(configManager))).Methods("GET", "POST")
+	r.HandleFunc("/api/receivers", global(auth.Operator, handlers.HandleListReceivers(receivers))).Methods("GET")
+	r.HandleFunc("/api/receivers", global(auth.Operator, handlers.HandleAddReceiver(receivers))).Methods("POST")
+	r.HandleFunc("/api/receivers/{id}", global(auth.Operator, handlers.HandleGetReceiver(receivers))).Methods("GET")
+	r.HandleFunc("/api/receivers/{id}", global(auth.Operator, handlers.HandleRemoveReceiver(receivers))).Methods("DELETE")
+	r.HandleFunc("/api/receivers/{id}/backfill", global(auth.Operator, handlers.HandleGetBackfill(receivers))).Methods("GET")
+	r.HandleFunc("/api/receivers/{id}/backfill", global(auth.Operator, handlers.HandleStartBackfill(receivers))).Methods("POST")
+	r.HandleFunc("/api/receivers/{id}/deadletters", global(auth.Operator, handlers.HandleListDeadLetters(receivers))).Methods("GET")
+	r.HandleFunc("/api/receivers/{id}/deadletters", global(auth.Operator, handlers.HandlePurgeDeadLetters(receivers))).Methods("DELETE")
+	r.HandleFunc("/api/receivers/{id}/deadletters/retry", global(auth.Operator, handlers.HandleRetryDeadLetters(receivers))).Methods("POST")
 
 	// Static files for the web UI
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("./web")))
 
 	// Start server
-	fmt.Println("Starting CS2 Log Manager on :8081")
-	if err := http.ListenAndServe(":8081", r); err != nil {
+	port := cfg.Server.Port
+	if port == 0 {
+		port = 8081
+	}
+	fmt.Printf("Starting CS2 Log Manager on :%d\n", port)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), r); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// applyReceivers adds, replaces and removes the receivers that changed
+// between two configs. Receivers added through /api/receivers are left
+// alone. The config manager has validated the changed receivers.
+func applyReceivers(receivers *receiver.Manager, old, next []config.ReceiverConfig) error {
+	previous := make(map[string]config.ReceiverConfig)
+	for _, rc := range old {
+		previous[rc.ID] = rc
+	}
+	var changed []config.ReceiverConfig
+	for _, rc := range next {
+		if prev, ok := previous[rc.ID]; ok && reflect.DeepEqual(prev, rc) {
+			delete(previous, rc.ID)
+			continue
+		}
+		delete(previous, rc.ID)
+		changed = append(changed, rc)
+	}
+	for id := range previous {
+		receivers.RemoveReceiver(id)
+	}
+	for _, rc := range changed {
+		if _, err := receivers.AddReceiver(rc.ID, rc.Type, rc.Config); err != nil {
+			return fmt.Errorf("receiver %s: %w", rc.ID, err)
+		}
+	}
+	return nil
+}
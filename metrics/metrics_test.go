@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := &Registry{}
+	idle := &Counter{desc: desc{"test_idle_total", "Never incremented.", nil}, values: make(map[string]*counterValue)}
+	requests := &Counter{desc: desc{"test_requests_total", "Requests by path\nand code.", []string{"path", "code"}}, values: make(map[string]*counterValue)}
+	latency := &Histogram{desc: desc{"test_latency_seconds", `Latency with a \ in the help.`, []string{"op"}}, buckets: []float64{.1, 1}, values: make(map[string]*histogramValue)}
+	r.register(idle)
+	r.register(requests)
+	r.register(latency)
+	r.NewGaugeFunc("test_temperature", "A gauge.", []string{"room"}, func() []Sample {
+		return []Sample{{Labels: []string{"b"}, Value: math.Inf(1)}, {Labels: []string{"a"}, Value: 21.5}}
+	})
+
+	requests.Inc("/api", "200")
+	requests.Add(2, "/api", "200")
+	requests.Inc(`/say "hi"`+"\n", "404")
+	latency.Observe(.05, "append")
+	latency.Observe(.5, "append")
+	latency.Observe(3, "append")
+
+	const want = `# HELP test_idle_total Never incremented.
+# TYPE test_idle_total counter
+test_idle_total 0
+# HELP test_requests_total Requests by path\nand code.
+# TYPE test_requests_total counter
+test_requests_total{path="/api",code="200"} 3
+test_requests_total{path="/say \"hi\"\n",code="404"} 1
+# HELP test_latency_seconds Latency with a \\ in the help.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{op="append",le="0.1"} 1
+test_latency_seconds_bucket{op="append",le="1"} 2
+test_latency_seconds_bucket{op="append",le="+Inf"} 3
+test_latency_seconds_sum{op="append"} 3.55
+test_latency_seconds_count{op="append"} 3
+# HELP test_temperature A gauge.
+# TYPE test_temperature gauge
+test_temperature{room="a"} 21.5
+test_temperature{room="b"} +Inf
+`
+	var b strings.Builder
+	r.WriteText(&b)
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+func TestDuplicateMetric(t *testing.T) {
+	r := &Registry{}
+	r.NewGaugeFunc("test_gauge", "A gauge.", nil, func() []Sample { return nil })
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a metric twice didn't panic")
+		}
+	}()
+	r.NewGaugeFunc("test_gauge", "Again.", nil, func() []Sample { return nil })
+}
@@ -0,0 +1,102 @@
+package parser
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Event types recognised in CS2 log lines
+const (
+	EventMatchStart = "match_start"
+	EventMatchEnd   = "match_end"
+	EventRoundStart = "round_start"
+	EventRoundEnd   = "round_end"
+	EventTeamScored = "team_scored"
+)
+
+// Event is a single game event parsed from a log line
+type Event struct {
+	Type string            `json:"type"`
+	Time string            `json:"time"` // timestamp of the log line
+	Line string            `json:"line"`
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// lineRe splits a log line into timestamp and message. HTTP logs use
+// "01/30/2025 - 16:33:56.470 - msg", classic UDP logs "L 01/30/2025 - 16:33:56: msg".
+var lineRe = regexp.MustCompile(`^(?:L )?(\d{2}/\d{2}/\d{4} - \d{2}:\d{2}:\d{2}(?:\.\d+)?)(?: -|:) (.*)$`)
+
+var (
+	matchStartRe = regexp.MustCompile(`^World triggered "Match_Start" on "([^"]*)"`)
+	gameOverRe   = regexp.MustCompile(`^Game Over: (\S+) (\S+) (\S+) score (\d+):(\d+) after (\d+) min`)
+	teamScoredRe = regexp.MustCompile(`^Team "([^"]*)" scored "(\d+)" with "(\d+)" players`)
+)
+
+// SplitLine returns the timestamp and message of a log line
+func SplitLine(line string) (timestamp, message string, ok bool) {
+	m := lineRe.FindStringSubmatch(strings.TrimRight(line, "\r\n"))
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+// ParseLine recognises match and round events. Lines that don't carry one
+// of the known events return false.
+func ParseLine(line string) (Event, bool) {
+	ts, msg, ok := SplitLine(line)
+	if !ok {
+		return Event{}, false
+	}
+	ev := Event{Time: ts, Line: line}
+	switch {
+	case matchStartRe.MatchString(msg):
+		m := matchStartRe.FindStringSubmatch(msg)
+		ev.Type = EventMatchStart
+		ev.Data = map[string]string{"map": m[1]}
+	case gameOverRe.MatchString(msg):
+		m := gameOverRe.FindStringSubmatch(msg)
+		ev.Type = EventMatchEnd
+		ev.Data = map[string]string{
+			"mode":     m[1],
+			"map":      m[3],
+			"score_ct": m[4],
+			"score_t":  m[5],
+			"minutes":  m[6],
+		}
+	case strings.HasPrefix(msg, `World triggered "Round_Start"`):
+		ev.Type = EventRoundStart
+	case strings.HasPrefix(msg, `World triggered "Round_End"`):
+		ev.Type = EventRoundEnd
+	case teamScoredRe.MatchString(msg):
+		m := teamScoredRe.FindStringSubmatch(msg)
+		ev.Type = EventTeamScored
+		ev.Data = map[string]string{"team": m[1], "score": m[2], "players": m[3]}
+	default:
+		return Event{}, false
+	}
+	return ev, true
+}
+
+// Player is a player reference in a log line: "Name<userid><steamid><team>"
+type Player struct {
+	Name    string `json:"name"`
+	UserID  string `json:"user_id"`
+	SteamID string `json:"steam_id"`
+	Team    string `json:"team"`
+}
+
+var playerRe = regexp.MustCompile(`"([^"]*?)<(\d+)><([^>]*)><([^>]*)>"`)
+
+// Players returns the players referenced in a log line, skipping bots
+// and the console
+func Players(line string) []Player {
+	var players []Player
+	for _, m := range playerRe.FindAllStringSubmatch(line, -1) {
+		if m[3] == "BOT" || m[3] == "Console" || m[3] == "" {
+			continue
+		}
+		players = append(players, Player{Name: m[1], UserID: m[2], SteamID: m[3], Team: m[4]})
+	}
+	return players
+}
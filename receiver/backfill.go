@@ -0,0 +1,323 @@
+package receiver
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"cs2-log-proxy/storage"
+)
+
+// Backfill modes
+const (
+	BackfillAll   = "all"
+	BackfillSince = "since"
+	BackfillLogs  = "logs"
+)
+
+// defaultBackfillRate is the delivery rate in bytes per second used when a
+// request doesn't set one
+const defaultBackfillRate = 1 << 20
+
+// maxPendingChunks bounds the live chunks held back during a backfill
+const maxPendingChunks = 100000
+
+// timestampLayout is the layout of CS2 X-Timestamp headers
+const timestampLayout = "01/02/2006 - 15:04:05.000"
+
+var ErrBackfillRunning = errors.New("backfill already running")
+
+// LogSource is the part of the LogStore backfills read from
+type LogSource interface {
+	ListServers() ([]string, error)
+	LoadServerMeta(token string) (*storage.ServerMeta, error)
+	LoadChunkMetas(logID string) ([]storage.ChunkMeta, error)
+	GetLog(logID string) (string, error)
+}
+
+// BackfillRequest selects the stored logs a receiver should be sent
+type BackfillRequest struct {
+	Mode      string     `json:"mode"`                 // "all", "since" or "logs"
+	Since     *time.Time `json:"since,omitempty"`      // for "since": logs started at or after
+	LogIDs    []string   `json:"log_ids,omitempty"`    // for "logs"
+	RateLimit int        `json:"rate_limit,omitempty"` // bytes per second
+}
+
+// BackfillProgress reports the state of a receiver's backfill
+type BackfillProgress struct {
+	State      string          `json:"state"` // "running", "done", "failed" or "canceled"
+	Request    BackfillRequest `json:"request"`
+	LogsTotal  int             `json:"logs_total"`
+	LogsDone   int             `json:"logs_done"`
+	BytesTotal int64           `json:"bytes_total"`
+	BytesDone  int64           `json:"bytes_done"`
+	CurrentLog string          `json:"current_log,omitempty"`
+	StartedAt  time.Time       `json:"started_at"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// Validate checks the mode and options of a request
+func (req BackfillRequest) Validate() error {
+	switch req.Mode {
+	case BackfillAll:
+	case BackfillSince:
+		if req.Since == nil {
+			return errors.New("backfill mode since requires a date")
+		}
+	case BackfillLogs:
+		if len(req.LogIDs) == 0 {
+			return errors.New("backfill mode logs requires log_ids")
+		}
+	default:
+		return fmt.Errorf("unknown backfill mode %q", req.Mode)
+	}
+	if req.RateLimit < 0 {
+		return errors.New("rate_limit must be positive")
+	}
+	return nil
+}
+
+// selectLogs returns the stored logs matching the request, oldest first
+func (req BackfillRequest) selectLogs(source LogSource) ([]Chunk, error) {
+	tokens, err := source.ListServers()
+	if err != nil {
+		return nil, err
+	}
+	wanted := make(map[string]bool)
+	for _, id := range req.LogIDs {
+		wanted[storage.CanonicalLogID(id)] = true
+	}
+	type selected struct {
+		chunk Chunk
+		start time.Time
+	}
+	var found []selected
+	for _, token := range tokens {
+		meta, err := source.LoadServerMeta(token)
+		if err != nil {
+			return nil, err
+		}
+		for _, lm := range meta.Logs {
+			start, _ := time.Parse(timestampLayout, lm.LogStartTime)
+			switch req.Mode {
+			case BackfillSince:
+				if start.Before(*req.Since) {
+					continue
+				}
+			case BackfillLogs:
+				if !wanted[lm.LogID] {
+					continue
+				}
+			}
+			found = append(found, selected{
+				chunk: Chunk{
+					LogID:      lm.LogID,
+					Token:      token,
+					GameMap:    lm.GameMap,
+					SteamID:    meta.SteamID,
+					ServerAddr: lm.ServerAddr,
+				},
+				start: start,
+			})
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		return found[i].start.Before(found[j].start)
+	})
+	logs := make([]Chunk, len(found))
+	for i, f := range found {
+		logs[i] = f.chunk
+	}
+	return logs, nil
+}
+
+// backfillJob is run by the receiver's worker so that stored and live
+// chunks are delivered through one ordered pipeline
+type backfillJob struct {
+	req      BackfillRequest
+	progress BackfillProgress
+}
+
+// newBackfillJob checks a request and creates its job
+func (m *Manager) newBackfillJob(req BackfillRequest) (*backfillJob, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if m.source == nil {
+		return nil, errors.New("no log source configured for backfills")
+	}
+	if req.RateLimit == 0 {
+		req.RateLimit = defaultBackfillRate
+	}
+	return &backfillJob{
+		req: req,
+		progress: BackfillProgress{
+			State:     "running",
+			Request:   req,
+			StartedAt: time.Now(),
+		},
+	}, nil
+}
+
+// Backfill queues a backfill of stored logs. Live chunks that arrive while
+// it runs are held back and delivered afterwards, skipping everything the
+// backfill already covered, so the receiver sees no duplicates. Logs the
+// receiver already got live chunks of are only sent from where those
+// began; use AddReceiverWithBackfill for a receiver that gets every log
+// from its start.
+func (m *Manager) Backfill(id string, req BackfillRequest) error {
+	job, err := m.newBackfillJob(req)
+	if err != nil {
+		return err
+	}
+	receiver, exists := m.GetReceiver(id)
+	if !exists {
+		return fmt.Errorf("receiver %s not found", id)
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	select {
+	case <-receiver.quit:
+		return fmt.Errorf("receiver %s not found", id)
+	default:
+	}
+	if receiver.backfill != nil && receiver.backfill.progress.State == "running" {
+		return ErrBackfillRunning
+	}
+	select {
+	case receiver.queue <- queueItem{job: job}:
+	default:
+		return errors.New("receiver queue full")
+	}
+	receiver.backfill = job
+	receiver.backfilling = true
+	return nil
+}
+
+// BackfillProgress returns the progress of the receiver's latest backfill
+func (r *Receiver) BackfillProgress() (BackfillProgress, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.backfill == nil {
+		return BackfillProgress{}, false
+	}
+	return r.backfill.progress, true
+}
+
+func (r *Receiver) updateBackfill(update func(p *BackfillProgress)) {
+	r.mu.Lock()
+	update(&r.backfill.progress)
+	r.mu.Unlock()
+}
+
+// runBackfill delivers the selected stored logs and then the live chunks
+// held back meanwhile. It runs on the worker goroutine.
+func (r *Receiver) runBackfill(source LogSource, job *backfillJob) {
+	err := r.backfillLogs(source, job)
+	r.drainPending()
+
+	now := time.Now()
+	r.updateBackfill(func(p *BackfillProgress) {
+		p.FinishedAt = &now
+		p.CurrentLog = ""
+		switch {
+		case errors.Is(err, errStopped):
+			p.State = "canceled"
+		case err != nil:
+			p.State = "failed"
+			p.Error = err.Error()
+		default:
+			p.State = "done"
+		}
+	})
+}
+
+var errStopped = errors.New("receiver stopped")
+
+func (r *Receiver) backfillLogs(source LogSource, job *backfillJob) error {
+	logs, err := job.req.selectLogs(source)
+	if err != nil {
+		return err
+	}
+	metas := make([][]storage.ChunkMeta, len(logs))
+	var total int64
+	for i, l := range logs {
+		if metas[i], err = source.LoadChunkMetas(l.LogID); err != nil {
+			return err
+		}
+		for _, m := range metas[i] {
+			total += int64(m.EndOffset - m.BeginOffset)
+		}
+	}
+	r.updateBackfill(func(p *BackfillProgress) {
+		p.LogsTotal = len(logs)
+		p.BytesTotal = total
+	})
+
+	started := time.Now()
+	var sent int64
+	for i, l := range logs {
+		r.updateBackfill(func(p *BackfillProgress) { p.CurrentLog = l.LogID })
+		data, err := source.GetLog(l.LogID)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", l.LogID, err)
+		}
+		// The log file is the concatenation of its chunks
+		pos := 0
+		for j, m := range metas[i] {
+			size := m.EndOffset - m.BeginOffset
+			if size < 0 || pos+size > len(data) {
+				return fmt.Errorf("chunk index of %s doesn't match log file", l.LogID)
+			}
+			chunk := l
+			chunk.Data = data[pos : pos+size]
+			chunk.Meta = m
+			chunk.NewLog = j == 0
+			pos += size
+
+			if err := r.deliver(chunk); err != nil {
+				return err
+			}
+			sent += int64(size)
+			r.updateBackfill(func(p *BackfillProgress) { p.BytesDone = sent })
+
+			// Sleep until we are back under the rate limit
+			ahead := time.Duration(float64(sent)/float64(job.req.RateLimit)*float64(time.Second)) - time.Since(started)
+			if ahead > 0 {
+				select {
+				case <-time.After(ahead):
+				case <-r.quit:
+				}
+			}
+			select {
+			case <-r.quit:
+				return errStopped
+			default:
+			}
+		}
+		r.updateBackfill(func(p *BackfillProgress) { p.LogsDone++ })
+	}
+	return nil
+}
+
+// drainPending delivers the live chunks held back during a backfill and
+// switches the receiver back to live forwarding once none are left
+func (r *Receiver) drainPending() {
+	for {
+		r.mu.Lock()
+		pending := r.pending
+		r.pending = nil
+		if len(pending) == 0 {
+			r.backfilling = false
+			r.mu.Unlock()
+			return
+		}
+		r.mu.Unlock()
+		for _, chunk := range pending {
+			r.deliver(chunk)
+		}
+	}
+}
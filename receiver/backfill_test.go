@@ -0,0 +1,179 @@
+package receiver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cs2-log-proxy/storage"
+)
+
+// recordSink keeps what it was given, slowly enough for live chunks to
+// arrive during a backfill
+type recordSink struct {
+	mu     sync.Mutex
+	chunks []Chunk
+	delay  time.Duration
+	fail   func(chunk Chunk) error
+}
+
+func (s *recordSink) Deliver(ctx context.Context, chunk Chunk) error {
+	time.Sleep(s.delay)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail != nil {
+		if err := s.fail(chunk); err != nil {
+			return err
+		}
+	}
+	s.chunks = append(s.chunks, chunk)
+	return nil
+}
+
+func (s *recordSink) Close() error { return nil }
+
+// data returns the data the sink got per log, checking that every chunk
+// continues the one before it
+func (s *recordSink) data(t *testing.T) map[string]string {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]string)
+	for _, c := range s.chunks {
+		if c.Meta.BeginOffset != len(out[c.LogID]) {
+			t.Fatalf("%s: chunk [%d-%d] after %d bytes", c.LogID, c.Meta.BeginOffset, c.Meta.EndOffset, len(out[c.LogID]))
+		}
+		out[c.LogID] += c.Data
+	}
+	return out
+}
+
+// newTestManager returns a manager whose receivers of type "record"
+// deliver to sink
+func newTestManager(t *testing.T, source LogSource, sink *recordSink) *Manager {
+	t.Helper()
+	sinkFactories["record"] = func(map[string]interface{}) (Sink, error) { return sink, nil }
+	t.Cleanup(func() { delete(sinkFactories, "record") })
+	m := NewManager(source, NewDeadLetterStore(t.TempDir()))
+	t.Cleanup(m.Close)
+	return m
+}
+
+// testLog stores chunks of a log and forwards them like the LogService
+type testLog struct {
+	store *storage.LogStore
+	token string
+	logID string
+	end   int
+}
+
+func (l *testLog) ingest(t *testing.T, m *Manager, data string) {
+	t.Helper()
+	meta := storage.ChunkMeta{BeginOffset: l.end, EndOffset: l.end + len(data)}
+	if err := l.store.AppendChunk(l.logID, data, meta); err != nil {
+		t.Fatal(err)
+	}
+	newLog := l.end == 0
+	l.end = meta.EndOffset
+	err := storage.UpdateServerMeta(l.store, l.token, func(sm *storage.ServerMeta) error {
+		sm.ServerInstanceToken = l.token
+		for i := range sm.Logs {
+			if sm.Logs[i].LogID == l.logID {
+				sm.Logs[i].LastByteOffset = l.end
+				return nil
+			}
+		}
+		sm.Logs = append(sm.Logs, storage.LogMeta{LogID: l.logID, LogStartTime: "01/30/2025 - 16:00:00.000", LastByteOffset: l.end})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != nil {
+		m.Forward(Chunk{LogID: l.logID, Token: l.token, Data: data, Meta: meta, NewLog: newLog})
+	}
+}
+
+// waitFor polls cond until it holds or a few seconds passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBackfillWithLiveChunks(t *testing.T) {
+	store := storage.NewLogStore(t.TempDir())
+	sink := &recordSink{delay: time.Millisecond}
+	m := newTestManager(t, store, sink)
+	l := &testLog{store: store, token: "srv", logID: "srv_2025-01-30T16-00-00.000"}
+	for i := 0; i < 50; i++ {
+		l.ingest(t, nil, fmt.Sprintf("L stored %d\n", i))
+	}
+
+	rec, err := m.AddReceiverWithBackfill("r1", "record", map[string]interface{}{}, BackfillRequest{Mode: BackfillAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Live chunks keep arriving while the backfill runs
+	for i := 0; i < 50; i++ {
+		l.ingest(t, m, fmt.Sprintf("L live %d\n", i))
+	}
+	want, err := store.GetLog(l.logID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the backfill", func() bool {
+		p, _ := rec.BackfillProgress()
+		sink.mu.Lock()
+		defer sink.mu.Unlock()
+		n := 0
+		for _, c := range sink.chunks {
+			n += len(c.Data)
+		}
+		return p.State == "done" && n >= len(want)
+	})
+	if got := sink.data(t)[l.logID]; got != want {
+		t.Errorf("receiver got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBackfillRequestValidate(t *testing.T) {
+	since := time.Now()
+	tests := []struct {
+		req     BackfillRequest
+		wantErr string
+	}{
+		{BackfillRequest{Mode: BackfillAll}, ""},
+		{BackfillRequest{Mode: BackfillSince, Since: &since}, ""},
+		{BackfillRequest{Mode: BackfillSince}, "requires a date"},
+		{BackfillRequest{Mode: BackfillLogs}, "requires log_ids"},
+		{BackfillRequest{Mode: "some"}, "unknown backfill mode"},
+		{BackfillRequest{Mode: BackfillAll, RateLimit: -1}, "rate_limit"},
+	}
+	for _, tt := range tests {
+		err := tt.req.Validate()
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%+v: err = %v, want %q", tt.req, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAddReceiverWithInvalidBackfill(t *testing.T) {
+	store := storage.NewLogStore(t.TempDir())
+	m := newTestManager(t, store, &recordSink{})
+	if _, err := m.AddReceiverWithBackfill("r1", "record", map[string]interface{}{}, BackfillRequest{Mode: BackfillLogs}); err == nil {
+		t.Fatal("invalid backfill accepted")
+	}
+	if _, ok := m.GetReceiver("r1"); ok {
+		t.Error("receiver added despite the invalid backfill")
+	}
+}
@@ -0,0 +1,54 @@
+package receiver
+
+import "time"
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// breaker stops deliveries to a receiver that keeps failing. After
+// threshold consecutive failures it opens; once cooldown has passed one
+// probe delivery is let through (half open), which either closes the
+// breaker again or reopens it. Only the receiver's worker uses it.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+}
+
+func newBreaker(config map[string]interface{}) *breaker {
+	return &breaker{
+		threshold: intOpt(config, "breaker_threshold", 5),
+		cooldown:  durationOpt(config, "breaker_cooldown", 30*time.Second),
+		state:     BreakerClosed,
+	}
+}
+
+// allow reports whether a delivery may be attempted
+func (b *breaker) allow(now time.Time) bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= b.cooldown {
+		b.state = BreakerHalfOpen
+	}
+	return b.state != BreakerOpen
+}
+
+func (b *breaker) success() {
+	b.state = BreakerClosed
+	b.failures = 0
+}
+
+func (b *breaker) failure(now time.Time) {
+	b.failures++
+	if b.threshold > 0 && (b.state == BreakerHalfOpen || b.failures >= b.threshold) {
+		b.state = BreakerOpen
+		b.openedAt = now
+	}
+}
@@ -0,0 +1,119 @@
+package receiver
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cs2-log-proxy/storage"
+)
+
+// DeadLetter is a chunk a receiver gave up on, either after exhausting its
+// retries or because its circuit breaker was open. Chunk is stored as it
+// was handed to the sink, i.e. after transforms.
+type DeadLetter struct {
+	ID       string    `json:"id"`
+	Receiver string    `json:"receiver"`
+	Chunk    Chunk     `json:"chunk"`
+	Error    string    `json:"error"`
+	Attempts int       `json:"attempts"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+// DeadLetterStore keeps dead letters as one JSON file per entry in
+// {dir}/{receiver id}/{dead letter id}.json
+type DeadLetterStore struct {
+	Dir string
+	mu  sync.Mutex
+	seq uint64
+}
+
+func NewDeadLetterStore(dir string) *DeadLetterStore {
+	return &DeadLetterStore{Dir: dir}
+}
+
+func (s *DeadLetterStore) receiverDir(receiverID string) string {
+	return filepath.Join(s.Dir, storage.SafeName(receiverID))
+}
+
+// Add stores a new dead letter and assigns its ID
+func (s *DeadLetterStore) Add(dl *DeadLetter) error {
+	// IDs sort in the order the chunks failed
+	dl.ID = fmt.Sprintf("%019d-%04d", dl.FailedAt.UnixNano(), atomic.AddUint64(&s.seq, 1)%10000)
+	return s.Save(dl)
+}
+
+// Save writes a dead letter, replacing an existing entry with the same ID
+func (s *DeadLetterStore) Save(dl *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir := s.receiverDir(dl.Receiver)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, dl.ID+".json"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dl)
+}
+
+// Get loads a single dead letter
+func (s *DeadLetterStore) Get(receiverID, id string) (*DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(filepath.Join(s.receiverDir(receiverID), filepath.Base(id)+".json"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var dl DeadLetter
+	if err := json.NewDecoder(f).Decode(&dl); err != nil {
+		return nil, err
+	}
+	return &dl, nil
+}
+
+// List returns the IDs of a receiver's dead letters, oldest first
+func (s *DeadLetterStore) List(receiverID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries, err := os.ReadDir(s.receiverDir(receiverID))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, e := range entries {
+		if name := e.Name(); strings.HasSuffix(name, ".json") {
+			ids = append(ids, strings.TrimSuffix(name, ".json"))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Delete removes a dead letter
+func (s *DeadLetterStore) Delete(receiverID, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return os.Remove(filepath.Join(s.receiverDir(receiverID), filepath.Base(id)+".json"))
+}
+
+// Purge removes all dead letters of a receiver
+func (s *DeadLetterStore) Purge(receiverID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return os.RemoveAll(s.receiverDir(receiverID))
+}
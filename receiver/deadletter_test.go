@@ -0,0 +1,161 @@
+package receiver
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"cs2-log-proxy/storage"
+)
+
+// orderedRecordSink is a recordSink that needs the chunks of a log in order
+type orderedRecordSink struct {
+	*recordSink
+}
+
+func (orderedRecordSink) ordered() {}
+
+// failingSink returns a recordSink and a function setting which chunks it
+// fails
+func failingSink() (*recordSink, func(fails func(Chunk) bool)) {
+	sink := &recordSink{}
+	fails := func(Chunk) bool { return false }
+	sink.fail = func(c Chunk) error {
+		if fails(c) {
+			return errors.New("unavailable")
+		}
+		return nil
+	}
+	// sink.mu is held while Deliver calls fail
+	return sink, func(f func(Chunk) bool) {
+		sink.mu.Lock()
+		fails = f
+		sink.mu.Unlock()
+	}
+}
+
+// newDeadLetterReceiver adds a receiver delivering to sink once, without
+// retries or a circuit breaker
+func newDeadLetterReceiver(t *testing.T, sink *recordSink, ordered bool) *Manager {
+	t.Helper()
+	m := newTestManager(t, storage.NewLogStore(t.TempDir()), sink)
+	if ordered {
+		sinkFactories["record"] = func(map[string]interface{}) (Sink, error) { return orderedRecordSink{sink}, nil }
+	}
+	if _, err := m.AddReceiver("r1", "record", map[string]interface{}{"delivery_retries": 0, "breaker_threshold": 0}); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// forwardChunks forwards a log of the given chunks
+func forwardChunks(m *Manager, logID string, data ...string) {
+	end := 0
+	for _, d := range data {
+		m.Forward(Chunk{LogID: logID, Token: "srv", Data: d, Meta: storage.ChunkMeta{BeginOffset: end, EndOffset: end + len(d)}, NewLog: end == 0})
+		end += len(d)
+	}
+}
+
+// begins returns the begin offsets of the chunks the sink got
+func begins(sink *recordSink) []int {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	var offsets []int
+	for _, c := range sink.chunks {
+		offsets = append(offsets, c.Meta.BeginOffset)
+	}
+	return offsets
+}
+
+func TestRetryDeadLetters(t *testing.T) {
+	const logID = "srv_2025-01-30T16-00-00.000"
+	chunks := []string{"L 1\n", "L 2\n", "L 3\n", "L 4\n"}
+	tests := []struct {
+		name    string
+		ordered bool
+		live    []int // chunks delivered before the retry, by begin offset
+		retried []int // chunks delivered by the retry
+	}{
+		// The last chunk goes past the dead letters of the log
+		{"unordered", false, []int{12}, []int{0, 4, 8}},
+		// The last chunk is held back behind them
+		{"ordered", true, nil, []int{0, 4, 8, 12}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink, setFails := failingSink()
+			m := newDeadLetterReceiver(t, sink, tt.ordered)
+			setFails(func(Chunk) bool { return true })
+			forwardChunks(m, logID, chunks[:3]...)
+			waitFor(t, "the dead letters", func() bool {
+				letters, _ := m.DeadLetters("r1")
+				return len(letters) == 3
+			})
+			setFails(func(Chunk) bool { return false })
+			m.Forward(Chunk{LogID: logID, Token: "srv", Data: chunks[3], Meta: storage.ChunkMeta{BeginOffset: 12, EndOffset: 16}})
+			waitFor(t, "the last chunk", func() bool {
+				letters, _ := m.DeadLetters("r1")
+				return len(letters)+len(begins(sink)) == 4
+			})
+			if got := begins(sink); !reflect.DeepEqual(got, tt.live) {
+				t.Fatalf("delivered %v before the retry, want %v", got, tt.live)
+			}
+
+			// Dead letters are retried in offset order, whatever order they are given in
+			letters, err := m.DeadLetters("r1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for i := len(letters) - 1; i >= 0; i-- {
+				ids = append(ids, letters[i].ID)
+			}
+			if err := m.RetryDeadLetters("r1", ids); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "the retry", func() bool {
+				letters, _ := m.DeadLetters("r1")
+				return len(letters) == 0
+			})
+			if got, want := begins(sink), append(tt.live, tt.retried...); !reflect.DeepEqual(got, want) {
+				t.Errorf("delivered %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRetryDeadLettersStopsAtFailure(t *testing.T) {
+	const logID = "srv_2025-01-30T16-00-00.000"
+	sink, setFails := failingSink()
+	m := newDeadLetterReceiver(t, sink, true)
+	setFails(func(Chunk) bool { return true })
+	forwardChunks(m, logID, "L 1\n", "L 2\n", "L 3\n")
+	waitFor(t, "the dead letters", func() bool {
+		letters, _ := m.DeadLetters("r1")
+		return len(letters) == 3
+	})
+
+	// The second chunk still fails, the third must not overtake it
+	setFails(func(c Chunk) bool { return c.Meta.BeginOffset == 4 })
+	if err := m.RetryDeadLetters("r1", nil); err != nil {
+		t.Fatal(err)
+	}
+	// The chunks held back behind the first were never attempted
+	wantAttempts := map[int]int{4: 1, 8: 0}
+	waitFor(t, "the retry", func() bool {
+		letters, _ := m.DeadLetters("r1")
+		if len(letters) != 2 {
+			return false
+		}
+		for _, dl := range letters {
+			if dl.Attempts != wantAttempts[dl.Chunk.Meta.BeginOffset] {
+				return false
+			}
+		}
+		return true
+	})
+	if got := begins(sink); !reflect.DeepEqual(got, []int{0}) {
+		t.Errorf("delivered %v, want [0]", got)
+	}
+}
@@ -0,0 +1,85 @@
+package receiver
+
+import (
+	"log"
+	"time"
+)
+
+// maxDelayedChunks is the number of chunks held back by the forwarding
+// delay before new chunks get dropped
+const maxDelayedChunks = 100000
+
+type delayedChunk struct {
+	chunk   Chunk
+	arrived time.Time
+}
+
+// SetDelay holds chunks back for d after they were stored before they are
+// forwarded, e.g. to delay broadcasts of a match. Chunks already waiting
+// are released according to the new delay.
+func (m *Manager) SetDelay(d time.Duration) {
+	m.delayMu.Lock()
+	m.delay = d
+	m.delayMu.Unlock()
+	m.wakeDelayed()
+}
+
+// Delay returns the forwarding delay
+func (m *Manager) Delay() time.Duration {
+	m.delayMu.Lock()
+	defer m.delayMu.Unlock()
+	return m.delay
+}
+
+// delayChunk queues a chunk for releaseDelayed if a delay is set or
+// chunks are still waiting, so chunks keep their order
+func (m *Manager) delayChunk(chunk Chunk) bool {
+	m.delayMu.Lock()
+	defer m.delayMu.Unlock()
+	if m.delay <= 0 && len(m.delayed) == 0 {
+		return false
+	}
+	if len(m.delayed) >= maxDelayedChunks {
+		log.Printf("Forwarding delay backlog full, dropping chunk %s [%d-%d]",
+			chunk.LogID, chunk.Meta.BeginOffset, chunk.Meta.EndOffset)
+		return true
+	}
+	m.delayed = append(m.delayed, delayedChunk{chunk: chunk, arrived: time.Now()})
+	if len(m.delayed) == 1 {
+		m.wakeDelayed()
+	}
+	return true
+}
+
+func (m *Manager) wakeDelayed() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// releaseDelayed forwards delayed chunks once their delay is over
+func (m *Manager) releaseDelayed() {
+	for {
+		var timeout <-chan time.Time
+		m.delayMu.Lock()
+		for len(m.delayed) > 0 {
+			if wait := time.Until(m.delayed[0].arrived.Add(m.delay)); wait > 0 {
+				timeout = time.After(wait)
+				break
+			}
+			// Forwarded under delayMu so a new chunk can't overtake it
+			m.forward(m.delayed[0].chunk)
+			m.delayed[0] = delayedChunk{}
+			m.delayed = m.delayed[1:]
+		}
+		m.delayMu.Unlock()
+
+		select {
+		case <-m.wake:
+		case <-timeout:
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
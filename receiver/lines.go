@@ -0,0 +1,37 @@
+package receiver
+
+import "strings"
+
+// lineBuffer reassembles complete lines per session. Chunks don't
+// necessarily end on a line boundary, so the trailing partial line of
+// every session is kept until the rest of it arrives.
+type lineBuffer map[string]string // logID -> incomplete trailing line
+
+// lines returns the complete lines in data, without line terminators
+func (b lineBuffer) lines(logID, data string) []string {
+	lines, rest := b.split(logID, data)
+	b.keep(logID, rest)
+	return lines
+}
+
+// split is lines without updating the buffer. Sinks that may fail call
+// keep with the returned rest only once the lines were delivered, so a
+// retried chunk is split the same way again.
+func (b lineBuffer) split(logID, data string) ([]string, string) {
+	parts := strings.Split(b[logID]+data, "\n")
+	// Last element is either "" (data ended with a newline) or an incomplete line
+	lines := parts[:len(parts)-1]
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, "\r")
+	}
+	return lines, parts[len(parts)-1]
+}
+
+// keep stores the incomplete trailing line of a session
+func (b lineBuffer) keep(logID, rest string) {
+	if rest != "" {
+		b[logID] = rest
+	} else {
+		delete(b, logID)
+	}
+}
@@ -2,10 +2,24 @@ package receiver
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+// queueSize is the number of chunks buffered per receiver before new
+// chunks get dropped
+const queueSize = 1024
+
+// tickInterval is how often sinks implementing Ticker are ticked
+const tickInterval = time.Second
+
 type Receiver struct {
 	ID        string
 	Type      string
@@ -14,22 +28,122 @@ type Receiver struct {
 	LastError error
 	LastSeen  time.Time
 	mu        sync.Mutex
+
+	sink      Sink
+	transform *transformer
+	breaker   *breaker // guarded by mu
+	queue     chan queueItem
+	quit      chan struct{}
+	done      chan struct{}
+
+	// Only used by the worker: ctx, cursor (the end offset delivered per
+	// log) and the retry policy
+	ctx          context.Context
+	cursor       map[string]cursorEntry
+	cursorPruned time.Time
+	retries      int
+	retryBackoff time.Duration
+	deadLetters  *DeadLetterStore
+
+	// guarded by mu
+	backfill    *backfillJob
+	backfilling bool
+	pending     []Chunk
+	held        map[string]bool // logs with dead letters, for ordered sinks
+}
+
+// queueItem is either a live chunk, a backfill job or a request to retry
+// dead letters
+type queueItem struct {
+	chunk *Chunk
+	job   *backfillJob
+	retry []string // dead letter IDs, empty to retry all
+}
+
+// ReceiverInfo is a JSON friendly snapshot of a receiver
+type ReceiverInfo struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Config    map[string]interface{} `json:"config"`
+	Status    string                 `json:"status"`
+	LastError string                 `json:"last_error,omitempty"`
+	LastSeen  time.Time              `json:"last_seen"`
+	Breaker   string                 `json:"breaker"`
+	Backfill  *BackfillProgress      `json:"backfill,omitempty"`
 }
 
 type Manager struct {
-	receivers map[string]*Receiver
-	mu        sync.RWMutex
+	receivers   map[string]*Receiver
+	mu          sync.RWMutex
+	source      LogSource
+	deadLetters *DeadLetterStore
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	// Forwarding delay, see SetDelay
+	delayMu sync.Mutex
+	delay   time.Duration
+	delayed []delayedChunk
+	wake    chan struct{}
 }
 
-func NewManager() *Manager {
-	return &Manager{
-		receivers: make(map[string]*Receiver),
+// NewManager creates a receiver manager. source is used to backfill stored
+// logs, deadLetters keeps chunks receivers failed to deliver. Both may be nil.
+func NewManager(source LogSource, deadLetters *DeadLetterStore) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		receivers:   make(map[string]*Receiver),
+		source:      source,
+		deadLetters: deadLetters,
+		ctx:         ctx,
+		cancel:      cancel,
+		wake:        make(chan struct{}, 1),
 	}
+	go m.releaseDelayed()
+	return m
 }
 
-func (m *Manager) AddReceiver(id, typ string, config map[string]interface{}) *Receiver {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// idRe matches receiver IDs. They name the receiver's dead-letter
+// directory, among others.
+var idRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// ValidateID checks a receiver ID
+func ValidateID(id string) error {
+	if !idRe.MatchString(id) {
+		return fmt.Errorf("invalid receiver id %q: use up to 64 letters, digits, '.', '-' and '_'", id)
+	}
+	return nil
+}
+
+// AddReceiver creates the sink for a receiver and starts its delivery worker.
+// An existing receiver with the same ID is replaced.
+func (m *Manager) AddReceiver(id, typ string, config map[string]interface{}) (*Receiver, error) {
+	return m.addReceiver(id, typ, config, nil)
+}
+
+// AddReceiverWithBackfill adds a receiver that starts with a backfill of
+// stored logs. The job is queued before the receiver is listed, so every
+// live chunk is held back until the backfill caught up.
+func (m *Manager) AddReceiverWithBackfill(id, typ string, config map[string]interface{}, req BackfillRequest) (*Receiver, error) {
+	job, err := m.newBackfillJob(req)
+	if err != nil {
+		return nil, err
+	}
+	return m.addReceiver(id, typ, config, job)
+}
+
+func (m *Manager) addReceiver(id, typ string, config map[string]interface{}, job *backfillJob) (*Receiver, error) {
+	if err := ValidateID(id); err != nil {
+		return nil, err
+	}
+	transform, err := newTransformer(config)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := NewSink(typ, config)
+	if err != nil {
+		return nil, err
+	}
 
 	receiver := &Receiver{
 		ID:        id,
@@ -37,9 +151,60 @@ func (m *Manager) AddReceiver(id, typ string, config map[string]interface{}) *Re
 		Config:    config,
 		Status:    "pending",
 		LastError: nil,
+		sink:      sink,
+		transform: transform,
+		breaker:   newBreaker(config),
+		queue:     make(chan queueItem, queueSize),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+
+		retries:      intOpt(config, "delivery_retries", 2),
+		retryBackoff: durationOpt(config, "delivery_backoff", time.Second),
+		cursor:       make(map[string]cursorEntry),
+		deadLetters:  m.deadLetters,
 	}
+	if job != nil {
+		receiver.queue <- queueItem{job: job}
+		receiver.backfill = job
+		receiver.backfilling = true
+	}
+
+	m.mu.Lock()
+	old := m.receivers[id]
 	m.receivers[id] = receiver
-	return receiver
+	m.mu.Unlock()
+
+	if old != nil {
+		old.stop()
+	}
+	go receiver.run(m.ctx, m.source)
+	return receiver, nil
+}
+
+// ValidateReceiver checks a receiver config by creating its sink and
+// transforms without starting it
+func ValidateReceiver(typ string, config map[string]interface{}) error {
+	if _, err := newTransformer(config); err != nil {
+		return err
+	}
+	sink, err := NewSink(typ, config)
+	if err != nil {
+		return err
+	}
+	return sink.Close()
+}
+
+// RemoveReceiver stops a receiver and closes its sink
+func (m *Manager) RemoveReceiver(id string) bool {
+	m.mu.Lock()
+	receiver, exists := m.receivers[id]
+	delete(m.receivers, id)
+	m.mu.Unlock()
+
+	if exists {
+		receiver.stop()
+	}
+	return exists
 }
 
 func (m *Manager) GetReceiver(id string) (*Receiver, bool) {
@@ -51,13 +216,12 @@ func (m *Manager) GetReceiver(id string) (*Receiver, bool) {
 }
 
 func (m *Manager) UpdateReceiverStatus(id string, status string, err error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	m.mu.RLock()
+	receiver, exists := m.receivers[id]
+	m.mu.RUnlock()
 
-	if receiver, exists := m.receivers[id]; exists {
-		receiver.Status = status
-		receiver.LastError = err
-		receiver.LastSeen = time.Now()
+	if exists {
+		receiver.setStatus(status, err)
 	}
 }
 
@@ -72,17 +236,521 @@ func (m *Manager) ListReceivers() []*Receiver {
 	return receivers
 }
 
-func (m *Manager) ForwardLog(ctx context.Context, log string) {
+// Forward queues a stored chunk for every receiver, after the forwarding
+// delay if one is set. Each receiver delivers its queue from a single
+// goroutine, so chunks of a session always arrive in the order they were
+// stored.
+func (m *Manager) Forward(chunk Chunk) {
+	if m.delayChunk(chunk) {
+		return
+	}
+	m.forward(chunk)
+}
+
+func (m *Manager) forward(chunk Chunk) {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	for _, receiver := range m.receivers {
-		go func(r *Receiver) {
-			// TODO: Implement actual forwarding logic
-			r.mu.Lock()
-			r.Status = "active"
-			r.LastSeen = time.Now()
-			r.mu.Unlock()
-		}(receiver)
+		receiver.enqueue(chunk)
+	}
+}
+
+// DeadLetters returns a receiver's dead letters, oldest first
+func (m *Manager) DeadLetters(id string) ([]*DeadLetter, error) {
+	if m.deadLetters == nil {
+		return []*DeadLetter{}, nil
+	}
+	ids, err := m.deadLetters.List(id)
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]*DeadLetter, 0, len(ids))
+	for _, dlID := range ids {
+		if dl, err := m.deadLetters.Get(id, dlID); err == nil {
+			letters = append(letters, dl)
+		}
+	}
+	return letters, nil
+}
+
+// RetryDeadLetters queues dead letters for redelivery by the receiver's
+// worker. With no IDs all of the receiver's dead letters are retried.
+func (m *Manager) RetryDeadLetters(id string, ids []string) error {
+	receiver, exists := m.GetReceiver(id)
+	if !exists {
+		return fmt.Errorf("receiver %s not found", id)
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	select {
+	case <-receiver.quit:
+		return fmt.Errorf("receiver %s not found", id)
+	default:
+	}
+	select {
+	case receiver.queue <- queueItem{retry: ids}:
+		return nil
+	default:
+		return errors.New("receiver queue full")
+	}
+}
+
+// PurgeDeadLetters deletes dead letters of a receiver, all of them if no
+// IDs are given
+func (m *Manager) PurgeDeadLetters(id string, ids []string) error {
+	receiver, exists := m.GetReceiver(id)
+	if !exists {
+		return fmt.Errorf("receiver %s not found", id)
+	}
+	if m.deadLetters == nil {
+		return nil
+	}
+	err := m.purgeDeadLetters(id, ids)
+	// Ordered sinks may send the purged logs again
+	receiver.mu.Lock()
+	receiver.held = receiver.heldLogs()
+	receiver.mu.Unlock()
+	return err
+}
+
+func (m *Manager) purgeDeadLetters(id string, ids []string) error {
+	if len(ids) == 0 {
+		return m.deadLetters.Purge(id)
+	}
+	for _, dlID := range ids {
+		if err := m.deadLetters.Delete(id, dlID); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops all receivers
+func (m *Manager) Close() {
+	m.cancel()
+	m.mu.Lock()
+	receivers := m.receivers
+	m.receivers = make(map[string]*Receiver)
+	m.mu.Unlock()
+
+	for _, r := range receivers {
+		r.stop()
+	}
+}
+
+// enqueue queues a live chunk, or holds it back while a backfill runs.
+// mu is held while sending so a chunk can't overtake the backfill job.
+func (r *Receiver) enqueue(chunk Chunk) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.backfilling {
+		if len(r.pending) >= maxPendingChunks {
+			droppedChunks.Inc(r.ID)
+			log.Printf("Receiver %s backfill backlog full, dropping chunk %s [%d-%d]",
+				r.ID, chunk.LogID, chunk.Meta.BeginOffset, chunk.Meta.EndOffset)
+			return
+		}
+		r.pending = append(r.pending, chunk)
+		return
+	}
+	select {
+	case r.queue <- queueItem{chunk: &chunk}:
+	default:
+		droppedChunks.Inc(r.ID)
+		log.Printf("Receiver %s queue full, dropping chunk %s [%d-%d]",
+			r.ID, chunk.LogID, chunk.Meta.BeginOffset, chunk.Meta.EndOffset)
+	}
+}
+
+func (r *Receiver) run(ctx context.Context, source LogSource) {
+	defer close(r.done)
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	r.ctx = ctx
+	r.mu.Lock()
+	r.held = r.heldLogs()
+	r.mu.Unlock()
+	for {
+		select {
+		case item, ok := <-r.queue:
+			if !ok {
+				return
+			}
+			switch {
+			case item.job != nil:
+				r.runBackfill(source, item.job)
+			case item.chunk != nil:
+				r.deliver(*item.chunk)
+			default:
+				r.retryDeadLetters(item.retry)
+			}
+		case now := <-ticker.C:
+			r.pruneCursor(now)
+			if t, ok := r.sink.(Ticker); ok {
+				if err := t.Tick(ctx, now); err != nil {
+					log.Printf("Receiver %s tick failed: %v", r.ID, err)
+					r.setStatus("error", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// cursorEntry is how far a log was delivered
+type cursorEntry struct {
+	end int
+	at  time.Time
+}
+
+// cursorIdle is how long the cursor of a log is kept after its last chunk,
+// as long as the server may still continue the log
+const cursorIdle = 2 * time.Hour
+
+// pruneCursor forgets logs no chunks arrived for within cursorIdle, which
+// a backfill sends again in full, along with their transform state
+func (r *Receiver) pruneCursor(now time.Time) {
+	if now.Sub(r.cursorPruned) < time.Minute {
+		return
+	}
+	r.cursorPruned = now
+	for logID, c := range r.cursor {
+		if now.Sub(c.at) >= cursorIdle {
+			delete(r.cursor, logID)
+		}
+	}
+	if r.transform != nil {
+		r.transform.state.prune(now)
+	}
+}
+
+// deliver sends a chunk to the sink, skipping any part of it that was
+// already delivered, e.g. by a backfill
+func (r *Receiver) deliver(chunk Chunk) error {
+	if c, ok := r.cursor[chunk.LogID]; ok {
+		end := c.end
+		if chunk.Meta.EndOffset <= end {
+			return nil
+		}
+		if skip := end - chunk.Meta.BeginOffset; skip > 0 {
+			if skip > len(chunk.Data) {
+				return nil
+			}
+			chunk.Data = chunk.Data[skip:]
+			chunk.Meta.BeginOffset = end
+			chunk.NewLog = false
+		}
+	}
+	// Failed chunks end up in the dead-letter store, so the cursor moves on
+	r.cursor[chunk.LogID] = cursorEntry{end: chunk.Meta.EndOffset, at: time.Now()}
+	return r.send(chunk)
+}
+
+var (
+	errBreakerOpen = errors.New("circuit breaker open")
+	errHeldBack    = errors.New("held back behind an earlier dead letter of the log")
+)
+
+// transformed returns a chunk as the sink gets it, in offsets of the
+// transformed stream, and the function committing the transform once the
+// sink took it. Chunks in the cursor and dead letters stay untransformed.
+func (r *Receiver) transformed(chunk Chunk) (Chunk, func()) {
+	if r.transform == nil {
+		return chunk, func() {}
+	}
+	return r.transform.apply(chunk)
+}
+
+// send delivers a chunk to the sink, retrying with exponential backoff.
+// Chunks that still fail, or arrive while the circuit breaker is open, are
+// dead-lettered, as are the chunks of ordered sinks behind them.
+func (r *Receiver) send(chunk Chunk) error {
+	r.mu.Lock()
+	held := r.held[chunk.LogID]
+	allowed := held || r.breaker.allow(time.Now())
+	probing := r.breaker.state == BreakerHalfOpen
+	r.mu.Unlock()
+	if held {
+		r.deadLetter(chunk, errHeldBack, 0)
+		return errHeldBack
+	}
+	if !allowed {
+		deliveryFailures.Inc(r.ID)
+		r.deadLetter(chunk, errBreakerOpen, 0)
+		return errBreakerOpen
+	}
+
+	var err error
+	attempts := 0
+	start := time.Now()
+	backoff := r.retryBackoff
+	out, commit := r.transformed(chunk)
+	for {
+		attempts++
+		if err = r.sink.Deliver(r.ctx, out); err == nil {
+			commit()
+			break
+		}
+		// A failing probe reopens the breaker right away
+		if probing || attempts > r.retries {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-r.quit:
+		case <-r.ctx.Done():
+		}
+	}
+
+	deliverySeconds.Observe(time.Since(start).Seconds(), r.ID)
+
+	r.mu.Lock()
+	if err != nil {
+		r.breaker.failure(time.Now())
+	} else {
+		r.breaker.success()
+	}
+	r.mu.Unlock()
+
+	if err != nil {
+		deliveryFailures.Inc(r.ID)
+		log.Printf("Receiver %s failed to deliver %s after %d attempts: %v", r.ID, chunk.LogID, attempts, err)
+		r.setStatus("error", err)
+		r.deadLetter(chunk, err, attempts)
+		return err
+	}
+	r.setStatus("active", nil)
+	return nil
+}
+
+func (r *Receiver) deadLetter(chunk Chunk, cause error, attempts int) {
+	if r.deadLetters == nil {
+		return
+	}
+	if _, ok := r.sink.(orderedSink); ok {
+		r.mu.Lock()
+		r.held[chunk.LogID] = true
+		r.mu.Unlock()
+	}
+	dl := &DeadLetter{
+		Receiver: r.ID,
+		Chunk:    chunk,
+		Error:    cause.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now().UTC(),
+	}
+	if err := r.deadLetters.Add(dl); err != nil {
+		log.Printf("Receiver %s failed to dead-letter %s: %v", r.ID, chunk.LogID, err)
+	}
+}
+
+// retryDeadLetters redelivers dead letters, bypassing the circuit breaker
+// but recording the outcome in it. Delivered entries are removed. The dead
+// letters of each log are sent in offset order, with a line buffer and
+// transforms of their own; for ordered sinks a log stops at its first
+// failing entry.
+func (r *Receiver) retryDeadLetters(ids []string) {
+	if r.deadLetters == nil {
+		return
 	}
+	if len(ids) == 0 {
+		var err error
+		if ids, err = r.deadLetters.List(r.ID); err != nil {
+			log.Printf("Receiver %s failed to list dead letters: %v", r.ID, err)
+			return
+		}
+	}
+	var letters []*DeadLetter
+	for _, id := range ids {
+		if dl, err := r.deadLetters.Get(r.ID, id); err == nil {
+			letters = append(letters, dl)
+		}
+	}
+	sort.SliceStable(letters, func(i, j int) bool {
+		a, b := letters[i].Chunk, letters[j].Chunk
+		if a.LogID != b.LogID {
+			return a.LogID < b.LogID
+		}
+		return a.Meta.BeginOffset < b.Meta.BeginOffset
+	})
+	if ls, ok := r.sink.(lineSink); ok {
+		live := ls.swapLines(make(lineBuffer))
+		defer ls.swapLines(live)
+	}
+	if r.transform != nil {
+		live := r.transform.swapState(newTransformState())
+		defer r.transform.swapState(live)
+	}
+	_, ordered := r.sink.(orderedSink)
+
+	failed := make(map[string]bool)
+	for _, dl := range letters {
+		if ordered && failed[dl.Chunk.LogID] {
+			continue
+		}
+		out, commit := r.transformed(dl.Chunk)
+		err := r.sink.Deliver(r.ctx, out)
+		r.mu.Lock()
+		if err != nil {
+			r.breaker.failure(time.Now())
+		} else {
+			r.breaker.success()
+		}
+		r.mu.Unlock()
+		if err != nil {
+			failed[dl.Chunk.LogID] = true
+			dl.Attempts++
+			dl.Error = err.Error()
+			dl.FailedAt = time.Now().UTC()
+			r.deadLetters.Save(dl)
+			r.setStatus("error", err)
+			continue
+		}
+		commit()
+		r.deadLetters.Delete(r.ID, dl.ID)
+		r.setStatus("active", nil)
+	}
+
+	r.mu.Lock()
+	r.held = r.heldLogs()
+	r.mu.Unlock()
+}
+
+// heldLogs returns the logs an ordered sink holds back chunks of, those
+// with dead letters
+func (r *Receiver) heldLogs() map[string]bool {
+	held := make(map[string]bool)
+	if _, ok := r.sink.(orderedSink); !ok || r.deadLetters == nil {
+		return held
+	}
+	ids, err := r.deadLetters.List(r.ID)
+	if err != nil {
+		log.Printf("Receiver %s failed to list dead letters: %v", r.ID, err)
+		return held
+	}
+	for _, id := range ids {
+		if dl, err := r.deadLetters.Get(r.ID, id); err == nil {
+			held[dl.Chunk.LogID] = true
+		}
+	}
+	return held
+}
+
+// Info returns a snapshot of the receiver with secrets redacted
+func (r *Receiver) Info() ReceiverInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := ReceiverInfo{
+		ID:       r.ID,
+		Type:     r.Type,
+		Config:   RedactConfig(r.Config),
+		Status:   r.Status,
+		LastSeen: r.LastSeen,
+		Breaker:  r.breaker.state,
+	}
+	if r.LastError != nil {
+		info.LastError = r.LastError.Error()
+	}
+	if r.backfill != nil {
+		progress := r.backfill.progress
+		info.Backfill = &progress
+	}
+	return info
+}
+
+// redacted replaces secret values in receiver configs
+const redacted = "***"
+
+// isSecret reports whether a config key holds a secret, e.g. a webhook
+// secret or the salt of the anonymize transform
+func isSecret(key string) bool {
+	lower := strings.ToLower(key)
+	for _, s := range []string{"secret", "password", "key", "salt", "token", "authorization"} {
+		if strings.Contains(lower, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactConfig returns a copy of a receiver config with secret values
+// hidden, also inside nested objects such as transforms. Every value of a
+// "headers" object counts as secret.
+func RedactConfig(config map[string]interface{}) map[string]interface{} {
+	return redactValue(config, false).(map[string]interface{})
+}
+
+func redactValue(v interface{}, secret bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = redactValue(e, secret || isSecret(k) || strings.EqualFold(k, "headers"))
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = redactValue(e, secret)
+		}
+		return out
+	default:
+		if secret {
+			return redacted
+		}
+		return v
+	}
+}
+
+// RestoreSecrets puts the values of prev back where config holds the
+// placeholder of RedactConfig, so a redacted config can be sent back
+func RestoreSecrets(config, prev map[string]interface{}) {
+	for k, v := range config {
+		config[k] = restoreValue(v, prev[k])
+	}
+}
+
+func restoreValue(v, prev interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if v == redacted {
+			return prev
+		}
+	case map[string]interface{}:
+		if p, ok := prev.(map[string]interface{}); ok {
+			RestoreSecrets(v, p)
+		}
+	case []interface{}:
+		if p, ok := prev.([]interface{}); ok {
+			for i := range v {
+				if i < len(p) {
+					v[i] = restoreValue(v[i], p[i])
+				}
+			}
+		}
+	}
+	return v
+}
+
+// stop closes the queue, waits for the worker to drain it and closes the sink
+func (r *Receiver) stop() {
+	close(r.quit)
+	r.mu.Lock()
+	close(r.queue)
+	r.mu.Unlock()
+	<-r.done
+	if err := r.sink.Close(); err != nil {
+		log.Printf("Receiver %s close: %v", r.ID, err)
+	}
+}
+
+func (r *Receiver) setStatus(status string, err error) {
+	r.mu.Lock()
+	r.Status = status
+	r.LastError = err
+	r.LastSeen = time.Now()
+	r.mu.Unlock()
 }
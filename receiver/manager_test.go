@@ -0,0 +1,44 @@
+package receiver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactConfig(t *testing.T) {
+	config := map[string]interface{}{
+		"url":             "https://example.com/hook",
+		"secret":          "s3cret",
+		"session_headers": true,
+		"headers":         map[string]interface{}{"X-Custom": "value"},
+		"transforms": []interface{}{
+			map[string]interface{}{"type": "anonymize", "salt": "pepper"},
+			map[string]interface{}{"type": "drop_chat"},
+		},
+	}
+	want := map[string]interface{}{
+		"url":             "https://example.com/hook",
+		"secret":          redacted,
+		"session_headers": true,
+		"headers":         map[string]interface{}{"X-Custom": redacted},
+		"transforms": []interface{}{
+			map[string]interface{}{"type": "anonymize", "salt": redacted},
+			map[string]interface{}{"type": "drop_chat"},
+		},
+	}
+	got := RedactConfig(config)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("RedactConfig = %v, want %v", got, want)
+	}
+	if config["secret"] != "s3cret" || config["transforms"].([]interface{})[0].(map[string]interface{})["salt"] != "pepper" {
+		t.Errorf("RedactConfig changed its argument: %v", config)
+	}
+
+	// Sending the redacted config back keeps the secrets
+	got["url"] = "https://example.com/other"
+	RestoreSecrets(got, config)
+	config["url"] = "https://example.com/other"
+	if !reflect.DeepEqual(got, config) {
+		t.Errorf("RestoreSecrets = %v, want %v", got, config)
+	}
+}
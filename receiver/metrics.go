@@ -0,0 +1,23 @@
+package receiver
+
+import "cs2-log-proxy/metrics"
+
+var (
+	deliverySeconds  = metrics.NewHistogram("cs2_log_proxy_receiver_delivery_seconds", "Time taken to deliver a chunk to a receiver, including retries.", metrics.LatencyBuckets, "receiver")
+	deliveryFailures = metrics.NewCounter("cs2_log_proxy_receiver_delivery_failures_total", "Chunks a receiver failed to deliver and dead-lettered.", "receiver")
+	droppedChunks    = metrics.NewCounter("cs2_log_proxy_receiver_dropped_chunks_total", "Chunks dropped because a receiver's queue was full.", "receiver")
+)
+
+// RegisterMetrics adds the queue depths of the receivers to r
+func (m *Manager) RegisterMetrics(r *metrics.Registry) {
+	r.NewGaugeFunc("cs2_log_proxy_receiver_queue_depth", "Chunks waiting in each receiver's queue.", []string{"receiver"}, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, receiver := range m.ListReceivers() {
+			receiver.mu.Lock()
+			n := len(receiver.queue) + len(receiver.pending)
+			receiver.mu.Unlock()
+			samples = append(samples, metrics.Sample{Labels: []string{receiver.ID}, Value: float64(n)})
+		}
+		return samples
+	})
+}
@@ -0,0 +1,95 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers identifying chunks relayed between proxies
+const (
+	ProxyHopsHeader       = "X-Proxy-Hops"
+	ProxyOriginHeader     = "X-Proxy-Origin"
+	ProxyViaHeader        = "X-Proxy-Via"
+	ProxyReceivedAtHeader = "X-Proxy-Received-At"
+)
+
+// proxySink relays chunks to another proxy's /api/logs endpoint. It sends
+// the same headers as a game server plus the proxy chain, so the next proxy
+// can detect loops and keep the original arrival time.
+type proxySink struct {
+	url    string
+	client *http.Client
+}
+
+func newProxySink(config map[string]interface{}) (Sink, error) {
+	url := stringOpt(config, "url", "")
+	if url == "" {
+		return nil, errors.New("proxy receiver requires a url")
+	}
+	return &proxySink{
+		url:    url,
+		client: &http.Client{Timeout: durationOpt(config, "timeout", 10*time.Second)},
+	}, nil
+}
+
+func (s *proxySink) Deliver(ctx context.Context, chunk Chunk) error {
+	if chunk.Data == "" {
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, strings.NewReader(chunk.Data))
+	if err != nil {
+		return err
+	}
+	m := chunk.Meta
+	h := req.Header
+	h.Set("Content-Type", "text/plain")
+	h.Set("X-Server-Instance-Token", chunk.Token)
+	h.Set("X-Game-Map", chunk.GameMap)
+	h.Set("X-Steamid", chunk.SteamID)
+	h.Set("X-Server-Addr", chunk.ServerAddr)
+	h.Set("X-Logbytes-Beginoffset", strconv.Itoa(m.BeginOffset))
+	h.Set("X-Logbytes-Endoffset", strconv.Itoa(m.EndOffset))
+	h.Set("X-Game-Scorect", strconv.Itoa(m.GameScoreCT))
+	h.Set("X-Game-Scoret", strconv.Itoa(m.GameScoreT))
+	h.Set("X-Game-State", m.GameState)
+	h.Set("X-Game-Teamct", m.GameTeamCT)
+	h.Set("X-Game-Teamt", m.GameTeamT)
+	h.Set("X-Tick-Start", strconv.Itoa(m.TickStart))
+	h.Set("X-Tick-End", strconv.Itoa(m.TickEnd))
+	h.Set("X-Timestamp", m.Timestamp)
+
+	if len(m.ProxyVia) > 0 {
+		h.Set(ProxyOriginHeader, m.ProxyVia[0])
+		h.Set(ProxyViaHeader, strings.Join(m.ProxyVia, ","))
+	}
+	h.Set(ProxyHopsHeader, strconv.Itoa(len(m.ProxyVia)))
+	if !m.ReceivedAt.IsZero() {
+		h.Set(ProxyReceivedAtHeader, m.ReceivedAt.UTC().Format(time.RFC3339Nano))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("proxy returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// ordered holds chunks back behind failed ones, the next proxy rejects
+// chunks past a gap
+func (s *proxySink) ordered() {}
+
+func (s *proxySink) Close() error {
+	return nil
+}
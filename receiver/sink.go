@@ -0,0 +1,124 @@
+package receiver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cs2-log-proxy/storage"
+)
+
+// Chunk is a stored log chunk handed to receivers for forwarding.
+// Data and Meta are exactly what was appended to the LogStore.
+// NewLog is set on the first chunk of a session.
+type Chunk struct {
+	LogID      string            `json:"log_id"`
+	Token      string            `json:"server_instance_token"`
+	Data       string            `json:"data"`
+	Meta       storage.ChunkMeta `json:"meta"`
+	NewLog     bool              `json:"new_log"`
+	GameMap    string            `json:"game_map"`
+	SteamID    string            `json:"steam_id"`
+	ServerAddr string            `json:"server_addr"`
+}
+
+// Sink delivers chunks to the destination of a single receiver.
+// Deliver is only ever called from the receiver's own worker goroutine,
+// so implementations don't need to be safe for concurrent use. A chunk
+// Deliver failed on may be delivered again, by a retry or from the
+// dead-letter store.
+type Sink interface {
+	Deliver(ctx context.Context, chunk Chunk) error
+	Close() error
+}
+
+// Ticker is implemented by sinks with time based work, such as flushing
+// batches or detecting silent servers. Tick is called from the receiver's
+// worker goroutine, between deliveries.
+type Ticker interface {
+	Tick(ctx context.Context, now time.Time) error
+}
+
+// orderedSink is implemented by sinks whose destination needs the chunks of
+// a session in order and without gaps, such as another proxy checking the
+// offsets. Once a chunk of a session is dead-lettered, the later ones are
+// held back behind it in the dead-letter store rather than sent past it.
+type orderedSink interface {
+	ordered()
+}
+
+// lineSink is implemented by sinks joining the lines of a session across
+// chunks. Dead letters are retried with a separate line buffer, so they
+// don't mix with the partial lines of live chunks.
+type lineSink interface {
+	swapLines(b lineBuffer) lineBuffer
+}
+
+// SinkFactory builds a Sink from a receiver's config map
+type SinkFactory func(config map[string]interface{}) (Sink, error)
+
+var sinkFactories = map[string]SinkFactory{
+	"udp":     newUDPSink,
+	"proxy":   newProxySink,
+	"tcp":     newTCPSink,
+	"file":    newFileSink,
+	"webhook": newWebhookSink,
+}
+
+// NewSink creates the Sink for a receiver type
+func NewSink(typ string, config map[string]interface{}) (Sink, error) {
+	factory, ok := sinkFactories[typ]
+	if !ok {
+		return nil, fmt.Errorf("unknown receiver type %q", typ)
+	}
+	return factory(config)
+}
+
+// stringOpt reads a string option from a receiver config map
+func stringOpt(config map[string]interface{}, key, def string) string {
+	if v, ok := config[key].(string); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// stringsOpt reads a list of strings option
+func stringsOpt(config map[string]interface{}, key string) []string {
+	var out []string
+	switch v := config[key].(type) {
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+	case []string:
+		out = append(out, v...)
+	}
+	return out
+}
+
+// intOpt reads an integer option; JSON numbers decode as float64
+func intOpt(config map[string]interface{}, key string, def int) int {
+	switch v := config[key].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	}
+	return def
+}
+
+// durationOpt reads a duration option given either as a Go duration
+// string ("5s") or as a number of seconds
+func durationOpt(config map[string]interface{}, key string, def time.Duration) time.Duration {
+	switch v := config[key].(type) {
+	case string:
+		if d, err := time.ParseDuration(v); err == nil {
+			return d
+		}
+	case float64:
+		return time.Duration(v * float64(time.Second))
+	}
+	return def
+}
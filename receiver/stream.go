@@ -0,0 +1,277 @@
+package receiver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// lineStream renders chunks as a newline delimited stream of complete
+// lines. Several sessions share one stream, so unless disabled a header
+// line announces which log the following lines belong to whenever the
+// session changes:
+//
+//	# log_id=<log id> server_instance_token=<token> game_map=<map>
+type lineStream struct {
+	headers bool
+	prefix  string
+	lines   lineBuffer
+	current string // log ID of the last header written
+}
+
+func newLineStream(config map[string]interface{}) lineStream {
+	headers := true
+	if v, ok := config["session_headers"].(bool); ok {
+		headers = v
+	}
+	return lineStream{
+		headers: headers,
+		prefix:  stringOpt(config, "header_prefix", "# "),
+		lines:   make(lineBuffer),
+	}
+}
+
+// render returns the bytes to write for a chunk. commit must be called
+// once they were written.
+func (ls *lineStream) render(chunk Chunk) (data []byte, commit func()) {
+	lines, rest := ls.lines.split(chunk.LogID, chunk.Data)
+	commit = func() {
+		ls.lines.keep(chunk.LogID, rest)
+		if len(lines) > 0 {
+			ls.current = chunk.LogID
+		}
+	}
+	if len(lines) == 0 {
+		return nil, commit
+	}
+	var b strings.Builder
+	if ls.headers && ls.current != chunk.LogID {
+		fmt.Fprintf(&b, "%slog_id=%s server_instance_token=%s game_map=%s\n",
+			ls.prefix, chunk.LogID, chunk.Token, chunk.GameMap)
+	}
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	return []byte(b.String()), commit
+}
+
+func (ls *lineStream) swapLines(b lineBuffer) lineBuffer {
+	old := ls.lines
+	ls.lines = b
+	return old
+}
+
+// reset forces a header before the next line, e.g. for a new connection
+func (ls *lineStream) reset() {
+	ls.current = ""
+}
+
+// tcpSink writes the line stream to a TCP socket, reconnecting when the
+// connection breaks
+type tcpSink struct {
+	address        string
+	reconnectDelay time.Duration
+	dialTimeout    time.Duration
+	stream         lineStream
+	conn           net.Conn
+	lastDial       time.Time
+}
+
+func newTCPSink(config map[string]interface{}) (Sink, error) {
+	address := stringOpt(config, "address", "")
+	if address == "" {
+		return nil, errors.New("tcp receiver requires an address")
+	}
+	return &tcpSink{
+		address:        address,
+		reconnectDelay: durationOpt(config, "reconnect_delay", 5*time.Second),
+		dialTimeout:    durationOpt(config, "timeout", 10*time.Second),
+		stream:         newLineStream(config),
+	}, nil
+}
+
+func (s *tcpSink) Deliver(ctx context.Context, chunk Chunk) error {
+	if s.conn == nil {
+		if time.Since(s.lastDial) < s.reconnectDelay {
+			return fmt.Errorf("not connected to %s, waiting to reconnect", s.address)
+		}
+		s.lastDial = time.Now()
+		dialer := net.Dialer{Timeout: s.dialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", s.address)
+		if err != nil {
+			return err
+		}
+		log.Printf("TCP receiver connected to %s", s.address)
+		s.conn = conn
+		s.stream.reset()
+	}
+	data, commit := s.stream.render(chunk)
+	if len(data) > 0 {
+		s.conn.SetWriteDeadline(time.Now().Add(s.dialTimeout))
+		if _, err := s.conn.Write(data); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	commit()
+	return nil
+}
+
+func (s *tcpSink) swapLines(b lineBuffer) lineBuffer {
+	return s.stream.swapLines(b)
+}
+
+func (s *tcpSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// fileSink appends the line stream to a local file or named pipe. The path
+// is checked before every write, so the file can be rotated by moving it
+// away. Pipes are opened without blocking and writes to them give up after
+// timeout; the rest of a write cut short is written before anything else.
+type fileSink struct {
+	path    string
+	timeout time.Duration
+	stream  lineStream
+	file    *os.File
+	pipe    bool
+	pending []byte // rest of a partial write
+}
+
+func newFileSink(config map[string]interface{}) (Sink, error) {
+	path := stringOpt(config, "path", "")
+	if path == "" {
+		return nil, errors.New("file receiver requires a path")
+	}
+	return &fileSink{
+		path:    path,
+		timeout: durationOpt(config, "timeout", 10*time.Second),
+		stream:  newLineStream(config),
+	}, nil
+}
+
+func (s *fileSink) open() error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	info, err := os.Stat(s.path)
+	pipe := err == nil && info.Mode()&os.ModeNamedPipe != 0
+	if pipe {
+		// Don't block the receiver until a reader opens the pipe
+		flags = os.O_WRONLY | syscall.O_NONBLOCK
+	}
+	f, err := os.OpenFile(s.path, flags, 0644)
+	if errors.Is(err, syscall.ENXIO) {
+		return fmt.Errorf("no reader on named pipe %s", s.path)
+	}
+	if err != nil {
+		return err
+	}
+	s.file, s.pipe = f, pipe
+	s.stream.reset()
+	return nil
+}
+
+// close closes the file. The rest of a partial write belongs to it and
+// is dropped.
+func (s *fileSink) close() error {
+	if len(s.pending) > 0 {
+		log.Printf("File receiver dropped %d bytes of a line cut short in %s", len(s.pending), s.path)
+		s.pending = nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// rotated reports whether the open file is no longer at the path
+func (s *fileSink) rotated() bool {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return true
+	}
+	open, err := s.file.Stat()
+	return err != nil || !os.SameFile(info, open)
+}
+
+// write writes data and returns how much of it was written. Writes to a
+// pipe without room wait up to timeout for the reader.
+func (s *fileSink) write(data []byte) (int, error) {
+	if s.pipe {
+		s.file.SetWriteDeadline(time.Now().Add(s.timeout))
+	}
+	n, err := s.file.Write(data)
+	switch {
+	case err == nil:
+		return n, nil
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		err = fmt.Errorf("reader of named pipe %s too slow: %w", s.path, err)
+	case errors.Is(err, syscall.EPIPE):
+		s.close()
+		err = fmt.Errorf("reader closed named pipe %s: %w", s.path, io.ErrClosedPipe)
+	default:
+		s.close()
+	}
+	return n, err
+}
+
+func (s *fileSink) Deliver(ctx context.Context, chunk Chunk) error {
+	if s.file != nil && s.rotated() {
+		s.close()
+	}
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if len(s.pending) > 0 {
+		n, err := s.write(s.pending)
+		if err != nil {
+			if s.file != nil {
+				s.pending = s.pending[n:]
+			}
+			return err
+		}
+		s.pending = nil
+	}
+	data, commit := s.stream.render(chunk)
+	if len(data) > 0 {
+		n, err := s.write(data)
+		if err != nil && n == 0 {
+			return err
+		}
+		if err != nil && s.file != nil {
+			// Part of a line is out, the rest must follow it
+			log.Printf("File receiver wrote %d of %d bytes to %s: %v", n, len(data), s.path, err)
+			s.pending = data[n:]
+		}
+	}
+	commit()
+	return nil
+}
+
+func (s *fileSink) swapLines(b lineBuffer) lineBuffer {
+	return s.stream.swapLines(b)
+}
+
+func (s *fileSink) Close() error {
+	if s.file != nil && len(s.pending) > 0 {
+		if n, _ := s.write(s.pending); s.file != nil {
+			s.pending = s.pending[n:]
+		}
+	}
+	if s.file == nil {
+		return nil
+	}
+	return s.close()
+}
@@ -0,0 +1,223 @@
+package receiver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"cs2-log-proxy/parser"
+)
+
+// lineTransform rewrites a single log line; returning false drops the line
+type lineTransform func(line string) (string, bool)
+
+// transformer is the per receiver rewrite stage in front of the sink,
+// configured with an ordered "transforms" list, e.g.
+//
+//	"transforms": [
+//	  { "type": "replace_teams", "names": { "Team A": "Alpha" } },
+//	  { "type": "anonymize", "salt": "..." },
+//	  { "type": "drop_chat" },
+//	  { "type": "drop_rcon" },
+//	  { "type": "strip_ip" },
+//	  { "type": "regex", "pattern": "...", "replace": "..." }
+//	]
+//
+// Transforms work on complete lines, so a trailing partial line is held
+// back until the next chunk of the session. The forwarded chunk's offsets
+// are rewritten to positions in the transformed stream.
+type transformer struct {
+	steps     []lineTransform
+	teamNames map[string]string
+	state     transformState
+}
+
+// transformState is what a transformer remembers of the sessions it saw
+type transformState struct {
+	lines   lineBuffer
+	offsets map[string]int       // logID -> end offset of the transformed stream
+	seen    map[string]time.Time // logID -> last chunk
+}
+
+func newTransformState() transformState {
+	return transformState{lines: make(lineBuffer), offsets: make(map[string]int), seen: make(map[string]time.Time)}
+}
+
+// prune forgets logs no chunks arrived for within cursorIdle, like the
+// receiver's cursor
+func (s transformState) prune(now time.Time) {
+	for logID, at := range s.seen {
+		if now.Sub(at) >= cursorIdle {
+			delete(s.lines, logID)
+			delete(s.offsets, logID)
+			delete(s.seen, logID)
+		}
+	}
+}
+
+// newTransformer builds the transform stage from a receiver config. It
+// returns nil when no transforms are configured.
+func newTransformer(config map[string]interface{}) (*transformer, error) {
+	list, _ := config["transforms"].([]interface{})
+	if len(list) == 0 {
+		return nil, nil
+	}
+	t := &transformer{state: newTransformState()}
+	for i, item := range list {
+		opts, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("transform %d: expected an object", i)
+		}
+		step, err := t.newStep(opts)
+		if err != nil {
+			return nil, fmt.Errorf("transform %d: %w", i, err)
+		}
+		t.steps = append(t.steps, step)
+	}
+	return t, nil
+}
+
+func (t *transformer) newStep(opts map[string]interface{}) (lineTransform, error) {
+	switch typ := stringOpt(opts, "type", ""); typ {
+	case "replace_teams":
+		names, _ := opts["names"].(map[string]interface{})
+		if len(names) == 0 {
+			return nil, fmt.Errorf("replace_teams requires names")
+		}
+		if t.teamNames == nil {
+			t.teamNames = make(map[string]string)
+		}
+		pairs := make([]string, 0, 2*len(names))
+		for from, to := range names {
+			s, _ := to.(string)
+			t.teamNames[from] = s
+			pairs = append(pairs, from, s)
+		}
+		replacer := strings.NewReplacer(pairs...)
+		return func(line string) (string, bool) {
+			return replacer.Replace(line), true
+		}, nil
+	case "anonymize":
+		return anonymizer(stringOpt(opts, "salt", "")), nil
+	case "drop_chat":
+		return dropMatching(chatRe), nil
+	case "drop_rcon":
+		return dropMatching(rconRe), nil
+	case "strip_ip":
+		return func(line string) (string, bool) {
+			return connectAddrRe.ReplaceAllString(line, `${1}""`), true
+		}, nil
+	case "regex":
+		re, err := regexp.Compile(stringOpt(opts, "pattern", ""))
+		if err != nil {
+			return nil, err
+		}
+		replace := stringOpt(opts, "replace", "")
+		return func(line string) (string, bool) {
+			return re.ReplaceAllString(line, replace), true
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown transform %q", typ)
+	}
+}
+
+var (
+	// "Name<12><[U:1:12345]><CT>" say "gg"
+	chatRe = regexp.MustCompile(`^".*<\d+><[^>]*><[^>]*>" say(_team)? "`)
+	rconRe = regexp.MustCompile(`^rcon from "`)
+	// "Name<12><[U:1:12345]><>" connected, address "1.2.3.4:27005"
+	connectAddrRe = regexp.MustCompile(`(connected, address )"[^"]*"`)
+	// player reference inside a log line: "Name<userid><steamid>
+	playerRe  = regexp.MustCompile(`"([^"]*?)<(\d+)><([^>]*)>`)
+	steamIDRe = regexp.MustCompile(`STEAM_\d:\d:\d+|\[U:\d:\d+\]|\b7656119\d{10}\b`)
+)
+
+// dropMatching drops lines whose message matches re
+func dropMatching(re *regexp.Regexp) lineTransform {
+	return func(line string) (string, bool) {
+		msg := line
+		if _, m, ok := parser.SplitLine(line); ok {
+			msg = m
+		}
+		return line, !re.MatchString(msg)
+	}
+}
+
+// anonymizer replaces player names and SteamIDs with stable pseudonyms
+// derived from an HMAC of the SteamID, so the same player keeps the same
+// pseudonym across lines and logs
+func anonymizer(salt string) lineTransform {
+	pseudonym := func(id string) string {
+		mac := hmac.New(sha256.New, []byte(salt))
+		mac.Write([]byte(id))
+		return hex.EncodeToString(mac.Sum(nil))[:10]
+	}
+	return func(line string) (string, bool) {
+		line = playerRe.ReplaceAllStringFunc(line, func(m string) string {
+			parts := playerRe.FindStringSubmatch(m)
+			userID, steamID := parts[2], parts[3]
+			if steamID == "BOT" || steamID == "Console" || steamID == "" {
+				return m
+			}
+			p := pseudonym(steamID)
+			return `"Player_` + p + "<" + userID + "><ANON_" + p + ">"
+		})
+		return steamIDRe.ReplaceAllStringFunc(line, func(id string) string {
+			return "ANON_" + pseudonym(id)
+		}), true
+	}
+}
+
+// apply rewrites the complete lines of a chunk and moves its offsets into
+// the transformed stream. commit must be called once the sink took the
+// chunk; until then a retry is transformed the same way.
+func (t *transformer) apply(chunk Chunk) (_ Chunk, commit func()) {
+	begin, seen := t.state.offsets[chunk.LogID]
+	if !seen {
+		// Nothing is known about the transformed size of earlier data
+		begin = chunk.Meta.BeginOffset
+	}
+
+	lines, rest := t.state.lines.split(chunk.LogID, chunk.Data)
+	var out strings.Builder
+	for _, line := range lines {
+		keep := true
+		for _, step := range t.steps {
+			if line, keep = step(line); !keep {
+				break
+			}
+		}
+		if keep {
+			out.WriteString(line)
+			out.WriteString("\n")
+		}
+	}
+
+	chunk.Data = out.String()
+	chunk.Meta.BeginOffset = begin
+	chunk.Meta.EndOffset = begin + len(chunk.Data)
+	if name, ok := t.teamNames[chunk.Meta.GameTeamCT]; ok {
+		chunk.Meta.GameTeamCT = name
+	}
+	if name, ok := t.teamNames[chunk.Meta.GameTeamT]; ok {
+		chunk.Meta.GameTeamT = name
+	}
+	state := t.state
+	return chunk, func() {
+		state.lines.keep(chunk.LogID, rest)
+		state.offsets[chunk.LogID] = chunk.Meta.EndOffset
+		state.seen[chunk.LogID] = time.Now()
+	}
+}
+
+// swapState replaces the state, e.g. to redeliver dead letters apart from
+// the live sessions, and returns the previous one
+func (t *transformer) swapState(s transformState) transformState {
+	old := t.state
+	t.state = s
+	return old
+}
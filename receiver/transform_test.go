@@ -0,0 +1,128 @@
+package receiver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cs2-log-proxy/storage"
+)
+
+func newTestTransformer(t *testing.T, transforms ...map[string]interface{}) *transformer {
+	t.Helper()
+	list := make([]interface{}, len(transforms))
+	for i, tr := range transforms {
+		list[i] = tr
+	}
+	tr, err := newTransformer(map[string]interface{}{"transforms": list})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func TestTransforms(t *testing.T) {
+	const (
+		say     = `L 01/30/2025 - 16:33:56: "alice<2><[U:1:1001]><CT>" say "gg"`
+		kill    = `L 01/30/2025 - 16:33:57: "alice<2><[U:1:1001]><CT>" killed "Bot<3><BOT><TERRORIST>" with "ak47"`
+		rcon    = `L 01/30/2025 - 16:33:58: rcon from "10.0.0.1:5000": command "status"`
+		connect = `L 01/30/2025 - 16:33:59: "alice<2><[U:1:1001]><>" connected, address "1.2.3.4:27005"`
+		teams   = `L 01/30/2025 - 16:34:00: Team "Team A" scored "1" with "5" players`
+	)
+	tests := []struct {
+		name      string
+		transform map[string]interface{}
+		in        string
+		want      string
+	}{
+		{"drop_chat", map[string]interface{}{"type": "drop_chat"}, say + "\n" + kill + "\n", kill + "\n"},
+		{"drop_rcon", map[string]interface{}{"type": "drop_rcon"}, rcon + "\n" + kill + "\n", kill + "\n"},
+		{"strip_ip", map[string]interface{}{"type": "strip_ip"}, connect + "\n",
+			`L 01/30/2025 - 16:33:59: "alice<2><[U:1:1001]><>" connected, address ""` + "\n"},
+		{"replace_teams", map[string]interface{}{"type": "replace_teams", "names": map[string]interface{}{"Team A": "Alpha"}},
+			teams + "\n", strings.Replace(teams, "Team A", "Alpha", 1) + "\n"},
+		{"regex", map[string]interface{}{"type": "regex", "pattern": `ak47`, "replace": "rifle"},
+			kill + "\n", strings.Replace(kill, "ak47", "rifle", 1) + "\n"},
+		{"partial line held back", map[string]interface{}{"type": "drop_chat"}, kill + "\n" + say[:10], kill + "\n"},
+	}
+	for _, tt := range tests {
+		tr := newTestTransformer(t, tt.transform)
+		out, commit := tr.apply(Chunk{LogID: "a_1", Data: tt.in, Meta: storage.ChunkMeta{EndOffset: len(tt.in)}})
+		commit()
+		if out.Data != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, out.Data, tt.want)
+		}
+		if out.Meta.BeginOffset != 0 || out.Meta.EndOffset != len(tt.want) {
+			t.Errorf("%s: offsets [%d-%d], want [0-%d]", tt.name, out.Meta.BeginOffset, out.Meta.EndOffset, len(tt.want))
+		}
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	const line = `L 01/30/2025 - 16:33:57: "alice<2><[U:1:1001]><CT>" killed "Bot<3><BOT><TERRORIST>" with "ak47"` + "\n"
+	anonymize := func(salt string) string {
+		tr := newTestTransformer(t, map[string]interface{}{"type": "anonymize", "salt": salt})
+		out, _ := tr.apply(Chunk{LogID: "a_1", Data: line})
+		return out.Data
+	}
+	got := anonymize("s1")
+	if strings.Contains(got, "alice") || strings.Contains(got, "[U:1:1001]") {
+		t.Errorf("player not anonymized: %q", got)
+	}
+	if !strings.Contains(got, `"Bot<3><BOT>`) {
+		t.Errorf("bot anonymized: %q", got)
+	}
+	if again := anonymize("s1"); again != got {
+		t.Errorf("pseudonyms differ for the same salt: %q and %q", got, again)
+	}
+	if other := anonymize("s2"); other == got {
+		t.Errorf("pseudonyms equal for different salts: %q", got)
+	}
+}
+
+func TestTransformOffsetsAcrossChunks(t *testing.T) {
+	tr := newTestTransformer(t, map[string]interface{}{"type": "drop_chat"})
+	chunks := []string{
+		"L 01/30/2025 - 16:33:56: \"a<2><[U:1:1]><CT>\" say \"x\"\nL 01/30/2025 - 16:33:57: World tr",
+		"iggered \"Round_Start\"\n",
+	}
+	begin := 0
+	var got string
+	for _, data := range chunks {
+		out, commit := tr.apply(Chunk{LogID: "a_1", Data: data, Meta: storage.ChunkMeta{BeginOffset: begin, EndOffset: begin + len(data)}})
+		// A retry before the commit is transformed the same way
+		if again, _ := tr.apply(Chunk{LogID: "a_1", Data: data, Meta: storage.ChunkMeta{BeginOffset: begin, EndOffset: begin + len(data)}}); !reflect.DeepEqual(again, out) {
+			t.Fatalf("retry transformed to %+v, first try %+v", again, out)
+		}
+		commit()
+		if out.Meta.BeginOffset != len(got) {
+			t.Fatalf("chunk begins at %d after %d transformed bytes", out.Meta.BeginOffset, len(got))
+		}
+		got += out.Data
+		begin += len(data)
+	}
+	if want := "L 01/30/2025 - 16:33:57: World triggered \"Round_Start\"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTransformStatePrune(t *testing.T) {
+	tr := newTestTransformer(t, map[string]interface{}{"type": "drop_chat"})
+	for _, logID := range []string{"a_1", "a_2"} {
+		_, commit := tr.apply(Chunk{LogID: logID, Data: "L 01/30/2025 - 16:33:56: partial"})
+		commit()
+	}
+	tr.state.seen["a_1"] = time.Now().Add(-cursorIdle)
+
+	tr.state.prune(time.Now())
+	if _, ok := tr.state.offsets["a_1"]; ok {
+		t.Error("offset of the idle log kept")
+	}
+	if _, ok := tr.state.lines["a_1"]; ok {
+		t.Error("partial line of the idle log kept")
+	}
+	if _, ok := tr.state.offsets["a_2"]; !ok || tr.state.lines["a_2"] == "" {
+		t.Error("state of the active log pruned")
+	}
+}
@@ -0,0 +1,126 @@
+package receiver
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+)
+
+// defaultMaxPacketSize mirrors the datagram size srcds uses for logaddress
+const defaultMaxPacketSize = 1024
+
+// udpSink replays the stored log stream as classic logaddress UDP packets.
+// Each complete line becomes one datagram:
+//
+//	"\xff\xff\xff\xffRL <line>\n\x00"            without a secret
+//	"\xff\xff\xff\xffS<secret>L <line>\n\x00"    with logaddress secret
+type udpSink struct {
+	conn          net.Conn
+	secret        string
+	maxPacketSize int
+	lines         lineBuffer
+	// sent is how far chunks that failed part way got, as the log offset
+	// after their last sent line, so retries don't send those lines again
+	sent map[udpChunk]int
+}
+
+type udpChunk struct {
+	logID      string
+	begin, end int
+}
+
+// maxUDPProgress bounds the failed chunks whose progress is kept
+const maxUDPProgress = 1000
+
+func newUDPSink(config map[string]interface{}) (Sink, error) {
+	addr := stringOpt(config, "address", "")
+	if addr == "" {
+		return nil, errors.New("udp receiver requires an address")
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpSink{
+		conn:          conn,
+		secret:        stringOpt(config, "secret", ""),
+		maxPacketSize: intOpt(config, "max_packet_size", defaultMaxPacketSize),
+		lines:         make(lineBuffer),
+		sent:          make(map[udpChunk]int),
+	}, nil
+}
+
+func (s *udpSink) Deliver(ctx context.Context, chunk Chunk) error {
+	key := udpChunk{chunk.LogID, chunk.Meta.BeginOffset, chunk.Meta.EndOffset}
+	sent, resumed := s.sent[key]
+	prefix := s.lines[chunk.LogID]
+	lines, rest := s.lines.split(chunk.LogID, chunk.Data)
+	// Offsets of the line ends follow the chunk's, whatever the held back
+	// prefix is, so a retry with another line buffer skips the same lines
+	text, end := prefix+chunk.Data, chunk.Meta.BeginOffset-len(prefix)
+	for _, line := range lines {
+		n := strings.IndexByte(text, '\n') + 1
+		text, end = text[n:], end+n
+		if line == "" || resumed && end <= sent {
+			continue
+		}
+		err := ctx.Err()
+		if err == nil {
+			_, err = s.conn.Write(s.packet(line))
+		}
+		if err != nil {
+			if resumed {
+				s.progress(key, sent)
+			}
+			return err
+		}
+		sent, resumed = end, true
+	}
+	delete(s.sent, key)
+	s.lines.keep(chunk.LogID, rest)
+	return nil
+}
+
+// progress records how far a failed chunk got
+func (s *udpSink) progress(key udpChunk, sent int) {
+	if _, ok := s.sent[key]; !ok && len(s.sent) >= maxUDPProgress {
+		// Dead letters that are never retried would pile up
+		for k := range s.sent {
+			delete(s.sent, k)
+			break
+		}
+	}
+	s.sent[key] = sent
+}
+
+// packet builds a logaddress datagram, truncating the line if the packet
+// would exceed maxPacketSize
+func (s *udpSink) packet(line string) []byte {
+	var header string
+	if s.secret != "" {
+		header = "\xff\xff\xff\xffS" + s.secret
+	} else {
+		header = "\xff\xff\xff\xffR"
+	}
+	if !strings.HasPrefix(line, "L ") {
+		line = "L " + line
+	}
+	const trailer = "\n\x00"
+	if room := s.maxPacketSize - len(header) - len(trailer); len(line) > room && room > 0 {
+		log.Printf("UDP receiver: truncating %d byte line to %d bytes", len(line), room)
+		line = line[:room]
+	}
+	return []byte(header + line + trailer)
+}
+
+func (s *udpSink) swapLines(b lineBuffer) lineBuffer {
+	old := s.lines
+	s.lines = b
+	return old
+}
+
+func (s *udpSink) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,304 @@
+package receiver
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cs2-log-proxy/parser"
+)
+
+// Webhook event types
+const (
+	WebhookNewLog       = "new_log"
+	WebhookMatchStart   = "match_start"
+	WebhookMatchEnd     = "match_end"
+	WebhookRoundEnd     = "round_end"
+	WebhookScoreUpdate  = "score_update"
+	WebhookServerSilent = "server_silent"
+)
+
+var allWebhookEvents = []string{
+	WebhookNewLog, WebhookMatchStart, WebhookMatchEnd,
+	WebhookRoundEnd, WebhookScoreUpdate, WebhookServerSilent,
+}
+
+// Signature headers. The signature is hex(HMAC-SHA256(secret, timestamp + "." + body))
+// so consumers can reject replayed requests by checking the timestamp.
+const (
+	SignatureHeader          = "X-Proxy-Signature-256"
+	SignatureTimestampHeader = "X-Proxy-Timestamp"
+)
+
+// WebhookEvent is a structured notification sent to webhook receivers
+type WebhookEvent struct {
+	Type       string            `json:"type"`
+	LogID      string            `json:"log_id"`
+	Token      string            `json:"server_instance_token"`
+	Time       string            `json:"time"` // game timestamp of the event
+	CreatedAt  time.Time         `json:"created_at"`
+	GameMap    string            `json:"game_map,omitempty"`
+	ScoreCT    int               `json:"score_ct"`
+	ScoreT     int               `json:"score_t"`
+	TeamCT     string            `json:"team_ct,omitempty"`
+	TeamT      string            `json:"team_t,omitempty"`
+	Data       map[string]string `json:"data,omitempty"`
+	Line       string            `json:"line,omitempty"`
+	SteamID    string            `json:"steam_id,omitempty"`
+	ServerAddr string            `json:"server_addr,omitempty"`
+}
+
+// webhookBatch is the JSON body POSTed to the webhook URL
+type webhookBatch struct {
+	Events []WebhookEvent `json:"events"`
+}
+
+// webhookSession tracks what has been reported for a single log
+type webhookSession struct {
+	token     string
+	gameMap   string
+	scoreCT   int
+	scoreT    int
+	teamCT    string
+	teamT     string
+	lastChunk time.Time
+	lastTime  string
+	silent    bool
+}
+
+// webhookSink POSTs structured events instead of raw log text.
+// Events are batched until batch_size events are pending or the oldest
+// pending event is batch_interval old.
+type webhookSink struct {
+	url           string
+	secret        string
+	events        map[string]bool
+	batchSize     int
+	batchInterval time.Duration
+	silentAfter   time.Duration
+	client        *http.Client
+
+	lines    lineBuffer
+	sessions map[string]*webhookSession
+	pending  []WebhookEvent
+}
+
+func newWebhookSink(config map[string]interface{}) (Sink, error) {
+	url := stringOpt(config, "url", "")
+	if url == "" {
+		return nil, errors.New("webhook receiver requires a url")
+	}
+	selected := stringsOpt(config, "events")
+	if len(selected) == 0 {
+		selected = allWebhookEvents
+	}
+	events := make(map[string]bool)
+	for _, e := range selected {
+		events[e] = true
+	}
+	return &webhookSink{
+		url:           url,
+		secret:        stringOpt(config, "secret", ""),
+		events:        events,
+		batchSize:     intOpt(config, "batch_size", 1),
+		batchInterval: durationOpt(config, "batch_interval", time.Second),
+		silentAfter:   durationOpt(config, "silent_after", time.Minute),
+		client:        &http.Client{Timeout: durationOpt(config, "timeout", 10*time.Second)},
+		lines:         make(lineBuffer),
+		sessions:      make(map[string]*webhookSession),
+	}, nil
+}
+
+// Deliver turns a chunk into events. If the events can't be sent the
+// chunk leaves no trace, so it can be delivered again later.
+func (s *webhookSink) Deliver(ctx context.Context, chunk Chunk) error {
+	sess := s.sessions[chunk.LogID]
+	if sess == nil {
+		sess = &webhookSession{token: chunk.Token, gameMap: chunk.GameMap}
+		s.sessions[chunk.LogID] = sess
+	}
+	saved, pendingBefore := *sess, len(s.pending)
+	sess.lastChunk = time.Now()
+	sess.lastTime = chunk.Meta.Timestamp
+	sess.silent = false
+	sess.teamCT = chunk.Meta.GameTeamCT
+	sess.teamT = chunk.Meta.GameTeamT
+
+	if chunk.NewLog {
+		ev := s.event(WebhookNewLog, chunk.LogID, sess, chunk.Meta.Timestamp)
+		ev.SteamID = chunk.SteamID
+		ev.ServerAddr = chunk.ServerAddr
+		s.add(ev)
+	}
+
+	lines, rest := s.lines.split(chunk.LogID, chunk.Data)
+	for _, line := range lines {
+		pe, ok := parser.ParseLine(line)
+		if !ok {
+			continue
+		}
+		var typ string
+		switch pe.Type {
+		case parser.EventMatchStart:
+			typ = WebhookMatchStart
+			if m := pe.Data["map"]; m != "" {
+				sess.gameMap = m
+			}
+		case parser.EventMatchEnd:
+			typ = WebhookMatchEnd
+		case parser.EventRoundEnd:
+			typ = WebhookRoundEnd
+		default:
+			continue
+		}
+		ev := s.event(typ, chunk.LogID, sess, pe.Time)
+		ev.Data = pe.Data
+		ev.Line = line
+		s.add(ev)
+	}
+
+	if chunk.Meta.GameScoreCT != sess.scoreCT || chunk.Meta.GameScoreT != sess.scoreT {
+		sess.scoreCT = chunk.Meta.GameScoreCT
+		sess.scoreT = chunk.Meta.GameScoreT
+		s.add(s.event(WebhookScoreUpdate, chunk.LogID, sess, chunk.Meta.Timestamp))
+	}
+
+	if len(s.pending) >= s.batchSize {
+		if err := s.flush(ctx); err != nil {
+			if pendingBefore <= len(s.pending) {
+				s.pending = s.pending[:pendingBefore]
+			}
+			*sess = saved
+			return err
+		}
+	}
+	s.lines.keep(chunk.LogID, rest)
+	return nil
+}
+
+// webhookSessionTTL is how long the session of a silent server is kept,
+// as long as the server may still continue its log
+const webhookSessionTTL = 2 * time.Hour
+
+// Tick reports servers that stopped sending and flushes aged batches.
+// Silent sessions keep their score and map, so a server that resumes
+// doesn't report them as changed.
+func (s *webhookSink) Tick(ctx context.Context, now time.Time) error {
+	for logID, sess := range s.sessions {
+		silentFor := now.Sub(sess.lastChunk)
+		switch {
+		case silentFor >= webhookSessionTTL:
+			delete(s.sessions, logID)
+		case sess.silent || silentFor < s.silentAfter:
+		default:
+			sess.silent = true
+			ev := s.event(WebhookServerSilent, logID, sess, sess.lastTime)
+			ev.Data = map[string]string{"silent_for": silentFor.Round(time.Second).String()}
+			s.add(ev)
+		}
+	}
+	if len(s.pending) > 0 && (len(s.pending) >= s.batchSize || now.Sub(s.pending[0].CreatedAt) >= s.batchInterval) {
+		return s.flush(ctx)
+	}
+	return nil
+}
+
+func (s *webhookSink) event(typ, logID string, sess *webhookSession, gameTime string) WebhookEvent {
+	return WebhookEvent{
+		Type:      typ,
+		LogID:     logID,
+		Token:     sess.token,
+		Time:      gameTime,
+		CreatedAt: time.Now().UTC(),
+		GameMap:   sess.gameMap,
+		ScoreCT:   sess.scoreCT,
+		ScoreT:    sess.scoreT,
+		TeamCT:    sess.teamCT,
+		TeamT:     sess.teamT,
+	}
+}
+
+// maxPendingEvents bounds the events kept while the webhook is unreachable
+const maxPendingEvents = 10000
+
+func (s *webhookSink) add(ev WebhookEvent) {
+	if !s.events[ev.Type] {
+		return
+	}
+	if len(s.pending) >= maxPendingEvents {
+		s.pending = s.pending[1:]
+	}
+	s.pending = append(s.pending, ev)
+}
+
+// flush sends all pending events. On failure the events stay pending and
+// are sent with the next flush; retries with backoff are up to the
+// receiver, see delivery_retries.
+func (s *webhookSink) flush(ctx context.Context) error {
+	body, err := json.Marshal(webhookBatch{Events: s.pending})
+	if err != nil {
+		return err
+	}
+	if err := s.post(ctx, body); err != nil {
+		return err
+	}
+	s.pending = nil
+	return nil
+}
+
+// post sends one signed request
+func (s *webhookSink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(SignatureTimestampHeader, ts)
+		req.Header.Set(SignatureHeader, "sha256="+Sign(s.secret, ts, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	return fmt.Errorf("webhook returned %s", resp.Status)
+}
+
+func (s *webhookSink) swapLines(b lineBuffer) lineBuffer {
+	old := s.lines
+	s.lines = b
+	return old
+}
+
+// Sign computes the webhook signature for a timestamp and body
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *webhookSink) Close() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.client.Timeout)
+	defer cancel()
+	return s.flush(ctx)
+}
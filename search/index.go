@@ -0,0 +1,221 @@
+package search
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"cs2-log-proxy/storage"
+)
+
+// timestampLayout is the layout of CS2 X-Timestamp headers
+const timestampLayout = "01/02/2006 - 15:04:05.000"
+
+// logDoc is an indexed log
+type logDoc struct {
+	id      string
+	token   string
+	gameMap string
+	start   time.Time
+	base    int     // stream offset of the first stored byte
+	end     int     // stream offset indexed up to, including partial
+	lines   []int32 // stored byte offsets of the indexed lines
+	partial string  // incomplete trailing line
+}
+
+// Index is an in-memory inverted index of the lines of every stored log.
+// Postings refer to a line by log number and line number; the line text is
+// read back from the store when a query needs it. After Build the index
+// only learns of chunks passed to Add, not of writes to the store itself.
+type Index struct {
+	store storage.Backend
+
+	mu       sync.RWMutex
+	docs     []*logDoc
+	byID     map[string]int
+	postings map[string][]uint64 // term -> doc<<32 | line
+
+	building bool
+	queued   []queuedChunk
+}
+
+type queuedChunk struct {
+	logID, token, gameMap string
+	meta                  storage.ChunkMeta
+	data                  string
+}
+
+func NewIndex(store storage.Backend) *Index {
+	return &Index{
+		store:    store,
+		byID:     make(map[string]int),
+		postings: make(map[string][]uint64),
+		building: true,
+	}
+}
+
+// Building reports whether the startup build is still running, in which
+// case queries only cover the logs indexed so far
+func (idx *Index) Building() bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.building
+}
+
+// Build indexes every stored log. Chunks added while it runs are queued
+// and indexed afterwards, skipping what the build already covered.
+func (idx *Index) Build() error {
+	start := time.Now()
+	defer func() {
+		idx.mu.Lock()
+		for _, q := range idx.queued {
+			idx.add(q.logID, q.token, q.gameMap, q.meta, q.data)
+		}
+		idx.queued = nil
+		idx.building = false
+		logs, terms := len(idx.docs), len(idx.postings)
+		idx.mu.Unlock()
+		log.Printf("Search index built in %s: %d logs, %d terms", time.Since(start).Round(time.Millisecond), logs, terms)
+	}()
+
+	tokens, err := idx.store.ListServers()
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		meta, err := idx.store.LoadServerMeta(token)
+		if err != nil {
+			return err
+		}
+		for _, lm := range meta.Logs {
+			if err := idx.indexStored(token, lm); err != nil {
+				log.Printf("Failed to index log %s: %v", lm.LogID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// indexStored indexes the part of a stored log covered by its chunk index
+func (idx *Index) indexStored(token string, lm storage.LogMeta) error {
+	metas, err := idx.store.LoadChunkMetas(lm.LogID)
+	if err != nil || len(metas) == 0 {
+		return err
+	}
+	data, err := idx.store.GetLog(lm.LogID)
+	if err != nil {
+		return err
+	}
+	base := metas[0].BeginOffset
+	if n := metas[len(metas)-1].EndOffset - base; n >= 0 && n < len(data) {
+		// Appended after the chunk index was read, queued by Add
+		data = data[:n]
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.add(lm.LogID, token, lm.GameMap, storage.ChunkMeta{
+		BeginOffset: base,
+		EndOffset:   base + len(data),
+		Timestamp:   lm.LogStartTime,
+	}, data)
+	return nil
+}
+
+// Add indexes a chunk appended to a log
+func (idx *Index) Add(logID, token, gameMap string, meta storage.ChunkMeta, data string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.building {
+		idx.queued = append(idx.queued, queuedChunk{logID, token, gameMap, meta, data})
+		return
+	}
+	idx.add(logID, token, gameMap, meta, data)
+}
+
+func (idx *Index) add(logID, token, gameMap string, meta storage.ChunkMeta, data string) {
+	n, ok := idx.byID[logID]
+	if !ok {
+		start, _ := time.Parse(timestampLayout, meta.Timestamp)
+		n = len(idx.docs)
+		idx.docs = append(idx.docs, &logDoc{
+			id:      logID,
+			token:   token,
+			gameMap: gameMap,
+			start:   start,
+			base:    meta.BeginOffset,
+			end:     meta.BeginOffset,
+		})
+		idx.byID[logID] = n
+	}
+	doc := idx.docs[n]
+	if meta.EndOffset <= doc.end {
+		return
+	}
+	if skip := doc.end - meta.BeginOffset; skip > 0 && skip < len(data) {
+		data = data[skip:]
+	}
+
+	text := doc.partial + data
+	pos := doc.end - doc.base - len(doc.partial)
+	for {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			break
+		}
+		line := text[:i]
+		ref := uint64(n)<<32 | uint64(len(doc.lines))
+		doc.lines = append(doc.lines, int32(pos))
+		for _, term := range uniqueTerms(line) {
+			idx.postings[term] = append(idx.postings[term], ref)
+		}
+		pos += i + 1
+		text = text[i+1:]
+	}
+	doc.partial = text
+	doc.end += len(data)
+}
+
+// Remove drops a log from the index
+func (idx *Index) Remove(logID string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	n, ok := idx.byID[logID]
+	if !ok {
+		return
+	}
+	// Postings keep pointing at the emptied doc and are skipped by queries
+	delete(idx.byID, logID)
+	idx.docs[n] = &logDoc{id: logID}
+}
+
+// minTermLength is the length of the shortest indexed term. Shorter
+// terms would have postings for nearly every line.
+const minTermLength = 2
+
+// terms splits text into lower case words of letters and digits
+func terms(text string) []string {
+	var out []string
+	for _, f := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(f) >= minTermLength {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func uniqueTerms(text string) []string {
+	all := terms(text)
+	seen := make(map[string]bool, len(all))
+	out := all[:0]
+	for _, t := range all {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
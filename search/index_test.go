@@ -0,0 +1,179 @@
+package search
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cs2-log-proxy/storage"
+)
+
+const (
+	logA = "a_2025-01-30T16-00-00.000"
+	logB = "b_2025-02-01T10-00-00.000"
+
+	startA = `L 01/30/2025 - 16:00:00: World triggered "Round_Start"` + "\n"
+	killA  = `L 01/30/2025 - 16:00:05: "alice<2><[U:1:1001]><CT>" killed "bob<3><[U:1:1002]><TERRORIST>" with "ak47"` + "\n"
+	endA   = `L 01/30/2025 - 16:00:10: World triggered "Round_End"` + "\n"
+	startB = `L 02/01/2025 - 10:00:00: World triggered "Round_Start"` + "\n"
+	killB  = `L 02/01/2025 - 10:00:05: "bob<3><[U:1:1002]><CT>" killed "alice<2><[U:1:1001]><TERRORIST>" with "awp"` + "\n"
+	endB   = `L 02/01/2025 - 10:00:10: World triggered "Round_End"` + "\n"
+)
+
+// testIndex stores a log of server a and the start of one of server b,
+// and indexes them. Chunks of b arrive during the build and after it.
+func testIndex(t *testing.T) (*Index, storage.Backend) {
+	t.Helper()
+	store := storage.NewLogStore(t.TempDir())
+	appendChunk := func(logID, token, gameMap, timestamp, data string) storage.ChunkMeta {
+		metas, err := store.LoadChunkMetas(logID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		begin := 0
+		if len(metas) > 0 {
+			begin = metas[len(metas)-1].EndOffset
+		}
+		meta := storage.ChunkMeta{BeginOffset: begin, EndOffset: begin + len(data), Timestamp: timestamp}
+		if err := store.AppendChunk(logID, data, meta); err != nil {
+			t.Fatal(err)
+		}
+		err = storage.UpdateServerMeta(store, token, func(sm *storage.ServerMeta) error {
+			sm.ServerInstanceToken = token
+			for i := range sm.Logs {
+				if sm.Logs[i].LogID == logID {
+					sm.Logs[i].LastByteOffset = meta.EndOffset
+					return nil
+				}
+			}
+			sm.Logs = append(sm.Logs, storage.LogMeta{LogID: logID, GameMap: gameMap, LogStartTime: timestamp, LastByteOffset: meta.EndOffset})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta
+	}
+
+	// The line of the kill is split across chunks
+	appendChunk(logA, "a", "de_dust2", "01/30/2025 - 16:00:00.000", startA+killA[:30])
+	appendChunk(logA, "a", "de_dust2", "01/30/2025 - 16:00:05.000", killA[30:]+endA)
+	idx := NewIndex(store)
+	meta := appendChunk(logB, "b", "de_inferno", "02/01/2025 - 10:00:00.000", startB)
+	idx.Add(logB, "b", "de_inferno", meta, startB)
+	// Stored before the build read the log, the queued chunk is skipped
+	meta = appendChunk(logB, "b", "de_inferno", "02/01/2025 - 10:00:05.000", killB)
+	idx.Add(logB, "b", "de_inferno", meta, killB)
+	if err := idx.Build(); err != nil {
+		t.Fatal(err)
+	}
+	meta = appendChunk(logB, "b", "de_inferno", "02/01/2025 - 10:00:10.000", endB)
+	idx.Add(logB, "b", "de_inferno", meta, endB)
+	return idx, store
+}
+
+func line(s string) string {
+	return strings.TrimSuffix(s, "\n")
+}
+
+func TestSearch(t *testing.T) {
+	idx, store := testIndex(t)
+	tests := []struct {
+		query     string
+		limit     int
+		want      []string // matching lines
+		truncated bool
+	}{
+		{"killed", 100, []string{killA, killB}, false},
+		{`"World Triggered" round_end`, 100, []string{endA, endB}, false},
+		{`"triggered world"`, 100, nil, false},
+		{"killed server:a", 100, []string{killA}, false},
+		{"round_start map:de_inferno", 100, []string{startB}, false},
+		{"round", 100, []string{startA, endA, startB, endB}, false},
+		{"round from:2025-02-01", 100, []string{startB, endB}, false},
+		{"round to:2025-01-30T16:00:05Z", 100, []string{startA}, false},
+		{"U:1:1001", 100, []string{killA, killB}, false},
+		{"round", 3, []string{startA, endA, startB}, true},
+		{"headshot", 100, nil, false},
+	}
+	for _, tt := range tests {
+		q, err := ParseQuery(tt.query)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		q.Context, q.Limit = 0, tt.limit
+		res, err := idx.Search(q)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		var got []string
+		for _, r := range res.Results {
+			got = append(got, r.Line+"\n")
+			// The offset locates the line in the stored log
+			if text, err := store.GetLog(r.LogID); err != nil || !strings.HasPrefix(text[r.Offset:], r.Line) {
+				t.Errorf("%s: %s has no %q at %d", tt.query, r.LogID, r.Line, r.Offset)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) || res.Truncated != tt.truncated {
+			t.Errorf("%s: got %q (truncated %v), want %q (truncated %v)", tt.query, got, res.Truncated, tt.want, tt.truncated)
+		}
+	}
+}
+
+func TestSearchContext(t *testing.T) {
+	idx, _ := testIndex(t)
+	res, err := idx.Search(Query{Parts: []string{"ak47"}, Context: 1, Limit: 10})
+	if err != nil || len(res.Results) != 1 {
+		t.Fatalf("Search = %+v, %v", res, err)
+	}
+	r := res.Results[0]
+	if r.LogID != logA || r.Token != "a" || r.GameMap != "de_dust2" || r.Offset != len(startA) {
+		t.Errorf("result %+v", r)
+	}
+	if !reflect.DeepEqual(r.Before, []string{line(startA)}) || !reflect.DeepEqual(r.After, []string{line(endA)}) {
+		t.Errorf("context %q / %q", r.Before, r.After)
+	}
+}
+
+func TestSearchRemove(t *testing.T) {
+	idx, _ := testIndex(t)
+	idx.Remove(logA)
+	res, err := idx.Search(Query{Parts: []string{"killed"}, Limit: 10})
+	if err != nil || len(res.Results) != 1 || res.Results[0].LogID != logB {
+		t.Errorf("Search after removing %s = %+v, %v", logA, res, err)
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	from := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in      string
+		want    Query
+		wantErr bool
+	}{
+		{`killed "Bob Smith" server:abc map:de_dust2 from:2025-01-01`,
+			Query{Parts: []string{"killed", "bob smith"}, Server: "abc", Map: "de_dust2", From: from, Context: 2, Limit: 100}, false},
+		{"[U:1:42] other:x", Query{Parts: []string{"[u:1:42]", "other:x"}, Context: 2, Limit: 100}, false},
+		{`"unterminated`, Query{}, true},
+		{"from:yesterday", Query{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseQuery(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: no error", tt.in)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, %v; want %+v", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := (&Index{}).Search(Query{Parts: []string{"a"}, Limit: 1}); err != ErrBroadQuery {
+		t.Errorf("one-letter query: err = %v, want ErrBroadQuery", err)
+	}
+	if _, err := (&Index{}).Search(Query{Parts: []string{"round"}}); err != ErrInvalidLimit {
+		t.Errorf("no limit: err = %v, want ErrInvalidLimit", err)
+	}
+}
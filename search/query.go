@@ -0,0 +1,268 @@
+package search
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"cs2-log-proxy/parser"
+)
+
+// Query is a parsed search query. Text is matched against single lines:
+// every word and every quoted phrase must appear in the line, case
+// insensitively. Server, Map and the From/To range on the line timestamp
+// (To exclusive) narrow the lines returned.
+type Query struct {
+	Parts   []string // words and phrases, lower case
+	Server  string
+	Servers map[string]bool // only these servers, nil for all
+	Map     string
+	From    time.Time
+	To      time.Time
+	Context int // lines of context before and after each hit
+	Limit   int
+}
+
+// ParseQuery parses q, e.g. `"killed Bob" server:abc map:de_dust2 from:2025-01-01 to:2025-02-01`.
+// Dates are YYYY-MM-DD or RFC 3339.
+func ParseQuery(q string) (Query, error) {
+	query := Query{Context: 2, Limit: 100}
+	for len(q) > 0 {
+		q = strings.TrimLeft(q, " \t")
+		if q == "" {
+			break
+		}
+		var part string
+		if q[0] == '"' {
+			end := strings.IndexByte(q[1:], '"')
+			if end < 0 {
+				return query, errors.New("unterminated phrase")
+			}
+			part, q = q[1:end+1], q[end+2:]
+			if part != "" {
+				query.Parts = append(query.Parts, strings.ToLower(part))
+			}
+			continue
+		}
+		if end := strings.IndexAny(q, " \t"); end >= 0 {
+			part, q = q[:end], q[end:]
+		} else {
+			part, q = q, ""
+		}
+		if err := query.addField(part); err != nil {
+			return query, err
+		}
+	}
+	return query, nil
+}
+
+// addField handles field:value filters and plain words
+func (q *Query) addField(part string) error {
+	field, value, ok := strings.Cut(part, ":")
+	if !ok || value == "" {
+		q.Parts = append(q.Parts, strings.ToLower(part))
+		return nil
+	}
+	var err error
+	switch field {
+	case "server":
+		q.Server = value
+	case "map":
+		q.Map = value
+	case "from":
+		q.From, err = ParseDate(value)
+	case "to":
+		q.To, err = ParseDate(value)
+	default:
+		// e.g. a SteamID like U:1:42
+		q.Parts = append(q.Parts, strings.ToLower(part))
+	}
+	return err
+}
+
+// ParseDate parses YYYY-MM-DD or RFC 3339 times
+func ParseDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// Result is a matching line
+type Result struct {
+	LogID   string   `json:"log_id"`
+	Token   string   `json:"server_instance_token"`
+	GameMap string   `json:"game_map"`
+	Offset  int      `json:"offset"` // byte offset of the line in the stored log
+	Line    string   `json:"line"`
+	Before  []string `json:"before,omitempty"`
+	After   []string `json:"after,omitempty"`
+}
+
+// Results of a search. Truncated is set when more lines matched than Limit.
+type Results struct {
+	Results   []Result `json:"results"`
+	Truncated bool     `json:"truncated"`
+	Indexing  bool     `json:"indexing"` // the index is still being built
+}
+
+// ErrBroadQuery is returned for queries without an indexed term
+var ErrBroadQuery = errors.New("query needs a word of at least two letters or digits")
+
+// ErrInvalidLimit is returned for queries asking for less than one hit
+var ErrInvalidLimit = errors.New("limit must be at least 1")
+
+// Search returns the matching lines, oldest log first
+func (idx *Index) Search(q Query) (*Results, error) {
+	if q.Limit < 1 {
+		return nil, ErrInvalidLimit
+	}
+	var lookup []string
+	for _, p := range q.Parts {
+		lookup = append(lookup, terms(p)...)
+	}
+	if len(lookup) == 0 {
+		return nil, ErrBroadQuery
+	}
+
+	idx.mu.RLock()
+	refs := idx.candidates(lookup)
+	type hit struct {
+		doc   *logDoc
+		lines []int32 // doc.lines as of the lookup
+		line  int
+	}
+	var hits []hit
+	for _, ref := range refs {
+		doc := idx.docs[ref>>32]
+		line := int(ref & 0xffffffff)
+		if line >= len(doc.lines) ||
+			q.Server != "" && doc.token != q.Server ||
+			q.Servers != nil && !q.Servers[doc.token] ||
+			q.Map != "" && doc.gameMap != q.Map {
+			continue
+		}
+		hits = append(hits, hit{doc: doc, lines: doc.lines, line: line})
+	}
+	building := idx.building
+	idx.mu.RUnlock()
+
+	res := &Results{Results: []Result{}, Indexing: building}
+	texts := make(map[string]string)
+	for _, h := range hits {
+		text, ok := texts[h.doc.id]
+		if !ok {
+			var err error
+			if text, err = idx.store.GetLog(h.doc.id); err != nil {
+				// Removed since it was indexed
+				texts[h.doc.id] = ""
+				continue
+			}
+			texts[h.doc.id] = text
+		}
+		lines := lineRange(text, h.lines, h.line-q.Context, h.line+q.Context)
+		at := h.line - q.Context
+		if at < 0 {
+			at = 0
+		}
+		line := lines[h.line-at]
+		if !q.matches(line, h.doc) {
+			continue
+		}
+		if len(res.Results) == q.Limit {
+			res.Truncated = true
+			break
+		}
+		res.Results = append(res.Results, Result{
+			LogID:   h.doc.id,
+			Token:   h.doc.token,
+			GameMap: h.doc.gameMap,
+			Offset:  int(h.lines[h.line]),
+			Line:    line,
+			Before:  lines[:h.line-at],
+			After:   lines[h.line-at+1:],
+		})
+	}
+	return res, nil
+}
+
+// candidates intersects the postings of all terms, in index order.
+// Callers hold idx.mu.
+func (idx *Index) candidates(lookup []string) []uint64 {
+	sort.Slice(lookup, func(i, j int) bool {
+		return len(idx.postings[lookup[i]]) < len(idx.postings[lookup[j]])
+	})
+	refs := append([]uint64(nil), idx.postings[lookup[0]]...)
+	for _, term := range lookup[1:] {
+		if len(refs) == 0 {
+			break
+		}
+		set := make(map[uint64]bool, len(refs))
+		for _, r := range refs {
+			set[r] = true
+		}
+		refs = refs[:0]
+		for _, r := range idx.postings[term] {
+			if set[r] {
+				refs = append(refs, r)
+				delete(set, r)
+			}
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+	return refs
+}
+
+// lineRange returns the indexed lines first..last of a log, clamped
+func lineRange(text string, offsets []int32, first, last int) []string {
+	if first < 0 {
+		first = 0
+	}
+	if last >= len(offsets) {
+		last = len(offsets) - 1
+	}
+	var out []string
+	for i := first; i <= last; i++ {
+		start := int(offsets[i])
+		end := len(text)
+		if i+1 < len(offsets) {
+			end = int(offsets[i+1])
+		}
+		if start > len(text) {
+			start = len(text)
+		}
+		if end > len(text) {
+			end = len(text)
+		}
+		line := text[start:end]
+		if j := strings.IndexByte(line, '\n'); j >= 0 {
+			line = line[:j]
+		}
+		out = append(out, strings.TrimRight(line, "\r"))
+	}
+	return out
+}
+
+// matches checks the parts and the date range against the line text
+func (q Query) matches(line string, doc *logDoc) bool {
+	lower := strings.ToLower(line)
+	for _, p := range q.Parts {
+		if !strings.Contains(lower, p) {
+			return false
+		}
+	}
+	if q.From.IsZero() && q.To.IsZero() {
+		return true
+	}
+	t := doc.start
+	if ts, _, ok := parser.SplitLine(line); ok {
+		for _, layout := range []string{timestampLayout, "01/02/2006 - 15:04:05"} {
+			if lt, err := time.Parse(layout, ts); err == nil {
+				t = lt
+				break
+			}
+		}
+	}
+	return (q.From.IsZero() || !t.Before(q.From)) && (q.To.IsZero() || t.Before(q.To))
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Backend stores log sessions: the metadata of every server and its logs,
+// the raw log of each session and the index of the chunks it was built from.
+// The domain only talks to a Backend, so new storage implementations can be
+// registered without touching it.
+type Backend interface {
+	// ListServers returns the ServerInstanceTokens of all known servers
+	ListServers() ([]string, error)
+	// LoadServerMeta returns the metadata of a server, or empty metadata
+	// if the server is unknown
+	LoadServerMeta(token string) (*ServerMeta, error)
+	SaveServerMeta(token string, meta *ServerMeta) error
+
+	// AppendChunk appends chunk data to a log and adds meta to its chunk index
+	AppendChunk(logID string, chunkData string, meta ChunkMeta) error
+	// LoadChunkMetas returns the chunk index of a log, empty if the log is unknown
+	LoadChunkMetas(logID string) ([]ChunkMeta, error)
+	GetLog(logID string) (string, error)
+}
+
+// BackendFactory creates a Backend from the storage configuration
+type BackendFactory func(config Config) (Backend, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = map[string]BackendFactory{
+		"file": newFileBackend,
+	}
+)
+
+// RegisterBackend makes a backend available under a storage type name
+func RegisterBackend(typ string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[typ] = factory
+}
+
+// NewBackend creates the backend selected by config.Type, "file" by default
+func NewBackend(config Config) (Backend, error) {
+	if config.Type == "" {
+		config.Type = "file"
+	}
+	if config.Path == "" {
+		config.Path = "./logs"
+	}
+	backendsMu.RLock()
+	factory, ok := backends[config.Type]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage type %q", config.Type)
+	}
+	return factory(config)
+}
+
+// Reconfigurable is implemented by backends that can apply changed
+// settings without a restart. Type, Path and S3 still require one.
+type Reconfigurable interface {
+	Reconfigure(config Config) error
+}
+
+// SessionLister is implemented by backends that index sessions and can
+// list those of all servers in one query instead of loading every
+// ServerMeta
+type SessionLister interface {
+	ListSessions() ([]ServerSession, error)
+}
+
+// PlayerIndex is implemented by backends that index the players seen in
+// each log
+type PlayerIndex interface {
+	// LogsWithPlayer returns the IDs of the logs a SteamID was seen in
+	LogsWithPlayer(steamID string) ([]string, error)
+}
+
+// ValidateConfig checks config without creating a backend
+func ValidateConfig(config Config) error {
+	if config.Type != "" {
+		backendsMu.RLock()
+		_, ok := backends[config.Type]
+		backendsMu.RUnlock()
+		if !ok {
+			return fmt.Errorf("unknown storage type %q", config.Type)
+		}
+	}
+	if _, _, err := parseCompression(config); err != nil {
+		return err
+	}
+	return validateRetention(config.Retention)
+}
+
+// newFileBackend stores logs in the flat directory layout of LogStore
+func newFileBackend(config Config) (Backend, error) {
+	if err := os.MkdirAll(config.Path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	ls := NewLogStore(config.Path)
+	ls.StartLayoutMigration()
+	if err := StartCompression(ls, config); err != nil {
+		return nil, err
+	}
+	return ls, nil
+}
+
+var (
+	_ Backend        = (*LogStore)(nil)
+	_ LogCompressor  = (*LogStore)(nil)
+	_ LogOpener      = (*LogStore)(nil)
+	_ LogDeleter     = (*LogStore)(nil)
+	_ LogStater      = (*LogStore)(nil)
+	_ Reconfigurable = (*LogStore)(nil)
+)
@@ -1,5 +1,7 @@
 package storage
 
+import "time"
+
 // ChunkMeta holds metadata about a received log chunk
 // Used for idempotency and audit
 // The JSON file will contain a list of these for each LogID
@@ -16,4 +18,11 @@ type ChunkMeta struct {
 	TickEnd     int    `json:"tick_end"`
 	TickStart   int    `json:"tick_start"`
 	Timestamp   string `json:"timestamp"`
+
+	// ReceivedAt is when the chunk first reached a proxy. Chunks relayed by
+	// another proxy keep the arrival time of the first one.
+	ReceivedAt time.Time `json:"received_at"`
+	// ProxyVia lists the IDs of the proxies the chunk passed through,
+	// starting with the one that received it from the game server
+	ProxyVia []string `json:"proxy_via,omitempty"`
 }
@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms for finished logs. The values double as
+// Content-Encoding names.
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var compressedExts = map[string]string{
+	CompressionGzip: ".gz",
+	CompressionZstd: ".zst",
+}
+
+// LogCompressor is implemented by backends that can compress a log once it
+// is finished. Appending to a compressed log transparently restores it.
+type LogCompressor interface {
+	CompressLog(logID string) error
+}
+
+// LogOpener is implemented by backends that can stream a log in its stored
+// encoding: "" for plain text, otherwise one of the Compression constants
+type LogOpener interface {
+	OpenLog(logID string) (io.ReadCloser, string, error)
+}
+
+// Decompress wraps r, which holds data in the given stored encoding, in a
+// reader returning the plain log
+func Decompress(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "":
+		return io.NopCloser(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q", encoding)
+	}
+}
+
+func compressor(w io.Writer, algo string) (io.WriteCloser, error) {
+	switch algo {
+	case CompressionGzip:
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case CompressionZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	default:
+		return nil, fmt.Errorf("unknown compression %q", algo)
+	}
+}
+
+// findLog returns the path and encoding of the stored form of a log.
+// Callers hold the log's mutex.
+func (ls *LogStore) findLog(logID string) (string, string, error) {
+	path := ls.LogPath(logID)
+	if _, err := os.Stat(path); err == nil || !os.IsNotExist(err) {
+		return path, "", err
+	}
+	for algo, ext := range compressedExts {
+		if _, err := os.Stat(path + ext); err == nil {
+			return path + ext, algo, nil
+		}
+	}
+	return "", "", &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+}
+
+// OpenLog opens a log without decompressing it
+func (ls *LogStore) OpenLog(logID string) (io.ReadCloser, string, error) {
+	m := ls.getMutex(logID)
+	m.Lock()
+	defer m.Unlock()
+	path, encoding, err := ls.findLog(logID)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, encoding, nil
+}
+
+// CompressLog replaces a plain log file with its compressed form using
+// the store's compression. It does nothing if compression is disabled or
+// the log is already compressed.
+func (ls *LogStore) CompressLog(logID string) error {
+	compression, _ := ls.compressionSettings()
+	if compression == "" {
+		return nil
+	}
+	m := ls.getMutex(logID)
+	m.Lock()
+	defer m.Unlock()
+
+	path := ls.LogPath(logID)
+	src, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst := path + compressedExts[compression]
+	if err := writeAtomic(dst, func(w io.Writer) error {
+		cw, err := compressor(w, compression)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(cw, src); err != nil {
+			cw.Close()
+			return err
+		}
+		return cw.Close()
+	}); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// restoreLog turns a compressed log back into a plain file so it can be
+// appended to. Callers hold the log's mutex.
+func (ls *LogStore) restoreLog(logID string) error {
+	path, encoding, err := ls.findLog(logID)
+	if err != nil || encoding == "" {
+		// Missing logs are created by the append
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := Decompress(f, encoding)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := writeAtomic(ls.LogPath(logID), func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	}); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// writeAtomic writes path through a temporary file that is synced and
+// renamed into place, so readers never see a partial file
+func writeAtomic(path string, write func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// CompressIdle compresses every plain log not written to since idle
+func (ls *LogStore) CompressIdle(idle time.Duration, now time.Time) (int, error) {
+	if compression, _ := ls.compressionSettings(); compression == "" {
+		return 0, nil
+	}
+	n := 0
+	err := filepath.WalkDir(ls.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		var logID string
+		switch {
+		case d.IsDir():
+			return nil
+		case d.Name() == sessionLogName:
+			rel, _ := filepath.Rel(ls.Dir, filepath.Dir(path))
+			id, ok := logIDFromDir(rel)
+			if !ok {
+				return nil
+			}
+			logID = id
+		case filepath.Dir(path) == filepath.Clean(ls.Dir) && strings.HasSuffix(d.Name(), ".log"):
+			// Not migrated yet
+			logID = strings.TrimSuffix(d.Name(), ".log")
+		default:
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || now.Sub(info.ModTime()) < idle {
+			return nil
+		}
+		if err := ls.CompressLog(logID); err != nil {
+			return fmt.Errorf("compress %s: %w", logID, err)
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// defaultCompressAfter is how long a log must be idle before it is compressed
+const defaultCompressAfter = 30 * time.Minute
+
+// parseCompression returns the compression settings of config
+func parseCompression(config Config) (string, time.Duration, error) {
+	if config.Compression != "" {
+		if _, ok := compressedExts[config.Compression]; !ok {
+			return "", 0, fmt.Errorf("unknown compression %q", config.Compression)
+		}
+	}
+	idle := defaultCompressAfter
+	if config.CompressAfter != "" {
+		d, err := time.ParseDuration(config.CompressAfter)
+		if err != nil {
+			return "", 0, fmt.Errorf("invalid compressAfter: %w", err)
+		}
+		if d <= 0 {
+			return "", 0, errors.New("compressAfter must be positive")
+		}
+		idle = d
+	}
+	return config.Compression, idle, nil
+}
+
+// SetCompression sets the algorithm finished logs are compressed with,
+// empty to keep them plain, and how long a log must be idle before it is
+// compressed in the background
+func (ls *LogStore) SetCompression(compression string, idle time.Duration) {
+	ls.compressMu.Lock()
+	ls.compression, ls.compressAfter = compression, idle
+	ls.compressMu.Unlock()
+	if compression != "" {
+		ls.compressOnce.Do(func() { go ls.compressLoop() })
+	}
+}
+
+func (ls *LogStore) compressionSettings() (string, time.Duration) {
+	ls.compressMu.RLock()
+	defer ls.compressMu.RUnlock()
+	return ls.compression, ls.compressAfter
+}
+
+// compressLoop compresses idle logs every minute, or every compressAfter
+// if that is shorter
+func (ls *LogStore) compressLoop() {
+	for {
+		_, idle := ls.compressionSettings()
+		select {
+		case <-time.After(min(idle, time.Minute)):
+		case <-ls.stop:
+			return
+		}
+		if n, err := ls.CompressIdle(idle, time.Now()); err != nil {
+			log.Printf("Log compression failed: %v", err)
+		} else if n > 0 {
+			log.Printf("Compressed %d idle logs", n)
+		}
+	}
+}
+
+// Close stops compressing idle logs in the background
+func (ls *LogStore) Close() error {
+	ls.stopOnce.Do(func() { close(ls.stop) })
+	return nil
+}
+
+// Reconfigure applies changed compression settings
+func (ls *LogStore) Reconfigure(config Config) error {
+	compression, idle, err := parseCompression(config)
+	if err != nil {
+		return err
+	}
+	ls.SetCompression(compression, idle)
+	return nil
+}
+
+// StartCompression sets the compression of ls from config and compresses
+// idle logs in the background
+func StartCompression(ls *LogStore, config Config) error {
+	return ls.Reconfigure(config)
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCompressLog(t *testing.T) {
+	const logID = "abc_2025-01-30T16-33-56.470"
+	const first, second, late = "L first\n", "L second\n", "L late\n"
+	for _, algo := range []string{CompressionGzip, CompressionZstd} {
+		t.Run(algo, func(t *testing.T) {
+			ls := NewLogStore(t.TempDir())
+			ls.SetCompression(algo, time.Hour)
+			t.Cleanup(func() { ls.Close() })
+			if err := AppendChunks(ls, logID, first+second, []ChunkMeta{
+				{EndOffset: len(first)},
+				{BeginOffset: len(first), EndOffset: len(first + second)},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := ls.CompressLog(logID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(ls.LogPath(logID)); !os.IsNotExist(err) {
+				t.Errorf("plain log kept: %v", err)
+			}
+			f, encoding, err := ls.OpenLog(logID)
+			if err != nil || encoding != algo {
+				t.Fatalf("OpenLog: %q, %v", encoding, err)
+			}
+			r, err := Decompress(f, encoding)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(r)
+			r.Close()
+			f.Close()
+			if err != nil || string(data) != first+second {
+				t.Errorf("decompressed %q, %v", data, err)
+			}
+			// Compressing twice does nothing
+			if err := ls.CompressLog(logID); err != nil {
+				t.Fatal(err)
+			}
+
+			// A late chunk restores the plain log and appends to it
+			if err := ls.AppendChunk(logID, late, ChunkMeta{BeginOffset: len(first + second), EndOffset: len(first + second + late)}); err != nil {
+				t.Fatal(err)
+			}
+			if _, encoding, err := ls.StatLog(logID); err != nil || encoding != "" {
+				t.Errorf("after a late chunk: encoding %q, %v", encoding, err)
+			}
+			if got, err := ls.GetLog(logID); err != nil || got != first+second+late {
+				t.Errorf("GetLog = %q, %v", got, err)
+			}
+			if metas, err := ls.LoadChunkMetas(logID); err != nil || len(metas) != 3 {
+				t.Errorf("LoadChunkMetas = %+v, %v", metas, err)
+			}
+		})
+	}
+}
+
+func TestCompressIdle(t *testing.T) {
+	const idle, active = "abc_2025-01-30T16-00-00.000", "abc_2025-01-30T17-00-00.000"
+	ls := NewLogStore(t.TempDir())
+	for _, logID := range []string{idle, active} {
+		if err := ls.AppendChunk(logID, "L line\n", ChunkMeta{EndOffset: 7}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	if err := os.Chtimes(ls.LogPath(idle), now.Add(-time.Hour), now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is compressed while compression is disabled
+	if n, err := ls.CompressIdle(30*time.Minute, now); err != nil || n != 0 {
+		t.Fatalf("CompressIdle without compression = %d, %v", n, err)
+	}
+	ls.SetCompression(CompressionGzip, 30*time.Minute)
+	t.Cleanup(func() { ls.Close() })
+	if n, err := ls.CompressIdle(30*time.Minute, now); err != nil || n != 1 {
+		t.Fatalf("CompressIdle = %d, %v; want 1", n, err)
+	}
+	for logID, want := range map[string]string{idle: CompressionGzip, active: ""} {
+		if _, encoding, err := ls.StatLog(logID); err != nil || encoding != want {
+			t.Errorf("%s: encoding %q, %v; want %q", logID, encoding, err, want)
+		}
+	}
+}
@@ -1,27 +1,49 @@
 package storage
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
+// LogEntry is one record of a FileStorage, stored as a JSON object per line
+type LogEntry struct {
+	Time   time.Time `json:"time"`
+	Server string    `json:"server,omitempty"`
+	Line   string    `json:"line"`
+}
+
+// FileStorage is an append-only store of log entries in rotating files
+// under config.Path. Files are rotated once they reach config.MaxFileSize.
+// Any number of StreamLogs subscribers tail the files independently, so a
+// slow subscriber never holds up writers or other subscribers.
 type FileStorage struct {
 	config    Config
 	filePath  string
 	file      *os.File
 	fileMutex sync.Mutex
-	logChan   chan string
-	closed    bool
+	// notify is closed and replaced on every write to wake subscribers
+	notify chan struct{}
+	done   chan struct{}
+	closed bool
 }
 
+const fileStoragePrefix = "cs2-log-"
+
 func NewFileStorage(config Config) (*FileStorage, error) {
 	storage := &FileStorage{
-		config:  config,
-		logChan: make(chan string, 1000),
+		config: config,
+		notify: make(chan struct{}),
+		done:   make(chan struct{}),
 	}
 
 	// Create directory if it doesn't exist
@@ -29,52 +51,61 @@ func NewFileStorage(config Config) (*FileStorage, error) {
 		return nil, fmt.Errorf("failed to create storage directory: %w", err)
 	}
 
-	// Start log processing goroutine
-	go storage.processLogs()
-
 	return storage, nil
 }
 
 func (s *FileStorage) SaveLog(ctx context.Context, log string) error {
-	select {
-	case s.logChan <- log:
-		return nil
-	case <-ctx.Done():
-		return ctx.Err()
-	}
+	return s.SaveEntry(ctx, LogEntry{Line: log})
 }
 
-func (s *FileStorage) processLogs() {
-	for {
-		log, ok := <-s.logChan
-		if !ok {
-			return
-		}
+// SaveServerLog saves a log line received from a server
+func (s *FileStorage) SaveServerLog(ctx context.Context, server, log string) error {
+	return s.SaveEntry(ctx, LogEntry{Server: server, Line: log})
+}
 
-		// Create new file if needed
-		s.fileMutex.Lock()
-		if s.file == nil || s.shouldCreateNewFile() {
-			s.closeCurrentFile()
-			if err := s.createNewFile(); err != nil {
-				fmt.Printf("Error creating new log file: %v\n", err)
-				continue
-			}
-		}
-		s.fileMutex.Unlock()
+// SaveEntry appends an entry, stamped with the current time if it has none
+func (s *FileStorage) SaveEntry(ctx context.Context, entry LogEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
 
-		// Write log
-		s.fileMutex.Lock()
-		if _, err := s.file.WriteString(log + "\n"); err != nil {
-			fmt.Printf("Error writing to log file: %v\n", err)
+	s.fileMutex.Lock()
+	defer s.fileMutex.Unlock()
+	if s.closed {
+		return errors.New("storage closed")
+	}
+
+	// Create new file if needed
+	if s.file == nil || s.shouldCreateNewFile() {
+		s.closeCurrentFile()
+		if err := s.createNewFile(); err != nil {
+			return err
 		}
-		s.fileMutex.Unlock()
 	}
+
+	if _, err := s.file.Write(data); err != nil {
+		return fmt.Errorf("failed to write log entry: %w", err)
+	}
+	close(s.notify)
+	s.notify = make(chan struct{})
+	return nil
 }
 
 func (s *FileStorage) shouldCreateNewFile() bool {
 	if s.file == nil {
 		return true
 	}
+	if s.config.MaxFileSize <= 0 {
+		return false
+	}
 
 	info, err := s.file.Stat()
 	if err != nil {
@@ -87,7 +118,7 @@ func (s *FileStorage) shouldCreateNewFile() bool {
 func (s *FileStorage) createNewFile() error {
 	s.filePath = filepath.Join(
 		s.config.Path,
-		fmt.Sprintf("cs2-log-%s.log", time.Now().Format("2006-01-02_15-04-05")),
+		fmt.Sprintf("%s%s.log", fileStoragePrefix, time.Now().Format("2006-01-02_15-04-05")),
 	)
 
 	file, err := os.OpenFile(
@@ -110,19 +141,200 @@ func (s *FileStorage) closeCurrentFile() {
 	}
 }
 
+// files returns the store's files, oldest first
+func (s *FileStorage) files() ([]string, error) {
+	entries, err := os.ReadDir(s.config.Path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasPrefix(name, fileStoragePrefix) && strings.HasSuffix(name, ".log") {
+			names = append(names, name)
+		}
+	}
+	// The timestamp in the name sorts chronologically
+	sort.Strings(names)
+	return names, nil
+}
+
+// parseEntry decodes a stored line. Files written before entries were
+// JSON contain bare log lines.
+func parseEntry(line []byte) LogEntry {
+	var entry LogEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return LogEntry{Line: string(line)}
+	}
+	return entry
+}
+
+// LogFilter selects entries in GetLogs
+type LogFilter struct {
+	Server string
+	Since  time.Time
+	Until  time.Time
+	Text   string // case-insensitive substring of the line
+	Limit  int    // newest Limit matches, 0 for all
+}
+
+func (f LogFilter) match(e LogEntry) bool {
+	if f.Server != "" && e.Server != f.Server {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return f.Text == "" || strings.Contains(strings.ToLower(e.Line), strings.ToLower(f.Text))
+}
+
+// ParseLogFilter reads a LogFilter from GetLogs filters: "server" and
+// "text" strings, "since" and "until" as time.Time or RFC 3339 strings and
+// an integer "limit"
+func ParseLogFilter(filters map[string]interface{}) (LogFilter, error) {
+	var f LogFilter
+	for key, v := range filters {
+		switch key {
+		case "server", "text":
+			s, ok := v.(string)
+			if !ok {
+				return f, fmt.Errorf("filter %s must be a string", key)
+			}
+			if key == "server" {
+				f.Server = s
+			} else {
+				f.Text = s
+			}
+		case "since", "until":
+			var t time.Time
+			switch tv := v.(type) {
+			case time.Time:
+				t = tv
+			case string:
+				var err error
+				if t, err = time.Parse(time.RFC3339, tv); err != nil {
+					return f, fmt.Errorf("filter %s: %w", key, err)
+				}
+			default:
+				return f, fmt.Errorf("filter %s must be a time", key)
+			}
+			if key == "since" {
+				f.Since = t
+			} else {
+				f.Until = t
+			}
+		case "limit":
+			switch n := v.(type) {
+			case int:
+				f.Limit = n
+			case float64:
+				f.Limit = int(n)
+			default:
+				return f, fmt.Errorf("filter limit must be a number")
+			}
+		default:
+			return f, fmt.Errorf("unknown filter %q", key)
+		}
+	}
+	return f, nil
+}
+
+// GetLogs returns the lines of entries matching filters, oldest first.
+// See ParseLogFilter for the supported filters.
 func (s *FileStorage) GetLogs(ctx context.Context, filters map[string]interface{}) ([]string, error) {
-	// TODO: Implement log retrieval with filters
-	return nil, nil
+	f, err := ParseLogFilter(filters)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.QueryLogs(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		lines[i] = e.Line
+	}
+	return lines, nil
+}
+
+// QueryLogs returns the entries matching f, oldest first
+func (s *FileStorage) QueryLogs(ctx context.Context, f LogFilter) ([]LogEntry, error) {
+	names, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	result := []LogEntry{}
+	for i, name := range names {
+		// A file only holds entries written before the next file was created
+		if !f.Since.IsZero() && i+1 < len(names) {
+			if next, ok := fileStorageTime(names[i+1]); ok && next.Before(f.Since) {
+				continue
+			}
+		}
+		if start, ok := fileStorageTime(name); ok && !f.Until.IsZero() && !start.Before(f.Until) {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := s.scanFile(name, func(e LogEntry) {
+			if f.match(e) {
+				result = append(result, e)
+			}
+		}); err != nil {
+			return nil, err
+		}
+	}
+	if f.Limit > 0 && len(result) > f.Limit {
+		result = result[len(result)-f.Limit:]
+	}
+	return result, nil
 }
 
+// fileStorageTime returns the creation time encoded in a file name
+func fileStorageTime(name string) (time.Time, bool) {
+	ts := strings.TrimSuffix(strings.TrimPrefix(name, fileStoragePrefix), ".log")
+	t, err := time.ParseInLocation("2006-01-02_15-04-05", ts, time.Local)
+	return t, err == nil
+}
+
+func (s *FileStorage) scanFile(name string, fn func(LogEntry)) error {
+	f, err := os.Open(filepath.Join(s.config.Path, name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial line is still being written
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(parseEntry(line[:len(line)-1]))
+	}
+}
+
+// StreamLogs returns a channel receiving the lines of every entry saved
+// from now on. Each call gets an independent subscription that reads the
+// files at its own pace; it ends when ctx is done or the storage is closed.
 func (s *FileStorage) StreamLogs(ctx context.Context) (<-chan string, error) {
+	entries, err := s.StreamEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
 	out := make(chan string)
 	go func() {
 		defer close(out)
-		for {
+		for e := range entries {
 			select {
-			case log := <-s.logChan:
-				out <- log
+			case out <- e.Line:
 			case <-ctx.Done():
 				return
 			}
@@ -131,11 +343,137 @@ func (s *FileStorage) StreamLogs(ctx context.Context) (<-chan string, error) {
 	return out, nil
 }
 
+// StreamEntries is StreamLogs with the full entries
+func (s *FileStorage) StreamEntries(ctx context.Context) (<-chan LogEntry, error) {
+	s.fileMutex.Lock()
+	if s.closed {
+		s.fileMutex.Unlock()
+		return nil, errors.New("storage closed")
+	}
+	// Start at the current end of the newest file
+	c := &streamCursor{s: s}
+	names, err := s.files()
+	if err == nil && len(names) > 0 {
+		c.name = names[len(names)-1]
+		if info, err := os.Stat(filepath.Join(s.config.Path, c.name)); err == nil {
+			c.offset = info.Size()
+		}
+	}
+	s.fileMutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan LogEntry)
+	go c.run(ctx, out)
+	return out, nil
+}
+
+// streamCursor is the position of one subscriber in the files
+type streamCursor struct {
+	s      *FileStorage
+	name   string // current file, empty before the first file exists
+	offset int64
+}
+
+func (c *streamCursor) run(ctx context.Context, out chan<- LogEntry) {
+	defer close(out)
+	for {
+		c.s.fileMutex.Lock()
+		notify := c.s.notify
+		c.s.fileMutex.Unlock()
+
+		// Drain everything written so far, then wait for the next write
+		for {
+			entries, more, err := c.read()
+			if err != nil {
+				fmt.Printf("Error streaming logs: %v\n", err)
+				return
+			}
+			for _, e := range entries {
+				select {
+				case out <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if !more {
+				break
+			}
+		}
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return
+		case <-c.s.done:
+			return
+		}
+	}
+}
+
+// read returns the complete entries after the cursor in the current file,
+// or moves to the next file once the current one is exhausted. more
+// reports whether another read may return further entries right away.
+func (c *streamCursor) read() ([]LogEntry, bool, error) {
+	names, err := c.s.files()
+	if err != nil {
+		return nil, false, err
+	}
+	if c.name == "" {
+		if len(names) == 0 {
+			return nil, false, nil
+		}
+		c.name = names[0]
+	}
+
+	f, err := os.Open(filepath.Join(c.s.config.Path, c.name))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	var entries []LogEntry
+	if err == nil {
+		defer f.Close()
+		if _, err := f.Seek(c.offset, io.SeekStart); err != nil {
+			return nil, false, err
+		}
+		r := bufio.NewReader(f)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, false, err
+			}
+			c.offset += int64(len(line))
+			entries = append(entries, parseEntry(line[:len(line)-1]))
+		}
+	}
+	if len(entries) > 0 {
+		return entries, true, nil
+	}
+
+	// The current file is exhausted, continue with the next one if any
+	i := sort.SearchStrings(names, c.name)
+	if i < len(names) && names[i] == c.name {
+		i++
+	}
+	if i < len(names) {
+		c.name, c.offset = names[i], 0
+		return nil, true, nil
+	}
+	return nil, false, nil
+}
+
 func (s *FileStorage) Close() error {
-	s.closed = true
-	close(s.logChan)
 	s.fileMutex.Lock()
+	defer s.fileMutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
 	s.closeCurrentFile()
-	s.fileMutex.Unlock()
 	return nil
 }
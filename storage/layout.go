@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// LayoutVersion is the on-disk layout written by LogStore:
+//
+//	layout.json
+//	{server}/server.json
+//	{server}/{yyyy}/{mm}/{yyyy-mm-ddThh-mm-ss.sss}/session.log (.gz, .zst)
+//	{server}/{yyyy}/{mm}/{yyyy-mm-ddThh-mm-ss.sss}/chunks.json
+//	_other/{logid}/...   logs whose ID doesn't name a server and start time
+//
+// Version 1 is the original flat layout with every file directly in Dir.
+// Version 2 introduced the sharded layout but kept the former log IDs in
+// server.json; version 3 rewrites them to the IDs of NewLogID. Stores of
+// an older version are migrated by MigrateLayout and read from both
+// layouts until it finishes.
+const LayoutVersion = 3
+
+const (
+	layoutMarker    = "layout.json"
+	serverMetaName  = "server.json"
+	sessionLogName  = "session.log"
+	chunkIndexName  = "chunks.json"
+	unshardedLogDir = "_other"
+)
+
+type layoutInfo struct {
+	Version int `json:"version"`
+}
+
+// SafeName escapes s for use as a single path element. Letters, digits,
+// '-', '_' and non-leading '.' are kept, everything else becomes %XX, so
+// the name can be turned back with url.PathUnescape.
+func SafeName(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' ||
+			c == '.' && i > 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (ls *LogStore) serverDir(token string) string {
+	return filepath.Join(ls.Dir, SafeName(token))
+}
+
+// logDir is the directory of a log in the sharded layout. Logs are filed
+// under the server their ID names, see CheckLogOwners.
+func (ls *LogStore) logDir(logID string) string {
+	logID = CanonicalLogID(logID)
+	m := logIDRe.FindStringSubmatch(logID)
+	if m == nil {
+		return filepath.Join(ls.Dir, unshardedLogDir, SafeName(logID))
+	}
+	token, ok := unescapeToken(m[1])
+	if !ok {
+		return filepath.Join(ls.Dir, unshardedLogDir, SafeName(logID))
+	}
+	year, month := m[2], m[3]
+	name := fmt.Sprintf("%s-%s-%sT%s-%s-%s%s", year, month, m[4], m[5], m[6], m[7], m[8])
+	return filepath.Join(ls.serverDir(token), year, month, name)
+}
+
+// logIDFromDir is the inverse of logDir for a log directory relative to Dir
+func logIDFromDir(rel string) (string, bool) {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if len(parts) == 2 && parts[0] == unshardedLogDir {
+		id, err := url.PathUnescape(parts[1])
+		return id, err == nil
+	}
+	if len(parts) != 4 {
+		return "", false
+	}
+	if _, ok := tokenFromDir(parts[0]); !ok || !logDirRe.MatchString(parts[3]) {
+		return "", false
+	}
+	return parts[0] + "_" + parts[3], true
+}
+
+// logDirRe matches the directory names created by logDir
+var logDirRe = regexp.MustCompile(`^(\d{4})-(\d{2})-(\d{2})T(\d{2})-(\d{2})-(\d{2})(\.\d+)?$`)
+
+// legacy paths of the flat layout, named after the former log ID. They
+// are only read until MigrateLayout has moved them.
+func (ls *LogStore) legacyLogPath(logID string) string {
+	return filepath.Join(ls.Dir, legacyName(logID)+".log")
+}
+
+func (ls *LogStore) legacyChunkIndexPath(logID string) string {
+	return filepath.Join(ls.Dir, legacyName(logID)+"_chunks.json")
+}
+
+// legacyName is the name of a log's flat layout files
+func legacyName(logID string) string {
+	if former, ok := FormerLogID(logID); ok {
+		return former
+	}
+	return logID
+}
+
+func (ls *LogStore) legacyServerMetaPath(token string) string {
+	return filepath.Join(ls.Dir, "server_"+token+".json")
+}
+
+// legacyLogFiles returns the existing flat layout files of a log
+func (ls *LogStore) legacyLogFiles(logID string) []string {
+	if !ls.legacy.Load() {
+		return nil
+	}
+	var files []string
+	candidates := []string{ls.legacyLogPath(logID), ls.legacyChunkIndexPath(logID)}
+	for _, ext := range compressedExts {
+		candidates = append(candidates, ls.legacyLogPath(logID)+ext)
+	}
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// detectLayout reads the layout marker and checks whether Dir still holds
+// flat layout files
+func (ls *LogStore) detectLayout() {
+	data, err := os.ReadFile(filepath.Join(ls.Dir, layoutMarker))
+	if err == nil {
+		var info layoutInfo
+		if json.Unmarshal(data, &info) == nil {
+			ls.version = info.Version
+		}
+		if ls.version >= LayoutVersion {
+			return
+		}
+	}
+	entries, err := os.ReadDir(ls.Dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() && isLegacyFile(e.Name()) {
+			ls.legacy.Store(true)
+			return
+		}
+	}
+}
+
+func isLegacyFile(name string) bool {
+	if strings.HasPrefix(name, "server_") && strings.HasSuffix(name, ".json") ||
+		strings.HasSuffix(name, "_chunks.json") || strings.HasSuffix(name, ".log") {
+		return true
+	}
+	for _, ext := range compressedExts {
+		if strings.HasSuffix(name, ".log"+ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyLogID returns the log ID of a flat layout log file
+func legacyLogID(name string) (string, bool) {
+	for _, suffix := range []string{"_chunks.json", ".log", ".log.gz", ".log.zst"} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), true
+		}
+	}
+	return "", false
+}
+
+// MigrateLayout moves flat layout files into the sharded layout, rewrites
+// the former log IDs in server.json files, writes the layout marker and
+// returns the number of files moved or rewritten. Each log and server is
+// migrated under its lock, so the store keeps serving reads and writes
+// while the migration runs.
+func (ls *LogStore) MigrateLayout() (int, error) {
+	moved := 0
+	if ls.legacy.Load() {
+		entries, err := os.ReadDir(ls.Dir)
+		if err != nil {
+			return 0, err
+		}
+		for _, e := range entries {
+			name := e.Name()
+			if e.IsDir() {
+				continue
+			}
+			if strings.HasPrefix(name, "server_") && strings.HasSuffix(name, ".json") {
+				token := strings.TrimSuffix(strings.TrimPrefix(name, "server_"), ".json")
+				n, err := ls.migrateServer(token)
+				if err != nil {
+					return moved, fmt.Errorf("server %s: %w", token, err)
+				}
+				moved += n
+			} else if logID, ok := legacyLogID(name); ok {
+				// All files of the log move together, later entries find nothing left
+				n, err := ls.migrateLog(logID)
+				if err != nil {
+					return moved, fmt.Errorf("log %s: %w", logID, err)
+				}
+				moved += n
+			}
+		}
+	}
+
+	tokens, err := ls.ListServers()
+	if err != nil && !os.IsNotExist(err) {
+		return moved, err
+	}
+	for _, token := range tokens {
+		n, err := ls.migrateLogIDs(token)
+		if err != nil {
+			return moved, fmt.Errorf("server %s: %w", token, err)
+		}
+		moved += n
+	}
+
+	if err := os.MkdirAll(ls.Dir, 0755); err != nil {
+		return moved, err
+	}
+	data, _ := json.Marshal(layoutInfo{Version: LayoutVersion})
+	if err := os.WriteFile(filepath.Join(ls.Dir, layoutMarker), data, 0644); err != nil {
+		return moved, err
+	}
+	ls.legacy.Store(false)
+	return moved, nil
+}
+
+func (ls *LogStore) migrateServer(token string) (int, error) {
+	m := ls.getMutex(serverLockKey(token))
+	m.Lock()
+	defer m.Unlock()
+	src := ls.legacyServerMetaPath(token)
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return 0, nil
+	}
+	dst := filepath.Join(ls.serverDir(token), serverMetaName)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// migrateLogIDs rewrites the former log IDs in a server's metadata. The
+// log files don't move, logDir is the same for both IDs.
+func (ls *LogStore) migrateLogIDs(token string) (int, error) {
+	m := ls.getMutex(serverLockKey(token))
+	m.Lock()
+	defer m.Unlock()
+	f, err := os.Open(ls.ServerMetaPath(token))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var meta ServerMeta
+	err = json.NewDecoder(f).Decode(&meta)
+	f.Close()
+	if err != nil {
+		return 0, err
+	}
+	changed := CanonicalizeLogIDs(&meta)
+	// Logs of other servers could only be added by importing crafted
+	// archives; their files are with the other server
+	logs := meta.Logs[:0]
+	for _, lm := range meta.Logs {
+		if owner, ok := LogIDOwner(lm.LogID); ok && owner != token {
+			log.Printf("Removing log %s of server %s from server %s", lm.LogID, owner, token)
+			changed = true
+			continue
+		}
+		logs = append(logs, lm)
+	}
+	meta.Logs = logs
+	if !changed {
+		return 0, nil
+	}
+	return 1, ls.saveServerMeta(token, &meta)
+}
+
+func (ls *LogStore) migrateLog(logID string) (int, error) {
+	m := ls.getMutex(logID)
+	m.Lock()
+	defer m.Unlock()
+	files := ls.legacyLogFiles(logID)
+	if len(files) == 0 {
+		return 0, nil
+	}
+	dir := ls.logDir(logID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	for _, src := range files {
+		var dst string
+		if strings.HasSuffix(src, "_chunks.json") {
+			dst = filepath.Join(dir, chunkIndexName)
+		} else {
+			dst = filepath.Join(dir, sessionLogName+strings.TrimPrefix(src, ls.legacyLogPath(logID)))
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return 0, err
+		}
+	}
+	return len(files), nil
+}
+
+// StartLayoutMigration migrates a store of an older layout in the
+// background. New stores get the layout marker right away.
+func (ls *LogStore) StartLayoutMigration() {
+	if !ls.legacy.Load() && (ls.version == 0 || ls.version >= LayoutVersion) {
+		if _, err := ls.MigrateLayout(); err != nil {
+			log.Printf("Failed to write storage layout marker: %v", err)
+		}
+		return
+	}
+	go func() {
+		log.Printf("Migrating %s to storage layout %d", ls.Dir, LayoutVersion)
+		n, err := ls.MigrateLayout()
+		if err != nil {
+			log.Printf("Storage layout migration failed after %d files: %v", n, err)
+			return
+		}
+		log.Printf("Migrated %d files to storage layout %d", n, LayoutVersion)
+	}()
+}
+
+func serverLockKey(token string) string {
+	return "server:" + token
+}
+
+// tokenFromDir turns a server directory name back into its token
+func tokenFromDir(name string) (string, bool) {
+	token, err := url.PathUnescape(name)
+	return token, err == nil && name != unshardedLogDir
+}
@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogIDs(t *testing.T) {
+	const timestamp = "01/30/2025 - 16:33:56.470"
+	tests := []struct {
+		token, timestamp string
+		id, former       string
+		owner            string
+	}{
+		{"abc", timestamp, "abc_2025-01-30T16-33-56.470", "abc_01_30_2025 - 16:33:56.470", "abc"},
+		{"a_b", timestamp, "a_b_2025-01-30T16-33-56.470", "a_b_01_30_2025 - 16:33:56.470", "a_b"},
+		{"a b/c", timestamp, "a%20b%2Fc_2025-01-30T16-33-56.470", "a b/c_01_30_2025 - 16:33:56.470", "a b/c"},
+		{"abc", "01/30/2025 - 16:33:56", "abc_2025-01-30T16-33-56", "abc_01_30_2025 - 16:33:56", "abc"},
+		{"abc", "yesterday", "abc_yesterday", "", ""},
+	}
+	for _, tt := range tests {
+		id := NewLogID(tt.token, tt.timestamp)
+		if id != tt.id {
+			t.Errorf("NewLogID(%q, %q) = %q, want %q", tt.token, tt.timestamp, id, tt.id)
+			continue
+		}
+		if strings.ContainsAny(id, " /:\\") {
+			t.Errorf("%q is not filesystem safe", id)
+		}
+		if former, ok := FormerLogID(id); former != tt.former || ok != (tt.former != "") {
+			t.Errorf("FormerLogID(%q) = %q, %v, want %q", id, former, ok, tt.former)
+		}
+		if tt.former != "" {
+			if got := CanonicalLogID(tt.former); got != id {
+				t.Errorf("CanonicalLogID(%q) = %q, want %q", tt.former, got, id)
+			}
+		}
+		if got := CanonicalLogID(id); got != id {
+			t.Errorf("CanonicalLogID(%q) = %q, want it unchanged", id, got)
+		}
+		if owner, ok := LogIDOwner(id); owner != tt.owner || ok != (tt.owner != "") {
+			t.Errorf("LogIDOwner(%q) = %q, %v, want %q", id, owner, ok, tt.owner)
+		}
+	}
+}
+
+func TestLogDirOfFormerID(t *testing.T) {
+	ls := NewLogStore(t.TempDir())
+	const id, former = "abc_2025-01-30T16-33-56.470", "abc_01_30_2025 - 16:33:56.470"
+	if ls.logDir(id) != ls.logDir(former) {
+		t.Errorf("logDir(%q) = %s, logDir(%q) = %s", id, ls.logDir(id), former, ls.logDir(former))
+	}
+	if want := filepath.Join(ls.Dir, "abc", "2025", "01", "2025-01-30T16-33-56.470"); ls.logDir(id) != want {
+		t.Errorf("logDir(%q) = %s, want %s", id, ls.logDir(id), want)
+	}
+	rel, _ := filepath.Rel(ls.Dir, ls.logDir(id))
+	if got, ok := logIDFromDir(rel); !ok || got != id {
+		t.Errorf("logIDFromDir(%s) = %q, %v, want %q", rel, got, ok, id)
+	}
+	// IDs that don't name a server stay out of the server directories
+	for _, other := range []string{"imported", "x y_2025-01-30T16-33-56.470"} {
+		if dir := ls.logDir(other); !strings.HasPrefix(dir, filepath.Join(ls.Dir, unshardedLogDir)) {
+			t.Errorf("logDir(%q) = %s, want it under %s", other, dir, unshardedLogDir)
+		}
+	}
+}
+
+// writeFile writes a file below dir, creating its directory
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateFormerLogIDs(t *testing.T) {
+	const (
+		id     = "abc_2025-01-30T16-33-56.470"
+		former = "abc_01_30_2025 - 16:33:56.470"
+		data   = "L first\n"
+		chunks = `[{"begin_offset":0,"end_offset":8}]`
+		meta   = `{"server_instance_token":"abc","logs":[{"log_id":"` + former + `","last_byte_offset":8}]}`
+	)
+	tests := []struct {
+		name  string
+		store func(t *testing.T, dir string)
+	}{
+		{"flat layout", func(t *testing.T, dir string) {
+			writeFile(t, filepath.Join(dir, "server_abc.json"), meta)
+			writeFile(t, filepath.Join(dir, former+".log"), data)
+			writeFile(t, filepath.Join(dir, former+"_chunks.json"), chunks)
+		}},
+		{"layout version 2", func(t *testing.T, dir string) {
+			logDir := filepath.Join(dir, "abc", "2025", "01", "2025-01-30T16-33-56.470")
+			writeFile(t, filepath.Join(dir, layoutMarker), `{"version":2}`)
+			writeFile(t, filepath.Join(dir, "abc", serverMetaName), meta)
+			writeFile(t, filepath.Join(logDir, sessionLogName), data)
+			writeFile(t, filepath.Join(logDir, chunkIndexName), chunks)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.store(t, dir)
+
+			// Reads map the former ID before the migration ran
+			ls := NewLogStore(dir)
+			if got, err := ls.GetLog(id); err != nil || got != data {
+				t.Fatalf("GetLog before migrating = %q, %v", got, err)
+			}
+			if _, err := ls.MigrateLayout(); err != nil {
+				t.Fatal(err)
+			}
+
+			// and after a restart, by both IDs
+			ls = NewLogStore(dir)
+			if ls.legacy.Load() || ls.version != LayoutVersion {
+				t.Errorf("reopened store: legacy %v, version %d", ls.legacy.Load(), ls.version)
+			}
+			raw, err := os.ReadFile(ls.ServerMetaPath("abc"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var saved ServerMeta
+			if err := json.Unmarshal(raw, &saved); err != nil || len(saved.Logs) != 1 || saved.Logs[0].LogID != id {
+				t.Errorf("server.json = %s, %v", raw, err)
+			}
+			for _, logID := range []string{id, former} {
+				if got, err := ls.GetLog(logID); err != nil || got != data {
+					t.Errorf("GetLog(%q) = %q, %v", logID, got, err)
+				}
+				if metas, err := ls.LoadChunkMetas(logID); err != nil || len(metas) != 1 || metas[0].EndOffset != 8 {
+					t.Errorf("LoadChunkMetas(%q) = %+v, %v", logID, metas, err)
+				}
+			}
+			if entries, _ := filepath.Glob(filepath.Join(dir, "*.log")); len(entries) != 0 {
+				t.Errorf("flat layout files left: %v", entries)
+			}
+		})
+	}
+}
+
+func TestSaveServerMetaOwners(t *testing.T) {
+	ls := NewLogStore(t.TempDir())
+	tests := []struct {
+		logID string
+		ok    bool
+	}{
+		{"abc_2025-01-30T16-33-56.470", true},
+		{"abc_01_30_2025 - 16:33:56.470", true},
+		{"imported", true},
+		{"xyz_2025-01-30T16-33-56.470", false},
+		{"xyz_01_30_2025 - 16:33:56.470", false},
+		{"ab_2025-01-30T16-33-56.470", false},
+	}
+	for _, tt := range tests {
+		meta := &ServerMeta{ServerInstanceToken: "abc", Logs: []LogMeta{{LogID: tt.logID}}}
+		if err := ls.SaveServerMeta("abc", meta); (err == nil) != tt.ok {
+			t.Errorf("SaveServerMeta with log %q: err = %v", tt.logID, err)
+		}
+	}
+}
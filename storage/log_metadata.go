@@ -1,5 +1,11 @@
 package storage
 
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
 // LogMeta holds metadata about a single log session
 // LogID is unique per log: ServerInstanceToken + LogStartTime
 // LogStartTime is the timestamp of the first chunk with BeginOffset == 0
@@ -12,14 +18,58 @@ type LogMeta struct {
 	ServerAddr     string `json:"server_addr"`
 	LastActivity   string `json:"last_activity"`
 	LastByteOffset int    `json:"last_byte_offset"`
+
+	// First and last arrival time of the log's chunks, see ChunkMeta.ReceivedAt
+	FirstReceivedAt time.Time `json:"first_received_at"`
+	LastReceivedAt  time.Time `json:"last_received_at"`
+
+	// Protected logs are never removed by retention
+	Protected bool `json:"protected,omitempty"`
+}
+
+// ServerSession is the metadata of a log together with its server
+type ServerSession struct {
+	Token   string `json:"server_instance_token"`
+	SteamID string `json:"steam_id"`
+	LogMeta
 }
 
 type ServerMeta struct {
 	ServerInstanceToken string    `json:"server_instance_token"`
 	SteamID             string    `json:"steam_id"`
+	UniqueToken         string    `json:"unique_token,omitempty"` // X-Server-Unique-Token, CRC64 of the log secret
 	Logs                []LogMeta `json:"logs"`
 }
 
+// serverMetaLocks serialize the load, change and save of ServerMeta per
+// server. Tokens are hashed onto a fixed set of locks.
+var serverMetaLocks [256]sync.Mutex
+
+// LockServerMeta locks the metadata of a server and returns the function
+// unlocking it. Whoever loads a ServerMeta to save it again must hold the
+// lock, or concurrent changes are lost. Don't lock two servers at once.
+func LockServerMeta(token string) (unlock func()) {
+	h := fnv.New32a()
+	h.Write([]byte(token))
+	mu := &serverMetaLocks[h.Sum32()%uint32(len(serverMetaLocks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// UpdateServerMeta loads the metadata of a server, changes it with update
+// and saves it, holding LockServerMeta. Nothing is saved if update fails.
+func UpdateServerMeta(b Backend, token string, update func(meta *ServerMeta) error) error {
+	defer LockServerMeta(token)()
+	meta, err := b.LoadServerMeta(token)
+	if err != nil {
+		return err
+	}
+	if err := update(meta); err != nil {
+		return err
+	}
+	return b.SaveServerMeta(token, meta)
+}
+
 // Legacy: LogMetadata stores per-log metadata (one file per ServerInstanceToken)
 type LogMetadata struct {
 	ServerInstanceToken string `json:"server_instance_token"`
@@ -5,34 +5,89 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // LogStore manages log file and chunk metadata for each ServerInstanceToken
 type LogStore struct {
-	Dir      string
-	mutexMap map[string]*sync.Mutex // per-token mutex
+	Dir string
+
+	// compression settings, see SetCompression
+	compressMu    sync.RWMutex
+	compression   string
+	compressAfter time.Duration
+	compressOnce  sync.Once
+	stop          chan struct{} // closed by Close
+	stopOnce      sync.Once
+
+	mutexMap map[string]*sync.Mutex // per-log and per-server mutex
 	mu       sync.Mutex             // guards mutexMap
+
+	// legacy is set while Dir still holds flat layout files, see LayoutVersion
+	legacy atomic.Bool
+	// version is the layout version found by detectLayout, 0 without marker
+	version int
 }
 
 func NewLogStore(dir string) *LogStore {
-	return &LogStore{
+	ls := &LogStore{
 		Dir:      dir,
 		mutexMap: make(map[string]*sync.Mutex),
+		stop:     make(chan struct{}),
 	}
+	ls.detectLayout()
+	return ls
 }
 
-func (ls *LogStore) getMutex(token string) *sync.Mutex {
+// getMutex returns the mutex of a log, or of a server for serverLockKey.
+// A log has the same mutex under its former ID.
+func (ls *LogStore) getMutex(key string) *sync.Mutex {
+	key = CanonicalLogID(key)
 	ls.mu.Lock()
 	defer ls.mu.Unlock()
-	m, ok := ls.mutexMap[token]
+	m, ok := ls.mutexMap[key]
 	if !ok {
 		m = &sync.Mutex{}
-		ls.mutexMap[token] = m
+		ls.mutexMap[key] = m
 	}
 	return m
 }
 
+// LogPath is the path of a log's raw log file. Logs not migrated yet are
+// still found at their flat layout path.
+func (ls *LogStore) LogPath(logID string) string {
+	if len(ls.legacyLogFiles(logID)) > 0 {
+		return ls.legacyLogPath(logID)
+	}
+	return filepath.Join(ls.logDir(logID), sessionLogName)
+}
+
+// ChunkIndexPath is the path of a log's chunk index
+func (ls *LogStore) ChunkIndexPath(logID string) string {
+	if len(ls.legacyLogFiles(logID)) > 0 {
+		return ls.legacyChunkIndexPath(logID)
+	}
+	return filepath.Join(ls.logDir(logID), chunkIndexName)
+}
+
+// ServerMetaPath is the path of a server's metadata file
+func (ls *LogStore) ServerMetaPath(token string) string {
+	if ls.legacy.Load() {
+		if path := ls.legacyServerMetaPath(token); fileExists(path) {
+			return path
+		}
+	}
+	return filepath.Join(ls.serverDir(token), serverMetaName)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
 // SaveLogMetadata writes metadata for a log (ServerInstanceToken, GameMap)
 func (ls *LogStore) SaveLogMetadata(token string, meta LogMetadata) error {
 	metaPath := filepath.Join(ls.Dir, token+"_meta.json")
@@ -46,17 +101,31 @@ func (ls *LogStore) SaveLogMetadata(token string, meta LogMetadata) error {
 	return enc.Encode(meta)
 }
 
-// ListTokens returns all log tokens by scanning for *_meta.json files
+// ListServers returns all server tokens by scanning for server directories
+// and, until migrated, flat layout server_*.json files
 func (ls *LogStore) ListServers() ([]string, error) {
 	dirEntries, err := os.ReadDir(ls.Dir)
 	if err != nil {
 		return nil, err
 	}
 	tokens := []string{}
+	seen := make(map[string]bool)
 	for _, entry := range dirEntries {
 		name := entry.Name()
-		if len(name) > 7 && name[:7] == "server_" {
-			token := name[7 : len(name)-5]
+		var token string
+		if entry.IsDir() {
+			t, ok := tokenFromDir(name)
+			if !ok || !fileExists(filepath.Join(ls.Dir, name, serverMetaName)) {
+				continue
+			}
+			token = t
+		} else if strings.HasPrefix(name, "server_") && strings.HasSuffix(name, ".json") {
+			token = strings.TrimSuffix(strings.TrimPrefix(name, "server_"), ".json")
+		} else {
+			continue
+		}
+		if !seen[token] {
+			seen[token] = true
 			tokens = append(tokens, token)
 		}
 	}
@@ -65,13 +134,17 @@ func (ls *LogStore) ListServers() ([]string, error) {
 
 // LoadServerMeta loads ServerMeta for a given ServerInstanceToken
 func (ls *LogStore) LoadServerMeta(token string) (*ServerMeta, error) {
-	metaPath := filepath.Join(ls.Dir, "server_"+token+".json")
+	m := ls.getMutex(serverLockKey(token))
+	m.Lock()
+	defer m.Unlock()
+	metaPath := ls.ServerMetaPath(token)
 	var meta ServerMeta
 	if f, err := os.Open(metaPath); err == nil {
 		defer f.Close()
 		if err := json.NewDecoder(f).Decode(&meta); err != nil {
 			return nil, err
 		}
+		CanonicalizeLogIDs(&meta)
 		return &meta, nil
 	} else if os.IsNotExist(err) {
 		return &ServerMeta{ServerInstanceToken: token, Logs: []LogMeta{}}, nil
@@ -80,9 +153,24 @@ func (ls *LogStore) LoadServerMeta(token string) (*ServerMeta, error) {
 	}
 }
 
-// SaveServerMeta writes ServerMeta to disk
+// SaveServerMeta writes ServerMeta to disk. Logs of other servers are
+// refused, see CheckLogOwners.
 func (ls *LogStore) SaveServerMeta(token string, meta *ServerMeta) error {
-	metaPath := filepath.Join(ls.Dir, "server_"+token+".json")
+	CanonicalizeLogIDs(meta)
+	if err := CheckLogOwners(token, meta); err != nil {
+		return err
+	}
+	m := ls.getMutex(serverLockKey(token))
+	m.Lock()
+	defer m.Unlock()
+	return ls.saveServerMeta(token, meta)
+}
+
+func (ls *LogStore) saveServerMeta(token string, meta *ServerMeta) error {
+	metaPath := ls.ServerMetaPath(token)
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0755); err != nil {
+		return err
+	}
 	f, err := os.OpenFile(metaPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
@@ -95,19 +183,14 @@ func (ls *LogStore) SaveServerMeta(token string, meta *ServerMeta) error {
 
 // AppendChunk appends chunk data to log file and updates chunk metadata for a given LogID
 func (ls *LogStore) AppendChunk(logID string, chunkData string, meta ChunkMeta) error {
-	logPath := filepath.Join(ls.Dir, logID+".log")
-	metaPath := filepath.Join(ls.Dir, logID+"_chunks.json")
+	m := ls.getMutex(logID)
+	m.Lock()
+	defer m.Unlock()
 
-	// Append chunk to log file
-	f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
+	if _, err := ls.appendLogData(logID, chunkData); err != nil {
 		return err
 	}
-	if _, err := f.WriteString(chunkData); err != nil {
-		f.Close()
-		return err
-	}
-	f.Close()
+	metaPath := ls.ChunkIndexPath(logID)
 
 	// Add to metadata and save
 	var metas []ChunkMeta
@@ -131,9 +214,56 @@ func (ls *LogStore) AppendChunk(logID string, chunkData string, meta ChunkMeta)
 	return nil
 }
 
+// AppendLogData appends chunk data to a log file without touching its
+// chunk index. It returns the size of the log before the append, for
+// TruncateLog if the chunk can't be indexed.
+func (ls *LogStore) AppendLogData(logID string, chunkData string) (int64, error) {
+	m := ls.getMutex(logID)
+	m.Lock()
+	defer m.Unlock()
+	return ls.appendLogData(logID, chunkData)
+}
+
+// TruncateLog cuts a log file back to size, undoing an AppendLogData
+func (ls *LogStore) TruncateLog(logID string, size int64) error {
+	m := ls.getMutex(logID)
+	m.Lock()
+	defer m.Unlock()
+	return os.Truncate(ls.LogPath(logID), size)
+}
+
+func (ls *LogStore) appendLogData(logID string, chunkData string) (int64, error) {
+	if err := ls.restoreLog(logID); err != nil {
+		return 0, err
+	}
+	path := ls.LogPath(logID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+	if _, err := f.WriteString(chunkData); err != nil {
+		// Don't leave a partial chunk for the retry to append after
+		f.Truncate(size)
+		f.Close()
+		return 0, err
+	}
+	return size, f.Close()
+}
+
 // LoadChunkMetas loads all chunk metadata for a given token.
 func (ls *LogStore) LoadChunkMetas(token string) ([]ChunkMeta, error) {
-	metaPath := filepath.Join(ls.Dir, token+"_chunks.json")
+	m := ls.getMutex(token)
+	m.Lock()
+	defer m.Unlock()
+	metaPath := ls.ChunkIndexPath(token)
 	var metas []ChunkMeta
 	if f, err := os.Open(metaPath); err == nil {
 		defer f.Close()
@@ -144,16 +274,58 @@ func (ls *LogStore) LoadChunkMetas(token string) ([]ChunkMeta, error) {
 	return metas, nil
 }
 
+// GetLog returns a log, decompressing it if needed
 func (ls *LogStore) GetLog(token string) (string, error) {
-	logPath := filepath.Join(ls.Dir, token+".log")
-	f, err := os.Open(logPath)
+	f, encoding, err := ls.OpenLog(token)
 	if err != nil {
 		return "", err
 	}
 	defer f.Close()
-	data, err := io.ReadAll(f)
+	r, err := Decompress(f, encoding)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
 	if err != nil {
 		return "", err
 	}
 	return string(data), nil
 }
+
+// StatLog returns the stored size and encoding of a log
+func (ls *LogStore) StatLog(logID string) (int64, string, error) {
+	m := ls.getMutex(logID)
+	m.Lock()
+	defer m.Unlock()
+	path, encoding, err := ls.findLog(logID)
+	if err != nil {
+		return 0, "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, "", err
+	}
+	return info.Size(), encoding, nil
+}
+
+// DeleteLog removes a log file, in any encoding, and its chunk index
+func (ls *LogStore) DeleteLog(logID string) error {
+	m := ls.getMutex(logID)
+	m.Lock()
+	defer m.Unlock()
+	paths := []string{ls.LogPath(logID), ls.ChunkIndexPath(logID)}
+	for _, ext := range compressedExts {
+		paths = append(paths, ls.LogPath(logID)+ext)
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// Remove the emptied log directory, a non-empty one is kept
+	if dir := ls.logDir(logID); filepath.Dir(paths[0]) == dir {
+		os.Remove(dir)
+	}
+	return nil
+}
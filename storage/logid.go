@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+)
+
+// Log IDs are the escaped server token and the start time of the log,
+// e.g. "abc_2025-01-30T16-33-56.470", so they can be used unchanged as
+// path elements, URL path segments and S3 keys. Earlier versions used the
+// X-Timestamp header as is, e.g. "abc_01_30_2025 - 16:33:56.470"; those
+// former IDs are mapped to the current ones wherever an ID is read.
+var (
+	logIDRe       = regexp.MustCompile(`^(.+)_(\d{4})-(\d{2})-(\d{2})T(\d{2})-(\d{2})-(\d{2})(\.\d+)?$`)
+	formerLogIDRe = regexp.MustCompile(`^(.+)_(\d{2})_(\d{2})_(\d{4}) - (\d{2}):(\d{2}):(\d{2})(\.\d+)?$`)
+	timestampRe   = regexp.MustCompile(`^(\d{2})/(\d{2})/(\d{4}) - (\d{2}):(\d{2}):(\d{2})(\.\d+)?$`)
+)
+
+// NewLogID returns the ID of a log of server token that started at
+// timestamp, an X-Timestamp such as "01/30/2025 - 16:33:56.470"
+func NewLogID(token, timestamp string) string {
+	m := timestampRe.FindStringSubmatch(timestamp)
+	if m == nil {
+		return SafeName(token) + "_" + SafeName(timestamp)
+	}
+	month, day, year := m[1], m[2], m[3]
+	return fmt.Sprintf("%s_%s-%s-%sT%s-%s-%s%s", SafeName(token), year, month, day, m[4], m[5], m[6], m[7])
+}
+
+// CanonicalLogID returns the current ID of a log given by its former ID.
+// Other IDs are returned unchanged.
+func CanonicalLogID(logID string) string {
+	m := formerLogIDRe.FindStringSubmatch(logID)
+	if m == nil {
+		return logID
+	}
+	month, day, year := m[2], m[3], m[4]
+	return fmt.Sprintf("%s_%s-%s-%sT%s-%s-%s%s", SafeName(m[1]), year, month, day, m[5], m[6], m[7], m[8])
+}
+
+// FormerLogID returns the ID earlier versions gave a log, under which its
+// flat layout files and S3 objects may still be stored
+func FormerLogID(logID string) (string, bool) {
+	m := logIDRe.FindStringSubmatch(logID)
+	if m == nil {
+		return "", false
+	}
+	token, ok := unescapeToken(m[1])
+	if !ok {
+		return "", false
+	}
+	year, month, day := m[2], m[3], m[4]
+	return fmt.Sprintf("%s_%s_%s_%s - %s:%s:%s%s", token, month, day, year, m[5], m[6], m[7], m[8]), true
+}
+
+// LogIDOwner returns the server token a log ID was made for. IDs that
+// don't name a server, e.g. of logs imported from elsewhere, have none.
+func LogIDOwner(logID string) (string, bool) {
+	m := logIDRe.FindStringSubmatch(CanonicalLogID(logID))
+	if m == nil {
+		return "", false
+	}
+	return unescapeToken(m[1])
+}
+
+// unescapeToken reverses SafeName, accepting only names SafeName returns
+func unescapeToken(name string) (string, bool) {
+	token, err := url.PathUnescape(name)
+	if err != nil || token == "" || SafeName(token) != name {
+		return "", false
+	}
+	return token, true
+}
+
+// CanonicalizeLogIDs replaces the former IDs of meta's logs and reports
+// whether any changed
+func CanonicalizeLogIDs(meta *ServerMeta) bool {
+	changed := false
+	for i, lm := range meta.Logs {
+		if id := CanonicalLogID(lm.LogID); id != lm.LogID {
+			meta.Logs[i].LogID = id
+			changed = true
+		}
+	}
+	return changed
+}
+
+// CheckLogOwners returns an error if meta lists a log made for another
+// server than token. The sharded layout files a log under the server its
+// ID names, so a server's metadata must not claim another's logs.
+func CheckLogOwners(token string, meta *ServerMeta) error {
+	for _, lm := range meta.Logs {
+		if owner, ok := LogIDOwner(lm.LogID); ok && owner != token {
+			return fmt.Errorf("log %s belongs to server %s, not %s", lm.LogID, owner, token)
+		}
+	}
+	return nil
+}
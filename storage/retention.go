@@ -0,0 +1,533 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Retention actions
+const (
+	RetentionDelete   = "delete"
+	RetentionCompress = "compress"
+	RetentionArchive  = "archive"
+)
+
+// LogDeleter is implemented by backends that can remove a log's data and
+// chunk index. The caller removes the log from its server's metadata.
+type LogDeleter interface {
+	DeleteLog(logID string) error
+}
+
+// LogStater is implemented by backends that know the stored size and
+// encoding of a log
+type LogStater interface {
+	StatLog(logID string) (int64, string, error)
+}
+
+// activeWindow is how long after its last activity a server may still
+// continue a log. Retention leaves such logs alone.
+const activeWindow = 2 * time.Hour
+
+// timestampLayout is the layout of CS2 X-Timestamp headers
+const timestampLayout = "01/02/2006 - 15:04:05.000"
+
+// RetentionItem is a log selected by the policy
+type RetentionItem struct {
+	LogID        string    `json:"log_id"`
+	Token        string    `json:"server_instance_token"`
+	LastActivity time.Time `json:"last_activity"`
+	Size         int64     `json:"size"`
+	Reason       string    `json:"reason"` // e.g. "server max_logs"
+	Error        string    `json:"error,omitempty"`
+}
+
+// RetentionReport describes a retention run, or what a run would do when DryRun is set
+type RetentionReport struct {
+	DryRun     bool            `json:"dry_run"`
+	Action     string          `json:"action"`
+	RanAt      time.Time       `json:"ran_at"`
+	LogsTotal  int             `json:"logs_total"`
+	BytesTotal int64           `json:"bytes_total"`
+	Protected  int             `json:"protected"`
+	Items      []RetentionItem `json:"items"`
+	BytesFreed int64           `json:"bytes_freed"`
+}
+
+// limits is one set of retention limits
+type limits struct {
+	maxAge       time.Duration
+	maxTotalSize int64
+	maxLogs      int
+}
+
+func (l limits) empty() bool {
+	return l.maxAge == 0 && l.maxTotalSize == 0 && l.maxLogs == 0
+}
+
+func parseLimits(maxAge string, maxTotalSize int64, maxLogs int) (limits, error) {
+	l := limits{maxTotalSize: maxTotalSize, maxLogs: maxLogs}
+	if maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil {
+			return l, fmt.Errorf("invalid maxAge: %w", err)
+		}
+		l.maxAge = d
+	}
+	return l, nil
+}
+
+// Retention applies the retention policy of a storage configuration
+type Retention struct {
+	store     Backend
+	global    limits
+	perServer limits
+	action    string
+	archive   Backend
+	archiveOf *Config // config archive was created from
+	interval  time.Duration
+
+	// OnRemove is called for every log deleted or archived. Set it before Start.
+	OnRemove func(token, logID string)
+
+	mu   sync.Mutex // one run at a time
+	last *RetentionReport
+}
+
+// NewRetention validates the retention policy of config. The archive
+// backend is created here, so its type must already be registered.
+func NewRetention(store Backend, config Config) (*Retention, error) {
+	return newRetention(store, config, nil)
+}
+
+// newRetention is NewRetention reusing archive, if not nil, as the
+// archive backend
+func newRetention(store Backend, config Config, archive Backend) (*Retention, error) {
+	rc := config.Retention
+	maxLogs := rc.MaxLogs
+	if maxLogs == 0 {
+		maxLogs = config.MaxFiles
+	}
+	global, err := parseLimits(rc.MaxAge, rc.MaxTotalSize, maxLogs)
+	if err != nil {
+		return nil, err
+	}
+	perServer, err := parseLimits(rc.PerServer.MaxAge, rc.PerServer.MaxTotalSize, rc.PerServer.MaxLogs)
+	if err != nil {
+		return nil, fmt.Errorf("perServer: %w", err)
+	}
+	r := &Retention{
+		store:     store,
+		global:    global,
+		perServer: perServer,
+		action:    rc.Action,
+		interval:  time.Hour,
+	}
+	if r.action == "" {
+		r.action = RetentionDelete
+	}
+	switch r.action {
+	case RetentionDelete:
+	case RetentionCompress:
+		if _, ok := store.(LogCompressor); !ok {
+			return nil, errors.New("retention: storage backend can't compress logs")
+		}
+	case RetentionArchive:
+		if rc.Archive == nil {
+			return nil, errors.New("retention: archive action requires an archive backend")
+		}
+	default:
+		return nil, fmt.Errorf("unknown retention action %q", r.action)
+	}
+	if r.action != RetentionCompress {
+		if _, ok := store.(LogDeleter); !ok && !r.disabled() {
+			return nil, errors.New("retention: storage backend can't delete logs")
+		}
+	}
+	if rc.Interval != "" {
+		d, err := time.ParseDuration(rc.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention interval: %w", err)
+		}
+		r.interval = d
+	}
+	if r.action == RetentionArchive {
+		archiveOf := *rc.Archive
+		r.archive, r.archiveOf = archive, &archiveOf
+		if r.archive == nil {
+			if r.archive, err = NewBackend(archiveOf); err != nil {
+				return nil, fmt.Errorf("retention archive: %w", err)
+			}
+		}
+	}
+	return r, nil
+}
+
+// validateRetention checks a retention policy without creating its
+// archive backend
+func validateRetention(rc RetentionConfig) error {
+	if _, err := parseLimits(rc.MaxAge, rc.MaxTotalSize, rc.MaxLogs); err != nil {
+		return err
+	}
+	if _, err := parseLimits(rc.PerServer.MaxAge, rc.PerServer.MaxTotalSize, rc.PerServer.MaxLogs); err != nil {
+		return fmt.Errorf("perServer: %w", err)
+	}
+	switch rc.Action {
+	case "", RetentionDelete, RetentionCompress:
+	case RetentionArchive:
+		if rc.Archive == nil {
+			return errors.New("retention: archive action requires an archive backend")
+		}
+		if err := ValidateConfig(*rc.Archive); err != nil {
+			return fmt.Errorf("retention archive: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown retention action %q", rc.Action)
+	}
+	if rc.Interval != "" {
+		if d, err := time.ParseDuration(rc.Interval); err != nil || d <= 0 {
+			return fmt.Errorf("invalid retention interval %q", rc.Interval)
+		}
+	}
+	return nil
+}
+
+// Update replaces the policy with the one in config. A run in progress
+// finishes with the old policy. The archive backend is only created again
+// when its config changed, and the one it replaces is closed.
+func (r *Retention) Update(config Config) error {
+	r.mu.Lock()
+	archive, archiveOf := r.archive, r.archiveOf
+	r.mu.Unlock()
+	if next := config.Retention.Archive; archiveOf == nil || next == nil || !reflect.DeepEqual(*next, *archiveOf) {
+		archive = nil
+	}
+	next, err := newRetention(r.store, config, archive)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	old := r.archive
+	r.global, r.perServer = next.global, next.perServer
+	r.action, r.archive, r.archiveOf, r.interval = next.action, next.archive, next.archiveOf, next.interval
+	r.mu.Unlock()
+	if old != nil && old != next.archive {
+		closeBackend(old)
+	}
+	return nil
+}
+
+// closeBackend closes backends that hold resources, such as a database or
+// background work
+func closeBackend(b Backend) {
+	if c, ok := b.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("Failed to close storage backend: %v", err)
+		}
+	}
+}
+
+// Disabled reports whether no limits are configured
+func (r *Retention) Disabled() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.disabled()
+}
+
+func (r *Retention) disabled() bool {
+	return r.global.empty() && r.perServer.empty()
+}
+
+// Start runs the policy every interval in the background. Policies
+// without limits are skipped until Update adds some.
+func (r *Retention) Start() {
+	go func() {
+		for {
+			r.mu.Lock()
+			interval := r.interval
+			r.mu.Unlock()
+			time.Sleep(interval)
+			if r.Disabled() {
+				continue
+			}
+			report, err := r.Run(time.Now(), false)
+			if err != nil {
+				log.Printf("Retention failed: %v", err)
+			} else if len(report.Items) > 0 {
+				log.Printf("Retention: %s %d logs, %d bytes freed", report.Action, len(report.Items), report.BytesFreed)
+			}
+		}
+	}()
+}
+
+// LastReport returns the report of the latest run, nil before the first
+func (r *Retention) LastReport() *RetentionReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// retentionLog is a log considered by a run
+type retentionLog struct {
+	meta       LogMeta
+	token      string
+	activity   time.Time
+	size       int64
+	compressed bool
+	selected   string // reason, empty while kept
+}
+
+// candidate reports whether the policy may act on the log
+func (l *retentionLog) candidate(action string, now time.Time) bool {
+	if l.meta.Protected || l.selected != "" || now.Sub(l.activity) < activeWindow {
+		return false
+	}
+	return action != RetentionCompress || !l.compressed
+}
+
+// Run evaluates the policy and, unless dryRun is set, applies it
+func (r *Retention) Run(now time.Time, dryRun bool) (*RetentionReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := &RetentionReport{DryRun: dryRun, Action: r.action, RanAt: now.UTC(), Items: []RetentionItem{}}
+	servers, err := r.collect()
+	if err != nil {
+		return nil, err
+	}
+	var all []*retentionLog
+	for _, logs := range servers {
+		r.selectLogs(logs, r.perServer, "server", now)
+		all = append(all, logs...)
+	}
+	r.selectLogs(all, r.global, "global", now)
+
+	for _, l := range all {
+		report.LogsTotal++
+		report.BytesTotal += l.size
+		if l.meta.Protected {
+			report.Protected++
+		}
+	}
+	selected := make(map[string][]*retentionLog)
+	for _, l := range all {
+		if l.selected == "" {
+			continue
+		}
+		report.Items = append(report.Items, RetentionItem{
+			LogID:        l.meta.LogID,
+			Token:        l.token,
+			LastActivity: l.activity,
+			Size:         l.size,
+			Reason:       l.selected,
+		})
+		selected[l.token] = append(selected[l.token], l)
+	}
+	sort.Slice(report.Items, func(i, j int) bool {
+		return report.Items[i].LastActivity.Before(report.Items[j].LastActivity)
+	})
+	if dryRun {
+		return report, nil
+	}
+
+	failed := make(map[string]string)
+	for token, logs := range selected {
+		for logID, err := range r.apply(token, logs) {
+			failed[logID] = err.Error()
+		}
+	}
+	for i, item := range report.Items {
+		if msg, ok := failed[item.LogID]; ok {
+			report.Items[i].Error = msg
+		} else if r.action != RetentionCompress {
+			report.BytesFreed += item.Size
+		}
+	}
+	r.last = report
+	return report, nil
+}
+
+// collect loads every log with its activity time and stored size, oldest first per server
+func (r *Retention) collect() (map[string][]*retentionLog, error) {
+	tokens, err := r.store.ListServers()
+	if err != nil {
+		return nil, err
+	}
+	stater, _ := r.store.(LogStater)
+	servers := make(map[string][]*retentionLog)
+	for _, token := range tokens {
+		meta, err := r.store.LoadServerMeta(token)
+		if err != nil {
+			return nil, fmt.Errorf("server %s: %w", token, err)
+		}
+		var logs []*retentionLog
+		for _, lm := range meta.Logs {
+			l := &retentionLog{meta: lm, token: token, activity: lm.LastReceivedAt, size: int64(lm.LastByteOffset)}
+			if l.activity.IsZero() {
+				l.activity, _ = time.Parse(timestampLayout, lm.LastActivity)
+			}
+			if stater != nil {
+				if size, encoding, err := stater.StatLog(lm.LogID); err == nil {
+					l.size = size
+					l.compressed = encoding != ""
+				}
+			}
+			logs = append(logs, l)
+		}
+		sort.SliceStable(logs, func(i, j int) bool { return logs[i].activity.Before(logs[j].activity) })
+		servers[token] = logs
+	}
+	return servers, nil
+}
+
+// selectLogs marks the logs, oldest first, that exceed lim. Logs already
+// selected no longer count towards the limits.
+func (r *Retention) selectLogs(logs []*retentionLog, lim limits, scope string, now time.Time) {
+	if lim.empty() {
+		return
+	}
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].activity.Before(logs[j].activity) })
+	count, size := 0, int64(0)
+	for _, l := range logs {
+		if l.selected == "" {
+			count++
+			size += l.size
+		}
+	}
+	for _, l := range logs {
+		if !l.candidate(r.action, now) {
+			continue
+		}
+		var reason string
+		switch {
+		case lim.maxAge > 0 && now.Sub(l.activity) > lim.maxAge:
+			reason = "max_age"
+		case lim.maxLogs > 0 && count > lim.maxLogs:
+			reason = "max_logs"
+		case lim.maxTotalSize > 0 && size > lim.maxTotalSize:
+			reason = "max_total_size"
+		default:
+			continue
+		}
+		l.selected = scope + " " + reason
+		count--
+		size -= l.size
+	}
+}
+
+// apply carries out the action for the selected logs of a server and
+// returns the logs it failed for
+func (r *Retention) apply(token string, logs []*retentionLog) map[string]error {
+	failed := make(map[string]error)
+	if r.action == RetentionCompress {
+		c := r.store.(LogCompressor)
+		for _, l := range logs {
+			if err := c.CompressLog(l.meta.LogID); err != nil {
+				failed[l.meta.LogID] = err
+			}
+		}
+		return failed
+	}
+
+	removed := make(map[string]bool)
+	for _, l := range logs {
+		if r.action == RetentionArchive {
+			if err := r.archiveLog(token, l.meta); err != nil {
+				failed[l.meta.LogID] = err
+				continue
+			}
+		}
+		if err := r.store.(LogDeleter).DeleteLog(l.meta.LogID); err != nil {
+			failed[l.meta.LogID] = err
+			continue
+		}
+		removed[l.meta.LogID] = true
+	}
+	if len(removed) == 0 {
+		return failed
+	}
+
+	// Reload to keep changes made since collect
+	err := UpdateServerMeta(r.store, token, func(meta *ServerMeta) error {
+		kept := meta.Logs[:0]
+		for _, lm := range meta.Logs {
+			if !removed[lm.LogID] {
+				kept = append(kept, lm)
+			}
+		}
+		meta.Logs = kept
+		return nil
+	})
+	if err != nil {
+		for logID := range removed {
+			failed[logID] = fmt.Errorf("update server metadata: %w", err)
+		}
+		return failed
+	}
+	if r.OnRemove != nil {
+		for logID := range removed {
+			r.OnRemove(token, logID)
+		}
+	}
+	return failed
+}
+
+// archiveLog copies a log with its chunk index and metadata to the archive backend
+func (r *Retention) archiveLog(token string, lm LogMeta) error {
+	existing, err := r.archive.LoadChunkMetas(lm.LogID)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		data, err := r.store.GetLog(lm.LogID)
+		if err != nil {
+			return err
+		}
+		metas, err := r.store.LoadChunkMetas(lm.LogID)
+		if err != nil {
+			return err
+		}
+		if err := AppendChunks(r.archive, lm.LogID, data, metas); err != nil {
+			return err
+		}
+	}
+
+	src, srcErr := r.store.LoadServerMeta(token)
+	return UpdateServerMeta(r.archive, token, func(meta *ServerMeta) error {
+		if srcErr == nil {
+			meta.SteamID = src.SteamID
+		}
+		for _, m := range meta.Logs {
+			if m.LogID == lm.LogID {
+				return nil
+			}
+		}
+		meta.Logs = append(meta.Logs, lm)
+		return nil
+	})
+}
+
+// AppendChunks writes a log to dst chunk by chunk. The data is split by
+// the chunk offsets; anything the index doesn't cover goes into the last chunk.
+func AppendChunks(dst Backend, logID, data string, metas []ChunkMeta) error {
+	if len(metas) == 0 {
+		return dst.AppendChunk(logID, data, ChunkMeta{EndOffset: len(data)})
+	}
+	pos := 0
+	for i, m := range metas {
+		end := pos + m.EndOffset - m.BeginOffset
+		if end > len(data) || end < pos || i == len(metas)-1 {
+			end = len(data)
+		}
+		if err := dst.AppendChunk(logID, data[pos:end], m); err != nil {
+			return err
+		}
+		pos = end
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// closingBackend records whether it was closed
+type closingBackend struct {
+	*LogStore
+	closed bool
+}
+
+func (b *closingBackend) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestRetentionUpdateArchive(t *testing.T) {
+	var created []*closingBackend
+	RegisterBackend("test-archive", func(config Config) (Backend, error) {
+		b := &closingBackend{LogStore: NewLogStore(config.Path)}
+		created = append(created, b)
+		return b, nil
+	})
+	config := func(path string) Config {
+		c := Config{Path: t.TempDir()}
+		c.Retention.MaxLogs = 10
+		c.Retention.Action = RetentionArchive
+		c.Retention.Archive = &Config{Type: "test-archive", Path: path}
+		return c
+	}
+	first, second := t.TempDir(), t.TempDir()
+
+	r, err := NewRetention(NewLogStore(t.TempDir()), config(first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An unchanged archive config keeps the backend
+	if err := r.Update(config(first)); err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 1 || created[0].closed {
+		t.Fatalf("created %d archive backends, first closed %v", len(created), created[0].closed)
+	}
+	if err := r.Update(config(second)); err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 2 || !created[0].closed || created[1].closed {
+		t.Errorf("after changing the archive: created %d, closed %v", len(created), []bool{created[0].closed, created[len(created)-1].closed})
+	}
+	c := config(second)
+	c.Retention.Action = RetentionDelete
+	if err := r.Update(c); err != nil {
+		t.Fatal(err)
+	}
+	if !created[1].closed {
+		t.Error("archive backend kept after switching to delete")
+	}
+}
+
+// retentionStore holds the logs of servers a and b, each 10 bytes and
+// last active the given time before now. a_0 is protected, a_4 is still
+// active.
+func retentionStore(t *testing.T, now time.Time) *LogStore {
+	t.Helper()
+	ls := NewLogStore(t.TempDir())
+	logs := []struct {
+		token, logID string
+		idle         time.Duration
+		protected    bool
+	}{
+		{"a", "a_0", 20 * time.Hour, true},
+		{"a", "a_1", 10 * time.Hour, false},
+		{"a", "a_2", 5 * time.Hour, false},
+		{"b", "b_1", 4 * time.Hour, false},
+		{"a", "a_3", 3 * time.Hour, false},
+		{"a", "a_4", time.Hour, false},
+	}
+	for _, l := range logs {
+		if err := ls.AppendChunk(l.logID, "L 0123456\n", ChunkMeta{EndOffset: 10}); err != nil {
+			t.Fatal(err)
+		}
+		err := UpdateServerMeta(ls, l.token, func(meta *ServerMeta) error {
+			meta.ServerInstanceToken = l.token
+			meta.Logs = append(meta.Logs, LogMeta{LogID: l.logID, LastByteOffset: 10, LastReceivedAt: now.Add(-l.idle), Protected: l.protected})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ls
+}
+
+// storedLogs returns the logs listed in the metadata of servers a and b
+func storedLogs(t *testing.T, ls *LogStore) []string {
+	t.Helper()
+	var ids []string
+	for _, token := range []string{"a", "b"} {
+		meta, err := ls.LoadServerMeta(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, lm := range meta.Logs {
+			ids = append(ids, lm.LogID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestRetentionRun(t *testing.T) {
+	now := time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC)
+	all := []string{"a_0", "a_1", "a_2", "a_3", "a_4", "b_1"}
+	tests := []struct {
+		name   string
+		config func(c *RetentionConfig)
+		want   []string // selected logs, oldest first
+		reason string
+	}{
+		{"global max_logs", func(c *RetentionConfig) { c.MaxLogs = 3 }, []string{"a_1", "a_2", "b_1"}, "global max_logs"},
+		{"server max_logs", func(c *RetentionConfig) { c.PerServer.MaxLogs = 2 }, []string{"a_1", "a_2", "a_3"}, "server max_logs"},
+		{"max_age", func(c *RetentionConfig) { c.MaxAge = "4h30m" }, []string{"a_1", "a_2"}, "global max_age"},
+		{"max_total_size", func(c *RetentionConfig) { c.MaxTotalSize = 35 }, []string{"a_1", "a_2", "b_1"}, "global max_total_size"},
+		{"within the limits", func(c *RetentionConfig) { c.MaxLogs = 6 }, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ls := retentionStore(t, now)
+			var config Config
+			tt.config(&config.Retention)
+			r, err := NewRetention(ls, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var removed []string
+			r.OnRemove = func(token, logID string) { removed = append(removed, logID) }
+
+			for _, dryRun := range []bool{true, false} {
+				report, err := r.Run(now, dryRun)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, item := range report.Items {
+					got = append(got, item.LogID)
+					if item.Reason != tt.reason || item.Error != "" {
+						t.Errorf("%s: reason %q, error %q", item.LogID, item.Reason, item.Error)
+					}
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("dry run %v: selected %v, want %v", dryRun, got, tt.want)
+				}
+				if report.LogsTotal != 6 || report.BytesTotal != 60 || report.Protected != 1 {
+					t.Errorf("report totals %d logs, %d bytes, %d protected", report.LogsTotal, report.BytesTotal, report.Protected)
+				}
+				if dryRun && !reflect.DeepEqual(storedLogs(t, ls), all) {
+					t.Errorf("dry run changed the store: %v", storedLogs(t, ls))
+				}
+			}
+
+			var kept []string
+			for _, id := range all {
+				if !contains(tt.want, id) {
+					kept = append(kept, id)
+				}
+			}
+			if got := storedLogs(t, ls); !reflect.DeepEqual(got, kept) {
+				t.Errorf("stored logs %v, want %v", got, kept)
+			}
+			sort.Strings(removed)
+			if !reflect.DeepEqual(removed, tt.want) {
+				t.Errorf("OnRemove called for %v, want %v", removed, tt.want)
+			}
+			for _, id := range tt.want {
+				if _, err := ls.GetLog(id); err == nil {
+					t.Errorf("%s still stored", id)
+				}
+			}
+		})
+	}
+}
+
+func TestRetentionActions(t *testing.T) {
+	now := time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC)
+	t.Run("compress", func(t *testing.T) {
+		ls := retentionStore(t, now)
+		ls.SetCompression(CompressionGzip, time.Hour)
+		t.Cleanup(func() { ls.Close() })
+		var config Config
+		config.Retention.MaxAge = "4h30m"
+		config.Retention.Action = RetentionCompress
+		r, err := NewRetention(ls, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Run(now, false); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{"a_1", "a_2"} {
+			if _, encoding, err := ls.StatLog(id); err != nil || encoding != CompressionGzip {
+				t.Errorf("%s: encoding %q, %v", id, encoding, err)
+			}
+			if data, err := ls.GetLog(id); err != nil || data != "L 0123456\n" {
+				t.Errorf("%s: compressed log reads %q, %v", id, data, err)
+			}
+		}
+		// Compressed logs are kept and not selected again
+		report, err := r.Run(now, true)
+		if err != nil || len(report.Items) != 0 {
+			t.Errorf("second run selected %+v, %v", report.Items, err)
+		}
+		if got := storedLogs(t, ls); len(got) != 6 {
+			t.Errorf("stored logs %v after compressing", got)
+		}
+	})
+	t.Run("archive", func(t *testing.T) {
+		ls := retentionStore(t, now)
+		archive := NewLogStore(t.TempDir())
+		var config Config
+		config.Retention.MaxAge = "4h30m"
+		config.Retention.Action = RetentionArchive
+		config.Retention.Archive = &Config{Path: archive.Dir}
+		r, err := newRetention(ls, config, archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Run(now, false); err != nil {
+			t.Fatal(err)
+		}
+		if got := storedLogs(t, archive); !reflect.DeepEqual(got, []string{"a_1", "a_2"}) {
+			t.Errorf("archived logs %v", got)
+		}
+		for _, id := range []string{"a_1", "a_2"} {
+			if data, err := archive.GetLog(id); err != nil || data != "L 0123456\n" {
+				t.Errorf("%s: archived log %q, %v", id, data, err)
+			}
+			if _, err := ls.GetLog(id); err == nil {
+				t.Errorf("%s still in the store", id)
+			}
+		}
+	})
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,530 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cs2-log-proxy/storage"
+)
+
+func init() {
+	storage.RegisterBackend("s3", func(config storage.Config) (storage.Backend, error) {
+		return New(config)
+	})
+}
+
+const defaultPartSize = 8 << 20
+
+var (
+	_ storage.LogDeleter = (*Backend)(nil)
+	_ storage.LogOpener  = (*Backend)(nil)
+)
+
+// Backend buffers active sessions in a local LogStore and moves them to an
+// S3 compatible bucket once they have been idle for IdleTimeout. Reads of
+// archived logs are served from the bucket. Bucket layout:
+//
+//	{prefix}servers/{token}.json       ServerMeta
+//	{prefix}logs/{logID}.log           raw log
+//	{prefix}logs/{logID}_chunks.json   chunk index
+type Backend struct {
+	local    *storage.LogStore
+	client   *Client
+	prefix   string
+	idle     time.Duration
+	partSize int64
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex // per log, serializes appends and archiving
+	stop  chan struct{}
+}
+
+// New creates the backend and starts archiving idle sessions
+func New(config storage.Config) (*Backend, error) {
+	cfg := config.S3
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 storage requires an endpoint and a bucket")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	idle := 30 * time.Minute
+	if cfg.IdleTimeout != "" {
+		d, err := time.ParseDuration(cfg.IdleTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 idleTimeout: %w", err)
+		}
+		idle = d
+	}
+	partSize := cfg.PartSize
+	if partSize == 0 {
+		partSize = defaultPartSize
+	}
+	if partSize < 5<<20 {
+		return nil, errors.New("s3 partSize must be at least 5 MiB")
+	}
+	if err := os.MkdirAll(config.Path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	b := &Backend{
+		local: storage.NewLogStore(config.Path),
+		client: &Client{
+			Endpoint:  cfg.Endpoint,
+			Region:    cfg.Region,
+			Bucket:    cfg.Bucket,
+			AccessKey: cfg.AccessKey,
+			SecretKey: cfg.SecretKey,
+			HTTP:      &http.Client{Timeout: 5 * time.Minute},
+		},
+		prefix:   cfg.Prefix,
+		idle:     idle,
+		partSize: partSize,
+		locks:    make(map[string]*sync.Mutex),
+		stop:     make(chan struct{}),
+	}
+	b.local.StartLayoutMigration()
+	go b.archiveLoop()
+	return b, nil
+}
+
+func (b *Backend) serverKey(token string) string { return b.prefix + "servers/" + token + ".json" }
+func (b *Backend) logKey(logID string) string    { return b.prefix + "logs/" + logID + ".log" }
+func (b *Backend) chunksKey(logID string) string { return b.prefix + "logs/" + logID + "_chunks.json" }
+
+// archivedKeys returns the keys an archived object of a log may have.
+// Logs archived before storage.NewLogID are stored under their former ID.
+func archivedKeys(logID string, key func(logID string) string) []string {
+	keys := []string{key(logID)}
+	if former, ok := storage.FormerLogID(logID); ok {
+		keys = append(keys, key(former))
+	}
+	return keys
+}
+
+// getArchived gets the first of keys that exists
+func (b *Backend) getArchived(keys []string) (io.ReadCloser, error) {
+	var err error
+	for _, key := range keys {
+		var r io.ReadCloser
+		if r, err = b.client.GetObject(context.Background(), key, ""); !errors.Is(err, ErrNotFound) {
+			return r, err
+		}
+	}
+	return nil, err
+}
+
+func (b *Backend) lock(logID string) func() {
+	b.mu.Lock()
+	m, ok := b.locks[logID]
+	if !ok {
+		m = &sync.Mutex{}
+		b.locks[logID] = m
+	}
+	b.mu.Unlock()
+	m.Lock()
+	return m.Unlock
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// ListServers returns servers buffered locally and archived in the bucket
+func (b *Backend) ListServers() ([]string, error) {
+	tokens, err := b.local.ListServers()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	for _, t := range tokens {
+		seen[t] = true
+	}
+	objects, err := b.client.ListObjects(context.Background(), b.prefix+"servers/")
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range objects {
+		t := strings.TrimSuffix(strings.TrimPrefix(o.Key, b.prefix+"servers/"), ".json")
+		if !seen[t] {
+			seen[t] = true
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, nil
+}
+
+func (b *Backend) LoadServerMeta(token string) (*storage.ServerMeta, error) {
+	if exists(b.local.ServerMetaPath(token)) {
+		return b.local.LoadServerMeta(token)
+	}
+	var meta storage.ServerMeta
+	err := b.getJSON(b.serverKey(token), &meta)
+	if errors.Is(err, ErrNotFound) {
+		return b.local.LoadServerMeta(token)
+	}
+	if err != nil {
+		return nil, err
+	}
+	storage.CanonicalizeLogIDs(&meta)
+	return &meta, nil
+}
+
+// SaveServerMeta saves locally; the bucket copy is updated when logs of
+// the server are archived
+func (b *Backend) SaveServerMeta(token string, meta *storage.ServerMeta) error {
+	return b.local.SaveServerMeta(token, meta)
+}
+
+// AppendChunk appends to the local buffer. A chunk for an already archived
+// log first brings the log back from the bucket.
+func (b *Backend) AppendChunk(logID string, chunkData string, meta storage.ChunkMeta) error {
+	logID = storage.CanonicalLogID(logID)
+	unlock := b.lock(logID)
+	defer unlock()
+	if !exists(b.local.LogPath(logID)) {
+		if err := b.restore(logID); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return b.local.AppendChunk(logID, chunkData, meta)
+}
+
+func (b *Backend) LoadChunkMetas(logID string) ([]storage.ChunkMeta, error) {
+	logID = storage.CanonicalLogID(logID)
+	unlock := b.lock(logID)
+	defer unlock()
+	if exists(b.local.ChunkIndexPath(logID)) {
+		return b.local.LoadChunkMetas(logID)
+	}
+	var metas []storage.ChunkMeta
+	if err := b.getArchivedJSON(archivedKeys(logID, b.chunksKey), &metas); err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+	return metas, nil
+}
+
+func (b *Backend) GetLog(logID string) (string, error) {
+	logID = storage.CanonicalLogID(logID)
+	unlock := b.lock(logID)
+	defer unlock()
+	if exists(b.local.LogPath(logID)) {
+		return b.local.GetLog(logID)
+	}
+	r, err := b.getArchived(archivedKeys(logID, b.logKey))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// OpenLog opens a buffered log from disk and an archived one for ranged
+// reads from the bucket, so serving a window or a tail doesn't download
+// the whole object
+func (b *Backend) OpenLog(logID string) (io.ReadCloser, string, error) {
+	logID = storage.CanonicalLogID(logID)
+	unlock := b.lock(logID)
+	defer unlock()
+	if exists(b.local.LogPath(logID)) {
+		return b.local.OpenLog(logID)
+	}
+	var key string
+	var size int64
+	var err error
+	for _, key = range archivedKeys(logID, b.logKey) {
+		if size, err = b.client.HeadObject(context.Background(), key); !errors.Is(err, ErrNotFound) {
+			break
+		}
+	}
+	if errors.Is(err, ErrNotFound) {
+		return nil, "", fmt.Errorf("%s: %w", key, os.ErrNotExist)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return &objectReader{client: b.client, key: key, size: size}, "", nil
+}
+
+// objectReader reads an object with ranged GETs. Reads continuing where
+// the previous one stopped share one open response.
+type objectReader struct {
+	client *Client
+	key    string
+	size   int64
+
+	mu   sync.Mutex
+	pos  int64 // for Read and Seek
+	body io.ReadCloser
+	next int64 // offset body continues at
+}
+
+func (o *objectReader) ReadAt(p []byte, off int64) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.readAt(p, off)
+}
+
+func (o *objectReader) readAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	want := min(int64(len(p)), o.size-off)
+	if o.body == nil || off != o.next {
+		o.closeBody()
+		body, err := o.client.GetObject(context.Background(), o.key, fmt.Sprintf("bytes=%d-", off))
+		if err != nil {
+			return 0, err
+		}
+		o.body, o.next = body, off
+	}
+	n, err := io.ReadFull(o.body, p[:want])
+	o.next += int64(n)
+	if err != nil {
+		o.closeBody()
+		return n, err
+	}
+	if want < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n, err := o.readAt(p, o.pos)
+	o.pos += int64(n)
+	return n, err
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += o.pos
+	case io.SeekEnd:
+		offset += o.size
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	o.pos = offset
+	return offset, nil
+}
+
+func (o *objectReader) closeBody() {
+	if o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+}
+
+func (o *objectReader) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closeBody()
+	return nil
+}
+
+// DeleteLog removes a log from the local buffer and the bucket, for
+// retention. The caller removes it from the server's metadata.
+func (b *Backend) DeleteLog(logID string) error {
+	logID = storage.CanonicalLogID(logID)
+	unlock := b.lock(logID)
+	defer unlock()
+	if err := b.local.DeleteLog(logID); err != nil {
+		return err
+	}
+	for _, key := range append(archivedKeys(logID, b.logKey), archivedKeys(logID, b.chunksKey)...) {
+		if err := b.client.DeleteObject(context.Background(), key); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops archiving
+func (b *Backend) Close() error {
+	close(b.stop)
+	return b.local.Close()
+}
+
+func (b *Backend) getJSON(key string, v interface{}) error {
+	r, err := b.client.GetObject(context.Background(), key, "")
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+func (b *Backend) getArchivedJSON(keys []string, v interface{}) error {
+	r, err := b.getArchived(keys)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+func (b *Backend) putJSON(key string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return b.client.PutObject(context.Background(), key, data)
+}
+
+// restore downloads an archived log and its chunk index into the local buffer
+func (b *Backend) restore(logID string) error {
+	var metas []storage.ChunkMeta
+	if err := b.getArchivedJSON(archivedKeys(logID, b.chunksKey), &metas); err != nil {
+		return err
+	}
+	r, err := b.getArchived(archivedKeys(logID, b.logKey))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	logPath := b.local.LogPath(logID)
+	if err := os.MkdirAll(filepath.Dir(logPath), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(logPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	f.Close()
+	data, err := json.MarshalIndent(metas, "", "  ")
+	if err != nil {
+		return err
+	}
+	log.Printf("Restored archived log %s from bucket", logID)
+	return os.WriteFile(b.local.ChunkIndexPath(logID), data, 0644)
+}
+
+func (b *Backend) archiveLoop() {
+	interval := time.Minute
+	if b.idle < interval {
+		interval = b.idle
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.ArchiveIdle(time.Now()); err != nil {
+				log.Printf("S3 archiving failed: %v", err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// ArchiveIdle uploads every locally buffered log not written to since
+// IdleTimeout, together with the metadata of its server, and removes the
+// local copy
+func (b *Backend) ArchiveIdle(now time.Time) error {
+	tokens, err := b.local.ListServers()
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		meta, err := b.local.LoadServerMeta(token)
+		if err != nil {
+			return err
+		}
+		archived := 0
+		for _, lm := range meta.Logs {
+			info, err := os.Stat(b.local.LogPath(lm.LogID))
+			if err != nil || now.Sub(info.ModTime()) < b.idle {
+				continue
+			}
+			if err := b.archive(lm.LogID, now); err != nil {
+				return fmt.Errorf("archive %s: %w", lm.LogID, err)
+			}
+			archived++
+		}
+		if archived > 0 {
+			if err := b.putJSON(b.serverKey(token), meta); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *Backend) archive(logID string, now time.Time) error {
+	unlock := b.lock(logID)
+	defer unlock()
+
+	logPath := b.local.LogPath(logID)
+	info, err := os.Stat(logPath)
+	if err != nil || now.Sub(info.ModTime()) < b.idle {
+		// written to or archived meanwhile
+		return nil
+	}
+	chunks, err := os.ReadFile(b.local.ChunkIndexPath(logID))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := b.client.PutObject(context.Background(), b.chunksKey(logID), chunks); err != nil {
+		return err
+	}
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info.Size() > b.partSize {
+		err = b.client.PutObjectMultipart(context.Background(), b.logKey(logID), f, b.partSize)
+	} else {
+		var data bytes.Buffer
+		if _, err = io.Copy(&data, f); err == nil {
+			err = b.client.PutObject(context.Background(), b.logKey(logID), data.Bytes())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	f.Close()
+	// Drop a copy archived under the former ID before the log was restored
+	if former, ok := storage.FormerLogID(logID); ok {
+		for _, key := range []string{b.logKey(former), b.chunksKey(former)} {
+			if err := b.client.DeleteObject(context.Background(), key); err != nil && !errors.Is(err, ErrNotFound) {
+				return err
+			}
+		}
+	}
+
+	log.Printf("Archived log %s to bucket (%d bytes)", logID, info.Size())
+	return b.local.DeleteLog(logID)
+}
@@ -0,0 +1,212 @@
+package s3
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cs2-log-proxy/storage"
+)
+
+const (
+	testBucket = "logs"
+	testToken  = "server1"
+	testLogID  = "server1_2025-01-30T16-33-56.470"
+)
+
+func newTestBackend(t *testing.T) (*Backend, *fakeServer) {
+	t.Helper()
+	fake := newFakeServer()
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	b, err := New(storage.Config{
+		Path: t.TempDir(),
+		S3: storage.S3Config{
+			Endpoint:  srv.URL,
+			Bucket:    testBucket,
+			Prefix:    "cs2/",
+			AccessKey: "access",
+			SecretKey: "secret",
+			PartSize:  5 << 20,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b, fake
+}
+
+// storeLog writes a log of the given chunks and the server metadata
+// listing it, then archives it to the bucket
+func storeLog(t *testing.T, b *Backend, chunks ...string) {
+	t.Helper()
+	offset := 0
+	for _, chunk := range chunks {
+		meta := storage.ChunkMeta{BeginOffset: offset, EndOffset: offset + len(chunk)}
+		if err := b.AppendChunk(testLogID, chunk, meta); err != nil {
+			t.Fatal(err)
+		}
+		offset += len(chunk)
+	}
+	meta := &storage.ServerMeta{ServerInstanceToken: testToken, Logs: []storage.LogMeta{{LogID: testLogID, LastByteOffset: offset}}}
+	if err := b.SaveServerMeta(testToken, meta); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.ArchiveIdle(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchivedReads(t *testing.T) {
+	b, fake := newTestBackend(t)
+	storeLog(t, b, "L first\n", "L second\n")
+
+	if exists(b.local.LogPath(testLogID)) {
+		t.Fatal("local copy kept after archiving")
+	}
+	if _, ok := fake.object(testBucket, "cs2/servers/"+testToken+".json"); !ok {
+		t.Error("server metadata not uploaded")
+	}
+	data, err := b.GetLog(testLogID)
+	if err != nil || data != "L first\nL second\n" {
+		t.Fatalf("GetLog = %q, %v", data, err)
+	}
+	metas, err := b.LoadChunkMetas(testLogID)
+	if err != nil || len(metas) != 2 || metas[1].EndOffset != len(data) {
+		t.Fatalf("LoadChunkMetas = %+v, %v", metas, err)
+	}
+	tokens, err := b.ListServers()
+	if err != nil || len(tokens) != 1 || tokens[0] != testToken {
+		t.Fatalf("ListServers = %v, %v", tokens, err)
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	b, fake := newTestBackend(t)
+	line := "L " + strings.Repeat("x", 1021) + "\n"
+	big := strings.Repeat(line, 6<<10) // 6 MiB, two parts
+	storeLog(t, b, big)
+
+	if fake.parts != 2 {
+		t.Errorf("uploaded %d parts, want 2", fake.parts)
+	}
+	data, ok := fake.object(testBucket, "cs2/logs/"+testLogID+".log")
+	if !ok || string(data) != big {
+		t.Fatalf("uploaded log has %d bytes, want %d", len(data), len(big))
+	}
+}
+
+func TestRestoreOnAppend(t *testing.T) {
+	b, _ := newTestBackend(t)
+	storeLog(t, b, "L first\n")
+
+	// A late chunk brings the log back from the bucket
+	if err := b.AppendChunk(testLogID, "L late\n", storage.ChunkMeta{BeginOffset: 8, EndOffset: 15}); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(b.local.LogPath(testLogID)) {
+		t.Fatal("log not restored to the local buffer")
+	}
+	data, err := b.GetLog(testLogID)
+	if err != nil || data != "L first\nL late\n" {
+		t.Fatalf("GetLog = %q, %v", data, err)
+	}
+	metas, err := b.LoadChunkMetas(testLogID)
+	if err != nil || len(metas) != 2 {
+		t.Fatalf("LoadChunkMetas = %+v, %v", metas, err)
+	}
+}
+
+func TestDeleteLog(t *testing.T) {
+	b, fake := newTestBackend(t)
+	storeLog(t, b, "L first\n")
+
+	if err := b.DeleteLog(testLogID); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"cs2/logs/" + testLogID + ".log", "cs2/logs/" + testLogID + "_chunks.json"} {
+		if _, ok := fake.object(testBucket, key); ok {
+			t.Errorf("%s still in the bucket", key)
+		}
+	}
+	metas, err := b.LoadChunkMetas(testLogID)
+	if err != nil || len(metas) != 0 {
+		t.Fatalf("LoadChunkMetas = %+v, %v", metas, err)
+	}
+}
+
+func TestOpenLogRanges(t *testing.T) {
+	b, fake := newTestBackend(t)
+	storeLog(t, b, "L first\n", "L second\n")
+	fake.mu.Lock()
+	fake.ranges = nil
+	fake.mu.Unlock()
+
+	f, encoding, err := b.OpenLog(testLogID)
+	if err != nil || encoding != "" {
+		t.Fatalf("OpenLog: %q, %v", encoding, err)
+	}
+	defer f.Close()
+	r, ok := f.(io.ReaderAt)
+	if !ok {
+		t.Fatal("archived log isn't an io.ReaderAt")
+	}
+	buf := make([]byte, 4)
+	// The second read continues the response of the first, the third
+	// needs a new one
+	for _, tt := range []struct {
+		off  int64
+		want string
+		err  error
+	}{
+		{8, "L se", nil},
+		{12, "cond", nil},
+		{15, "d\n", io.EOF},
+	} {
+		if n, err := r.ReadAt(buf, tt.off); err != tt.err || string(buf[:n]) != tt.want {
+			t.Fatalf("ReadAt(%d) = %q, %v, want %q, %v", tt.off, buf[:n], err, tt.want, tt.err)
+		}
+	}
+	fake.mu.Lock()
+	ranges := fake.ranges
+	fake.mu.Unlock()
+	if want := []string{"bytes=8-", "bytes=15-"}; !reflect.DeepEqual(ranges, want) {
+		t.Errorf("GETs with ranges %q, want %q", ranges, want)
+	}
+
+	if _, _, err := b.OpenLog("server1_missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing log: err = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestArchivedUnderFormerID(t *testing.T) {
+	b, fake := newTestBackend(t)
+	const former = "server1_01_30_2025 - 16:33:56.470"
+	fake.mu.Lock()
+	fake.objects[testBucket+"/cs2/logs/"+former+".log"] = []byte("L first\n")
+	fake.objects[testBucket+"/cs2/logs/"+former+"_chunks.json"] = []byte(`[{"begin_offset":0,"end_offset":8}]`)
+	fake.mu.Unlock()
+
+	for _, logID := range []string{testLogID, former} {
+		data, err := b.GetLog(logID)
+		if err != nil || data != "L first\n" {
+			t.Errorf("GetLog(%q) = %q, %v", logID, data, err)
+		}
+		metas, err := b.LoadChunkMetas(logID)
+		if err != nil || len(metas) != 1 || metas[0].EndOffset != 8 {
+			t.Errorf("LoadChunkMetas(%q) = %+v, %v", logID, metas, err)
+		}
+	}
+	if err := b.DeleteLog(former); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.object(testBucket, "cs2/logs/"+former+".log"); ok {
+		t.Error("log under the former key still in the bucket")
+	}
+}
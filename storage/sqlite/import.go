@@ -0,0 +1,111 @@
+package sqlite
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cs2-log-proxy/storage"
+)
+
+// ImportStats counts what ImportJSON imported
+type ImportStats struct {
+	Servers  int
+	Sessions int
+	Chunks   int
+}
+
+// ImportJSON imports the server_*.json and *_chunks.json files of a "file"
+// backend directory. Players are indexed from the raw logs.
+// Sessions that are already in the database are skipped, so an interrupted
+// import can be run again.
+func (s *Store) ImportJSON(dir string) (ImportStats, error) {
+	var stats ImportStats
+	src := storage.NewLogStore(dir)
+	tokens, err := src.ListServers()
+	if err != nil {
+		return stats, err
+	}
+	for _, token := range tokens {
+		meta, err := src.LoadServerMeta(token)
+		if err != nil {
+			return stats, fmt.Errorf("server %s: %w", token, err)
+		}
+		for _, lm := range meta.Logs {
+			var n int
+			if err := s.db.QueryRow(`SELECT COUNT(*) FROM chunks WHERE log_id = ?`, lm.LogID).Scan(&n); err != nil {
+				return stats, err
+			}
+			if n > 0 {
+				continue
+			}
+			chunks, err := s.importLog(src, lm.LogID)
+			if err != nil {
+				return stats, fmt.Errorf("log %s: %w", lm.LogID, err)
+			}
+			stats.Sessions++
+			stats.Chunks += chunks
+		}
+		tx, err := s.db.Begin()
+		if err != nil {
+			return stats, err
+		}
+		if err := saveServerMeta(tx, token, meta, meta.Logs); err != nil {
+			tx.Rollback()
+			return stats, err
+		}
+		if err := tx.Commit(); err != nil {
+			return stats, err
+		}
+		stats.Servers++
+		log.Printf("Imported server %s with %d logs", token, len(meta.Logs))
+	}
+	return stats, nil
+}
+
+// importLog indexes the chunks of a log. The raw log is copied if the
+// import source isn't the store's own directory.
+func (s *Store) importLog(src *storage.LogStore, logID string) (int, error) {
+	metas, err := src.LoadChunkMetas(logID)
+	if err != nil {
+		return 0, err
+	}
+	data, err := src.GetLog(logID)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if dst := s.files.LogPath(logID); src.LogPath(logID) != dst {
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return 0, err
+		}
+		if err := os.WriteFile(dst, []byte(data), 0644); err != nil {
+			return 0, err
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	pos := 0
+	rest := ""
+	for _, m := range metas {
+		if err := insertChunk(tx, logID, m); err != nil {
+			return 0, err
+		}
+		end := pos + m.EndOffset - m.BeginOffset
+		if end > len(data) || end < pos {
+			end = len(data)
+		}
+		parts := strings.Split(rest+data[pos:end], "\n")
+		rest = parts[len(parts)-1]
+		if err := indexLines(tx, logID, parts[:len(parts)-1]); err != nil {
+			return 0, err
+		}
+		pos = end
+	}
+	return len(metas), tx.Commit()
+}
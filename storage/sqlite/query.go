@@ -0,0 +1,96 @@
+package sqlite
+
+import (
+	"strings"
+	"time"
+
+	"cs2-log-proxy/storage"
+)
+
+// SessionQuery filters sessions; zero values don't filter
+type SessionQuery struct {
+	Token   string
+	GameMap string
+	SteamID string // a player seen in the log
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+	Offset  int
+}
+
+// Session is a session row together with its server
+type Session = storage.ServerSession
+
+// QuerySessions returns matching sessions, most recently active first
+func (s *Store) QuerySessions(q SessionQuery) ([]Session, error) {
+	var where []string
+	var args []interface{}
+	if q.Token != "" {
+		where = append(where, "s.token = ?")
+		args = append(args, q.Token)
+	}
+	if q.GameMap != "" {
+		where = append(where, "s.game_map = ?")
+		args = append(args, q.GameMap)
+	}
+	if q.SteamID != "" {
+		where = append(where, "s.log_id IN (SELECT log_id FROM players WHERE steam_id = ?)")
+		args = append(args, q.SteamID)
+	}
+	if !q.Since.IsZero() {
+		where = append(where, "s.last_activity_at >= ?")
+		args = append(args, q.Since.Unix())
+	}
+	if !q.Until.IsZero() {
+		where = append(where, "s.started_at < ?")
+		args = append(args, q.Until.Unix())
+	}
+	query := `SELECT s.log_id, s.log_start_time, s.game_map, s.server_addr, s.last_activity, s.last_byte_offset,
+		s.first_received_at, s.last_received_at, s.protected, s.token, v.steam_id
+		FROM sessions s JOIN servers v ON v.token = s.token`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY s.last_activity_at DESC, s.log_id"
+	if q.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, q.Limit, q.Offset)
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		var sess Session
+		var first, last string
+		if err := rows.Scan(&sess.LogID, &sess.LogStartTime, &sess.GameMap, &sess.ServerAddr, &sess.LastActivity,
+			&sess.LastByteOffset, &first, &last, &sess.Protected, &sess.Token, &sess.SteamID); err != nil {
+			return nil, err
+		}
+		sess.FirstReceivedAt, _ = time.Parse(time.RFC3339Nano, first)
+		sess.LastReceivedAt, _ = time.Parse(time.RFC3339Nano, last)
+		sessions = append(sessions, sess)
+	}
+	return sessions, rows.Err()
+}
+
+// ListSessions returns the sessions of all servers, see storage.SessionLister
+func (s *Store) ListSessions() ([]Session, error) {
+	return s.QuerySessions(SessionQuery{})
+}
+
+// LogsWithPlayer returns the IDs of the logs a player was seen in, see
+// storage.PlayerIndex
+func (s *Store) LogsWithPlayer(steamID string) ([]string, error) {
+	sessions, err := s.QuerySessions(SessionQuery{SteamID: steamID})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(sessions))
+	for i, sess := range sessions {
+		ids[i] = sess.LogID
+	}
+	return ids, nil
+}
@@ -0,0 +1,494 @@
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cs2-log-proxy/parser"
+	"cs2-log-proxy/storage"
+
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	storage.RegisterBackend("sqlite", func(config storage.Config) (storage.Backend, error) {
+		s, err := Open(config.Path)
+		if err != nil {
+			return nil, err
+		}
+		s.files.StartLayoutMigration()
+		if err := storage.StartCompression(s.files, config); err != nil {
+			s.Close()
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// timestampLayout is the layout of CS2 X-Timestamp headers
+const timestampLayout = "01/02/2006 - 15:04:05.000"
+
+const schema = `
+CREATE TABLE IF NOT EXISTS servers (
+	token    TEXT PRIMARY KEY,
+	steam_id TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS sessions (
+	log_id            TEXT PRIMARY KEY,
+	token             TEXT NOT NULL,
+	log_start_time    TEXT NOT NULL,
+	started_at        INTEGER NOT NULL, -- unix seconds of log_start_time
+	game_map          TEXT NOT NULL,
+	server_addr       TEXT NOT NULL,
+	last_activity     TEXT NOT NULL,
+	last_activity_at  INTEGER NOT NULL,
+	last_byte_offset  INTEGER NOT NULL,
+	first_received_at TEXT NOT NULL,
+	last_received_at  TEXT NOT NULL,
+	protected         INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS sessions_token ON sessions(token);
+CREATE INDEX IF NOT EXISTS sessions_started_at ON sessions(started_at);
+CREATE INDEX IF NOT EXISTS sessions_last_activity_at ON sessions(last_activity_at);
+CREATE INDEX IF NOT EXISTS sessions_game_map ON sessions(game_map);
+CREATE TABLE IF NOT EXISTS chunks (
+	log_id       TEXT NOT NULL,
+	chunk_number INTEGER NOT NULL,
+	begin_offset INTEGER NOT NULL,
+	end_offset   INTEGER NOT NULL,
+	meta         TEXT NOT NULL -- storage.ChunkMeta as JSON
+);
+CREATE INDEX IF NOT EXISTS chunks_log_id ON chunks(log_id, begin_offset);
+-- matches were kept by earlier versions, team filters use the chunk headers
+DROP TABLE IF EXISTS matches;
+CREATE TABLE IF NOT EXISTS players (
+	steam_id  TEXT NOT NULL,
+	log_id    TEXT NOT NULL,
+	name      TEXT NOT NULL,
+	last_seen TEXT NOT NULL,
+	PRIMARY KEY (steam_id, log_id)
+);
+CREATE INDEX IF NOT EXISTS players_log_id ON players(log_id);
+CREATE INDEX IF NOT EXISTS players_name ON players(name);
+`
+
+// columns added after the first release, for databases created before them
+var addedColumns = []struct{ table, column, definition string }{
+	{"sessions", "protected", "INTEGER NOT NULL DEFAULT 0"},
+	{"servers", "unique_token", "TEXT NOT NULL DEFAULT ''"},
+}
+
+func migrate(db *sql.DB) error {
+	for _, c := range addedColumns {
+		var n int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, c.table, c.column).Scan(&n); err != nil {
+			return err
+		}
+		if n == 0 {
+			if _, err := db.Exec(`ALTER TABLE ` + c.table + ` ADD COLUMN ` + c.column + ` ` + c.definition); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateLogIDs replaces the former log IDs of databases written before
+// storage.NewLogID, once, as recorded in the user_version pragma
+func migrateLogIDs(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version >= 1 {
+		return nil
+	}
+	rows, err := db.Query(`SELECT log_id FROM sessions UNION SELECT log_id FROM chunks`)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, id := range ids {
+		canonical := storage.CanonicalLogID(id)
+		if canonical == id {
+			continue
+		}
+		for _, table := range []string{"sessions", "chunks", "players"} {
+			if _, err := tx.Exec(`UPDATE `+table+` SET log_id = ? WHERE log_id = ?`, canonical, id); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.Exec(`PRAGMA user_version = 1`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Store keeps servers, sessions, chunk indexes and players in an
+// embedded SQLite database at {dir}/metadata.db. Raw logs stay on disk in
+// the LogStore layout.
+type Store struct {
+	db    *sql.DB
+	files *storage.LogStore
+
+	mu      sync.Mutex
+	partial map[string]string          // logID -> incomplete trailing line
+	saved   map[string]storage.LogMeta // logID -> session row as last written
+}
+
+var (
+	_ storage.Backend        = (*Store)(nil)
+	_ storage.LogCompressor  = (*Store)(nil)
+	_ storage.LogOpener      = (*Store)(nil)
+	_ storage.LogDeleter     = (*Store)(nil)
+	_ storage.LogStater      = (*Store)(nil)
+	_ storage.Reconfigurable = (*Store)(nil)
+	_ storage.SessionLister  = (*Store)(nil)
+	_ storage.PlayerIndex    = (*Store)(nil)
+)
+
+// Open opens or creates the metadata database in dir
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	db, err := sql.Open("sqlite", filepath.Join(dir, "metadata.db")+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, serialize in the pool instead of failing
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateLogIDs(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate log IDs: %w", err)
+	}
+	return &Store{
+		db:      db,
+		files:   storage.NewLogStore(dir),
+		partial: make(map[string]string),
+		saved:   make(map[string]storage.LogMeta),
+	}, nil
+}
+
+func (s *Store) Close() error {
+	s.files.Close()
+	return s.db.Close()
+}
+
+func (s *Store) ListServers() ([]string, error) {
+	rows, err := s.db.Query(`SELECT token FROM servers ORDER BY token`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []string{}
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+const sessionColumns = `log_id, log_start_time, game_map, server_addr, last_activity, last_byte_offset, first_received_at, last_received_at, protected`
+
+func scanSession(rows *sql.Rows) (storage.LogMeta, error) {
+	var lm storage.LogMeta
+	var first, last string
+	err := rows.Scan(&lm.LogID, &lm.LogStartTime, &lm.GameMap, &lm.ServerAddr,
+		&lm.LastActivity, &lm.LastByteOffset, &first, &last, &lm.Protected)
+	lm.FirstReceivedAt, _ = time.Parse(time.RFC3339Nano, first)
+	lm.LastReceivedAt, _ = time.Parse(time.RFC3339Nano, last)
+	return lm, err
+}
+
+func (s *Store) LoadServerMeta(token string) (*storage.ServerMeta, error) {
+	meta := &storage.ServerMeta{ServerInstanceToken: token, Logs: []storage.LogMeta{}}
+	err := s.db.QueryRow(`SELECT steam_id, unique_token FROM servers WHERE token = ?`, token).Scan(&meta.SteamID, &meta.UniqueToken)
+	if err == sql.ErrNoRows {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT `+sessionColumns+` FROM sessions WHERE token = ? ORDER BY rowid`, token)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		lm, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		meta.Logs = append(meta.Logs, lm)
+	}
+	return meta, rows.Err()
+}
+
+func unixOf(timestamp string) int64 {
+	t, err := time.Parse(timestampLayout, timestamp)
+	if err != nil {
+		return 0
+	}
+	return t.Unix()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// Reconfigure applies changed compression settings to the raw logs
+func (s *Store) Reconfigure(config storage.Config) error {
+	return s.files.Reconfigure(config)
+}
+
+// SaveServerMeta writes the server row and the sessions that changed since
+// this store last wrote them, usually just the one a chunk was added to
+func (s *Store) SaveServerMeta(token string, meta *storage.ServerMeta) error {
+	storage.CanonicalizeLogIDs(meta)
+	var changed []storage.LogMeta
+	s.mu.Lock()
+	for _, lm := range meta.Logs {
+		if saved, ok := s.saved[lm.LogID]; !ok || saved != lm {
+			changed = append(changed, lm)
+		}
+	}
+	s.mu.Unlock()
+	if err := storage.CheckLogOwners(token, &storage.ServerMeta{Logs: changed}); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := saveServerMeta(tx, token, meta, changed); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for _, lm := range changed {
+		s.saved[lm.LogID] = lm
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// saveServerMeta upserts the server row of meta and the given sessions
+func saveServerMeta(tx *sql.Tx, token string, meta *storage.ServerMeta, logs []storage.LogMeta) error {
+	if _, err := tx.Exec(`INSERT INTO servers (token, steam_id, unique_token) VALUES (?, ?, ?)
+		ON CONFLICT(token) DO UPDATE SET steam_id = excluded.steam_id, unique_token = excluded.unique_token`,
+		token, meta.SteamID, meta.UniqueToken); err != nil {
+		return err
+	}
+	if len(logs) == 0 {
+		return nil
+	}
+	stmt, err := tx.Prepare(`INSERT INTO sessions (` + sessionColumns + `, token, started_at, last_activity_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(log_id) DO UPDATE SET
+			game_map = excluded.game_map,
+			server_addr = excluded.server_addr,
+			last_activity = excluded.last_activity,
+			last_activity_at = excluded.last_activity_at,
+			last_byte_offset = excluded.last_byte_offset,
+			first_received_at = excluded.first_received_at,
+			last_received_at = excluded.last_received_at,
+			protected = excluded.protected`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, lm := range logs {
+		if _, err := stmt.Exec(lm.LogID, lm.LogStartTime, lm.GameMap, lm.ServerAddr, lm.LastActivity,
+			lm.LastByteOffset, formatTime(lm.FirstReceivedAt), formatTime(lm.LastReceivedAt), lm.Protected,
+			token, unixOf(lm.LogStartTime), unixOf(lm.LastActivity)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AppendChunk appends the raw chunk to the log file, indexes it and
+// records the players it mentions. If the chunk can't be indexed the file
+// is cut back, so a retry doesn't store the chunk twice.
+func (s *Store) AppendChunk(logID string, chunkData string, meta storage.ChunkMeta) error {
+	logID = storage.CanonicalLogID(logID)
+	size, err := s.files.AppendLogData(logID, chunkData)
+	if err != nil {
+		return err
+	}
+	if err := s.indexChunk(logID, chunkData, meta); err != nil {
+		if terr := s.files.TruncateLog(logID, size); terr != nil {
+			log.Printf("Failed to truncate log %s after a failed append: %v", logID, terr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *Store) indexChunk(logID string, chunkData string, meta storage.ChunkMeta) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := insertChunk(tx, logID, meta); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	parts := strings.Split(s.partial[logID]+chunkData, "\n")
+	s.mu.Unlock()
+	if err := indexLines(tx, logID, parts[:len(parts)-1]); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if rest := parts[len(parts)-1]; rest != "" {
+		s.partial[logID] = rest
+	} else {
+		delete(s.partial, logID)
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func insertChunk(tx *sql.Tx, logID string, meta storage.ChunkMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO chunks (log_id, chunk_number, begin_offset, end_offset, meta) VALUES (?, ?, ?, ?, ?)`,
+		logID, meta.ChunkNumber, meta.BeginOffset, meta.EndOffset, string(data))
+	return err
+}
+
+// indexLines records the players seen in lines
+func indexLines(tx *sql.Tx, logID string, lines []string) error {
+	for _, line := range lines {
+		line = strings.TrimRight(line, "\r")
+		ts, _, _ := parser.SplitLine(line)
+		for _, p := range parser.Players(line) {
+			if _, err := tx.Exec(`INSERT INTO players (steam_id, log_id, name, last_seen) VALUES (?, ?, ?, ?)
+				ON CONFLICT(steam_id, log_id) DO UPDATE SET name = excluded.name, last_seen = excluded.last_seen`,
+				p.SteamID, logID, p.Name, ts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Store) LoadChunkMetas(logID string) ([]storage.ChunkMeta, error) {
+	logID = storage.CanonicalLogID(logID)
+	rows, err := s.db.Query(`SELECT meta FROM chunks WHERE log_id = ? ORDER BY rowid`, logID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var metas []storage.ChunkMeta
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var m storage.ChunkMeta
+		if err := json.Unmarshal([]byte(data), &m); err != nil {
+			return nil, err
+		}
+		metas = append(metas, m)
+	}
+	return metas, rows.Err()
+}
+
+func (s *Store) GetLog(logID string) (string, error) {
+	return s.files.GetLog(logID)
+}
+
+func (s *Store) OpenLog(logID string) (io.ReadCloser, string, error) {
+	return s.files.OpenLog(logID)
+}
+
+// CompressLog compresses a log that ended, so its incomplete trailing line
+// won't be continued
+func (s *Store) CompressLog(logID string) error {
+	logID = storage.CanonicalLogID(logID)
+	s.mu.Lock()
+	delete(s.partial, logID)
+	s.mu.Unlock()
+	return s.files.CompressLog(logID)
+}
+
+func (s *Store) StatLog(logID string) (int64, string, error) {
+	return s.files.StatLog(logID)
+}
+
+// DeleteLog removes a log's file, chunks, players and session
+func (s *Store) DeleteLog(logID string) error {
+	logID = storage.CanonicalLogID(logID)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"chunks", "players", "sessions"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE log_id = ?`, logID); err != nil {
+			return err
+		}
+	}
+	if err := s.files.DeleteLog(logID); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.partial, logID)
+	delete(s.saved, logID)
+	s.mu.Unlock()
+	return tx.Commit()
+}
@@ -0,0 +1,168 @@
+package sqlite
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"cs2-log-proxy/storage"
+)
+
+const (
+	alice = `L 01/30/2025 - 16:33:56: "alice<2><[U:1:1001]><CT>" say "gl"` + "\n"
+	bob   = `L 01/30/2025 - 16:33:57: "bob<3><[U:1:1002]><TERRORIST>" killed "alice<2><[U:1:1001]><CT>" with "ak47"` + "\n"
+	bot   = `L 01/30/2025 - 16:33:58: "Bot<4><BOT><CT>" say "hi"` + "\n"
+)
+
+// appendLog stores data as one log of server token, one chunk per element
+func appendLog(t *testing.T, s *Store, token, logID string, data ...string) {
+	t.Helper()
+	end := 0
+	for _, d := range data {
+		meta := storage.ChunkMeta{BeginOffset: end, EndOffset: end + len(d), Timestamp: "01/30/2025 - 16:33:56.000"}
+		if err := s.AppendChunk(logID, d, meta); err != nil {
+			t.Fatal(err)
+		}
+		end = meta.EndOffset
+	}
+	err := storage.UpdateServerMeta(s, token, func(meta *storage.ServerMeta) error {
+		meta.ServerInstanceToken = token
+		meta.Logs = append(meta.Logs, storage.LogMeta{LogID: logID, LogStartTime: "01/30/2025 - 16:33:56.000", LastActivity: "01/30/2025 - 16:33:56.000", LastByteOffset: end})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogsWithPlayer(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// alice's line of the first log is split across two chunks
+	appendLog(t, s, "a", "a_1", alice[:20], alice[20:]+bot)
+	appendLog(t, s, "a", "a_2", bob)
+	appendLog(t, s, "b", "b_1", bot)
+	if err := s.DeleteLog("a_2"); err != nil {
+		t.Fatal(err)
+	}
+	appendLog(t, s, "b", "b_2", bob)
+	s.Close()
+
+	// The index survives a restart
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	tests := []struct {
+		steamID string
+		want    []string
+	}{
+		{"[U:1:1001]", []string{"a_1", "b_2"}},
+		{"[U:1:1002]", []string{"b_2"}},
+		{"BOT", []string{}},
+		{"[U:1:9999]", []string{}},
+	}
+	for _, tt := range tests {
+		got, err := s.LogsWithPlayer(tt.steamID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("LogsWithPlayer(%s) = %v, want %v", tt.steamID, got, tt.want)
+		}
+	}
+}
+
+func TestAppendChunkIndexFailure(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.AppendChunk("a_1", alice, storage.ChunkMeta{EndOffset: len(alice)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec(`DROP TABLE chunks`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendChunk("a_1", bob, storage.ChunkMeta{BeginOffset: len(alice), EndOffset: len(alice) + len(bob)}); err == nil {
+		t.Fatal("append without a chunks table succeeded")
+	}
+	// The file is cut back to the chunks that were indexed
+	if got, err := s.GetLog("a_1"); err != nil || got != alice {
+		t.Errorf("log = %q, %v; want %q", got, err, alice)
+	}
+}
+
+func TestAppendChunkPartialLines(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	appendLog(t, s, "a", "a_1", alice[:20])
+	if len(s.partial) != 1 {
+		t.Fatalf("partial lines = %v, want the start of alice's line", s.partial)
+	}
+	appendLog(t, s, "a", "a_2", alice[20:], bob)
+	// a_2 holds complete lines only; a_1 ends mid-line until it ends
+	if _, ok := s.partial["a_2"]; ok {
+		t.Errorf("partial line kept for a_2: %v", s.partial)
+	}
+	if err := s.CompressLog("a_1"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.partial) != 0 {
+		t.Errorf("partial lines after the log ended: %v", s.partial)
+	}
+}
+
+func TestMigrateLogIDs(t *testing.T) {
+	const id, former = "a_2025-01-30T16-33-56.000", "a_01_30_2025 - 16:33:56.000"
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendLog(t, s, "a", id, alice)
+	// Rows written by earlier versions hold the former ID
+	for _, stmt := range []string{
+		`UPDATE sessions SET log_id = ?`,
+		`UPDATE chunks SET log_id = ?`,
+		`UPDATE players SET log_id = ?`,
+	} {
+		if _, err := s.db.Exec(stmt, former); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.db.Exec(`PRAGMA user_version = 0`); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	meta, err := s.LoadServerMeta("a")
+	if err != nil || len(meta.Logs) != 1 || meta.Logs[0].LogID != id {
+		t.Fatalf("LoadServerMeta = %+v, %v", meta, err)
+	}
+	for _, logID := range []string{id, former} {
+		if metas, err := s.LoadChunkMetas(logID); err != nil || len(metas) != 1 {
+			t.Errorf("LoadChunkMetas(%q) = %+v, %v", logID, metas, err)
+		}
+		if got, err := s.GetLog(logID); err != nil || got != alice {
+			t.Errorf("GetLog(%q) = %q, %v", logID, got, err)
+		}
+	}
+	if got, err := s.LogsWithPlayer("[U:1:1001]"); err != nil || !reflect.DeepEqual(got, []string{id}) {
+		t.Errorf("LogsWithPlayer = %v, %v", got, err)
+	}
+}
@@ -21,5 +21,50 @@ type Config struct {
 	Type        string `json:"type"`
 	Path        string `json:"path"`
 	MaxFileSize int64  `json:"maxFileSize"`
-	MaxFiles    int    `json:"maxFiles"`
+	MaxFiles    int    `json:"maxFiles"` // limits the number of logs kept if retention.maxLogs is unset
+	// Compression compresses finished logs with "gzip" or "zstd"
+	Compression string `json:"compression"`
+	// CompressAfter is how long a log must be idle before it is compressed, e.g. "30m"
+	CompressAfter string `json:"compressAfter"`
+
+	Retention RetentionConfig `json:"retention"`
+
+	S3 S3Config `json:"s3"`
+}
+
+// RetentionConfig limits the logs kept, globally and per server. Zero
+// values don't limit.
+type RetentionConfig struct {
+	MaxAge       string `json:"maxAge"` // e.g. "720h"
+	MaxTotalSize int64  `json:"maxTotalSize"`
+	MaxLogs      int    `json:"maxLogs"`
+
+	PerServer struct {
+		MaxAge       string `json:"maxAge"`
+		MaxTotalSize int64  `json:"maxTotalSize"`
+		MaxLogs      int    `json:"maxLogs"`
+	} `json:"perServer"`
+
+	// Action is "delete" (default), "compress" or "archive"
+	Action string `json:"action"`
+	// Archive is the backend logs are moved to by the "archive" action
+	Archive *Config `json:"archive"`
+	// Interval between retention runs, default "1h"
+	Interval string `json:"interval"`
+}
+
+// S3Config configures the "s3" backend. Path is used as the local buffer
+// for active sessions.
+type S3Config struct {
+	Endpoint  string `json:"endpoint"` // e.g. https://s3.eu-central-1.amazonaws.com or http://localhost:9000
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+	// IdleTimeout is how long a session must be idle before it is uploaded, e.g. "30m"
+	IdleTimeout string `json:"idleTimeout"`
+	// PartSize is the multipart upload part size in bytes, logs larger than
+	// one part are uploaded in parts
+	PartSize int64 `json:"partSize"`
 }
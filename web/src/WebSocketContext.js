@@ -1,4 +1,5 @@
 import React, { createContext, useContext, useEffect, useRef, useState } from 'react';
+import { wsUrl } from './api';
 
 const WebSocketContext = createContext(null);
 
@@ -10,12 +11,17 @@ export const WebSocketProvider = ({ children }) => {
 
   const connect = () => {
     setStatus('connecting');
-    const ws = new WebSocket(`ws://localhost:8081/ws`);
+    const ws = new WebSocket(wsUrl(`ws://localhost:8081/ws`));
     wsRef.current = ws;
 
     ws.onopen = () => {
       setStatus('connected');
       reconnectAttempts.current = 0;
+      // (Re)send the subscriptions, a new connection has none
+      activeSubsRef.current = {};
+      Object.keys(listenersRef.current).forEach((eventType) => {
+        if (listenersRef.current[eventType].size > 0) sendSubscribe(eventType);
+      });
     };
     ws.onclose = () => {
       setStatus('disconnected');
@@ -53,33 +59,43 @@ export const WebSocketProvider = ({ children }) => {
   // --- Enhanced Subscription/Event API ---
   const listenersRef = useRef({}); // { eventType: Set of callbacks }
   const activeSubsRef = useRef({}); // { eventType: true }
+  const optionsRef = useRef({}); // { eventType: options or a function returning them }
+
+  // Options may be a function, called for every (re)subscription, e.g. to
+  // resume a log from the last offset received with from_offset
+  const subscribeOptions = (eventType) => {
+    const options = optionsRef.current[eventType] || {};
+    return typeof options === 'function' ? options() : options;
+  };
+
+  const sendSubscribe = (eventType) => {
+    if (!wsRef.current || wsRef.current.readyState !== WebSocket.OPEN) return;
+    wsRef.current.send(JSON.stringify({ type: 'subscribe', event: eventType, ...subscribeOptions(eventType) }));
+    activeSubsRef.current[eventType] = true;
+  };
 
   // Register a callback for a specific event type
   const subscribe = (eventType, callback, options = {}) => {
     if (!listenersRef.current[eventType]) listenersRef.current[eventType] = new Set();
     listenersRef.current[eventType].add(callback);
     // Only send subscribe message if this is the first listener for this event
-    if (
-      !activeSubsRef.current[eventType] &&
-      wsRef.current &&
-      wsRef.current.readyState === WebSocket.OPEN
-    ) {
-      wsRef.current.send(JSON.stringify({ type: 'subscribe', event: eventType, ...options }));
-      activeSubsRef.current[eventType] = true;
+    if (!activeSubsRef.current[eventType]) {
+      optionsRef.current[eventType] = options;
+      sendSubscribe(eventType);
     }
-    return () => unsubscribe(eventType, callback, options);
+    return () => unsubscribe(eventType, callback);
   };
 
-  const unsubscribe = (eventType, callback, options = {}) => {
+  const unsubscribe = (eventType, callback) => {
     if (listenersRef.current[eventType]) {
       listenersRef.current[eventType].delete(callback);
-      if (
-        listenersRef.current[eventType].size === 0 &&
-        wsRef.current &&
-        wsRef.current.readyState === WebSocket.OPEN
-      ) {
-        wsRef.current.send(JSON.stringify({ type: 'unsubscribe', event: eventType, ...options }));
+      if (listenersRef.current[eventType].size === 0) {
+        if (activeSubsRef.current[eventType] && wsRef.current && wsRef.current.readyState === WebSocket.OPEN) {
+          const { token } = subscribeOptions(eventType);
+          wsRef.current.send(JSON.stringify({ type: 'unsubscribe', event: eventType, token }));
+        }
         activeSubsRef.current[eventType] = false;
+        delete optionsRef.current[eventType];
       }
     }
   };
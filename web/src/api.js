@@ -0,0 +1,24 @@
+// API key of the proxy, if it requires one. Set it in the browser console
+// with localStorage.setItem('apiKey', '...').
+export const apiKey = () => localStorage.getItem('apiKey');
+
+// fetch with the API key. Without a key, a 401 sends the browser to the
+// OIDC login, if the proxy has one.
+export const apiFetch = (url, options = {}) => {
+  const key = apiKey();
+  if (!key) {
+    return fetch(url, options).then((res) => {
+      if (res.status === 401) {
+        window.location.assign(`/auth/login?redirect=${encodeURIComponent(window.location.pathname)}`);
+      }
+      return res;
+    });
+  }
+  return fetch(url, { ...options, headers: { ...options.headers, Authorization: `Bearer ${key}` } });
+};
+
+// wsUrl adds the API key to a websocket URL, browsers can't set headers on websockets
+export const wsUrl = (url) => {
+  const key = apiKey();
+  return key ? `${url}?api_key=${encodeURIComponent(key)}` : url;
+};
@@ -1,21 +1,33 @@
 import React, { useEffect, useState } from 'react';
 import { DataGrid } from '@mui/x-data-grid';
-import { Box, Typography, Paper, CircularProgress, Alert } from '@mui/material';
+import { Box, Button, Typography, Paper, CircularProgress, Alert } from '@mui/material';
 import { useWebSocket } from '../WebSocketContext';
+import { apiFetch } from '../api';
+
+// Logs are listed a page at a time, most recently active first
+const PAGE_SIZE = 100;
 
 export default function LogList({ selectedToken, onSelect }) {
   const [logs, setLogs] = useState([]);
+  const [nextCursor, setNextCursor] = useState(null);
   const [loading, setLoading] = useState(true);
+  const [loadingMore, setLoadingMore] = useState(false);
   const [error, setError] = useState(null);
 
+  const fetchPage = (cursor) => {
+    const params = new URLSearchParams({ limit: PAGE_SIZE });
+    if (cursor) params.set('cursor', cursor);
+    return apiFetch(`/api/listlogs?${params}`).then((res) => {
+      if (!res.ok) throw new Error('Failed to fetch logs');
+      return res.json();
+    });
+  };
+
   useEffect(() => {
-    fetch('/api/listlogs')
-      .then((res) => {
-        if (!res.ok) throw new Error('Failed to fetch logs');
-        return res.json();
-      })
+    fetchPage(null)
       .then((data) => {
-        setLogs(data);
+        setLogs(data.logs);
+        setNextCursor(data.next_cursor || null);
         setLoading(false);
       })
       .catch((err) => {
@@ -24,6 +36,23 @@ export default function LogList({ selectedToken, onSelect }) {
       });
   }, []);
 
+  const loadMore = () => {
+    setLoadingMore(true);
+    fetchPage(nextCursor)
+      .then((data) => {
+        setLogs((prev) => {
+          const seen = new Set(prev.map((log) => log.log_id));
+          return [...prev, ...data.logs.filter((log) => !seen.has(log.log_id))];
+        });
+        setNextCursor(data.next_cursor || null);
+        setLoadingMore(false);
+      })
+      .catch((err) => {
+        setError(err.message);
+        setLoadingMore(false);
+      });
+  };
+
   const { subscribe, unsubscribe } = useWebSocket();
 
   useEffect(() => {
@@ -99,6 +128,13 @@ export default function LogList({ selectedToken, onSelect }) {
             />
           </div>
         )}
+        {!loading && !error && nextCursor && (
+          <Box sx={{ display: 'flex', justifyContent: 'center', mt: 2 }}>
+            <Button variant="outlined" onClick={loadMore} disabled={loadingMore}>
+              {loadingMore ? 'Loading…' : 'Load more logs'}
+            </Button>
+          </Box>
+        )}
       </Paper>
     </Box>
   );
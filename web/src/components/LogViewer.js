@@ -12,43 +12,73 @@ import {
 import DownloadIcon from '@mui/icons-material/Download';
 import ArrowDownwardIcon from '@mui/icons-material/ArrowDownward';
 import { useWebSocket } from '../WebSocketContext';
+import { apiFetch } from '../api';
 
 function LogViewer({ token }) {
   const [logs, setLogs] = useState([]);
   const [loading, setLoading] = useState(false);
   const [autoScroll, setAutoScroll] = useState(true);
+  // Token whose stored log was fetched, live chunks are subscribed after that
+  const [fetched, setFetched] = useState(null);
+  // Bytes of the stored log shown, to resume from after a reconnect
+  const offsetRef = useRef(0);
   const containerRef = useRef(null);
 
   // Fetch the full log when token changes
   useEffect(() => {
     if (!token) return;
+    let cancelled = false;
     setLoading(true);
-    fetch(`/api/logs/${token}`)
+    setFetched(null);
+    apiFetch(`/api/logs/${token}`)
       .then((res) => (res.ok ? res.text() : Promise.reject('Failed to fetch log')))
       .then((data) => {
+        if (cancelled) return;
         setLogs(data.split('\n'));
+        offsetRef.current = new TextEncoder().encode(data).length;
         setLoading(false);
+        setFetched(token);
       })
       .catch(() => {
+        if (cancelled) return;
         setLogs([]);
+        offsetRef.current = 0;
         setLoading(false);
+        setFetched(token);
       });
+    return () => {
+      cancelled = true;
+    };
   }, [token]);
 
   const { subscribe } = useWebSocket();
 
   useEffect(() => {
-    if (!token) return;
+    if (!token || fetched !== token) return;
     const handleLogChunk = (data) => {
-      if (data.type === 'log_chunk' && data.token === token) {
-        setLogs((prev) => [...prev, data.payload]);
+      if (data.type !== 'log_chunk' || data.token !== token) return;
+      // The server replays what was missed and skips what was sent
+      let payload = data.payload;
+      if (data.end_offset !== undefined) {
+        if (data.end_offset <= offsetRef.current) return;
+        // A chunk overlapping what we have only adds the bytes after it
+        const overlap = offsetRef.current - data.begin_offset;
+        if (overlap > 0) {
+          payload = new TextDecoder().decode(new TextEncoder().encode(payload).slice(overlap));
+        }
+        offsetRef.current = data.end_offset;
       }
+      // Chunks may end inside a line, continue the last one
+      setLogs((prev) => {
+        const last = prev.length > 0 ? prev[prev.length - 1] : '';
+        return [...prev.slice(0, -1), ...(last + payload).split('\n')];
+      });
     };
-    const unsub = subscribe('log_chunk', handleLogChunk, { token });
+    const unsub = subscribe('log_chunk', handleLogChunk, () => ({ token, from_offset: offsetRef.current }));
     return () => {
       unsub();
     };
-  }, [token, subscribe]);
+  }, [token, fetched, subscribe]);
 
   const scrollToBottom = () => {
     if (containerRef.current) {
@@ -0,0 +1,32 @@
+package websocket
+
+import "cs2-log-proxy/metrics"
+
+var droppedMessages = metrics.NewCounter("cs2_log_proxy_websocket_dropped_messages_total", "Messages dropped because a client was too slow, by transport.", "transport")
+
+var slowDisconnects = metrics.NewCounter("cs2_log_proxy_websocket_slow_disconnects_total", "Clients disconnected for falling behind on log chunks they can't miss, by transport.", "transport")
+
+// transport names the connection type of a client for metrics
+func (c *Client) transport() string {
+	if c.Conn == nil {
+		return "sse"
+	}
+	return "websocket"
+}
+
+// RegisterMetrics adds the client counts of the hub to r
+func (h *Hub) RegisterMetrics(r *metrics.Registry) {
+	r.NewGaugeFunc("cs2_log_proxy_websocket_clients", "Connected live event clients, by transport.", []string{"transport"}, func() []metrics.Sample {
+		h.Mutex.Lock()
+		defer h.Mutex.Unlock()
+		counts := map[string]float64{"websocket": 0, "sse": 0}
+		for client := range h.Clients {
+			counts[client.transport()]++
+		}
+		var samples []metrics.Sample
+		for transport, n := range counts {
+			samples = append(samples, metrics.Sample{Labels: []string{transport}, Value: n})
+		}
+		return samples
+	})
+}
@@ -0,0 +1,177 @@
+package websocket
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"cs2-log-proxy/storage"
+)
+
+const (
+	// maxHeldChunks bounds the live chunks held back per log during a replay
+	maxHeldChunks = 10000
+	// replayPieceSize is the largest log_chunk a replay sends, split at a
+	// line break where possible
+	replayPieceSize = 64 << 10
+)
+
+// SubscribeFrom subscribes a client to the log_chunk events of a log and
+// first sends what the log store holds from offset on, so a reconnecting
+// client gets the chunks it missed. Live chunks arriving meanwhile are
+// sent after the replay, without the parts already replayed; a client
+// holding back more than maxHeldChunks is disconnected as slow. It blocks
+// until the replay was sent or the client is gone.
+func (h *Hub) SubscribeFrom(client *Client, logID string, offset int64) {
+	if !client.Principal.CanSeeLog(logID) {
+		return
+	}
+	offset = max(offset, 0)
+	client.Mutex.Lock()
+	if _, ok := client.replaying[logID]; ok {
+		client.Mutex.Unlock()
+		return
+	}
+	client.replaying[logID] = nil
+	client.Mutex.Unlock()
+	h.Subscribe(client, "log_chunk", logID)
+
+	sent := offset
+	if h.Logs != nil {
+		var ok bool
+		if sent, ok = h.replay(client, logID, offset); !ok {
+			return
+		}
+	}
+
+	// Send the chunks held back meanwhile, without holding the lock while
+	// blocked so live chunks keep being held back, until none are left
+	for {
+		client.Mutex.Lock()
+		held := client.replaying[logID]
+		if len(held) == 0 {
+			delete(client.replaying, logID)
+			client.offsets[logID] = sent
+			client.Mutex.Unlock()
+			return
+		}
+		client.replaying[logID] = nil
+		client.Mutex.Unlock()
+		for _, e := range held {
+			e, ok := e.after(sent)
+			if !ok {
+				continue
+			}
+			if !client.sendBlocking(e) {
+				return
+			}
+			sent = e.EndOffset
+		}
+	}
+}
+
+// replay sends the stored log from offset on in pieces of at most
+// replayPieceSize and returns the offset it got to, false if the client is
+// gone. Backends that can open logs are read from offset on instead of
+// loading the whole log.
+func (h *Hub) replay(client *Client, logID string, offset int64) (int64, bool) {
+	r, err := openLog(h.Logs, logID, offset)
+	if errors.Is(err, os.ErrNotExist) {
+		return offset, true
+	}
+	if err != nil {
+		log.Printf("Failed to replay %s: %v", logID, err)
+		return offset, true
+	}
+	defer r.Close()
+
+	sent := offset
+	buf := make([]byte, replayPieceSize)
+	pending := 0 // bytes of buf read but not sent yet
+	for {
+		n, err := io.ReadFull(r, buf[pending:])
+		total := pending + n
+		end := total
+		if err == nil {
+			// More may follow, end the piece at a line break
+			if i := bytes.LastIndexByte(buf[:total], '\n'); i >= 0 {
+				end = i + 1
+			}
+		}
+		if end > 0 {
+			e := Event{Type: "log_chunk", Token: logID, Payload: string(buf[:end]), BeginOffset: sent, EndOffset: sent + int64(end)}
+			if !client.sendBlocking(e) {
+				return sent, false
+			}
+			sent += int64(end)
+		}
+		pending = copy(buf, buf[end:total])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sent, true
+		}
+		if err != nil {
+			log.Printf("Failed to replay %s: %v", logID, err)
+			return sent, true
+		}
+	}
+}
+
+// openLog returns a reader of the plain log from offset on
+func openLog(logs LogReader, logID string, offset int64) (io.ReadCloser, error) {
+	opener, ok := logs.(storage.LogOpener)
+	if !ok {
+		data, err := logs.GetLog(logID)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(strings.NewReader(data[min(offset, int64(len(data))):])), nil
+	}
+	f, encoding, err := opener.OpenLog(logID)
+	if err != nil {
+		return nil, err
+	}
+	if seeker, ok := f.(io.Seeker); ok && encoding == "" {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return f, nil
+	}
+	body, err := storage.Decompress(f, encoding)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, body, offset); err != nil && err != io.EOF {
+		body.Close()
+		f.Close()
+		return nil, err
+	}
+	return &decompressedLog{body, f}, nil
+}
+
+// decompressedLog closes the decompressor and the stored file
+type decompressedLog struct {
+	io.ReadCloser
+	file io.Closer
+}
+
+func (d *decompressedLog) Close() error {
+	d.ReadCloser.Close()
+	return d.file.Close()
+}
+
+// sendBlocking sends e, false if the client is gone first
+func (c *Client) sendBlocking(e Event) bool {
+	select {
+	case c.Send <- e.message():
+		return true
+	case <-c.done:
+		return false
+	case <-c.slow:
+		return false
+	}
+}
@@ -0,0 +1,104 @@
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// testLogs is a LogReader whose log grows by the live chunks published
+// while a replay reads it
+type testLogs struct {
+	hub    *Hub
+	data   string
+	during []Event
+}
+
+func (l *testLogs) GetLog(logID string) (string, error) {
+	for _, e := range l.during {
+		l.hub.Publish(e)
+	}
+	if l.data == "" {
+		return "", os.ErrNotExist
+	}
+	return l.data, nil
+}
+
+// chunk is the event of log bytes [begin, end) of data
+func chunk(data string, begin, end int) Event {
+	return Event{Type: "log_chunk", Token: "log", Payload: data[begin:end], BeginOffset: int64(begin), EndOffset: int64(end)}
+}
+
+// received returns the log_chunk payloads sent to client so far, checking
+// that each begins where the one before ended
+func received(t *testing.T, client *Client, from int) string {
+	t.Helper()
+	var b strings.Builder
+	end := int64(from)
+	for {
+		select {
+		case data := <-client.Send:
+			var msg struct {
+				Payload     string `json:"payload"`
+				BeginOffset int64  `json:"begin_offset"`
+				EndOffset   int64  `json:"end_offset"`
+			}
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.BeginOffset != end || msg.EndOffset != msg.BeginOffset+int64(len(msg.Payload)) {
+				t.Fatalf("chunk [%d-%d] of %d bytes after %d", msg.BeginOffset, msg.EndOffset, len(msg.Payload), end)
+			}
+			b.WriteString(msg.Payload)
+			end = msg.EndOffset
+		default:
+			return b.String()
+		}
+	}
+}
+
+func TestSubscribeFrom(t *testing.T) {
+	var lines strings.Builder
+	for i := 0; lines.Len() < 2*replayPieceSize; i++ {
+		fmt.Fprintf(&lines, "L line %d\n", i)
+	}
+	long := lines.String()
+	const data = "L 01\nL 02\nL 03\nL 04\nL 05\nL 06\nL 07\nL 08\n"
+
+	tests := []struct {
+		name   string
+		stored string  // bytes of data stored when the replay reads the log
+		from   int     // offset the client resumes from
+		during []Event // live chunks published during the replay
+		after  []Event // live chunks published after it
+		log    string  // the full log
+	}{
+		{"replay only", data, 0, nil, nil, data},
+		{"resume mid-log", data, 10, nil, nil, data},
+		{"resume at the end", data, len(data), nil, []Event{chunk(data+"L 09\n", 40, 45)}, data + "L 09\n"},
+		{"live chunk already stored", data, 5, []Event{chunk(data, 10, 20)}, nil, data},
+		{"live chunk overlapping the replay", data[:20], 0, []Event{chunk(data, 15, 30)}, nil, data[:30]},
+		{"live chunks after the replay", data[:20], 0, []Event{chunk(data, 20, 25), chunk(data, 25, 30)}, []Event{chunk(data, 30, 40)}, data},
+		{"duplicate live chunk", data[:20], 0, []Event{chunk(data, 20, 30)}, []Event{chunk(data, 25, 35), chunk(data, 20, 30)}, data[:35]},
+		{"nothing stored yet", "", 0, []Event{chunk(data, 0, 10)}, []Event{chunk(data, 10, 20)}, data[:20]},
+		{"replay in pieces", long, 3, []Event{chunk(long+"L end\n", len(long)-4, len(long)+6)}, nil, long + "L end\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub()
+			hub.Logs = &testLogs{hub: hub, data: tt.stored, during: tt.during}
+			client := NewClient(nil, nil, 1024)
+			hub.AddClient(client)
+
+			hub.SubscribeFrom(client, "log", int64(tt.from))
+			for _, e := range tt.after {
+				hub.Publish(e)
+			}
+			if got, want := received(t, client, tt.from), tt.log[tt.from:]; got != want {
+				t.Errorf("received %d bytes, want %d:\n%q\nwant\n%q", len(got), len(want), got, want)
+			}
+		})
+	}
+}
@@ -6,23 +6,70 @@ import (
 	"net/http"
 	"sync"
 
+	"cs2-log-proxy/auth"
+	"cs2-log-proxy/storage"
+
 	"github.com/gorilla/websocket"
 )
 
-var Upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
+// Upgrader accepts same-origin pages and non-browser clients. main sets
+// CheckOrigin to the configured allowed origins.
+var Upgrader = websocket.Upgrader{}
 
 // Client represents a websocket client
 // Each client can subscribe to multiple event types and tokens
 // Subscriptions are managed in the Hub
 type Client struct {
-	Conn          *websocket.Conn
+	Conn          *websocket.Conn // nil for clients of other transports
 	Send          chan []byte
 	Subscriptions map[string]map[string]bool // eventType -> token -> subscribed
-	Mutex         sync.Mutex                 // protects Subscriptions
+	Mutex         sync.Mutex                 // protects Subscriptions, offsets and replaying
+	Principal     *auth.Principal            // key the client connected with, nil without auth
+	// Resumable clients track the offsets of all log_chunk events, like
+	// event streams with their event IDs. They are disconnected rather than
+	// skip a chunk when they fall behind.
+	Resumable bool
+
+	done      chan struct{}      // closed when the client is removed
+	slow      chan struct{}      // closed when the client fell behind, see Slow
+	offsets   map[string]int64   // log ID -> end of the chunks sent, for logs subscribed with SubscribeFrom
+	replaying map[string][]Event // log ID -> live chunks held back during a replay
+	slowOnce  sync.Once
+}
+
+// NewClient creates a client with a Send buffer of buffer messages. conn
+// is nil for transports that read Send themselves.
+func NewClient(conn *websocket.Conn, principal *auth.Principal, buffer int) *Client {
+	return &Client{
+		Conn:          conn,
+		Send:          make(chan []byte, buffer),
+		Subscriptions: make(map[string]map[string]bool),
+		Principal:     principal,
+		done:          make(chan struct{}),
+		slow:          make(chan struct{}),
+		offsets:       make(map[string]int64),
+		replaying:     make(map[string][]Event),
+	}
+}
+
+// Slow is closed when the client fell behind on log chunks it can't miss.
+// Its transport should disconnect it, the client then resumes from the
+// offsets it got.
+func (c *Client) Slow() <-chan struct{} {
+	return c.slow
+}
+
+func (c *Client) setSlow() {
+	c.slowOnce.Do(func() {
+		close(c.slow)
+		slowDisconnects.Inc(c.transport())
+	})
+}
+
+// LogReader reads stored logs for replays, see storage.Backend. Stores
+// that are also a storage.LogOpener are read from the replay offset on.
+type LogReader interface {
+	GetLog(logID string) (string, error)
 }
 
 // Hub manages all clients and their subscriptions
@@ -30,6 +77,34 @@ type Hub struct {
 	Clients       map[*Client]bool
 	Subscriptions map[string]map[string]map[*Client]bool // eventType -> token -> set of clients
 	Mutex         sync.Mutex
+	Logs          LogReader // replays missed chunks, see SubscribeFrom
+}
+
+// Event is published to the clients subscribed to its type and token
+type Event struct {
+	Type    string
+	Token   string // log ID, "*" for events about all logs
+	Server  string // ServerInstanceToken, events without one only go to unscoped clients
+	Payload interface{}
+	// BeginOffset and EndOffset locate a log_chunk in the stored log, as
+	// in GET /api/logs/{id}?from_offset=. EndOffset is 0 for other events.
+	BeginOffset int64
+	EndOffset   int64
+}
+
+// message returns the JSON sent to clients
+func (e Event) message() []byte {
+	msg := map[string]interface{}{
+		"type":    e.Type,
+		"token":   e.Token,
+		"payload": e.Payload,
+	}
+	if e.EndOffset > 0 {
+		msg["begin_offset"] = e.BeginOffset
+		msg["end_offset"] = e.EndOffset
+	}
+	data, _ := json.Marshal(msg)
+	return data
 }
 
 func NewHub() *Hub {
@@ -45,16 +120,27 @@ type Message struct {
 	Type  string `json:"type"`  // "subscribe", "unsubscribe"
 	Event string `json:"event"` // e.g. "log_chunk"
 	Token string `json:"token"` // log token
+	// FromOffset replays the log_chunk events after this offset of the
+	// stored log before the live ones, see Hub.SubscribeFrom
+	FromOffset *int64 `json:"from_offset,omitempty"`
 }
 
-func (c *Client) writePump() {
+// writePump sends the messages of the client until it is removed or the
+// connection fails. It then closes the connection, which ends readPump.
+func (c *Client) writePump(hub *Hub) {
+	defer func() {
+		hub.RemoveClient(c)
+		c.Conn.Close()
+	}()
 	for {
 		select {
-		case message, ok := <-c.Send:
-			if !ok {
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
+		case <-c.done:
+			c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case <-c.Slow():
+			c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "Too slow"))
+			return
+		case message := <-c.Send:
 			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				log.Printf("Error sending message: %v", err)
 				return
@@ -78,9 +164,16 @@ func (c *Client) readPump(hub *Hub) {
 		if err := json.Unmarshal(message, &msg); err != nil {
 			continue
 		}
+		// Clients may still use the former ID of a log
+		msg.Token = storage.CanonicalLogID(msg.Token)
 		switch msg.Type {
 		case "subscribe":
-			hub.Subscribe(c, msg.Event, msg.Token)
+			if msg.FromOffset != nil && msg.Event == "log_chunk" {
+				// The replay blocks until it is sent, keep reading meanwhile
+				go hub.SubscribeFrom(c, msg.Token, *msg.FromOffset)
+			} else {
+				hub.Subscribe(c, msg.Event, msg.Token)
+			}
 		case "unsubscribe":
 			hub.Unsubscribe(c, msg.Event, msg.Token)
 		}
@@ -95,16 +188,12 @@ func HandleConnections(hub *Hub) func(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Error upgrading to WebSocket: %v", err)
 			return
 		}
-		client := &Client{
-			Conn:          conn,
-			Send:          make(chan []byte, 256),
-			Subscriptions: make(map[string]map[string]bool),
-		}
+		client := NewClient(conn, auth.FromContext(r.Context()), 256)
 
 		hub.AddClient(client)
 		log.Printf("Client connected: %s", conn.RemoteAddr().String())
 
-		go client.writePump()
+		go client.writePump(hub)
 		client.readPump(hub)
 	}
 }
@@ -120,6 +209,9 @@ func (h *Hub) AddClient(client *Client) {
 func (h *Hub) RemoveClient(client *Client) {
 	h.Mutex.Lock()
 	defer h.Mutex.Unlock()
+	if h.Clients[client] {
+		close(client.done)
+	}
 	delete(h.Clients, client)
 	for eventType, tokens := range client.Subscriptions {
 		for token := range tokens {
@@ -133,10 +225,18 @@ func (h *Hub) RemoveClient(client *Client) {
 	}
 }
 
-// Subscribe adds a client's subscription for a given event and token
+// Subscribe adds a client's subscription for a given event and token.
+// Clients scoped to some servers can't subscribe to other servers' logs.
 func (h *Hub) Subscribe(client *Client, eventType, token string) {
+	if token != "*" && !client.Principal.CanSeeLog(token) {
+		return
+	}
 	h.Mutex.Lock()
 	defer h.Mutex.Unlock()
+	if !h.Clients[client] {
+		// Removed while subscribing
+		return
+	}
 	if h.Subscriptions[eventType] == nil {
 		h.Subscriptions[eventType] = make(map[string]map[*Client]bool)
 	}
@@ -166,28 +266,102 @@ func (h *Hub) Unsubscribe(client *Client, eventType, token string) {
 	if client.Subscriptions[eventType] != nil {
 		delete(client.Subscriptions[eventType], token)
 	}
+	if eventType == "log_chunk" {
+		delete(client.offsets, token)
+	}
 	client.Mutex.Unlock()
 }
 
-// BroadcastEvent sends a message to all clients subscribed to a given event and token
+// BroadcastEvent sends a message to all clients subscribed to a given event
+// and token. Clients scoped to some servers don't get it, see Publish.
 func (h *Hub) BroadcastEvent(eventType, token string, payload interface{}) {
+	h.Publish(Event{Type: eventType, Token: token, Payload: payload})
+}
+
+// Publish sends e to the clients subscribed to its type and token that may
+// see its server
+func (h *Hub) Publish(e Event) {
 	h.Mutex.Lock()
-	clients := h.Subscriptions[eventType][token]
+	var clients []*Client
+	for client := range h.Subscriptions[e.Type][e.Token] {
+		clients = append(clients, client)
+	}
 	h.Mutex.Unlock()
-	if clients == nil {
+	if len(clients) == 0 {
 		return
 	}
-	msg := map[string]interface{}{
-		"type":    eventType,
-		"token":   token,
-		"payload": payload,
+	data := e.message()
+	for _, client := range clients {
+		if client.Principal.Scoped() && (e.Server == "" || !client.Principal.CanSee(e.Server)) {
+			continue
+		}
+		client.deliver(e, data)
 	}
-	data, _ := json.Marshal(msg)
-	for client := range clients {
-		select {
-		case client.Send <- data:
-		default:
-			// Drop message if client is slow
+}
+
+// deliver sends e to the client, holding back chunks of logs being replayed
+// and skipping the parts of chunks the client already got
+func (c *Client) deliver(e Event, data []byte) {
+	if e.EndOffset == 0 {
+		c.trySend(data)
+		return
+	}
+	c.Mutex.Lock()
+	defer c.Mutex.Unlock()
+	if held, ok := c.replaying[e.Token]; ok {
+		if len(held) >= maxHeldChunks {
+			c.setSlow()
+			return
 		}
+		c.replaying[e.Token] = append(held, e)
+		return
+	}
+	c.sendChunk(e, data)
+}
+
+// after returns the part of chunk e after offset sent, false if the client
+// has all of it
+func (e Event) after(sent int64) (Event, bool) {
+	if e.EndOffset <= sent {
+		return e, false
+	}
+	if s, isString := e.Payload.(string); isString && e.BeginOffset < sent && int64(len(s)) == e.EndOffset-e.BeginOffset {
+		e.Payload, e.BeginOffset = s[sent-e.BeginOffset:], sent
+	}
+	return e, true
+}
+
+// sendChunk sends a chunk the client doesn't have yet. c.Mutex is held.
+// Chunks of logs whose offsets are tracked are never dropped, the client
+// is disconnected instead.
+func (c *Client) sendChunk(e Event, data []byte) {
+	sent, tracked := c.offsets[e.Token]
+	if tracked {
+		trimmed, ok := e.after(sent)
+		if !ok {
+			return
+		}
+		if trimmed.BeginOffset != e.BeginOffset {
+			data = trimmed.message()
+		}
+		c.offsets[e.Token] = e.EndOffset
+	}
+	if !tracked && !c.Resumable {
+		c.trySend(data)
+		return
+	}
+	select {
+	case c.Send <- data:
+	default:
+		c.setSlow()
+	}
+}
+
+func (c *Client) trySend(data []byte) {
+	select {
+	case c.Send <- data:
+	default:
+		// Drop message if client is slow
+		droppedMessages.Inc(c.transport())
 	}
 }